@@ -55,6 +55,28 @@ func (a *awareness) ApplyDelta(delta int) {
 	}
 }
 
+// SetMax updates the upper threshold for the timeout scale, clamping the
+// current score to fit under the new threshold. A max of 1 or less pins the
+// score at zero, which effectively disables awareness.
+func (a *awareness) SetMax(max int) {
+	if max < 1 {
+		max = 1
+	}
+
+	a.Lock()
+	initial := a.score
+	a.max = max
+	if a.score > (a.max - 1) {
+		a.score = (a.max - 1)
+	}
+	final := a.score
+	a.Unlock()
+
+	if initial != final {
+		metrics.SetGauge([]string{"memberlist", "health", "score"}, float32(final))
+	}
+}
+
 // GetHealthScore returns the raw health score.
 func (a *awareness) GetHealthScore() int {
 	a.RLock()
@@ -39,3 +39,37 @@ func TestAwareness(t *testing.T) {
 		}
 	}
 }
+
+func TestAwareness_SetMax(t *testing.T) {
+	a := newAwareness(8)
+	a.ApplyDelta(10)
+	if score := a.GetHealthScore(); score != 7 {
+		t.Fatalf("bad score: %d", score)
+	}
+
+	// Lowering the max should clamp the current score.
+	a.SetMax(4)
+	if score := a.GetHealthScore(); score != 3 {
+		t.Fatalf("bad score: %d", score)
+	}
+	if timeout := a.ScaleTimeout(1 * time.Second); timeout != 4*time.Second {
+		t.Fatalf("bad timeout: %v", timeout)
+	}
+
+	// Raising it should leave the score alone, but let it climb higher.
+	a.SetMax(10)
+	if score := a.GetHealthScore(); score != 3 {
+		t.Fatalf("bad score: %d", score)
+	}
+	a.ApplyDelta(10)
+	if score := a.GetHealthScore(); score != 9 {
+		t.Fatalf("bad score: %d", score)
+	}
+
+	// A max below one pins the score at zero.
+	a.SetMax(0)
+	a.ApplyDelta(5)
+	if score := a.GetHealthScore(); score != 0 {
+		t.Fatalf("bad score: %d", score)
+	}
+}
@@ -12,6 +12,36 @@ are contradictory. For example, if we send "{suspect M1 inc: 1},
 then a following {alive M1 inc: 2} will invalidate that message
 */
 
+import (
+	"fmt"
+	"sync"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// OversizedBroadcastPolicy controls what happens to a broadcast that's too
+// big to ever fit in a gossip packet, given UDPBufferSize and the packet
+// overheads.
+type OversizedBroadcastPolicy int
+
+const (
+	// OversizedBroadcastQueue queues the broadcast anyway. It will never be
+	// gossiped, and only reaches other nodes through push/pull. This is the
+	// default, for backwards compatibility.
+	OversizedBroadcastQueue OversizedBroadcastPolicy = iota
+
+	// OversizedBroadcastTCP sends the local node's own state over TCP
+	// instead, by pushing it to a few random peers right away. Broadcasts
+	// about other nodes are queued as usual, since their own node pushes
+	// them.
+	OversizedBroadcastTCP
+
+	// OversizedBroadcastReject drops the broadcast, and makes UpdateNode
+	// and Create return an error if the local node's alive message is too
+	// big.
+	OversizedBroadcastReject
+)
+
 type memberlistBroadcast struct {
 	node   string
 	msg    []byte
@@ -20,7 +50,7 @@ type memberlistBroadcast struct {
 
 func (b *memberlistBroadcast) Invalidates(other Broadcast) bool {
 	// Check if that broadcast is a memberlist type
-	mb, ok := other.(*memberlistBroadcast)
+	mb, ok := asMemberlistBroadcast(other)
 	if !ok {
 		return false
 	}
@@ -45,6 +75,102 @@ func (b *memberlistBroadcast) Finished() {
 	}
 }
 
+// queuedBroadcast is a memberlistBroadcast along with how we want it
+// gossiped.
+type queuedBroadcast struct {
+	*memberlistBroadcast
+	priority int  // See Config.BroadcastPriorityFunc
+	refute   bool // An alive message about us that answers an accusation
+
+	// Set for our own state that's too big to gossip, which is signaled
+	// here instead of through the notify channel. See pushPullOversized.
+	synced *notifyOnce
+}
+
+func (b *queuedBroadcast) Finished() {
+	if b.synced != nil {
+		b.synced.signal()
+		return
+	}
+	b.memberlistBroadcast.Finished()
+}
+
+// notifyOnce closes a notify channel the first time it's signaled, so it
+// can be signaled from more than one place without losing or repeating it.
+type notifyOnce struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (n *notifyOnce) signal() {
+	if n.ch == nil {
+		return
+	}
+	n.once.Do(func() { close(n.ch) })
+}
+
+// memberlist.PriorityBroadcast optional interface
+func (b *queuedBroadcast) Priority() int {
+	return b.priority
+}
+
+// asMemberlistBroadcast returns the memberlistBroadcast b is, or wraps.
+func asMemberlistBroadcast(b Broadcast) (*memberlistBroadcast, bool) {
+	switch b := b.(type) {
+	case *memberlistBroadcast:
+		return b, true
+	case *queuedBroadcast:
+		return b.memberlistBroadcast, true
+	}
+	return nil, false
+}
+
+// targetedBroadcast is a broadcast that's only gossiped to the nodes its
+// target function accepts. Each one is unique, so they never invalidate
+// each other or any other broadcasts.
+type targetedBroadcast struct {
+	msg    []byte
+	notify chan struct{}
+	target func(*Node) bool
+}
+
+func (b *targetedBroadcast) Invalidates(other Broadcast) bool {
+	return false
+}
+
+// memberlist.UniqueBroadcast optional interface
+func (b *targetedBroadcast) UniqueBroadcast() {}
+
+func (b *targetedBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *targetedBroadcast) Finished() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// userBroadcast is a user message queued with QueueBroadcasts. Each one is
+// unique, so they never invalidate each other or any other broadcasts.
+type userBroadcast struct {
+	msg []byte
+}
+
+func (b *userBroadcast) Invalidates(other Broadcast) bool {
+	return false
+}
+
+// memberlist.UniqueBroadcast optional interface
+func (b *userBroadcast) UniqueBroadcast() {}
+
+func (b *userBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *userBroadcast) Finished() {}
+
 // encodeAndBroadcast encodes a message and enqueues it for broadcast. Fails
 // silently if there is an encoding error.
 func (m *Memberlist) encodeAndBroadcast(node string, msgType messageType, msg interface{}) {
@@ -55,28 +181,270 @@ func (m *Memberlist) encodeAndBroadcast(node string, msgType messageType, msg in
 // and notifies the given channel when transmission is finished. Fails
 // silently if there is an encoding error.
 func (m *Memberlist) encodeBroadcastNotify(node string, msgType messageType, msg interface{}, notify chan struct{}) {
+	m.encodeBroadcast(node, msgType, msg, notify, false)
+}
+
+// encodeAndBroadcastRefute encodes an alive message about us that refutes
+// an accusation, and enqueues it for broadcast. Unlike our other alive
+// messages, it's gossiped even with SuppressSelfGossip set.
+func (m *Memberlist) encodeAndBroadcastRefute(a *alive) {
+	m.encodeBroadcast(a.Node, aliveMsg, a, nil, true)
+}
+
+// encodeBroadcast does the work for encodeBroadcastNotify and
+// encodeAndBroadcastRefute.
+func (m *Memberlist) encodeBroadcast(node string, msgType messageType, msg interface{}, notify chan struct{}, refute bool) {
 	buf, err := encode(msgType, msg)
 	if err != nil {
 		m.logger.Printf("[ERR] memberlist: Failed to encode message for broadcast: %s", err)
-	} else {
-		m.queueBroadcast(node, buf.Bytes(), notify)
+		return
+	}
+	countBroadcast(msgType)
+
+	if m.oversizedBroadcast(buf.Len()) {
+		metrics.IncrCounter([]string{"memberlist", "broadcast", "oversized"}, 1)
+		switch m.config.OversizedBroadcastPolicy {
+		case OversizedBroadcastTCP:
+			if node == m.localName() {
+				// Still queue it, so it replaces anything older about
+				// us, but it's the push/pull that delivers it.
+				n := &notifyOnce{ch: notify}
+				m.queueBroadcastSynced(node, buf.Bytes(), n, refute)
+				m.syncOversized(n)
+				return
+			}
+		case OversizedBroadcastReject:
+			m.logger.Printf("[WARN] memberlist: Dropping %d byte broadcast about %s, larger than the %d bytes available in a gossip packet",
+				buf.Len(), node, m.gossipBytesAvail())
+			return
+		}
+	}
+	m.queueBroadcast(node, buf.Bytes(), notify, refute)
+}
+
+// countBroadcast counts a state message we're about to broadcast, by type,
+// so it can be compared with the msg counters on the receiving side.
+func countBroadcast(msgType messageType) {
+	switch msgType {
+	case aliveMsg:
+		metrics.IncrCounter([]string{"memberlist", "broadcast", "alive"}, 1)
+	case suspectMsg:
+		metrics.IncrCounter([]string{"memberlist", "broadcast", "suspect"}, 1)
+	case deadMsg:
+		metrics.IncrCounter([]string{"memberlist", "broadcast", "dead"}, 1)
+	}
+}
+
+// oversizedBroadcast returns true if a broadcast of the given size can
+// never fit in a gossip packet.
+func (m *Memberlist) oversizedBroadcast(size int) bool {
+	return size+compoundOverhead > m.gossipBytesAvail()
+}
+
+// checkLocalAlive returns an error if the alive message for the local node
+// is too big to gossip and OversizedBroadcastReject is configured.
+func (m *Memberlist) checkLocalAlive(a *alive) error {
+	if m.config.OversizedBroadcastPolicy != OversizedBroadcastReject {
+		return nil
+	}
+	buf, err := encode(aliveMsg, a)
+	if err != nil {
+		return err
+	}
+	if m.oversizedBroadcast(buf.Len()) {
+		return fmt.Errorf("alive message of %d bytes is larger than the %d bytes available in a gossip packet",
+			buf.Len(), m.gossipBytesAvail())
+	}
+	return nil
+}
+
+// syncOversized asks for our state to be pushed over TCP, standing in for
+// gossiping an alive message about us that's too big for a packet, and
+// signals n once it has been. Requests that come in while a push is running
+// are coalesced into the next one.
+func (m *Memberlist) syncOversized(n *notifyOnce) {
+	m.oversizedLock.Lock()
+	defer m.oversizedLock.Unlock()
+	m.oversizedPending = append(m.oversizedPending, n)
+	if !m.oversizedSyncing {
+		m.oversizedSyncing = true
+		go m.pushPullOversized()
+	}
+}
+
+// pushPullOversized pushes our whole state to a few random peers over TCP,
+// for as long as there are syncOversized requests waiting. The requests
+// are signaled once a peer has the update. If none do, they're left to be
+// signaled when their broadcast leaves the queue.
+func (m *Memberlist) pushPullOversized() {
+	for {
+		m.oversizedLock.Lock()
+		pending := m.oversizedPending
+		m.oversizedPending = nil
+		if len(pending) == 0 || m.hasShutdown() {
+			m.oversizedSyncing = false
+			m.oversizedLock.Unlock()
+			return
+		}
+		m.oversizedLock.Unlock()
+
+		m.nodeLock.RLock()
+		nodes := kRandomNodes(m.gossipFanout(), m.nodes, func(n *nodeState) bool {
+			return n.Name == m.localName() || n.State != StateAlive
+		})
+		m.nodeLock.RUnlock()
+
+		sent := false
+		for _, node := range nodes {
+			if err := m.pushPullNode(node.FullAddress(), false); err != nil {
+				m.logger.Printf("[ERR] memberlist: Push/Pull of oversized broadcast with %s failed: %s", node.Name, err)
+				continue
+			}
+			sent = true
+		}
+
+		if sent {
+			for _, n := range pending {
+				n.signal()
+			}
+		}
 	}
 }
 
 // queueBroadcast is used to start dissemination of a message. It will be
 // sent up to a configured number of times. The message could potentially
-// be invalidated by a future message about the same node
-func (m *Memberlist) queueBroadcast(node string, msg []byte, notify chan struct{}) {
-	b := &memberlistBroadcast{node, msg, notify}
+// be invalidated by a future message about the same node. Refute marks an
+// alive message about us that answers an accusation.
+func (m *Memberlist) queueBroadcast(node string, msg []byte, notify chan struct{}, refute bool) {
+	b := &queuedBroadcast{memberlistBroadcast: &memberlistBroadcast{node, msg, notify}, refute: refute}
+	if m.config.BroadcastPriorityFunc != nil && len(msg) > 0 {
+		b.priority = m.config.BroadcastPriorityFunc(msg[0])
+	}
+	m.broadcasts.QueueBroadcast(b)
+}
+
+// queueBroadcastSynced is like queueBroadcast, for our own state that's too
+// big to gossip. It only serves to invalidate older messages about us, and
+// signals n rather than a notify channel when it leaves the queue.
+func (m *Memberlist) queueBroadcastSynced(node string, msg []byte, n *notifyOnce, refute bool) {
+	b := &queuedBroadcast{memberlistBroadcast: &memberlistBroadcast{node, msg, nil}, refute: refute, synced: n}
+	if m.config.BroadcastPriorityFunc != nil && len(msg) > 0 {
+		b.priority = m.config.BroadcastPriorityFunc(msg[0])
+	}
+	m.broadcasts.QueueBroadcast(b)
+}
+
+// encodeAndBroadcastTo encodes a message and enqueues it for broadcast to
+// only the nodes that target accepts. Fails silently if there is an encoding
+// error. This must not be used for the failure detection messages, which
+// always need to reach the whole cluster.
+func (m *Memberlist) encodeAndBroadcastTo(target func(*Node) bool, msgType messageType, msg interface{}) {
+	buf, err := encode(msgType, msg)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to encode message for broadcast: %s", err)
+		return
+	}
+	countBroadcast(msgType)
+	m.queueBroadcastTo(target, buf.Bytes(), nil)
+}
+
+// queueBroadcastTo is like queueBroadcast, but the message is only gossiped
+// to the nodes that target accepts. It's dropped by gossip if no node we
+// could gossip to is accepted.
+func (m *Memberlist) queueBroadcastTo(target func(*Node) bool, msg []byte, notify chan struct{}) {
+	b := &targetedBroadcast{msg, notify, target}
 	m.broadcasts.QueueBroadcast(b)
 }
 
+// BroadcastUserMsgTo queues a user message to be gossiped to only the nodes
+// that target returns true for, such as those with a given tag in their
+// meta data. The message is delivered to the UserMessages delegate, or to
+// Delegate.NotifyMsg, on each of those nodes. Like other broadcasts it's
+// retransmitted a limited number of times, so delivery isn't guaranteed,
+// and it must fit in a single gossip packet. If target accepts none of the
+// nodes we could gossip to, the message is dropped on the next gossip round.
+// The target function is called from the gossip loop, so it must be fast and
+// must not call back into memberlist.
+func (m *Memberlist) BroadcastUserMsgTo(msg []byte, target func(*Node) bool) error {
+	if target == nil {
+		return fmt.Errorf("target cannot be nil")
+	}
+	buf := make([]byte, 1, len(msg)+1)
+	buf[0] = byte(userMsg)
+	buf = append(buf, msg...)
+	if m.oversizedBroadcast(len(buf)) {
+		return fmt.Errorf("user message of %d bytes is larger than the %d bytes available in a gossip packet",
+			len(buf), m.gossipBytesAvail())
+	}
+	m.queueBroadcastTo(target, buf, nil)
+	return nil
+}
+
+// QueueBroadcasts queues a batch of user messages to be gossiped to the
+// whole cluster, delivered like those from Delegate.GetBroadcasts. The
+// batch is queued in one go, and kept together as a group, so the messages
+// are packed into the same gossip packets as far as they fit. None of them
+// are ever invalidated by other broadcasts. Like other broadcasts they're
+// retransmitted a limited number of times, so delivery isn't guaranteed.
+// An error is returned, and nothing is queued, if any message is too big
+// for a gossip packet on its own.
+func (m *Memberlist) QueueBroadcasts(msgs [][]byte) error {
+	bs := make([]Broadcast, 0, len(msgs))
+	for _, msg := range msgs {
+		buf := make([]byte, 1, len(msg)+1)
+		buf[0] = byte(userMsg)
+		buf = append(buf, msg...)
+		if m.oversizedBroadcast(len(buf)) {
+			return fmt.Errorf("user message of %d bytes is larger than the %d bytes available in a gossip packet",
+				len(buf), m.gossipBytesAvail())
+		}
+		bs = append(bs, &userBroadcast{buf})
+	}
+	m.broadcasts.QueueBroadcastGroup(bs)
+	return nil
+}
+
+// isSelfAlive returns true if the broadcast is an alive message about us.
+func (m *Memberlist) isSelfAlive(b Broadcast) bool {
+	mb, ok := asMemberlistBroadcast(b)
+	return ok && mb.node == m.localName() &&
+		len(mb.msg) > 0 && messageType(mb.msg[0]) == aliveMsg
+}
+
+// suppressSelfGossip returns true if the broadcast shouldn't be gossiped
+// because of SuppressSelfGossip. Refutes are always gossiped, since they
+// have to beat the suspicion they answer.
+func (m *Memberlist) suppressSelfGossip(b Broadcast) bool {
+	qb, ok := b.(*queuedBroadcast)
+	return m.config.SuppressSelfGossip && m.isSelfAlive(b) && !(ok && qb.refute)
+}
+
 // getBroadcasts is used to return a slice of broadcasts to send up to
 // a maximum byte size, while imposing a per-broadcast overhead. This is used
-// to fill a UDP packet with piggybacked data
+// to fill a UDP packet with piggybacked data. Targeted broadcasts are left
+// out, since the destination isn't known.
 func (m *Memberlist) getBroadcasts(overhead, limit int) [][]byte {
+	return m.getBroadcastsFor(nil, overhead, limit)
+}
+
+// getBroadcastsFor is like getBroadcasts, but also includes any targeted
+// broadcasts meant for the given node, if there is one. This is what gossip
+// uses, so when there's a node, our own alive messages are left out if
+// SuppressSelfGossip is set.
+func (m *Memberlist) getBroadcastsFor(node *Node, overhead, limit int) [][]byte {
+	accept := func(b Broadcast) bool {
+		if node != nil && m.suppressSelfGossip(b) {
+			return false
+		}
+		tb, ok := b.(*targetedBroadcast)
+		if !ok {
+			return true
+		}
+		return node != nil && tb.target(node)
+	}
+
 	// Get memberlist messages first
-	toSend := m.broadcasts.GetBroadcasts(overhead, limit)
+	toSend := m.broadcasts.getBroadcastsFiltered(overhead, limit, accept)
 
 	// Check if the user has anything to broadcast
 	d := m.config.Delegate
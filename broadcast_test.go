@@ -3,6 +3,8 @@ package memberlist
 import (
 	"reflect"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestMemberlistBroadcast_Invalidates(t *testing.T) {
@@ -25,3 +27,97 @@ func TestMemberlistBroadcast_Message(t *testing.T) {
 		t.Fatalf("messages do not match")
 	}
 }
+
+func TestMemberlist_OnBroadcastRetired(t *testing.T) {
+	type retiredMsg struct {
+		msgType uint8
+		node    string
+	}
+	var retired []retiredMsg
+	var m *Memberlist
+	m = GetMemberlist(t, func(c *Config) {
+		c.RetransmitMult = 1
+		c.OnBroadcastRetired = func(msgType uint8, node string) {
+			// No locks are held, so it's safe to call back in.
+			m.Members()
+			m.broadcasts.NumQueued()
+			retired = append(retired, retiredMsg{msgType, node})
+		}
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	// A single node gives a retransmit limit of one.
+	m.getBroadcasts(compoundOverhead, 1400)
+
+	expected := []retiredMsg{{uint8(aliveMsg), "test"}}
+	if !reflect.DeepEqual(retired, expected) {
+		t.Fatalf("bad retired broadcasts: %v", retired)
+	}
+}
+
+func TestMemberlist_BroadcastCounters(t *testing.T) {
+	tm := newTestMetrics(t)
+
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: m.config.Name})
+	m.deadNode(&dead{Node: "test", Incarnation: 1, From: m.config.Name})
+
+	for _, name := range []string{"alive", "suspect", "dead"} {
+		require.Equal(t, 1, tm.Counter("memberlist.broadcast."+name).Count, name)
+	}
+}
+
+func TestMemberlist_QueueBroadcasts(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	// Nothing is queued if one of the messages can't fit.
+	big := make([]byte, m.config.UDPBufferSize)
+	require.Error(t, m.QueueBroadcasts([][]byte{[]byte("ok"), big}))
+	require.Equal(t, 0, m.broadcasts.NumQueued())
+
+	require.NoError(t, m.QueueBroadcasts([][]byte{[]byte("one"), []byte("two")}))
+	require.Equal(t, 2, m.broadcasts.NumQueued())
+
+	msgs := m.getBroadcasts(compoundOverhead, m.config.UDPBufferSize)
+	require.ElementsMatch(t, [][]byte{
+		append([]byte{byte(userMsg)}, "one"...),
+		append([]byte{byte(userMsg)}, "two"...),
+	}, msgs)
+}
+
+func TestMemberlist_BroadcastPriorityFunc(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.BroadcastPriorityFunc = func(msgType uint8) int {
+			if messageType(msgType) == suspectMsg || messageType(msgType) == deadMsg {
+				return 1
+			}
+			return 0
+		}
+	})
+	defer m.Shutdown()
+
+	vsn := m.config.BuildVsnArray()
+	a := alive{Node: "a", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: vsn}
+	m.aliveNode(&a, nil, false)
+	m.suspectNode(&suspect{Node: "a", Incarnation: 1})
+
+	// The newer alive messages queue up behind the suspicion.
+	for _, name := range []string{"b", "c"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 2}, Incarnation: 1, Vsn: vsn}
+		m.aliveNode(&a, nil, false)
+	}
+
+	dump := m.broadcasts.orderedView(false)
+	require.Len(t, dump, 3)
+	require.Equal(t, "a", dump[0].name)
+	require.Equal(t, 1, dump[0].priority)
+	require.Equal(t, uint8(suspectMsg), dump[0].b.Message()[0])
+}
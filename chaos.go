@@ -0,0 +1,93 @@
+package memberlist
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// ChaosConfig injects network impairments into the packets memberlist
+// sends, for testing how the cluster copes with loss and delay without an
+// external tool. It must never be used in production.
+type ChaosConfig struct {
+	// SendDropProbability is the chance, from 0 to 1, that an outgoing
+	// packet is silently dropped instead of being sent.
+	SendDropProbability float64
+
+	// SendLatency delays every outgoing packet that isn't dropped by this
+	// long. The send itself happens in the background, so the caller isn't
+	// held up.
+	SendLatency time.Duration
+
+	// Seed seeds the random numbers used to decide which packets are
+	// dropped, so that runs can be repeated. Zero picks a seed from the
+	// current time.
+	Seed int64
+}
+
+// chaos applies a ChaosConfig to outgoing packets.
+type chaos struct {
+	config ChaosConfig
+
+	lock sync.Mutex
+	rng  *rand.Rand
+}
+
+// newChaos returns a chaos for the given config, or nil if it's nil.
+func newChaos(conf *ChaosConfig) *chaos {
+	if conf == nil {
+		return nil
+	}
+	seed := conf.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &chaos{
+		config: *conf,
+		rng:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// drop reports whether the next packet should be dropped.
+func (c *chaos) drop() bool {
+	if c.config.SendDropProbability <= 0 {
+		return false
+	}
+	c.lock.Lock()
+	r := c.rng.Float64()
+	c.lock.Unlock()
+	return r < c.config.SendDropProbability
+}
+
+// chaosSend sends a packet through the transport, dropping or delaying it
+// as the chaos config asks. Without a chaos config it's just a send.
+func (m *Memberlist) chaosSend(msg []byte, a Address) error {
+	c := m.chaos
+	if c == nil {
+		_, err := m.transport.WriteToAddress(msg, a)
+		return err
+	}
+	if c.drop() {
+		metrics.IncrCounter([]string{"memberlist", "chaos", "dropped"}, 1)
+		return nil
+	}
+	if c.config.SendLatency <= 0 {
+		_, err := m.transport.WriteToAddress(msg, a)
+		return err
+	}
+
+	metrics.IncrCounter([]string{"memberlist", "chaos", "delayed"}, 1)
+	buf := make([]byte, len(msg))
+	copy(buf, msg)
+	time.AfterFunc(c.config.SendLatency, func() {
+		if m.hasShutdown() {
+			return
+		}
+		if _, err := m.transport.WriteToAddress(buf, a); err != nil {
+			m.logger.Printf("[DEBUG] memberlist: Delayed packet to %s failed: %v", a.Addr, err)
+		}
+	})
+	return nil
+}
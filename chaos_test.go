@@ -0,0 +1,67 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaos_Drop(t *testing.T) {
+	require.Nil(t, newChaos(nil))
+
+	c := newChaos(&ChaosConfig{})
+	for i := 0; i < 100; i++ {
+		require.False(t, c.drop())
+	}
+
+	c = newChaos(&ChaosConfig{SendDropProbability: 1})
+	for i := 0; i < 100; i++ {
+		require.True(t, c.drop())
+	}
+
+	// The same seed drops the same packets.
+	c1 := newChaos(&ChaosConfig{SendDropProbability: 0.5, Seed: 42})
+	c2 := newChaos(&ChaosConfig{SendDropProbability: 0.5, Seed: 42})
+	var dropped int
+	for i := 0; i < 100; i++ {
+		d := c1.drop()
+		require.Equal(t, d, c2.drop())
+		if d {
+			dropped++
+		}
+	}
+	require.True(t, dropped > 0 && dropped < 100, "dropped %d", dropped)
+}
+
+func TestMemberlist_ChaosSend(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.EnableCompression = false
+		c.Chaos = &ChaosConfig{SendDropProbability: 1}
+	})
+	defer m.Shutdown()
+
+	udp := listenUDP(t)
+	defer udp.Close()
+
+	a := Address{Addr: udp.LocalAddr().String(), Name: "test"}
+	msg := []byte{byte(userMsg), 1, 2, 3}
+	require.NoError(t, m.rawSendMsgPacket(a, nil, msg))
+
+	in := make([]byte, 1500)
+	udp.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := udp.ReadFrom(in)
+	require.Error(t, err, "packet should have been dropped")
+
+	// Delayed packets still arrive, just late.
+	m.chaos = newChaos(&ChaosConfig{SendLatency: 100 * time.Millisecond})
+	start := time.Now()
+	require.NoError(t, m.rawSendMsgPacket(a, nil, msg))
+	require.True(t, time.Since(start) < 100*time.Millisecond, "send should not block")
+
+	udp.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := udp.ReadFrom(in)
+	require.NoError(t, err)
+	require.Equal(t, msg, in[:n])
+	require.True(t, time.Since(start) >= 100*time.Millisecond, "packet arrived too soon")
+}
@@ -0,0 +1,95 @@
+package memberlist
+
+import "time"
+
+// Clock is the source of time used for failure detection and the background
+// tasks. It defaults to the real time package, but can be replaced through
+// Config.Clock, for example with a fake clock that's advanced by hand so
+// timeout behavior can be tested without real sleeps.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a timer that delivers the current time on its
+	// channel after at least duration d.
+	NewTimer(d time.Duration) Timer
+
+	// AfterFunc waits for duration d to elapse and then calls f in its own
+	// goroutine. The returned Timer can be used to cancel the call.
+	AfterFunc(d time.Duration, f func()) Timer
+
+	// NewTicker creates a ticker that delivers the current time on its
+	// channel every duration d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a single event created by a Clock. It mirrors time.Timer.
+type Timer interface {
+	// C returns the channel the time is delivered on. It's nil for timers
+	// created with AfterFunc.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing, returning false if it has
+	// already fired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after duration d, returning true
+	// if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// Ticker delivers ticks at intervals created by a Clock. It mirrors
+// time.Ticker.
+type Ticker interface {
+	// C returns the channel the ticks are delivered on.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// clock returns the Clock to use, falling back to the real time package if
+// none was configured.
+func (m *Memberlist) clock() Clock {
+	if m.config == nil || m.config.Clock == nil {
+		return realClock{}
+	}
+	return m.config.Clock
+}
+
+// realClock is a Clock backed by the time package.
+type realClock struct{}
+
+var _ Clock = realClock{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return &realTimer{time.AfterFunc(d, f)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,551 @@
+package memberlist
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a Clock that only moves when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ Clock = (*fakeClock)(nil)
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.addTimer(d, 0, nil)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.addTimer(d, 0, f)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.addTimer(d, d, nil)}
+}
+
+func (c *fakeClock) addTimer(d, period time.Duration, f func()) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), period: period, f: f, active: true}
+	if f == nil {
+		t.ch = make(chan time.Time, 1)
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward, firing any timers that come due along
+// the way. AfterFunc callbacks are run synchronously.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if t.active && !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.when
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			next.active = false
+		}
+		if next.f != nil {
+			c.mu.Unlock()
+			next.f()
+			c.mu.Lock()
+		} else {
+			select {
+			case next.ch <- c.now:
+			default:
+			}
+		}
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	period time.Duration
+	f      func()
+	ch     chan time.Time
+	active bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.when = t.clock.now.Add(d)
+	t.active = true
+	return wasActive
+}
+
+type fakeTicker struct {
+	t *fakeTimer
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.t.C()
+}
+
+func (t fakeTicker) Stop() {
+	t.t.Stop()
+}
+
+func TestSuspicion_FakeClock(t *testing.T) {
+	clock := newFakeClock()
+	fired := false
+	s := newSuspicion(clock, "me", 1, 10*time.Second, 30*time.Second, func(int) {
+		fired = true
+	})
+
+	clock.Advance(5 * time.Second)
+	require.False(t, fired)
+
+	// A confirmation takes the timeout down to the minimum, less the time
+	// that has already passed.
+	require.True(t, s.Confirm("foo"))
+	clock.Advance(4 * time.Second)
+	require.False(t, fired)
+	clock.Advance(time.Second)
+	require.True(t, fired)
+}
+
+func TestMemberList_SuspectNode_FakeClock(t *testing.T) {
+	clock := newFakeClock()
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	s := suspect{Node: "test", Incarnation: 1, From: m.config.Name}
+	m.suspectNode(&s)
+	require.Equal(t, StateSuspect, m.getNodeState("test"))
+	require.Equal(t, clock.Now(), m.nodeMap["test"].StateChange)
+
+	// With too few nodes to expect any confirmations, the suspicion runs
+	// for the minimum timeout before the node is declared dead.
+	min := suspicionTimeout(m.config.SuspicionMult, m.estNumNodes(), m.config.ProbeInterval)
+	clock.Advance(min - time.Millisecond)
+	require.Equal(t, StateSuspect, m.getNodeState("test"))
+	clock.Advance(time.Millisecond)
+	require.Equal(t, StateDead, m.getNodeState("test"))
+}
+
+type recoveryRecorder struct {
+	ChannelEventDelegate
+	recovering []string
+}
+
+func (r *recoveryRecorder) NotifyRecovering(n *Node) {
+	r.recovering = append(r.recovering, n.Name)
+}
+
+func TestMemberList_RecoveryHysteresis(t *testing.T) {
+	clock := newFakeClock()
+	events := &recoveryRecorder{ChannelEventDelegate: ChannelEventDelegate{Ch: make(chan NodeEvent, 16)}}
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+		c.RecoveryHysteresis = 10 * time.Second
+		c.Events = events
+	})
+	defer m.Shutdown()
+
+	for i, name := range []string{"test", "a", "b", "c"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, byte(i + 10)}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+	require.False(t, m.IsRecovering("test"))
+
+	// Coming back from suspect starts the recovery window.
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "a"})
+	m.aliveNode(&alive{Node: "test", Addr: []byte{127, 0, 0, 10}, Incarnation: 2, Vsn: m.config.BuildVsnArray()}, nil, false)
+	require.True(t, m.IsRecovering("test"))
+	require.Equal(t, []string{"test"}, events.recovering)
+
+	clock.Advance(10 * time.Second)
+	require.False(t, m.IsRecovering("test"))
+
+	// Flapping inside the window skips straight to the minimum timeout.
+	m.suspectNode(&suspect{Node: "test", Incarnation: 2, From: "a"})
+	m.aliveNode(&alive{Node: "test", Addr: []byte{127, 0, 0, 10}, Incarnation: 3, Vsn: m.config.BuildVsnArray()}, nil, false)
+	clock.Advance(5 * time.Second)
+	require.True(t, m.IsRecovering("test"))
+	m.suspectNode(&suspect{Node: "test", Incarnation: 3, From: "a"})
+	require.False(t, m.IsRecovering("test"))
+
+	min := suspicionTimeout(m.config.SuspicionMult, m.estNumNodes(), m.config.ProbeInterval)
+	clock.Advance(min)
+	require.Equal(t, StateDead, m.getNodeState("test"))
+}
+
+func TestMemberList_MinSuspicionTimeout(t *testing.T) {
+	clock := newFakeClock()
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+		c.ProbeInterval = 10 * time.Millisecond
+		c.MinSuspicionTimeout = 5 * time.Second
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	s := suspect{Node: "test", Incarnation: 1, From: m.config.Name}
+	m.suspectNode(&s)
+
+	// The computed timeout would be well under a second, but the floor
+	// holds it at five.
+	require.True(t, suspicionTimeout(m.config.SuspicionMult, m.estNumNodes(), m.config.ProbeInterval) < time.Second)
+	clock.Advance(5*time.Second - time.Millisecond)
+	require.Equal(t, StateSuspect, m.getNodeState("test"))
+	clock.Advance(time.Millisecond)
+	require.Equal(t, StateDead, m.getNodeState("test"))
+}
+
+func TestMemberList_RefuteCoalesce(t *testing.T) {
+	clock := newFakeClock()
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+		c.RefuteCoalesce = time.Second
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	atomic.StoreUint32(&m.incarnation, 1)
+
+	stale := func(inc uint32) []pushNodeState {
+		return []pushNodeState{{
+			Name:        m.config.Name,
+			Addr:        []byte{127, 0, 0, 1},
+			Incarnation: inc,
+			State:       StateAlive,
+			Meta:        []byte("stale"),
+			Vsn:         m.config.BuildVsnArray(),
+		}}
+	}
+
+	// The first stale entry is refuted right away.
+	m.mergeState(stale(5))
+	require.Equal(t, uint32(6), atomic.LoadUint32(&m.incarnation))
+
+	// Others inside the window are held back and refuted together.
+	m.mergeState(stale(10))
+	m.mergeState(stale(12))
+	m.mergeState(stale(8))
+	require.Equal(t, uint32(6), atomic.LoadUint32(&m.incarnation))
+
+	clock.Advance(time.Second)
+	require.Equal(t, uint32(13), atomic.LoadUint32(&m.incarnation))
+	m.nodeLock.RLock()
+	require.Equal(t, uint32(13), m.nodeMap[m.config.Name].Incarnation)
+	m.nodeLock.RUnlock()
+
+	// Entries our refute already beats are simply ignored.
+	m.mergeState(stale(12))
+	clock.Advance(time.Second)
+	require.Equal(t, uint32(13), atomic.LoadUint32(&m.incarnation))
+
+	// A refute held back at shutdown is never sent.
+	clock.Advance(time.Second)
+	m.mergeState(stale(14))
+	m.mergeState(stale(20))
+	require.Equal(t, uint32(15), atomic.LoadUint32(&m.incarnation))
+	m.broadcasts.Reset()
+	require.NoError(t, m.Shutdown())
+	clock.Advance(time.Second)
+	require.Equal(t, uint32(15), atomic.LoadUint32(&m.incarnation))
+	require.Zero(t, m.broadcasts.NumQueued())
+}
+
+func TestMemberList_MinRefuteInterval(t *testing.T) {
+	clock := newFakeClock()
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+		c.MinRefuteInterval = time.Second
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	atomic.StoreUint32(&m.incarnation, 1)
+	m.broadcasts.Reset()
+
+	// The first accusation is refuted right away.
+	m.suspectNode(&suspect{Node: m.config.Name, Incarnation: 1, From: "accuser"})
+	require.Equal(t, uint32(2), atomic.LoadUint32(&m.incarnation))
+	require.Equal(t, 1, m.broadcasts.NumQueued())
+
+	// A burst of accusations inside the window doesn't bump our
+	// incarnation or broadcast anything.
+	for i := 0; i < 20; i++ {
+		m.suspectNode(&suspect{Node: m.config.Name, Incarnation: 2, From: "accuser"})
+		m.deadNode(&dead{Node: m.config.Name, Incarnation: 2, From: "accuser"})
+	}
+	m.deadNode(&dead{Node: m.config.Name, Incarnation: 7, From: "accuser"})
+	require.Equal(t, uint32(2), atomic.LoadUint32(&m.incarnation))
+
+	// Once the window is up, one refute beats all of them.
+	m.broadcasts.Reset()
+	clock.Advance(time.Second)
+	require.Equal(t, uint32(8), atomic.LoadUint32(&m.incarnation))
+	require.Equal(t, 1, m.broadcasts.NumQueued())
+	require.Equal(t, StateAlive, m.getNodeState(m.config.Name))
+	m.nodeLock.RLock()
+	require.Equal(t, uint32(8), m.nodeMap[m.config.Name].Incarnation)
+	m.nodeLock.RUnlock()
+
+	// Later accusations are refuted right away again.
+	clock.Advance(time.Second)
+	m.suspectNode(&suspect{Node: m.config.Name, Incarnation: 8, From: "accuser"})
+	require.Equal(t, uint32(9), atomic.LoadUint32(&m.incarnation))
+
+	// A held back refute isn't sent if we've moved past the accusation
+	// in the meantime.
+	m.suspectNode(&suspect{Node: m.config.Name, Incarnation: 9, From: "accuser"})
+	require.NoError(t, m.UpdateNode(0))
+	require.Equal(t, uint32(10), atomic.LoadUint32(&m.incarnation))
+	m.broadcasts.Reset()
+	clock.Advance(time.Second)
+	require.Equal(t, uint32(10), atomic.LoadUint32(&m.incarnation))
+	require.Zero(t, m.broadcasts.NumQueued())
+
+	// Nor is one that's still held back at shutdown.
+	clock.Advance(time.Second)
+	m.suspectNode(&suspect{Node: m.config.Name, Incarnation: 10, From: "accuser"})
+	m.suspectNode(&suspect{Node: m.config.Name, Incarnation: 11, From: "accuser"})
+	require.Equal(t, uint32(11), atomic.LoadUint32(&m.incarnation))
+	m.broadcasts.Reset()
+	require.NoError(t, m.Shutdown())
+	clock.Advance(time.Second)
+	require.Equal(t, uint32(11), atomic.LoadUint32(&m.incarnation))
+	require.Zero(t, m.broadcasts.NumQueued())
+}
+
+func TestMemberList_RefuteCoalesce_MinRefuteInterval(t *testing.T) {
+	clock := newFakeClock()
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+		c.RefuteCoalesce = 10 * time.Second
+		c.MinRefuteInterval = time.Second
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	atomic.StoreUint32(&m.incarnation, 1)
+
+	stale := []pushNodeState{{
+		Name:        m.config.Name,
+		Addr:        []byte{127, 0, 0, 1},
+		Incarnation: 5,
+		State:       StateAlive,
+		Meta:        []byte("stale"),
+		Vsn:         m.config.BuildVsnArray(),
+	}}
+
+	// The first refute goes out right away, and a stale merged entry
+	// right after it is held back for the longer interval.
+	m.suspectNode(&suspect{Node: m.config.Name, Incarnation: 1, From: "accuser"})
+	require.Equal(t, uint32(2), atomic.LoadUint32(&m.incarnation))
+	m.mergeState(stale)
+	require.Equal(t, uint32(2), atomic.LoadUint32(&m.incarnation))
+
+	// An accusation is only held back for the shorter one, and its refute
+	// beats the merged entry too.
+	m.suspectNode(&suspect{Node: m.config.Name, Incarnation: 2, From: "accuser"})
+	clock.Advance(time.Second)
+	require.Equal(t, uint32(6), atomic.LoadUint32(&m.incarnation))
+
+	// So there's nothing left to refute once the longer interval is up.
+	clock.Advance(10 * time.Second)
+	require.Equal(t, uint32(6), atomic.LoadUint32(&m.incarnation))
+}
+
+func TestMemberList_ShadowSuspicion(t *testing.T) {
+	tm := newTestMetrics(t)
+
+	clock := newFakeClock()
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+		c.SuspicionMult = 4
+		c.ShadowSuspicion = []SuspicionParams{
+			{Name: "quick", SuspicionMult: 1, SuspicionMaxTimeoutMult: 1},
+			{SuspicionMult: 8, SuspicionMaxTimeoutMult: 1},
+		}
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: m.config.Name})
+
+	count := func(name string) int {
+		return tm.Counter("memberlist.shadow_suspicion." + name + ".dead").Count
+	}
+
+	// The quick shadow fires well before the real timer, but the node is
+	// left alone.
+	real := suspicionTimeout(4, m.estNumNodes(), m.config.ProbeInterval)
+	clock.Advance(real / 4)
+	require.Equal(t, 1, count("quick"))
+	require.Equal(t, StateSuspect, m.getNodeState("test"))
+
+	// The real timer still decides, and the slow shadow reports later on
+	// even though the node is already dead.
+	clock.Advance(real)
+	require.Equal(t, StateDead, m.getNodeState("test"))
+	require.Equal(t, 0, count("mult_8_max_1"))
+	clock.Advance(2 * real)
+	require.Equal(t, 1, count("mult_8_max_1"))
+	require.Empty(t, m.shadowTimers)
+
+	// Shadows of a node that's refuted or leaves never report.
+	for _, name := range []string{"refuted", "left"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+		m.suspectNode(&suspect{Node: name, Incarnation: 1, From: m.config.Name})
+	}
+	a = alive{Node: "refuted", Addr: []byte{127, 0, 0, 1}, Incarnation: 2, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	m.deadNode(&dead{Node: "left", Incarnation: 1, From: "left"})
+	require.Empty(t, m.shadowTimers)
+	clock.Advance(3 * real)
+	require.Equal(t, 1, count("quick"))
+	require.Equal(t, 1, count("mult_8_max_1"))
+}
+
+func TestMemberList_SuspicionMetrics(t *testing.T) {
+	tm := newTestMetrics(t)
+
+	clock := newFakeClock()
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+	})
+	defer m.Shutdown()
+
+	for _, name := range []string{"flaky", "gone"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+		m.suspectNode(&suspect{Node: name, Incarnation: 1, From: m.config.Name})
+	}
+
+	count := func(name string) int {
+		return tm.Counter("memberlist.suspicion." + name).Count
+	}
+	require.Equal(t, 2, count("started"))
+
+	// One node refutes before the timeout, the other doesn't.
+	a := alive{Node: "flaky", Addr: []byte{127, 0, 0, 1}, Incarnation: 2, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	require.Equal(t, 1, count("refuted"))
+
+	clock.Advance(2 * suspicionTimeout(m.config.SuspicionMult, m.estNumNodes(), m.config.ProbeInterval) *
+		time.Duration(m.config.SuspicionMaxTimeoutMult))
+	require.Equal(t, StateAlive, m.getNodeState("flaky"))
+	require.Equal(t, StateDead, m.getNodeState("gone"))
+	require.Equal(t, 1, count("fired"))
+	require.Equal(t, 1, count("refuted"))
+}
+
+func TestMemberList_LeaveDebounce(t *testing.T) {
+	clock := newFakeClock()
+	eventCh := make(chan NodeEvent, 4)
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+		c.LeaveDebounce = 5 * time.Second
+		c.Events = &ChannelEventDelegate{Ch: eventCh}
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	require.Equal(t, NodeJoin, (<-eventCh).Event)
+
+	// A node that's back before the window is up is never reported as
+	// having left or joined.
+	m.deadNode(&dead{Node: "test", Incarnation: 1, From: m.config.Name})
+	clock.Advance(time.Second)
+	a.Incarnation = 2
+	m.aliveNode(&a, nil, false)
+	clock.Advance(10 * time.Second)
+	require.Len(t, eventCh, 0)
+
+	// One that stays gone is reported once the window is up.
+	m.deadNode(&dead{Node: "test", Incarnation: 2, From: m.config.Name})
+	clock.Advance(4 * time.Second)
+	require.Len(t, eventCh, 0)
+	clock.Advance(time.Second)
+	require.Len(t, eventCh, 1)
+	e := <-eventCh
+	require.Equal(t, NodeLeave, e.Event)
+	require.Equal(t, "test", e.Node.Name)
+	require.Empty(t, m.leaveTimers)
+
+	// The leave is still reported if the node is reaped before the
+	// window is up.
+	a.Incarnation = 3
+	m.aliveNode(&a, nil, false)
+	require.Equal(t, NodeJoin, (<-eventCh).Event)
+	m.deadNode(&dead{Node: "test", Incarnation: 3, From: m.config.Name})
+	m.nodeLock.Lock()
+	m.nodeMap["test"].StateChange = clock.Now().Add(-time.Hour)
+	m.nodeLock.Unlock()
+	m.resetNodes()
+	_, ok := m.NodeState("test")
+	require.False(t, ok)
+	clock.Advance(5 * time.Second)
+	require.Len(t, eventCh, 1)
+	e = <-eventCh
+	require.Equal(t, NodeLeave, e.Event)
+	require.Equal(t, "test", e.Node.Name)
+
+	// Pending leaves are dropped on shutdown.
+	a.Incarnation = 4
+	m.aliveNode(&a, nil, false)
+	m.deadNode(&dead{Node: "test", Incarnation: 4, From: m.config.Name})
+	require.NoError(t, m.Shutdown())
+	require.Empty(t, m.leaveTimers)
+	clock.Advance(5 * time.Second)
+	require.Len(t, eventCh, 1)
+	require.Equal(t, NodeJoin, (<-eventCh).Event)
+}
@@ -28,11 +28,45 @@ type Config struct {
 	BindAddr string
 	BindPort int
 
+	// BindAddrs, if set, is a list of addresses for the default
+	// NetTransport to listen on instead of BindAddr, all on BindPort. This
+	// is for multi-homed hosts that need to take part from more than one
+	// network. Packets and connections from every address are handled the
+	// same way, and outgoing ones use the address that best matches the
+	// destination. The node still has the one identity, and advertises the
+	// first address, or AdvertiseAddr if it's set.
+	BindAddrs []string
+
+	// UDPRecvBufSize is the size, in bytes, we ask the OS for as the
+	// receive buffer of our UDP socket when using the default NetTransport.
+	// If the OS won't allow it we keep halving it until it does. Busy
+	// nodes may need a bigger buffer, since packets that overflow it are
+	// dropped by the kernel before we ever see them. By default, this is
+	// 0, which asks for 2MB.
+	UDPRecvBufSize int
+
 	// Configuration related to what address to advertise to other
 	// cluster members. Used for nat traversal.
 	AdvertiseAddr string
 	AdvertisePort int
 
+	// AdvertiseRefreshInterval, if set, is how often we ask the transport
+	// for our advertise address again, to pick up changes like a new DHCP
+	// lease on a long-running node. When it changes, OnAdvertiseChange is
+	// called and we re-announce ourselves at the new address. Peers accept
+	// the new address once they've declared us dead at the old one and
+	// DeadNodeReclaimTime allows it to be reclaimed; until then they see it
+	// as a conflict. This means DeadNodeReclaimTime must be set across the
+	// cluster for the new address to take, and Create logs a warning if
+	// it isn't set here. By default, this is 0, and the address is only
+	// worked out at startup.
+	AdvertiseRefreshInterval time.Duration
+
+	// OnAdvertiseChange, if set, is called when AdvertiseRefreshInterval
+	// finds that our advertise address has changed, with the old and new
+	// addresses.
+	OnAdvertiseChange func(old, new net.IP)
+
 	// ProtocolVersion is the configured protocol version that we
 	// will _speak_. This must be between ProtocolVersionMin and
 	// ProtocolVersionMax.
@@ -46,13 +80,64 @@ type Config struct {
 	// tcp 全量状态同步连接建立以及 tcp 连接读取和写入的超时时限
 	TCPTimeout time.Duration
 
+	// TCPDialTimeout, if set, limits how long we wait to establish a stream
+	// connection, separately from the overall deadline for the exchange.
+	// It applies to push/pull syncs, user messages and the fallback TCP
+	// ping. Where a dead node's address silently drops connection attempts,
+	// a short dial timeout lets us give up on it quickly while still
+	// allowing slow reads from live nodes. It never extends the deadline an
+	// operation would otherwise have. Zero uses the overall deadline.
+	TCPDialTimeout time.Duration
+
+	// AddressResolver, if set, gives the address to use when sending a
+	// packet or starting a push/pull with a known node, in "host:port"
+	// form. This allows nodes to be dialed through something like DNS
+	// rather than at the address they announced. If it returns an error or
+	// an empty string, the node's announced address is used. The node's
+	// announced address is still what's used to identify it and to detect
+	// conflicts. It's called for every packet sent to a known node,
+	// including the acks to pings we receive, and nothing is cached, so it
+	// sits on the hot path and must be fast. Anything slow, like a DNS
+	// lookup, should be cached by the resolver itself. The Node argument
+	// must not be modified.
+	AddressResolver func(node *Node) (string, error)
+
+	// Chaos, if set, makes memberlist drop and delay the packets it sends,
+	// to test the cluster's behavior under poor network conditions. It's
+	// off by default, a warning is logged at startup when it's on, and it
+	// must never be used in production. Stream connections aren't
+	// affected.
+	Chaos *ChaosConfig
+
 	// IndirectChecks is the number of nodes that will be asked to perform
 	// an indirect probe of a node in the case a direct probe fails. Memberlist
 	// waits for an ack from any single indirect node, so increasing this
 	// number will increase the likelihood that an indirect probe will succeed
-	// at the expense of bandwidth.
+	// at the expense of bandwidth. Setting this to 0 turns indirect probes
+	// off, for networks where peers can't reach each other anyway, leaving
+	// the TCP fallback as the only second chance a node gets. Since no
+	// nacks can be expected then, every failed probe counts against our
+	// own health, see AwarenessMaxMultiplier.
 	IndirectChecks int
 
+	// IndirectRetries is the number of extra rounds of indirect probes to
+	// make if no ack comes back from the first. Each round asks a fresh set
+	// of IndirectChecks nodes that haven't been asked yet, which helps when
+	// the first set happens to be cut off from the node as well. The rounds
+	// share the time left in the probe interval, so this sends more probe
+	// traffic but doesn't make probes take any longer. Zero disables this.
+	IndirectRetries int
+
+	// IndirectPingTTL is the number of hops an indirect ping request is
+	// allowed to take, which guards against requests being relayed around
+	// and amplifying traffic. Each node that handles a request decrements
+	// the TTL, and requests that arrive with a TTL of zero are dropped.
+	// Memberlist itself never forwards indirect ping requests, so the
+	// default of 1 is all that's needed; values below 1 are treated as 1.
+	// The TTL is only sent to peers who understand version 6 of the
+	// protocol.
+	IndirectPingTTL int
+
 	// RetransmitMult is the multiplier for the number of retransmissions
 	// that are attempted for messages broadcasted over gossip. The actual
 	// count of retransmissions is calculated using the formula:
@@ -94,6 +179,34 @@ type Config struct {
 	// nodes failed in a reasonable amount of time.
 	SuspicionMaxTimeoutMult int
 
+	// MinSuspicionTimeout is a hard floor on the base SuspicionTimeout
+	// computed above, so the time a node gets to refute a suspicion doesn't
+	// shrink along with a short ProbeInterval. The max timeout is still
+	// SuspicionMaxTimeoutMult times the floored value. By default, this is
+	// 0, meaning no floor is applied.
+	MinSuspicionTimeout time.Duration
+
+	// ShadowSuspicion runs extra suspicion timers with other parameters
+	// alongside the real one whenever a node is suspected. They take the
+	// same confirmations, but never act on a node: each one only logs and
+	// counts memberlist.shadow_suspicion.<name>.dead when it would have
+	// declared the node dead. A shadow that's slower than the real timer
+	// keeps running after the node is marked dead, so it still reports,
+	// while one for a node that's refuted or leaves is stopped. This is a
+	// way to try out new values for SuspicionMult and
+	// SuspicionMaxTimeoutMult against real traffic before switching to
+	// them.
+	ShadowSuspicion []SuspicionParams
+
+	// ConfirmWeightFunc, if set, returns how much a suspicion confirmation
+	// from the given node counts towards the acceleration described above.
+	// By default every confirmation has a weight of 1.0. Giving accusers
+	// that look unhealthy themselves a smaller weight slows down how quickly
+	// a suspect node is marked dead, and a weight of zero or less ignores
+	// the confirmation. This is called while holding the node lock, so it
+	// must not call back into memberlist.
+	ConfirmWeightFunc func(from string) float64
+
 	// PushPullInterval is the interval between complete state syncs.
 	// Complete state syncs are done with a single node over TCP and are
 	// quite expensive relative to standard gossiped messages. Setting this
@@ -104,6 +217,30 @@ type Config struct {
 	// usage.
 	PushPullInterval time.Duration
 
+	// PushPullScaleFunc, if set, overrides how PushPullInterval is scaled
+	// up as the cluster grows. It's given the configured interval and the
+	// current number of nodes, and returns the interval to wait before the
+	// next push/pull. By default, the interval is left alone for up to 32
+	// nodes, and grows by another multiple of the base interval every time
+	// the cluster doubles in size beyond that.
+	PushPullScaleFunc func(base time.Duration, n int) time.Duration
+
+	// PushPullStateFilter, if set, decides which nodes may be picked for
+	// the periodic push/pull, in place of the default of only alive nodes.
+	// Allowing suspect nodes, for example, lets us resync with a node we
+	// may only have lost touch with, which helps recovery from asymmetric
+	// partitions. The local node is never picked. This is called while
+	// holding the node lock, so it must not call back into memberlist, and
+	// the Node argument must not be modified.
+	PushPullStateFilter func(n *Node, state NodeStateType) bool
+
+	// MaxConcurrentPushPull limits how many inbound push/pull syncs are
+	// handled at once. Each one merges the remote state under the node
+	// lock, so a join storm can otherwise pile up contending handlers. A
+	// sync beyond the limit waits briefly for a slot, and is then turned
+	// away with an error the peer can retry on. Zero means no limit.
+	MaxConcurrentPushPull int
+
 	// ProbeInterval and ProbeTimeout are used to configure probing
 	// behavior for memberlist.
 	//
@@ -117,6 +254,13 @@ type Config struct {
 	ProbeInterval time.Duration
 	ProbeTimeout  time.Duration
 
+	// ProbesPerTick is the number of distinct nodes that are probed each
+	// ProbeInterval. Probes are run in parallel, and the next round won't
+	// start until they have all completed. Raising this lowers the time it
+	// takes to detect a failed node in large clusters at the expense of
+	// increased bandwidth usage. Values less than 1 are treated as 1.
+	ProbesPerTick int
+
 	// DisableTcpPings will turn off the fallback TCP pings that are attempted
 	// if the direct UDP ping fails. These get pipelined along with the
 	// indirect UDP pings.
@@ -126,6 +270,73 @@ type Config struct {
 	// whether to perform TCP pings on a node-by-node basis.
 	DisableTcpPingsForNode func(nodeName string) bool
 
+	// PreferTCPForNode, if set, is asked whether to probe a node over TCP
+	// rather than UDP, for nodes that are known not to be reachable over
+	// UDP. For those nodes, the direct ping goes straight over TCP, with
+	// the usual ProbeTimeout, and the fallback TCP ping is skipped, since
+	// it would only repeat it. Indirect probes still go over UDP, as does
+	// the suspect message that lets a suspect node refute. The Ping
+	// delegate is still notified of TCP probes, but with no payload, since
+	// TCP acks don't carry one. Nodes that don't speak protocol version 3
+	// or later are always probed over UDP. The Node argument must not be
+	// modified.
+	PreferTCPForNode func(node *Node) bool
+
+	// TCPPingTimeout is how long the fallback TCP ping has to connect and
+	// get an ack, measured from when the probe started. If this is zero,
+	// the fallback shares the probe's deadline, which is the ProbeInterval
+	// scaled by our awareness. Setting it higher gives distant nodes more
+	// time to complete a TCP handshake, at the cost of probes taking longer
+	// to finish when a node is really down.
+	TCPPingTimeout time.Duration
+
+	// SkipProbeForNode, if set, is consulted when picking the next node to
+	// probe, and any node it returns true for is never probed by this node.
+	// Such nodes are still gossiped to and remain in the member list, but
+	// this node won't detect their failure, so if they die without leaving
+	// they will only be marked dead if another node probes them. This is
+	// called while holding the node lock, so it must not call back into
+	// memberlist.
+	SkipProbeForNode func(node *Node) bool
+
+	// StalenessWeightedProbing biases which node we probe next towards the
+	// ones we haven't heard from directly in a while, since they're the
+	// most likely to have failed silently. Every other probe is picked at
+	// random, weighted by how long it's been since we last heard from each
+	// node, while the rest keep to the usual round robin, so every node is
+	// still probed within at most twice the usual number of rounds.
+	StalenessWeightedProbing bool
+
+	// StableProbeOrder probes nodes round robin in a fixed order, rather
+	// than shuffling them after every round. New nodes are added at the
+	// end, so every node is still probed once per round. Both orders give
+	// the same average time between two probes of a node, but a fixed
+	// order keeps it to one round, while with shuffling a node probed
+	// early in one round and late in the next can wait close to two. The
+	// trade-off is that the order is predictable, and members that learned
+	// about nodes in the same order probe them in lockstep. This is meant
+	// for monitoring that wants predictable coverage. By default nodes are
+	// shuffled.
+	StableProbeOrder bool
+
+	// ProbeNodeSuspects controls whether a failed on-demand probe made via
+	// ProbeNode is treated like one from the regular probe cycle, marking
+	// the node as suspect and updating our awareness. By default ProbeNode
+	// is purely diagnostic.
+	ProbeNodeSuspects bool
+
+	// Observer turns this node into a read-only observer. It learns the
+	// cluster's membership through push/pull and gossip like any other
+	// node, but never announces itself: its own alive messages aren't
+	// broadcast, it leaves itself out of push/pull state, it doesn't refute
+	// accusations and it doesn't probe other nodes. Peers never add an
+	// observer to their member lists, so it can't be failure-detected and
+	// must not be used for anything that relies on cluster membership, such
+	// as receiving gossip or being picked for indirect probes. An observer
+	// relies on push/pull to stay up to date, so PushPullInterval must not
+	// be disabled.
+	Observer bool
+
 	// AwarenessMaxMultiplier will increase the probe interval if the node
 	// becomes aware that it might be degraded and not meeting the soft real
 	// time requirements to reliably probe other nodes.
@@ -151,6 +362,50 @@ type Config struct {
 	GossipNodes         int
 	GossipToTheDeadTime time.Duration
 
+	// DeadNodeGossipCount keeps a dead node around, rather than reaping it
+	// once GossipToTheDeadTime is up, until the message saying it's dead
+	// has been gossiped at least this many times, whichever takes longer.
+	// This helps make sure the whole cluster hears about a death when
+	// gossip is slow. A message is never sent more times than the usual
+	// retransmit limit allows, though, and once it's been sent that many
+	// times, or is otherwise dropped from the queue, the node can be reaped.
+	// Zero disables this.
+	DeadNodeGossipCount int
+
+	// SuppressSelfGossip leaves alive messages about ourselves out of the
+	// gossip we send each GossipInterval. They're still piggybacked on the
+	// probes and acks we send, and peers keep gossiping them, so they still
+	// spread. Refutes of a suspicion are gossiped as usual, since they have
+	// to spread faster than the suspicion does. This trims redundant
+	// traffic in steady state, since peers hear that we're alive whenever
+	// they probe us anyway.
+	SuppressSelfGossip bool
+
+	// BroadcastPriorityFunc, if set, assigns a priority to each of the
+	// failure detection messages we queue for gossip, based on its message
+	// type: 3 for suspect, 4 for alive and 5 for dead. When there's more
+	// queued than fits in a gossip packet, higher priority messages are
+	// sent first, however many times they've already gone out, and lower
+	// priority ones are the first to be pruned. For example, returning 1
+	// for suspect and dead messages and 0 otherwise keeps a flood of
+	// refuting alive messages from delaying news of failures. If nil, all
+	// messages have a priority of 0, and are sent freshest first.
+	BroadcastPriorityFunc func(msgType uint8) int
+
+	// DynamicGossipNodes scales the number of nodes we gossip to on each
+	// GossipInterval with the estimated size of the cluster, similar to how
+	// the push/pull interval is scaled. The effective fanout is calculated
+	// using the formula:
+	//
+	//   Fanout = GossipNodes * max(1, log10(N+1))
+	//
+	// rounded up, so on its own it never drops below GossipNodes.
+	// MaxGossipNodes caps the result and takes precedence, so setting it
+	// below GossipNodes lowers the fanout to MaxGossipNodes. Zero means
+	// there is no cap.
+	DynamicGossipNodes bool
+	MaxGossipNodes     int
+
 	// GossipVerifyIncoming controls whether to enforce encryption for incoming
 	// gossip. It is used for upshifting from unencrypted to encrypted gossip on
 	// a running cluster.
@@ -179,6 +434,23 @@ type Config struct {
 	// automatically initialized using the SecretKey and SecretKeys values.
 	Keyring *Keyring
 
+	// ClusterName is an optional label that is prefixed to every outgoing
+	// packet and stream. Incoming packets and streams whose label doesn't
+	// match are dropped, which keeps traffic from separate clusters that
+	// share a network from being mixed together. The label may be at most
+	// 255 bytes.
+	//
+	// Nodes without a ClusterName send unlabeled traffic, and only accept
+	// unlabeled traffic. To migrate an existing cluster, set
+	// SkipInboundLabelCheck on every node, roll out the ClusterName, and
+	// then clear SkipInboundLabelCheck.
+	ClusterName string
+
+	// SkipInboundLabelCheck allows incoming packets and streams to be
+	// accepted regardless of their label, or lack of one. This is only
+	// meant to be used while migrating a cluster to or from a ClusterName.
+	SkipInboundLabelCheck bool
+
 	// Delegate and Events are delegates for receiving and providing
 	// data to memberlist via callback mechanisms. For Delegate, see
 	// the Delegate interface. For Events, see the EventDelegate interface.
@@ -197,6 +469,107 @@ type Config struct {
 	Ping                    PingDelegate
 	Alive                   AliveDelegate
 
+	// OnMergeCanceled, if set, is called whenever we abort merging the
+	// state we got from a push/pull, with the remote nodes, as NotifyMerge
+	// would see them, and the reason. This covers the remote side running
+	// an incompatible protocol version, in which case the reason is a
+	// *ProtocolMismatchError, as well as the Merge delegate refusing the
+	// merge, which gives a *MergeRejectedError.
+	OnMergeCanceled func(peers []*Node, reason error)
+
+	// NodeFilter, if set, is called for each node in the state we get from
+	// a push/pull, after the Merge delegate has accepted the merge. Nodes
+	// it returns false for are skipped, while the rest of the state is
+	// merged as usual. This is a place to drop entries with malformed meta
+	// data or disallowed addresses without rejecting the whole exchange.
+	// The Node argument must not be modified.
+	NodeFilter func(n *Node) bool
+
+	// MetaMergeFunc, if set, decides which meta data to keep when we hear
+	// about another node at the incarnation we already have, but with
+	// different meta data. It's called with the meta data we have and the
+	// meta data we just heard, and returns the one to keep. Without it,
+	// meta data made up of tags on both sides is merged key by key, going
+	// by each tag's version, and otherwise we keep whichever we heard
+	// first, which can differ from node to node. A deterministic choice
+	// here, such as the lexicographically greater meta data, lets the whole
+	// cluster settle on the same value.
+	MetaMergeFunc func(existing, incoming []byte) []byte
+
+	// LocalAliveOverride, if set, is called with the local node's meta data
+	// each time an alive message about the local node is about to be sent,
+	// such as when starting up, in UpdateNode or Refresh, and when refuting
+	// an accusation. The meta data it returns is sent instead, which lets
+	// ephemeral values such as the current load be computed fresh for each
+	// broadcast. It must return no more than MetaMaxSize bytes, and since
+	// it may be called while holding internal locks, it must not call back
+	// into memberlist.
+	LocalAliveOverride func(meta []byte) []byte
+
+	// MetaForPeer, if set, lets the local node advertise different meta
+	// data to different peers. It's called with the peer whenever our own
+	// entry is sent to a single known peer, which is in push/pull syncs and
+	// in the direct sends made by Refresh, and the meta data it returns is
+	// sent in place of the usual meta data. Returning nil sends the usual
+	// meta data. Gossip broadcasts reach many peers, so they always carry
+	// the usual meta data. Peers pass on what they hear in their own syncs,
+	// so this can't keep meta data from spreading, only choose what each
+	// peer hears from us. Tailored meta data that comes back to us through
+	// other nodes isn't refuted, until the peer it was made for dies. It
+	// must return no more than MetaMaxSize bytes, and since it's called
+	// while holding internal locks, it must not call back into memberlist.
+	MetaForPeer func(peer *Node) []byte
+
+	// Tags are key/value pairs describing the local node, which other
+	// nodes can read with Node.Tags. They're carried at the start of the
+	// node's meta data, ahead of anything from the Delegate, which is only
+	// offered the space that's left. Use Node.UserMeta to get just the
+	// Delegate's part back. Tags can be changed later with SetTag and
+	// DeleteTag.
+	Tags map[string]string
+
+	// DisplayName is a human friendly label for the local node, which other
+	// nodes can read with Node.DisplayName. It's carried in the reserved
+	// "memberlist.display_name" tag, and is only for showing to people:
+	// nodes are always identified by Name, and the display name doesn't
+	// need to be unique.
+	DisplayName string
+
+	// GossipHealthScore publishes the local node's health score, as given
+	// by GetHealthScore, in the reserved "memberlist.health" tag. Since
+	// every change costs an alive broadcast, a new score is only published
+	// once it has held for a few probe ticks, and at most once every ten
+	// ticks. Other nodes read it with Node.HealthScore, and ClusterHealth
+	// aggregates it over the alive members that publish one, which helps
+	// tell a cluster-wide problem from a few unhealthy nodes. Like any tag,
+	// it puts the tags in front of the Delegate's meta data, so nodes that
+	// read Node.Meta directly, rather than Node.UserMeta, will see them
+	// there. Only turn it on once every node's consumers can cope with
+	// that. This needs ProtocolVersion 6 or later, and is ignored
+	// otherwise.
+	GossipHealthScore bool
+
+	// EmitInitialJoins makes sure Events.NotifyJoin is invoked for every
+	// member the cluster knows about when joining it. Alive members are
+	// always announced, but by default members that the node we join
+	// through currently suspects are skipped until we hear they're alive.
+	// With this set, they're added and announced as well, and then marked
+	// suspect so they go through the usual suspicion process.
+	EmitInitialJoins bool
+
+	// UserMessages, if set, receives all incoming user-data messages in
+	// place of Delegate.NotifyMsg. See the UserMessageDelegate interface.
+	UserMessages UserMessageDelegate
+
+	// OnBroadcastRetired is invoked when one of memberlist's own broadcasts
+	// (alive, suspect, dead) is dropped from the gossip queue because it hit
+	// the retransmit limit. It is not invoked for broadcasts that were
+	// invalidated by a newer message about the same node. This can be used
+	// to re-inject messages that must reach every node. The callback is
+	// made from the gossip or probe goroutine with no locks held, so it may
+	// call back into memberlist, but it should not block for long.
+	OnBroadcastRetired func(msgType uint8, node string)
+
 	// DNSConfigPath points to the system's DNS config file, usually located
 	// at /etc/resolv.conf. It can be overridden via config for easier testing.
 	DNSConfigPath string
@@ -212,6 +585,27 @@ type Config struct {
 	// at the same time.
 	Logger *log.Logger
 
+	// LogSelfNoopAlive logs a debug message for every gossiped alive message
+	// about the local node that matches what we're already announcing, so
+	// there's nothing to do. These are normally ignored silently, and are
+	// also counted by the memberlist.msg.alive.self_noop metric. A high rate
+	// of them means we're being gossiped about more than we need to be.
+	LogSelfNoopAlive bool
+
+	// Clock is the source of time for suspicion timers, ack timeouts, node
+	// state change times and the background tickers. If this is not set, the
+	// real time package is used. It's mainly useful for tests that want to
+	// control time rather than sleep.
+	Clock Clock
+
+	// ManualTick stops us from starting the background tickers for
+	// probing, gossip, push/pull and advertise address refreshes. Instead,
+	// each round runs only when TickProbe, TickGossip, TickPushPull or
+	// TickAdvertise is called, which lets a simulation step a whole
+	// cluster deterministically. Those calls do nothing unless this is
+	// set. Incoming messages are still handled as usual.
+	ManualTick bool
+
 	// Size of Memberlist's internal channel which handles UDP messages. The
 	// size of this determines the size of the queue which Memberlist will keep
 	// while UDP messages are handled.
@@ -226,11 +620,108 @@ type Config struct {
 	// called PacketBufferSize now that we have generalized the transport.
 	UDPBufferSize int
 
+	// MaxPacketBytes is the largest packet the network is expected to carry
+	// without fragmentation, usually the path MTU less the IP and UDP
+	// headers. It is only used to sanity check UDPBufferSize at startup,
+	// and a warning is logged if packets could exceed it. Zero disables the
+	// check.
+	MaxPacketBytes int
+
+	// OversizedBroadcastPolicy controls what happens to a broadcast, such as
+	// an alive message carrying large meta data, that's too big to fit in a
+	// gossip packet. By default it's queued anyway, which means it will only
+	// spread through push/pull. See OversizedBroadcastPolicy for the other
+	// options.
+	OversizedBroadcastPolicy OversizedBroadcastPolicy
+
 	// DeadNodeReclaimTime controls the time before a dead node's name can be
 	// reclaimed by one with a different address or port. By default, this is 0,
 	// meaning nodes cannot be reclaimed this way.
 	DeadNodeReclaimTime time.Duration
 
+	// VerifyReclaimByProbe makes us probe the new address of a left or
+	// dead node that's being reclaimed, as allowed by DeadNodeReclaimTime,
+	// before accepting it. The reclaim only goes ahead if the node answers
+	// at its new address, which stops a buggy or malicious peer from
+	// redirecting a node elsewhere, at the cost of a probe round trip
+	// before the node is seen as alive again.
+	VerifyReclaimByProbe bool
+
+	// RecoveryHysteresis is how long a node that was suspect and is alive
+	// again is considered to be recovering, rather than fully healthy. A
+	// recovering node is reported through IsRecovering and the optional
+	// RecoveryDelegate, and if it's suspected again before the window is
+	// up, it's declared dead at the minimum suspicion timeout without
+	// waiting for confirmations, since it's likely flapping. By default,
+	// this is 0, which turns recovery tracking off.
+	RecoveryHysteresis time.Duration
+
+	// LeaveDebounce holds back Events.NotifyLeave for a node that's dead or
+	// left by this long. If the node comes back alive in the meantime, the
+	// leave is dropped along with the NotifyJoin that would have followed
+	// it, so a node that briefly flaps doesn't churn the application. The
+	// cost is that genuine leaves are reported this much later. By default,
+	// this is 0, and leaves are reported right away.
+	LeaveDebounce time.Duration
+
+	// SizeThresholds and OnSizeThreshold let the application react when the
+	// number of live members, which is alive and suspect nodes including
+	// ourselves, crosses a threshold, such as for autoscaling. For each
+	// threshold crossed, OnSizeThreshold is called with the threshold,
+	// whether the size went up to reach it or down to fall below it, and
+	// the size. A crossing is only reported once the size has stayed on
+	// the new side of the threshold for SizeThresholdDebounce, with the
+	// wait starting over whenever it crosses another, so a node flapping
+	// around a threshold doesn't cause a call each time. With
+	// SizeThresholdDebounce set to 0, crossings are reported right away.
+	// The callback is run from a separate goroutine and must not block.
+	SizeThresholds        []int
+	OnSizeThreshold       func(crossed int, up bool, size int)
+	SizeThresholdDebounce time.Duration
+
+	// RefuteCoalesce limits how often we refute stale alive messages about
+	// ourselves that arrive through push/pull merges. When a partition
+	// heals, many peers can deliver the same outdated view of us at once,
+	// and refuting each one separately floods the cluster with alive
+	// messages. With this set, a stale entry that arrives less than this
+	// long after our last refute is held back, and one refute at the end
+	// of the interval covers every stale entry seen in the meantime.
+	// Refutes of gossiped messages and of suspicions aren't delayed by this.
+	// Zero disables this.
+	RefuteCoalesce time.Duration
+
+	// MinRefuteInterval is the least time between any two refutes. A node
+	// that's accused over and over, by a misbehaving peer or another node
+	// using the same name, would otherwise bump its incarnation number and
+	// broadcast an alive message for every accusation. With this set,
+	// accusations that arrive too soon after a refute are answered by a
+	// single refute once the interval is up, which beats the newest of
+	// them. That refute is skipped if one sent in the meantime already
+	// beats them. This slows refutes down a little. Zero disables this.
+	MinRefuteInterval time.Duration
+
+	// LabeledMetrics adds a "node" label with the other node's name to
+	// per-node metrics, such as the probeNode timing and probe failures,
+	// so they can be broken down by node. It's off by default because the
+	// number of distinct series grows with the cluster, which is too much
+	// for some metrics backends in large clusters.
+	LabeledMetrics bool
+
+	// MinIncarnation is where the local node's incarnation number starts.
+	// After a restart, peers may still remember a higher incarnation for
+	// us than our fresh counter, and ignore our alive messages until we've
+	// refuted our way past it. Starting above anything peers are likely to
+	// remember, such as a value saved from the previous run, or one derived
+	// from the time, lets us rejoin right away. The default is 0.
+	MinIncarnation uint32
+
+	// UnknownNodePolicy controls what happens to suspect and dead messages
+	// about nodes we haven't heard of. By default they're ignored, but they
+	// can also be logged, or used to learn of the node, which helps when
+	// gossip delivers a suspect message before the alive message it
+	// follows. See UnknownNodePolicy for details.
+	UnknownNodePolicy UnknownNodePolicy
+
 	// RequireNodeNames controls if the name of a node is required when sending
 	// a message to that node.
 	RequireNodeNames bool
@@ -282,12 +773,14 @@ func DefaultLANConfig() *Config {
 		ProtocolVersion:         ProtocolVersion2Compatible,
 		TCPTimeout:              10 * time.Second,       // Timeout after 10 seconds
 		IndirectChecks:          3,                      // Use 3 nodes for the indirect ping
+		IndirectPingTTL:         1,                      // Indirect pings make a single hop
 		RetransmitMult:          4,                      // Retransmit a message 4 * log(N+1) nodes
 		SuspicionMult:           4,                      // Suspect a node for 4 * log(N+1) * Interval
 		SuspicionMaxTimeoutMult: 6,                      // For 10k nodes this will give a max timeout of 120 seconds
 		PushPullInterval:        30 * time.Second,       // Low frequency
 		ProbeTimeout:            500 * time.Millisecond, // Reasonable RTT time for LAN
 		ProbeInterval:           1 * time.Second,        // Failure check every second
+		ProbesPerTick:           1,                      // Probe a single node each interval
 		DisableTcpPings:         false,                  // TCP pings are safe, even with mixed versions
 		AwarenessMaxMultiplier:  8,                      // Probe interval backs off to 8 seconds
 
@@ -299,6 +792,8 @@ func DefaultLANConfig() *Config {
 
 		EnableCompression: true, // Enable compression by default
 
+		SizeThresholdDebounce: 5 * time.Second, // Ride out a node flapping
+
 		SecretKey: nil,
 		Keyring:   nil,
 
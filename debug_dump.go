@@ -0,0 +1,112 @@
+package memberlist
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// debugDump is the JSON document produced by DebugDump.
+type debugDump struct {
+	Name        string           `json:"name"`
+	Incarnation uint32           `json:"incarnation"`
+	HealthScore int              `json:"health_score"`
+	NumNodes    int              `json:"num_nodes"`
+	Protocol    debugVersions    `json:"protocol"`
+	Delegate    debugVersions    `json:"delegate"`
+	Nodes       []debugNode      `json:"nodes"`
+	Suspicions  []debugSuspicion `json:"suspicions"`
+}
+
+// debugVersions is the range of versions understood by every alive node,
+// along with the version this node is speaking. The range is left out if
+// there are no alive nodes to take it from.
+type debugVersions struct {
+	Min     *uint8 `json:"min,omitempty"`
+	Max     *uint8 `json:"max,omitempty"`
+	Current uint8  `json:"current"`
+}
+
+type debugNode struct {
+	Name        string    `json:"name"`
+	Addr        string    `json:"addr"`
+	State       string    `json:"state"`
+	Incarnation uint32    `json:"incarnation"`
+	StateChange time.Time `json:"state_change"`
+}
+
+type debugSuspicion struct {
+	Node          string    `json:"node"`
+	Started       time.Time `json:"started"`
+	Confirmations int       `json:"confirmations"`
+	Confirmers    []string  `json:"confirmers"`
+}
+
+// DebugDump returns a JSON snapshot of this memberlist's internal state for
+// attaching to bug reports. It includes the local node's name, incarnation
+// and health score, every known node, the active suspicion timers, and the
+// protocol versions all the alive nodes understand, if there are any. The
+// format is meant for humans and may change between releases.
+func (m *Memberlist) DebugDump() ([]byte, error) {
+	m.nodeLock.RLock()
+	dump := debugDump{
+		Name:        m.localName(),
+		Incarnation: atomic.LoadUint32(&m.incarnation),
+		HealthScore: m.awareness.GetHealthScore(),
+		NumNodes:    m.estNumNodes(),
+		Protocol:    debugVersions{Current: m.config.ProtocolVersion},
+		Delegate:    debugVersions{Current: m.config.DelegateProtocolVersion},
+		Nodes:       make([]debugNode, 0, len(m.nodes)),
+		Suspicions:  make([]debugSuspicion, 0, len(m.nodeTimers)),
+	}
+	var pmin, dmin uint8
+	var pmax, dmax uint8 = math.MaxUint8, math.MaxUint8
+	alive := false
+	for _, n := range m.nodes {
+		dump.Nodes = append(dump.Nodes, debugNode{
+			Name:        n.Name,
+			Addr:        n.Address(),
+			State:       n.State.metricName(),
+			Incarnation: n.Incarnation,
+			StateChange: n.StateChange,
+		})
+
+		if n.State != StateAlive {
+			continue
+		}
+		alive = true
+		if n.PMin > pmin {
+			pmin = n.PMin
+		}
+		if n.PMax < pmax {
+			pmax = n.PMax
+		}
+		if n.DMin > dmin {
+			dmin = n.DMin
+		}
+		if n.DMax < dmax {
+			dmax = n.DMax
+		}
+	}
+	if alive {
+		dump.Protocol.Min, dump.Protocol.Max = &pmin, &pmax
+		dump.Delegate.Min, dump.Delegate.Max = &dmin, &dmax
+	}
+	for name, s := range m.nodeTimers {
+		confirmers := s.Confirmers()
+		dump.Suspicions = append(dump.Suspicions, debugSuspicion{
+			Node:          name,
+			Started:       s.start,
+			Confirmations: len(confirmers),
+			Confirmers:    confirmers,
+		})
+	}
+	m.nodeLock.RUnlock()
+
+	sort.Slice(dump.Suspicions, func(i, j int) bool {
+		return dump.Suspicions[i].Node < dump.Suspicions[j].Node
+	})
+	return json.MarshalIndent(&dump, "", "  ")
+}
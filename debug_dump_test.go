@@ -0,0 +1,66 @@
+package memberlist
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemberlist_DebugDump(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+	require.NoError(t, m.setAlive())
+
+	for i, name := range []string{"test", "a", "b", "c"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, byte(i + 10)}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "a"})
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "b"})
+
+	buf, err := m.DebugDump()
+	require.NoError(t, err)
+
+	var dump debugDump
+	require.NoError(t, json.Unmarshal(buf, &dump))
+	require.Equal(t, m.config.Name, dump.Name)
+	require.Equal(t, uint32(1), dump.Incarnation)
+	require.Equal(t, 5, dump.NumNodes)
+	require.Len(t, dump.Nodes, 5)
+	pmin, pmax := uint8(ProtocolVersionMin), uint8(ProtocolVersionMax)
+	require.Equal(t, debugVersions{Min: &pmin, Max: &pmax, Current: m.config.ProtocolVersion}, dump.Protocol)
+
+	states := make(map[string]string)
+	for _, n := range dump.Nodes {
+		states[n.Name] = n.State
+	}
+	require.Equal(t, "suspect", states["test"])
+	require.Equal(t, "alive", states["a"])
+
+	require.Len(t, dump.Suspicions, 1)
+	require.Equal(t, "test", dump.Suspicions[0].Node)
+	require.Equal(t, 1, dump.Suspicions[0].Confirmations)
+	require.Equal(t, []string{"b"}, dump.Suspicions[0].Confirmers)
+}
+
+func TestMemberlist_DebugDump_NoAliveNodes(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	// Nothing is alive yet, so there's no range to report.
+	buf, err := m.DebugDump()
+	require.NoError(t, err)
+
+	var dump debugDump
+	require.NoError(t, json.Unmarshal(buf, &dump))
+	require.Equal(t, debugVersions{Current: m.config.ProtocolVersion}, dump.Protocol)
+	require.Equal(t, debugVersions{Current: m.config.DelegateProtocolVersion}, dump.Delegate)
+
+	var raw struct {
+		Protocol map[string]interface{} `json:"protocol"`
+	}
+	require.NoError(t, json.Unmarshal(buf, &raw))
+	require.NotContains(t, raw.Protocol, "min")
+	require.NotContains(t, raw.Protocol, "max")
+}
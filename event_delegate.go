@@ -1,5 +1,7 @@
 package memberlist
 
+import "net"
+
 // EventDelegate is a simpler delegate that is used only to receive
 // notifications about members joining and leaving. The methods in this
 // delegate may be called by multiple goroutines, but never concurrently.
@@ -18,12 +20,45 @@ type EventDelegate interface {
 	NotifyLeave(*Node)
 
 	// NotifyUpdate is invoked when a node is detected to have
-	// updated, usually involving the meta data. The Node argument
+	// updated, either its meta data or its address. The Node argument
 	// must not be modified.
 	// 当节点发现有目标节点的元素信息（ip地址、端口等）发生变更时则会触发回调该 hook。
 	NotifyUpdate(*Node)
 }
 
+// AddressChangeDelegate is an optional interface that an EventDelegate can
+// also implement to find out the previous address of a node whose address
+// changed, for example so connections to the stale address can be closed.
+type AddressChangeDelegate interface {
+	// NotifyAddressChange is invoked when a known node is seen at a new
+	// address, just before the NotifyJoin or NotifyUpdate call for the same
+	// change. This includes a dead or left node being reclaimed at a new
+	// address. The Node argument must not be modified.
+	NotifyAddressChange(n *Node, oldAddr net.IP, oldPort uint16)
+}
+
+// RecoveryDelegate is an optional interface that an EventDelegate can also
+// implement to hear about nodes that were suspect and are alive again. It's
+// only used when Config.RecoveryHysteresis is set.
+type RecoveryDelegate interface {
+	// NotifyRecovering is invoked when a suspect node is found to be alive
+	// again. The node stays recovering, as reported by IsRecovering, until
+	// it has been alive for RecoveryHysteresis. The Node argument must not
+	// be modified.
+	NotifyRecovering(n *Node)
+}
+
+// ReclaimDelegate is an optional interface that an EventDelegate can also
+// implement to tell a node that was dead or left coming back at a new
+// address apart from a node that's joining for the first time. This is
+// usually the same logical node restarting somewhere else.
+type ReclaimDelegate interface {
+	// NotifyReclaim is invoked instead of NotifyJoin when a dead or left
+	// node is reclaimed at a new address. The Node argument must not be
+	// modified.
+	NotifyReclaim(n *Node)
+}
+
 // ChannelEventDelegate is used to enable an application to receive
 // events about joins and leaves over a channel instead of a direct
 // function call.
@@ -51,19 +86,28 @@ const (
 type NodeEvent struct {
 	Event NodeEventType
 	Node  *Node
+
+	// Reclaimed is set on a NodeJoin event if the node was dead or left
+	// and has come back at a new address, rather than being new to us.
+	Reclaimed bool
 }
 
 func (c *ChannelEventDelegate) NotifyJoin(n *Node) {
 	node := *n
-	c.Ch <- NodeEvent{NodeJoin, &node}
+	c.Ch <- NodeEvent{Event: NodeJoin, Node: &node}
+}
+
+func (c *ChannelEventDelegate) NotifyReclaim(n *Node) {
+	node := *n
+	c.Ch <- NodeEvent{Event: NodeJoin, Node: &node, Reclaimed: true}
 }
 
 func (c *ChannelEventDelegate) NotifyLeave(n *Node) {
 	node := *n
-	c.Ch <- NodeEvent{NodeLeave, &node}
+	c.Ch <- NodeEvent{Event: NodeLeave, Node: &node}
 }
 
 func (c *ChannelEventDelegate) NotifyUpdate(n *Node) {
 	node := *n
-	c.Ch <- NodeEvent{NodeUpdate, &node}
+	c.Ch <- NodeEvent{Event: NodeUpdate, Node: &node}
 }
@@ -8,7 +8,7 @@ require (
 	github.com/google/btree v0.0.0-20180813153112-4030bb1f1f0c
 	github.com/hashicorp/go-immutable-radix v1.0.0 // indirect
 	github.com/hashicorp/go-msgpack v0.5.3
-	github.com/hashicorp/go-multierror v1.0.0
+	github.com/hashicorp/go-multierror v1.1.1
 	github.com/hashicorp/go-sockaddr v1.0.0
 	github.com/miekg/dns v1.1.26
 	github.com/pascaldekloe/goe v0.0.0-20180627143212-57f6aae5913c // indirect
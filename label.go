@@ -0,0 +1,225 @@
+package memberlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// General approach is to prefix all packets and streams with the same
+// structure:
+//
+// magic type byte (244): uint8
+// length of label name:  uint8 (because labels can't be longer than 255 bytes)
+// label name:            []uint8
+//
+// The magic type byte is well outside the range of the regular message
+// types, so unlabeled traffic can still be told apart from labeled traffic.
+
+const (
+	// hasLabelMsg is the magic type byte used to mark a labeled packet or
+	// stream.
+	hasLabelMsg messageType = 244
+
+	// labelMaxSize is the maximum length of a cluster label.
+	labelMaxSize = 255
+
+	// labelOverhead is the fixed number of bytes, beyond the label itself,
+	// that the label header adds to a packet.
+	labelOverhead = 2
+)
+
+// addLabelHeaderToPacket prefixes the outgoing packet with the label header
+// if the label is not empty.
+func addLabelHeaderToPacket(buf []byte, label string) ([]byte, error) {
+	if label == "" {
+		return buf, nil
+	}
+	if len(label) > labelMaxSize {
+		return nil, fmt.Errorf("label %q is too long", label)
+	}
+
+	return makeLabelHeader(label, buf), nil
+}
+
+// removeLabelHeaderFromPacket removes any label header from the provided
+// packet and returns it along with the remaining packet contents.
+func removeLabelHeaderFromPacket(buf []byte) (newBuf []byte, label string, err error) {
+	if len(buf) == 0 {
+		return buf, "", nil // can't possibly be labeled
+	}
+
+	// [type:byte] [size:byte] [size bytes]
+
+	msgType := messageType(buf[0])
+	if msgType != hasLabelMsg {
+		return buf, "", nil
+	}
+
+	if len(buf) < labelOverhead {
+		return nil, "", fmt.Errorf("cannot decode label; packet has been truncated")
+	}
+
+	size := int(buf[1])
+	if size < 1 {
+		return nil, "", fmt.Errorf("label header cannot be empty when present")
+	}
+
+	if len(buf) < labelOverhead+size {
+		return nil, "", fmt.Errorf("cannot decode label; packet has been truncated")
+	}
+
+	label = string(buf[labelOverhead : labelOverhead+size])
+	newBuf = buf[labelOverhead+size:]
+
+	return newBuf, label, nil
+}
+
+// addLabelHeaderToStream writes the label header to the outgoing stream if
+// the label is not empty.
+func addLabelHeaderToStream(conn net.Conn, label string) error {
+	if label == "" {
+		return nil
+	}
+	if len(label) > labelMaxSize {
+		return fmt.Errorf("label %q is too long", label)
+	}
+
+	header := makeLabelHeader(label, nil)
+
+	_, err := conn.Write(header)
+	return err
+}
+
+// removeLabelHeaderFromStream removes any label header from the beginning of
+// the stream if present and returns it along with an updated conn with that
+// header removed.
+//
+// Note that on error it is the caller's responsibility to close the
+// connection.
+func removeLabelHeaderFromStream(conn net.Conn) (net.Conn, string, error) {
+	br := bufio.NewReader(conn)
+
+	// First check for the type byte.
+	peeked, err := br.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			// It is safe to return the original net.Conn at this point because
+			// it never contained any data in the first place so we don't have
+			// to splice the buffer into the conn because both are empty.
+			return conn, "", nil
+		}
+		return nil, "", err
+	}
+
+	msgType := messageType(peeked[0])
+	if msgType != hasLabelMsg {
+		return &peekedConn{Peeked: br, Conn: conn}, "", nil
+	}
+
+	// We are guaranteed to get a size byte as well.
+	peeked, err = br.Peek(labelOverhead)
+	if err != nil {
+		if err == io.EOF {
+			return nil, "", fmt.Errorf("cannot decode label; stream has been truncated")
+		}
+		return nil, "", err
+	}
+
+	size := int(peeked[1])
+	if size < 1 {
+		return nil, "", fmt.Errorf("label header cannot be empty when present")
+	}
+
+	// Now read the whole header along with the label.
+	peeked, err = br.Peek(labelOverhead + size)
+	if err != nil {
+		if err == io.EOF {
+			return nil, "", fmt.Errorf("cannot decode label; stream has been truncated")
+		}
+		return nil, "", err
+	}
+
+	label := string(peeked[labelOverhead : labelOverhead+size])
+
+	if _, err := br.Discard(labelOverhead + size); err != nil {
+		return nil, "", err
+	}
+
+	return &peekedConn{Peeked: br, Conn: conn}, label, nil
+}
+
+func makeLabelHeader(label string, rest []byte) []byte {
+	newBuf := make([]byte, labelOverhead, labelOverhead+len(label)+len(rest))
+	newBuf[0] = byte(hasLabelMsg)
+	newBuf[1] = byte(len(label))
+	newBuf = append(newBuf, []byte(label)...)
+	if len(rest) > 0 {
+		newBuf = append(newBuf, rest...)
+	}
+	return newBuf
+}
+
+// peekedConn is a net.Conn that first serves any data buffered while peeking
+// at the head of the stream, and then reads from the underlying conn.
+type peekedConn struct {
+	Peeked *bufio.Reader
+	net.Conn
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.Peeked.Read(p)
+}
+
+// labelWrappedTransport is a NodeAwareTransport that adds the label header
+// to all outgoing packets and streams.
+type labelWrappedTransport struct {
+	label string
+	NodeAwareTransport
+}
+
+var _ NodeAwareTransport = (*labelWrappedTransport)(nil)
+
+func (t *labelWrappedTransport) WriteToAddress(buf []byte, addr Address) (time.Time, error) {
+	var err error
+	buf, err = addLabelHeaderToPacket(buf, t.label)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to add label header to packet: %w", err)
+	}
+	return t.NodeAwareTransport.WriteToAddress(buf, addr)
+}
+
+func (t *labelWrappedTransport) WriteTo(buf []byte, addr string) (time.Time, error) {
+	var err error
+	buf, err = addLabelHeaderToPacket(buf, t.label)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.NodeAwareTransport.WriteTo(buf, addr)
+}
+
+func (t *labelWrappedTransport) DialAddressTimeout(addr Address, timeout time.Duration) (net.Conn, error) {
+	conn, err := t.NodeAwareTransport.DialAddressTimeout(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := addLabelHeaderToStream(conn, t.label); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send our cluster label: %w", err)
+	}
+	return conn, nil
+}
+
+func (t *labelWrappedTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := t.NodeAwareTransport.DialTimeout(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := addLabelHeaderToStream(conn, t.label); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send our cluster label: %w", err)
+	}
+	return conn, nil
+}
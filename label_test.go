@@ -0,0 +1,146 @@
+package memberlist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddRemoveLabelHeaderToPacket(t *testing.T) {
+	type testcase struct {
+		buf          []byte
+		label        string
+		expectPacket []byte
+		expectErr    string
+	}
+
+	run := func(t *testing.T, tc testcase) {
+		got, err := addLabelHeaderToPacket(tc.buf, tc.label)
+		if tc.expectErr != "" {
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expectErr)
+			return
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.expectPacket, got)
+
+		buf, label, err := removeLabelHeaderFromPacket(got)
+		require.NoError(t, err)
+		require.Equal(t, tc.buf, buf)
+		require.Equal(t, tc.label, label)
+	}
+
+	longLabel := string(bytes.Repeat([]byte("a"), 256))
+
+	cases := map[string]testcase{
+		"nil buf with no label": {
+			buf:          nil,
+			label:        "",
+			expectPacket: nil,
+		},
+		"message with no label": {
+			buf:          []byte("foo"),
+			label:        "",
+			expectPacket: []byte("foo"),
+		},
+		"message with label": {
+			buf:          []byte("foo"),
+			label:        "abc",
+			expectPacket: []byte("\xf4\x03abcfoo"),
+		},
+		"message with label too long": {
+			buf:       []byte("foo"),
+			label:     longLabel,
+			expectErr: `label "` + longLabel + `" is too long`,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+func TestRemoveLabelHeaderFromPacket_Truncated(t *testing.T) {
+	for _, buf := range [][]byte{
+		[]byte("\xf4"),
+		[]byte("\xf4\x00"),
+		[]byte("\xf4\x05abc"),
+	} {
+		_, _, err := removeLabelHeaderFromPacket(buf)
+		require.Error(t, err, "buf: %q", buf)
+	}
+}
+
+func TestAddRemoveLabelHeaderToStream(t *testing.T) {
+	for _, label := range []string{"", "abc"} {
+		client, server := net.Pipe()
+
+		go func() {
+			defer client.Close()
+			if err := addLabelHeaderToStream(client, label); err != nil {
+				return
+			}
+			client.Write([]byte("foo"))
+		}()
+
+		conn, got, err := removeLabelHeaderFromStream(server)
+		require.NoError(t, err)
+		require.Equal(t, label, got)
+
+		rest, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, []byte("foo"), rest)
+		server.Close()
+	}
+}
+
+func TestMemberlist_ClusterName(t *testing.T) {
+	newMember := func(t *testing.T, bindPort int, clusterName string, skipCheck bool) *Memberlist {
+		c := testConfig(t)
+		c.BindPort = bindPort
+		c.ClusterName = clusterName
+		c.SkipInboundLabelCheck = skipCheck
+		m, err := Create(c)
+		require.NoError(t, err)
+		return m
+	}
+
+	m1 := newMember(t, 0, "blue", false)
+	defer m1.Shutdown()
+	bindPort := m1.config.BindPort
+
+	// Same cluster name joins fine.
+	m2 := newMember(t, bindPort, "blue", false)
+	defer m2.Shutdown()
+	_, err := m2.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+	require.NoError(t, err)
+	require.Len(t, m2.Members(), 2)
+
+	// A different cluster name, or none at all, is rejected.
+	m3 := newMember(t, bindPort, "green", false)
+	defer m3.Shutdown()
+	_, err = m3.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+	require.Error(t, err)
+
+	m4 := newMember(t, bindPort, "", false)
+	defer m4.Shutdown()
+	_, err = m4.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+	require.Error(t, err)
+
+	// Skipping the inbound check lets unlabeled and labeled nodes talk to
+	// each other during a migration.
+	m5 := newMember(t, bindPort, "", true)
+	defer m5.Shutdown()
+	m6 := newMember(t, bindPort, "blue", true)
+	defer m6.Shutdown()
+	_, err = m5.Join([]string{m6.config.Name + "/" + m6.config.BindAddr})
+	require.NoError(t, err)
+	_, err = m6.Join([]string{m5.config.Name + "/" + m5.config.BindAddr})
+	require.NoError(t, err)
+	require.Len(t, m5.Members(), 2)
+}
@@ -21,12 +21,14 @@ import (
 	"log"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/armon/go-metrics"
 	multierror "github.com/hashicorp/go-multierror"
 	sockaddr "github.com/hashicorp/go-sockaddr"
 	"github.com/miekg/dns"
@@ -40,6 +42,15 @@ type Memberlist struct {
 	numNodes    uint32 // Number of known nodes (estimate)
 	pushPullReq uint32 // Number of push/pull requests  // 用于限制并发进行的同步操作的数量
 
+	stats TransportStats // Wire byte counters, must stay 64-bit aligned
+
+	name atomic.Value // Local node's name, which SetName can change
+
+	// Serializes building and applying alive messages about ourselves, so
+	// one based on stale state can't land after a newer one. Take it
+	// before nodeLock.
+	localAliveLock sync.Mutex
+
 	advertiseLock sync.RWMutex
 	advertiseAddr net.IP
 	advertisePort uint16
@@ -49,11 +60,15 @@ type Memberlist struct {
 	shutdownCh     chan struct{}
 	leave          int32 // Used as an atomic boolean value
 	leaveBroadcast chan struct{}
+	paused         int32 // Used as an atomic boolean value
+	notReady       int32 // Used as an atomic boolean value
 
 	shutdownLock sync.Mutex // Serializes calls to Shutdown
 	leaveLock    sync.Mutex // Serializes calls to Leave
+	pauseLock    sync.Mutex // Serializes calls to Pause and Resume
 
 	transport NodeAwareTransport
+	chaos     *chaos // Injected packet loss and delay, see Config.Chaos
 
 	// 用户消息类型拥有优先级的区分。比如对于 alive 消息则优先级较高。
 	handoffCh            chan struct{}
@@ -61,20 +76,72 @@ type Memberlist struct {
 	lowPriorityMsgQueue  *list.List
 	msgQueueLock         sync.Mutex
 
-	nodeLock   sync.RWMutex
-	nodes      []*nodeState          // Known nodes
-	nodeMap    map[string]*nodeState // Maps Node.Name -> NodeState // 当前节点的集群节点列表视图
-	nodeTimers map[string]*suspicion // Maps Node.Name -> suspicion timer
-	awareness  *awareness
+	nodeLock      sync.RWMutex
+	nodes         []*nodeState             // Known nodes
+	nodeMap       map[string]*nodeState    // Maps Node.Name -> NodeState // 当前节点的集群节点列表视图
+	nodeTimers    map[string]*suspicion    // Maps Node.Name -> suspicion timer
+	shadowTimers  map[string][]*suspicion  // Maps Node.Name -> shadow suspicion timers
+	leaveTimers   map[string]Timer         // Maps Node.Name -> pending NotifyLeave, see LeaveDebounce
+	reclaimChecks map[string]*reclaimCheck // Maps Node.Name -> reclaim probe, see VerifyReclaimByProbe
+	awareness     *awareness
+
+	// Rate limiting of refutes, see MinRefuteInterval and RefuteCoalesce.
+	// These are protected by nodeLock.
+	refuteLast  time.Time // When we last sent a refute
+	refuteTimer Timer     // Sends the held back refute, if there is one
+	refuteDue   time.Time // When refuteTimer fires
+	refuteInc   uint32    // Newest accused incarnation held back
+
+	stateWaiters map[string][]*stateWaiter // Callers of WaitForState, protected by nodeLock
+
+	// When membership last changed, and a channel that's closed when it
+	// next changes, for WaitForStable. These are protected by nodeLock.
+	lastMembershipChange time.Time
+	membershipChangeCh   chan struct{}
+
+	// How many of the SizeThresholds we last reported the size as being at
+	// or above, how many it was at when it last changed, and the pending
+	// report, if any. These are protected by nodeLock.
+	sizeLevel int
+	sizeSeen  int
+	sizeTimer Timer
+
+	tagLock           sync.Mutex
+	tags              map[string]string // Local node's tags, replaced rather than modified
+	tagVersions       map[string]uint64 // Versions of the local node's tags, for merging
+	tagsUpdatePending bool
+
+	// The health score we last published, probe ticks since then, and
+	// how many ticks in a row the score has differed from it. See
+	// publishHealthScore. These are protected by tagLock.
+	healthPublished int
+	healthTicks     int
+	healthSettle    int
+
+	// Meta data that MetaForPeer has given each peer for our own entry at
+	// incarnation peerMetaInc, so it isn't refuted when it comes back to us.
+	// Peers are dropped when they die.
+	peerMetaLock sync.Mutex
+	peerMetaInc  uint32
+	peerMetas    map[string][]byte
+
+	// Our own oversized broadcasts waiting to be pushed over TCP, and
+	// whether a push is running. See OversizedBroadcastTCP.
+	oversizedLock    sync.Mutex
+	oversizedPending []*notifyOnce
+	oversizedSyncing bool
 
 	tickerLock sync.Mutex
-	tickers    []*time.Ticker
+	tickers    []Ticker
 	stopTick   chan struct{}
 	probeIndex int
+	probeStale bool // Whether the next probe is picked by staleness, see StalenessWeightedProbing
 
 	ackLock     sync.Mutex
 	ackHandlers map[uint32]*ackHandler
 
+	pushPullSem chan struct{} // Inbound push/pull slots, nil if unlimited
+
 	broadcasts *TransmitLimitedQueue
 
 	logger *log.Logger
@@ -117,6 +184,16 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 		}
 	}
 
+	if len(conf.ClusterName) > labelMaxSize {
+		return nil, fmt.Errorf("Cluster name is too long: %d bytes, must be at most %d",
+			len(conf.ClusterName), labelMaxSize)
+	}
+
+	tags := configTags(conf)
+	if size := len(encodeTags(tags)); size > MetaMaxSize {
+		return nil, fmt.Errorf("Tags are too long: %d bytes, must be at most %d", size, MetaMaxSize)
+	}
+
 	if conf.LogOutput != nil && conf.Logger != nil {
 		return nil, fmt.Errorf("Cannot specify both LogOutput and Logger. Please choose a single log configuration setting.")
 	}
@@ -136,10 +213,15 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 	// 设置网络通信传输框架
 	transport := conf.Transport
 	if transport == nil {
+		bindAddrs := conf.BindAddrs
+		if len(bindAddrs) == 0 {
+			bindAddrs = []string{conf.BindAddr}
+		}
 		nc := &NetTransportConfig{
-			BindAddrs: []string{conf.BindAddr},
-			BindPort:  conf.BindPort,
-			Logger:    logger,
+			BindAddrs:      bindAddrs,
+			BindPort:       conf.BindPort,
+			UDPRecvBufSize: conf.UDPRecvBufSize,
+			Logger:         logger,
 		}
 
 		// See comment below for details about the retry in here.
@@ -189,8 +271,16 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 		nodeAwareTransport = &shimNodeAwareTransport{transport}
 	}
 
+	if conf.ClusterName != "" {
+		nodeAwareTransport = &labelWrappedTransport{
+			label:              conf.ClusterName,
+			NodeAwareTransport: nodeAwareTransport,
+		}
+	}
+
 	// 创建 Memberlist 结构
 	m := &Memberlist{
+		incarnation:          conf.MinIncarnation,
 		config:               conf,
 		shutdownCh:           make(chan struct{}),
 		leaveBroadcast:       make(chan struct{}, 1),
@@ -200,14 +290,46 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 		lowPriorityMsgQueue:  list.New(),
 		nodeMap:              make(map[string]*nodeState),
 		nodeTimers:           make(map[string]*suspicion),
+		shadowTimers:         make(map[string][]*suspicion),
+		leaveTimers:          make(map[string]Timer),
+		reclaimChecks:        make(map[string]*reclaimCheck),
 		awareness:            newAwareness(conf.AwarenessMaxMultiplier),
 		ackHandlers:          make(map[uint32]*ackHandler),
 		broadcasts:           &TransmitLimitedQueue{RetransmitMult: conf.RetransmitMult},
 		logger:               logger,
+		tags:                 tags,
+		tagVersions:          make(map[string]uint64),
+		chaos:                newChaos(conf.Chaos),
+	}
+	m.name.Store(conf.Name)
+	if m.chaos != nil {
+		logger.Printf("[WARN] memberlist: Chaos testing is enabled, dropping %.0f%% of sent packets and delaying them by %v. Never use this in production!",
+			conf.Chaos.SendDropProbability*100, conf.Chaos.SendLatency)
+	}
+	if conf.AdvertiseRefreshInterval > 0 && conf.DeadNodeReclaimTime <= 0 {
+		logger.Printf("[WARN] memberlist: AdvertiseRefreshInterval is set without DeadNodeReclaimTime, so peers won't accept a new advertise address")
+	}
+	if conf.GossipHealthScore && !gossipsHealthScore(conf) {
+		logger.Printf("[WARN] memberlist: Not publishing the health score, which needs protocol version %d or later",
+			healthScoreProtocolVersion)
+	}
+	if conf.MaxConcurrentPushPull > 0 {
+		m.pushPullSem = make(chan struct{}, conf.MaxConcurrentPushPull)
 	}
 	m.broadcasts.NumNodes = func() int { // 设置获取集群成员数量的方法
 		return m.estNumNodes()
 	}
+	if conf.OnBroadcastRetired != nil {
+		m.broadcasts.Retired = func(b Broadcast) {
+			mb, ok := asMemberlistBroadcast(b)
+			if !ok || len(mb.msg) == 0 {
+				return
+			}
+			conf.OnBroadcastRetired(mb.msg[0], mb.node)
+		}
+	}
+
+	m.checkPacketSize()
 
 	// Get the final advertise address from the transport, which may need
 	// to see which address we bound to. We'll refresh this each time we
@@ -255,34 +377,123 @@ func Create(conf *Config) (*Memberlist, error) {
 func (m *Memberlist) Join(existing []string) (int, error) {
 	numSuccess := 0
 	var errs error
+	seen := make(map[string]struct{})
 	for _, exist := range existing {
-		addrs, err := m.resolveAddr(exist)
+		n, err := m.joinSeed(exist, seen)
 		if err != nil {
-			err = fmt.Errorf("Failed to resolve %s: %v", exist, err)
 			errs = multierror.Append(errs, err)
-			m.logger.Printf("[WARN] memberlist: %v", err)
-			continue
+		}
+		numSuccess += n
+	}
+	if numSuccess > 0 {
+		errs = nil
+	}
+	return numSuccess, errs
+}
+
+// JoinWithRetry is like Join, but retries seeds that couldn't be joined,
+// waiting an exponentially increasing and jittered backoff between attempts,
+// starting at baseBackoff. Seeds that were reachable but rejected the join,
+// such as because of incompatible protocol versions or a MergeDelegate,
+// aren't retried. This returns as soon as any seed is joined successfully,
+// with the number of nodes contacted through that seed. If every attempt
+// fails, the returned error has the last failure seen for each seed.
+func (m *Memberlist) JoinWithRetry(existing []string, maxAttempts int, baseBackoff time.Duration) (int, error) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	lastErr := make(map[string]error)
+	pending := existing
+	for attempt := 0; attempt < maxAttempts && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-m.clock().NewTimer(joinBackoff(baseBackoff, attempt)).C():
+			case <-m.shutdownCh:
+				return 0, fmt.Errorf("memberlist was shut down while joining")
+			}
 		}
 
-		for _, addr := range addrs {
-			hp := joinHostPort(addr.ip.String(), addr.port)
-			a := Address{Addr: hp, Name: addr.nodeName}
-			if err := m.pushPullNode(a, true); err != nil {
-				err = fmt.Errorf("Failed to join %s: %v", addr.ip, err)
-				errs = multierror.Append(errs, err)
-				m.logger.Printf("[DEBUG] memberlist: %v", err)
-				continue
+		var retry []string
+		seen := make(map[string]struct{})
+		for _, exist := range pending {
+			n, err := m.joinSeed(exist, seen)
+			if n > 0 {
+				return n, nil
+			}
+			lastErr[exist] = err
+			if joinRetryable(err) {
+				retry = append(retry, exist)
 			}
-			numSuccess++
 		}
+		pending = retry
+	}
 
+	var errs error
+	for _, exist := range existing {
+		if err, ok := lastErr[exist]; ok {
+			errs = multierror.Append(errs, err)
+		}
 	}
-	if numSuccess > 0 {
-		errs = nil
+	return 0, errs
+}
+
+// joinSeed attempts to join through a single seed, which may resolve to
+// several addresses. It returns the number of addresses successfully joined
+// along with any errors encountered. Addresses already in seen are skipped,
+// so seeds that are listed twice or resolve to the same place are only
+// tried once per round, and the ones tried here are added to it.
+func (m *Memberlist) joinSeed(exist string, seen map[string]struct{}) (int, error) {
+	addrs, err := m.resolveAddr(exist)
+	if err != nil {
+		err = fmt.Errorf("Failed to resolve %s: %v", exist, err)
+		m.logger.Printf("[WARN] memberlist: %v", err)
+		return 0, err
+	}
+
+	numSuccess := 0
+	var errs error
+	for _, addr := range addrs {
+		// IPv4 addresses format the same whether or not they're in
+		// their IPv6 form, so this also catches those duplicates.
+		hp := joinHostPort(addr.ip.String(), addr.port)
+		if _, ok := seen[hp]; ok {
+			m.logger.Printf("[DEBUG] memberlist: Skipping duplicate seed address %s", hp)
+			continue
+		}
+		seen[hp] = struct{}{}
+
+		a := Address{Addr: hp, Name: addr.nodeName}
+		if err := m.pushPullNode(a, true); err != nil {
+			err = fmt.Errorf("Failed to join %s: %w", addr.ip, err)
+			errs = multierror.Append(errs, err)
+			m.logger.Printf("[DEBUG] memberlist: %v", err)
+			continue
+		}
+		numSuccess++
 	}
 	return numSuccess, errs
 }
 
+// joinRetryable returns true if a failed join through a seed is worth
+// retrying. Seeds that were reached but refused to merge with us will keep
+// refusing, so they are not retried. A seed that resolved to several
+// addresses is only given up on if every one of them refused.
+func joinRetryable(err error) bool {
+	if merr, ok := err.(*multierror.Error); ok && len(merr.Errors) > 0 {
+		for _, e := range merr.Errors {
+			if joinRetryable(e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var mismatch *ProtocolMismatchError
+	var rejected *MergeRejectedError
+	return !errors.As(err, &mismatch) && !errors.As(err, &rejected)
+}
+
 // ipPort holds information about a node we want to try to join.
 type ipPort struct {
 	ip       net.IP
@@ -437,23 +648,25 @@ func (m *Memberlist) setAlive() error {
 		m.logger.Printf("[WARN] memberlist: Binding to public address without encryption!")
 	}
 
+	m.localAliveLock.Lock()
+	defer m.localAliveLock.Unlock()
+
 	// Set any metadata from the delegate.
-	var meta []byte
-	if m.config.Delegate != nil {
-		meta = m.config.Delegate.NodeMeta(MetaMaxSize)
-		if len(meta) > MetaMaxSize {
-			panic("Node meta data provided is longer than the limit")
-		}
-	}
+	meta := m.localMeta()
 
 	// 构建一条 alive　消息，然后进入 alive 消息的处理逻辑。
 	a := alive{
 		Incarnation: m.nextIncarnation(),
-		Node:        m.config.Name,
+		Node:        m.localName(),
 		Addr:        addr,
 		Port:        uint16(port),
 		Meta:        meta,
 		Vsn:         m.config.BuildVsnArray(),
+		NotReady:    m.isNotReady(),
+	}
+	m.overrideLocalAlive(&a)
+	if err := m.checkLocalAlive(&a); err != nil {
+		return err
 	}
 	m.aliveNode(&a, nil, true)
 
@@ -483,12 +696,52 @@ func (m *Memberlist) refreshAdvertise() (net.IP, int, error) {
 	return addr, port, nil
 }
 
-// LocalNode is used to return the local Node
+// checkAdvertise resolves our advertise address again, and if it has
+// changed, reports it through Config.OnAdvertiseChange and re-announces us
+// at the new address. See Config.AdvertiseRefreshInterval.
+func (m *Memberlist) checkAdvertise() {
+	oldAddr, oldPort := m.getAdvertise()
+	addr, port, err := m.refreshAdvertise()
+	if err != nil {
+		m.logger.Printf("[WARN] memberlist: Keeping advertise address %v:%d: %v", oldAddr, oldPort, err)
+		return
+	}
+	if oldAddr.Equal(addr) && int(oldPort) == port {
+		return
+	}
+
+	m.logger.Printf("[INFO] memberlist: Advertise address changed from %v:%d to %v:%d",
+		oldAddr, oldPort, addr, port)
+	metrics.IncrCounter([]string{"memberlist", "advertise", "changed"}, 1)
+	if m.config.OnAdvertiseChange != nil {
+		m.config.OnAdvertiseChange(oldAddr, addr)
+	}
+	if m.hasLeft() || m.hasShutdown() || m.config.Observer {
+		return
+	}
+	if err := m.Refresh(); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to announce new advertise address: %v", err)
+	}
+}
+
+// LocalNode is used to return the local Node, as the rest of the cluster
+// sees it. The address and port are the resolved advertise address rather
+// than what was configured, and the meta data is the latest we've
+// announced. The returned Node is a copy and may be kept or modified by the
+// caller.
 func (m *Memberlist) LocalNode() *Node {
+	addr, port := m.getAdvertise()
+
 	m.nodeLock.RLock()
 	defer m.nodeLock.RUnlock()
-	state := m.nodeMap[m.config.Name]
-	return &state.Node
+
+	n := &Node{Name: m.localName()}
+	if state, ok := m.nodeMap[m.localName()]; ok {
+		n = state.Node.copy()
+	}
+	n.Addr = append(net.IP(nil), addr...)
+	n.Port = port
+	return n
 }
 
 // UpdateNode is used to trigger re-advertising the local node. This is
@@ -497,31 +750,37 @@ func (m *Memberlist) LocalNode() *Node {
 // broadcasted to a member of the cluster, if any exist or until a specified
 // timeout is reached.
 func (m *Memberlist) UpdateNode(timeout time.Duration) error {
+	m.localAliveLock.Lock()
+
 	// Get the node meta data
-	var meta []byte
-	if m.config.Delegate != nil {
-		meta = m.config.Delegate.NodeMeta(MetaMaxSize)
-		if len(meta) > MetaMaxSize {
-			panic("Node meta data provided is longer than the limit")
-		}
-	}
+	meta := m.localMeta()
 
-	// Get the existing node
+	// Get the existing node, keeping any delegate version set with
+	// UpdateNodeInfo
 	m.nodeLock.RLock()
-	state := m.nodeMap[m.config.Name]
+	state := m.nodeMap[m.localName()]
+	vsn := m.config.BuildVsnArray()
+	vsn[5] = state.DCur
 	m.nodeLock.RUnlock()
 
 	// Format a new alive message
 	a := alive{
 		Incarnation: m.nextIncarnation(),
-		Node:        m.config.Name,
+		Node:        m.localName(),
 		Addr:        state.Addr,
 		Port:        state.Port,
 		Meta:        meta,
-		Vsn:         m.config.BuildVsnArray(),
+		Vsn:         vsn,
+		NotReady:    m.isNotReady(),
+	}
+	m.overrideLocalAlive(&a)
+	if err := m.checkLocalAlive(&a); err != nil {
+		m.localAliveLock.Unlock()
+		return err
 	}
 	notifyCh := make(chan struct{})
 	m.aliveNode(&a, notifyCh, true)
+	m.localAliveLock.Unlock()
 
 	// Wait for the broadcast or a timeout
 	if m.anyAlive() {
@@ -538,6 +797,224 @@ func (m *Memberlist) UpdateNode(timeout time.Duration) error {
 	return nil
 }
 
+// UpdateNodeInfo sets the local node's meta data and current delegate
+// protocol version together, and announces both in a single alive message
+// with a new incarnation number, so peers never see one change without the
+// other. This is useful for advancing the delegate version during a rolling
+// upgrade. The version must be within DelegateProtocolMin and
+// DelegateProtocolMax, and the meta data, along with the node's tags, no
+// longer than MetaMaxSize. The tags are kept in front as usual. Later
+// calls to UpdateNode keep the new version, but ask the Delegate for the
+// meta data as usual. Unlike UpdateNode, this doesn't wait for the broadcast.
+func (m *Memberlist) UpdateNodeInfo(meta []byte, dcur uint8) error {
+	if dcur < m.config.DelegateProtocolMin || dcur > m.config.DelegateProtocolMax {
+		return fmt.Errorf("delegate protocol version %d is outside the supported range [%d, %d]",
+			dcur, m.config.DelegateProtocolMin, m.config.DelegateProtocolMax)
+	}
+	if m.hasLeft() || m.hasShutdown() {
+		return fmt.Errorf("cannot update after leave or shutdown")
+	}
+	if m.config.Observer {
+		return fmt.Errorf("observers don't announce themselves")
+	}
+
+	m.localAliveLock.Lock()
+	defer m.localAliveLock.Unlock()
+
+	// Keep our tags in front, as UpdateNode does
+	tags := m.encodedTags()
+	if size := len(tags) + len(meta); size > MetaMaxSize {
+		return fmt.Errorf("node meta data of %d bytes, with %d bytes of tags, is longer than the limit of %d bytes",
+			len(meta), len(tags), MetaMaxSize)
+	}
+	meta = append(tags, meta...)
+
+	m.nodeLock.RLock()
+	me, ok := m.nodeMap[m.localName()]
+	if !ok {
+		m.nodeLock.RUnlock()
+		return fmt.Errorf("local node is not in the member list")
+	}
+	a := alive{
+		Incarnation: m.nextIncarnation(),
+		Node:        me.Name,
+		Addr:        me.Addr,
+		Port:        me.Port,
+		Meta:        meta,
+		Vsn: []uint8{
+			me.PMin, me.PMax, me.PCur,
+			me.DMin, me.DMax, dcur,
+		},
+		NotReady: m.isNotReady(),
+	}
+	m.nodeLock.RUnlock()
+
+	m.overrideLocalAlive(&a)
+	if err := m.checkLocalAlive(&a); err != nil {
+		return err
+	}
+	m.aliveNode(&a, nil, true)
+	return nil
+}
+
+// Refresh re-announces this node's current alive state, including its meta
+// data and current advertise address, with a new incarnation number. The
+// alive message is sent directly to a few random peers right away, as well
+// as being queued for gossip, so the rest of the cluster hears about it
+// faster than with UpdateNode alone. Unlike UpdateNode, this doesn't ask
+// the Delegate for new meta data.
+func (m *Memberlist) Refresh() error {
+	if m.hasLeft() || m.hasShutdown() {
+		return fmt.Errorf("cannot refresh after leave or shutdown")
+	}
+	if m.config.Observer {
+		return fmt.Errorf("observers don't announce themselves")
+	}
+
+	m.localAliveLock.Lock()
+	m.nodeLock.RLock()
+	me, ok := m.nodeMap[m.localName()]
+	if !ok {
+		m.nodeLock.RUnlock()
+		m.localAliveLock.Unlock()
+		return fmt.Errorf("local node is not in the member list")
+	}
+	addr, port := m.getAdvertise()
+	a := alive{
+		Incarnation: m.nextIncarnation(),
+		Node:        me.Name,
+		Addr:        addr,
+		Port:        port,
+		Meta:        me.Meta,
+		Vsn: []uint8{
+			me.PMin, me.PMax, me.PCur,
+			me.DMin, me.DMax, me.DCur,
+		},
+		NotReady: m.isNotReady(),
+	}
+	m.overrideLocalAlive(&a)
+	kNodes := kRandomNodes(m.gossipFanout(), m.nodes, func(n *nodeState) bool {
+		return n.Name == m.localName() || n.DeadOrLeft()
+	})
+	m.nodeLock.RUnlock()
+
+	// Update our own state and queue the alive message for gossip.
+	m.aliveNode(&a, nil, true)
+	m.localAliveLock.Unlock()
+
+	// Send it directly to some peers as well, rather than waiting for the
+	// next gossip round.
+	buf, err := encode(aliveMsg, &a)
+	if err != nil {
+		return err
+	}
+	for _, node := range kNodes {
+		out := buf
+		if m.config.MetaForPeer != nil {
+			peerAlive := a
+			peerAlive.Meta = m.metaForPeer(&node, a.Incarnation, a.Meta)
+			if out, err = encode(aliveMsg, &peerAlive); err != nil {
+				return err
+			}
+		}
+		if err := m.rawSendMsgPacket(node.FullAddress(), &node, out.Bytes()); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to send refreshed alive message to %s: %s", node.Name, err)
+		}
+	}
+	return nil
+}
+
+// SetReady marks the local node as ready or not ready for new work, and
+// announces the change right away, as Refresh does. A node that isn't ready
+// is still a full member: it keeps probing and gossiping, and it's still
+// probed, but other nodes see Node.Ready as false and get a NotifyUpdate,
+// so applications can stop routing new work to it. This is a lighter and
+// reversible alternative to Leave for things like maintenance.
+func (m *Memberlist) SetReady(ready bool) error {
+	var notReady int32
+	if !ready {
+		notReady = 1
+	}
+	if atomic.SwapInt32(&m.notReady, notReady) == notReady {
+		return nil
+	}
+	return m.Refresh()
+}
+
+// isNotReady returns true if SetReady has marked the local node as not ready.
+func (m *Memberlist) isNotReady() bool {
+	return atomic.LoadInt32(&m.notReady) == 1
+}
+
+// SetName renames the local node. An alive message is broadcast for the new
+// name, and the old name is marked as having left, so the rest of the
+// cluster sees it as the old node leaving and a new one joining at the same
+// address. The new name is rejected if it belongs to a live node, or to a
+// dead one whose name can't be reclaimed yet.
+//
+// This is meant for tests and simulations that exercise conflict handling
+// and reclaim with many memberlists in one process. Config.Name keeps the
+// name we started with, use LocalNode to get the current one.
+func (m *Memberlist) SetName(name string) error {
+	if name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+	if m.hasLeft() || m.hasShutdown() {
+		return fmt.Errorf("cannot rename after leave or shutdown")
+	}
+
+	m.localAliveLock.Lock()
+	defer m.localAliveLock.Unlock()
+
+	m.nodeLock.Lock()
+	oldName := m.localName()
+	if name == oldName {
+		m.nodeLock.Unlock()
+		return nil
+	}
+	if n, ok := m.nodeMap[name]; ok && !n.DeadOrLeft() {
+		m.nodeLock.Unlock()
+		return fmt.Errorf("name %q is in use by a live node", name)
+	}
+	me, ok := m.nodeMap[oldName]
+	if !ok {
+		m.nodeLock.Unlock()
+		return fmt.Errorf("local node is not in the member list")
+	}
+	a := alive{
+		Incarnation: m.nextIncarnation(),
+		Node:        name,
+		Addr:        me.Addr,
+		Port:        me.Port,
+		Meta:        me.Meta,
+		Vsn: []uint8{
+			me.PMin, me.PMax, me.PCur,
+			me.DMin, me.DMax, me.DCur,
+		},
+		NotReady: m.isNotReady(),
+	}
+	d := dead{Incarnation: me.Incarnation, Node: oldName, From: oldName}
+	m.name.Store(name)
+	m.nodeLock.Unlock()
+
+	// Announce the new name, and make sure it took before retiring the old
+	// one, since the alive message can be refused if it conflicts with a
+	// dead node.
+	m.aliveNode(&a, nil, true)
+
+	m.nodeLock.Lock()
+	n, ok := m.nodeMap[name]
+	if !ok || n.State != StateAlive || n.Incarnation != a.Incarnation {
+		m.name.Store(oldName)
+		m.nodeLock.Unlock()
+		return fmt.Errorf("name %q conflicts with a dead node that can't be reclaimed yet", name)
+	}
+	m.nodeLock.Unlock()
+
+	m.deadNode(&d)
+	return nil
+}
+
 // Deprecated: SendTo is deprecated in favor of SendBestEffort, which requires a node to
 // target. If you don't have a node then use SendToAddress.
 func (m *Memberlist) SendTo(to net.Addr, msg []byte) error {
@@ -580,6 +1057,13 @@ func (m *Memberlist) SendBestEffort(to *Node, msg []byte) error {
 	return m.rawSendMsgPacket(a, to, buf)
 }
 
+// SendUserMsg sends a best-effort user message to the given node, using the
+// same mechanism as SendBestEffort. The message is delivered to the remote
+// node's UserMessageDelegate, if it has one, or its Delegate otherwise.
+func (m *Memberlist) SendUserMsg(to *Node, msg []byte) error {
+	return m.SendBestEffort(to, msg)
+}
+
 // SendReliable uses the reliable stream-oriented interface of the transport to
 // target a user message at the given node (this does not use the gossip
 // mechanism). Delivery is guaranteed if no error is returned, and there is no
@@ -605,6 +1089,173 @@ func (m *Memberlist) Members() []*Node {
 	return nodes
 }
 
+// FindNodes returns copies of the known live nodes, the same nodes Members
+// returns, for which match returns true. The match function is called with
+// the node lock held, so it must be quick, mustn't modify the node it's
+// given, and mustn't call back into memberlist.
+func (m *Memberlist) FindNodes(match func(*Node) bool) []*Node {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	var nodes []*Node
+	for _, n := range m.nodes {
+		if !n.DeadOrLeft() && match(&n.Node) {
+			nodes = append(nodes, n.Node.copy())
+		}
+	}
+	return nodes
+}
+
+// MembersByRTT returns copies of the alive nodes other than ourselves,
+// nearest first, going by a moving average of the round-trip time of our
+// direct pings to each. RTT is only measured on direct pings, not indirect
+// ones, so nodes we haven't reached directly yet, such as ones that just
+// joined, have no RTT and come last, in no particular order.
+func (m *Memberlist) MembersByRTT() []*Node {
+	m.nodeLock.RLock()
+	var states []nodeState
+	for _, n := range m.nodes {
+		if n.State == StateAlive && n.Name != m.localName() {
+			states = append(states, *n)
+		}
+	}
+	m.nodeLock.RUnlock()
+
+	sort.SliceStable(states, func(i, j int) bool {
+		if states[i].hasRTT != states[j].hasRTT {
+			return states[i].hasRTT
+		}
+		return states[i].rtt < states[j].rtt
+	})
+	nodes := make([]*Node, 0, len(states))
+	for i := range states {
+		nodes = append(nodes, states[i].Node.copy())
+	}
+	return nodes
+}
+
+// IsAlive returns true if the named node is known and we currently consider
+// it alive. Suspect nodes aren't counted, even though Members still returns
+// them.
+func (m *Memberlist) IsAlive(name string) bool {
+	state, ok := m.NodeState(name)
+	return ok && state == StateAlive
+}
+
+// NodeState returns our current view of the named node's state, or false
+// if we don't know about the node, including once a dead node has been
+// reaped.
+func (m *Memberlist) NodeState(name string) (NodeStateType, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	n, ok := m.nodeMap[name]
+	if !ok {
+		return 0, false
+	}
+	return n.State, true
+}
+
+// ReplayJoins calls d.NotifyJoin for every known live node, the same nodes
+// Members returns, so an EventDelegate that's set up after we've started
+// can build its initial view. The nodes are walked with the node lock held,
+// so the replay is a consistent snapshot, and d must not call back into
+// memberlist. Changes that happen after the replay are delivered through
+// Config.Events as usual, which may repeat a join the replay already
+// reported, so d should tolerate duplicates.
+func (m *Memberlist) ReplayJoins(d EventDelegate) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	for _, n := range m.nodes {
+		if !n.DeadOrLeft() {
+			d.NotifyJoin(&n.Node)
+		}
+	}
+}
+
+// AllNodes returns a copy of every node this memberlist knows about,
+// including nodes that are dead or have left, with each node's State set to
+// its current state. Unlike Members, the returned nodes are copies and may
+// be modified freely. This is a lower-level view meant for tooling and
+// debugging.
+func (m *Memberlist) AllNodes() []*Node {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	nodes := make([]*Node, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		node := n.Node.copy()
+		node.State = n.State
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+// SuspicionConfirmers returns the names of the peers that have confirmed our
+// suspicion of the given node, not counting the peer whose accusation
+// started it. This is useful for diagnosing asymmetric partitions, where
+// only some parts of the cluster can't reach a node. It returns false if the
+// node isn't currently suspect.
+func (m *Memberlist) SuspicionConfirmers(name string) ([]string, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	n, ok := m.nodeMap[name]
+	if !ok || n.State != StateSuspect {
+		return nil, false
+	}
+	s, ok := m.nodeTimers[name]
+	if !ok {
+		return nil, false
+	}
+	return s.Confirmers(), true
+}
+
+// IsRecovering returns true if the given node was suspect and has been alive
+// again for less than Config.RecoveryHysteresis. Applications may want to
+// hold off on treating such a node as fully healthy, since it could be
+// flapping.
+func (m *Memberlist) IsRecovering(name string) bool {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	n, ok := m.nodeMap[name]
+	return ok && m.isRecovering(n)
+}
+
+// LastContact returns when we last heard directly from the given node, by an
+// ack to one of our probes or a push/pull exchange. The time is zero if we
+// haven't heard from it yet, and the bool is false if the node isn't known.
+// Unlike the node's state, this advances on every successful probe, so it's
+// useful for preferring peers that have recently been responsive.
+func (m *Memberlist) LastContact(name string) (time.Time, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	n, ok := m.nodeMap[name]
+	if !ok {
+		return time.Time{}, false
+	}
+	return n.lastContact, true
+}
+
+// NodeVersions returns the protocol and delegate version ranges the named
+// node advertised, along with the versions it's currently speaking. This is
+// useful for deciding per peer whether it understands a newer format of an
+// application's own messages. The bool is false if the node isn't known.
+func (m *Memberlist) NodeVersions(name string) (pmin, pmax, pcur, dmin, dmax, dcur uint8, ok bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	n, ok := m.nodeMap[name]
+	if !ok {
+		return 0, 0, 0, 0, 0, 0, false
+	}
+	return n.PMin, n.PMax, n.PCur, n.DMin, n.DMax, n.DCur, true
+}
+
 // NumMembers returns the number of alive nodes currently known. Between
 // the time of calling this and calling Members, the number of alive nodes
 // may have changed, so this shouldn't be used to determine how many
@@ -644,7 +1295,7 @@ func (m *Memberlist) Leave(timeout time.Duration) error {
 		atomic.StoreInt32(&m.leave, 1)
 
 		m.nodeLock.Lock()
-		state, ok := m.nodeMap[m.config.Name]
+		state, ok := m.nodeMap[m.localName()]
 		m.nodeLock.Unlock()
 		if !ok {
 			m.logger.Printf("[WARN] memberlist: Leave but we're not in the node map.")
@@ -662,8 +1313,9 @@ func (m *Memberlist) Leave(timeout time.Duration) error {
 		}
 		m.deadNode(&d)
 
-		// Block until the broadcast goes out
-		if m.anyAlive() {
+		// Block until the broadcast goes out, unless we're an observer
+		// and there's nothing to send.
+		if m.anyAlive() && !m.config.Observer {
 			var timeoutCh <-chan time.Time
 			if timeout > 0 {
 				timeoutCh = time.After(timeout)
@@ -679,12 +1331,61 @@ func (m *Memberlist) Leave(timeout time.Duration) error {
 	return nil
 }
 
+// FastLeave is a last-gasp version of Leave for when the process is about to
+// exit, for example from a deferred recover or a signal handler. Instead of
+// gossiping that we've left and waiting for it to go out, it sends the
+// message straight to GossipNodes random live nodes over UDP and returns
+// right away, without waiting to hear back. Those nodes then spread the
+// news as usual. Once this is called, we won't refute being declared dead,
+// and Leave does nothing.
+func (m *Memberlist) FastLeave() error {
+	if m.hasShutdown() {
+		return fmt.Errorf("memberlist has been shut down")
+	}
+	atomic.StoreInt32(&m.leave, 1)
+
+	// Observers never announce themselves, so there's nobody to tell.
+	if m.config.Observer {
+		return nil
+	}
+
+	m.nodeLock.RLock()
+	me, ok := m.nodeMap[m.localName()]
+	if !ok {
+		m.nodeLock.RUnlock()
+		return fmt.Errorf("local node is not in the node map")
+	}
+	d := dead{
+		Incarnation: me.Incarnation,
+		Node:        me.Name,
+		From:        me.Name,
+	}
+	kNodes := kRandomNodes(m.config.GossipNodes, m.nodes, func(n *nodeState) bool {
+		return n.Name == m.localName() || n.DeadOrLeft()
+	})
+	m.nodeLock.RUnlock()
+
+	buf, err := encode(deadMsg, &d)
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	for _, node := range kNodes {
+		node := node
+		if err := m.rawSendMsgPacket(node.FullAddress(), &node, buf.Bytes()); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("failed to send leave to %s: %w", node.Name, err))
+		}
+	}
+	return errs
+}
+
 // Check for any other alive node.
 func (m *Memberlist) anyAlive() bool {
 	m.nodeLock.RLock()
 	defer m.nodeLock.RUnlock()
 	for _, n := range m.nodes {
-		if !n.DeadOrLeft() && n.Name != m.config.Name {
+		if !n.DeadOrLeft() && n.Name != m.localName() {
 			return true
 		}
 	}
@@ -698,6 +1399,100 @@ func (m *Memberlist) GetHealthScore() int {
 	return m.awareness.GetHealthScore()
 }
 
+// ClusterHealth aggregates the health scores published by the alive
+// members, including this one, returning the average score, the worst
+// score, and how many members have a non-zero score. Members that don't
+// publish a score are left out; see Config.GossipHealthScore. A large share
+// of degraded members points at a problem affecting the whole cluster,
+// such as the network, rather than at the members themselves.
+func (m *Memberlist) ClusterHealth() (avg float64, max int, degradedCount int) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	var sum, count int
+	for _, n := range m.nodes {
+		if n.State != StateAlive {
+			continue
+		}
+		score, ok := n.Node.HealthScore()
+		if !ok {
+			continue
+		}
+		count++
+		sum += score
+		if score > max {
+			max = score
+		}
+		if score > 0 {
+			degradedCount++
+		}
+	}
+	if count > 0 {
+		avg = float64(sum) / float64(count)
+	}
+	return avg, max, degradedCount
+}
+
+// EffectiveProbeInterval returns the probe interval currently in effect,
+// which is Config.ProbeInterval scaled up by the health score. It's also how
+// long each probe waits for indirect acks before giving up. When this is
+// longer than ProbeInterval, we're degraded and failure detection is slowed
+// down accordingly.
+func (m *Memberlist) EffectiveProbeInterval() time.Duration {
+	return m.awareness.ScaleTimeout(m.config.ProbeInterval)
+}
+
+// EstimatedConvergenceTime returns a rough estimate of how long it takes for
+// a change, such as a node joining or failing, to reach every member of the
+// cluster. It's based on the current number of nodes and the configured
+// gossip and push/pull settings, and assumes no packet loss, so it should be
+// treated as a guide rather than a guarantee.
+func (m *Memberlist) EstimatedConvergenceTime() time.Duration {
+	n := m.estNumNodes()
+	var pushPull time.Duration
+	if m.config.PushPullInterval > 0 {
+		pushPull = m.CurrentPushPullInterval()
+	}
+	return convergenceTime(n, m.gossipFanout(), retransmitLimit(m.config.RetransmitMult, n),
+		m.config.GossipInterval, pushPull)
+}
+
+// PendingAcks returns the number of outstanding ack handlers, which are
+// registered for each ping sent and removed when the ack arrives or the
+// handler times out. A count that keeps growing means acks aren't arriving
+// or the handlers aren't being reaped.
+func (m *Memberlist) PendingAcks() int {
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+	return len(m.ackHandlers)
+}
+
+// GossipBytesAvailable returns how many bytes of each gossip packet are left
+// for broadcasts once the compound message, cluster label and encryption
+// overheads are subtracted from UDPBufferSize. It's useful for checking that
+// UDPBufferSize is tuned correctly for the network's MTU.
+func (m *Memberlist) GossipBytesAvailable() int {
+	return m.gossipBytesAvail()
+}
+
+// ReportAppHealth lets the application feed its own view of its health into
+// the health score returned by GetHealthScore. A positive delta marks this
+// node as less healthy, which lengthens its probe timeouts so it's slower to
+// blame other nodes for its own problems, and a negative delta marks it as
+// healthier again. The score stays within its usual bounds, and memberlist
+// keeps adjusting it based on probe results as well.
+func (m *Memberlist) ReportAppHealth(delta int) {
+	m.awareness.ApplyDelta(delta)
+}
+
+// SetAwarenessMax changes the upper limit of the health score at runtime,
+// which is the multiplier applied to probe timeouts for an unhealthy node.
+// This is the runtime equivalent of Config.AwarenessMaxMultiplier. If the
+// current health score is above the new limit it's lowered to fit.
+func (m *Memberlist) SetAwarenessMax(max int) {
+	m.awareness.SetMax(max)
+}
+
 // ProtocolVersion returns the protocol version currently in use by
 // this memberlist.
 func (m *Memberlist) ProtocolVersion() uint8 {
@@ -707,6 +1502,42 @@ func (m *Memberlist) ProtocolVersion() uint8 {
 	return m.config.ProtocolVersion
 }
 
+// Pause stops the background maintenance of this memberlist, so it will no
+// longer initiate probes, gossip, or push/pull syncs of its own. Incoming
+// messages are still handled, so peers can continue to probe and gossip
+// with this node without suspecting it. Call Resume to restart the
+// background maintenance.
+//
+// This method is safe to call multiple times.
+func (m *Memberlist) Pause() {
+	m.pauseLock.Lock()
+	defer m.pauseLock.Unlock()
+
+	if m.hasShutdown() || m.isPaused() {
+		return
+	}
+
+	atomic.StoreInt32(&m.paused, 1)
+	m.deschedule()
+}
+
+// Resume restarts the background maintenance of a memberlist that was
+// stopped by Pause. This has no effect if the memberlist isn't paused or
+// has been shut down.
+//
+// This method is safe to call multiple times.
+func (m *Memberlist) Resume() {
+	m.pauseLock.Lock()
+	defer m.pauseLock.Unlock()
+
+	if m.hasShutdown() || !m.isPaused() {
+		return
+	}
+
+	atomic.StoreInt32(&m.paused, 0)
+	m.schedule()
+}
+
 // Shutdown will stop any background maintenance of network activity
 // for this memberlist, causing it to appear "dead". A leave message
 // will not be broadcasted prior, so the cluster being left will have
@@ -733,9 +1564,33 @@ func (m *Memberlist) Shutdown() error {
 	atomic.StoreInt32(&m.shutdown, 1)
 	close(m.shutdownCh)
 	m.deschedule()
+
+	// Drop any notifications we were holding back.
+	m.nodeLock.Lock()
+	for name, timer := range m.leaveTimers {
+		timer.Stop()
+		delete(m.leaveTimers, name)
+	}
+	if m.sizeTimer != nil {
+		m.sizeTimer.Stop()
+		m.sizeTimer = nil
+	}
+	if m.refuteTimer != nil {
+		m.refuteTimer.Stop()
+		m.refuteTimer = nil
+	}
+	m.nodeLock.Unlock()
 	return nil
 }
 
+// localName returns the local node's current name, see SetName.
+func (m *Memberlist) localName() string {
+	if name, ok := m.name.Load().(string); ok {
+		return name
+	}
+	return m.config.Name
+}
+
 func (m *Memberlist) hasShutdown() bool {
 	return atomic.LoadInt32(&m.shutdown) == 1
 }
@@ -744,12 +1599,18 @@ func (m *Memberlist) hasLeft() bool {
 	return atomic.LoadInt32(&m.leave) == 1
 }
 
-func (m *Memberlist) getNodeState(addr string) NodeStateType {
-	m.nodeLock.RLock()
-	defer m.nodeLock.RUnlock()
+func (m *Memberlist) isPaused() bool {
+	return atomic.LoadInt32(&m.paused) == 1
+}
 
-	n := m.nodeMap[addr]
-	return n.State
+// getNodeState is NodeState for callers that know the node exists. It
+// panics if it doesn't.
+func (m *Memberlist) getNodeState(addr string) NodeStateType {
+	state, ok := m.NodeState(addr)
+	if !ok {
+		panic(fmt.Sprintf("memberlist: unknown node %q", addr))
+	}
+	return state
 }
 
 func (m *Memberlist) getNodeStateChange(addr string) time.Time {
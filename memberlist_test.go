@@ -2,6 +2,7 @@ package memberlist
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,9 +12,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
+	multierror "github.com/hashicorp/go-multierror"
 	iretry "github.com/hashicorp/memberlist/internal/retry"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -341,6 +345,43 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreate_MinIncarnation(t *testing.T) {
+	c1 := testConfig(t)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.MinIncarnation = 1000
+
+	// m1 remembers m2 from before a restart, with a higher incarnation
+	// than a fresh counter would give it.
+	a := alive{
+		Node:        c2.Name,
+		Addr:        net.ParseIP(c2.BindAddr).To4(),
+		Port:        uint16(c2.BindPort),
+		Incarnation: 100,
+		Vsn:         c2.BuildVsnArray(),
+	}
+	m1.aliveNode(&a, nil, false)
+	m1.deadNode(&dead{Node: c2.Name, Incarnation: 100, From: c1.Name})
+
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+	require.Equal(t, uint32(1001), m2.nodeMap[c2.Name].Incarnation)
+
+	_, err = m2.Join([]string{c1.Name + "/" + c1.BindAddr})
+	require.NoError(t, err)
+
+	m1.nodeLock.RLock()
+	state := m1.nodeMap[c2.Name]
+	require.Equal(t, StateAlive, state.State)
+	require.Equal(t, uint32(1001), state.Incarnation)
+	m1.nodeLock.RUnlock()
+}
+
 func TestMemberList_CreateShutdown(t *testing.T) {
 	m := GetMemberlist(t, nil)
 	m.schedule()
@@ -643,6 +684,38 @@ func TestMemberlist_Join(t *testing.T) {
 	}
 }
 
+func TestMemberlist_Join_DuplicateSeeds(t *testing.T) {
+	c1 := testConfig(t)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	var merges int32
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.Merge = mergeCounter(func() { atomic.AddInt32(&merges, 1) })
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	// The same seed listed twice, and again in its IPv6 form, is only
+	// pushed/pulled with once.
+	seed := fmt.Sprintf("%s/%s:%d", c1.Name, c1.BindAddr, c1.BindPort)
+	mapped := fmt.Sprintf("%s/[::ffff:%s]:%d", c1.Name, c1.BindAddr, c1.BindPort)
+	num, err := m2.Join([]string{seed, seed, mapped})
+	require.NoError(t, err)
+	require.Equal(t, 1, num)
+	require.Equal(t, int32(1), atomic.LoadInt32(&merges))
+	require.Len(t, m2.Members(), 2)
+}
+
+type mergeCounter func()
+
+func (f mergeCounter) NotifyMerge(nodes []*Node) error {
+	f()
+	return nil
+}
+
 func TestMemberlist_JoinDifferentNetworksUniqueMask(t *testing.T) {
 	c1 := testConfigNet(t, 0)
 	c1.CIDRsAllowed, _ = ParseCIDRs([]string{"127.0.0.0/8"})
@@ -801,6 +874,10 @@ func TestMemberlist_Join_Cancel(t *testing.T) {
 	if !strings.Contains(err.Error(), "Custom merge canceled") {
 		t.Fatalf("unexpected err: %s", err)
 	}
+	var mergeErr *MergeRejectedError
+	if !errors.As(err, &mergeErr) {
+		t.Fatalf("expected a MergeRejectedError: %v", err)
+	}
 
 	// Check the hosts
 	if len(m2.Members()) != 1 {
@@ -810,136 +887,1132 @@ func TestMemberlist_Join_Cancel(t *testing.T) {
 		t.Fatalf("should have 1 nodes! %v", m1.Members())
 	}
 
-	// Check delegate invocation
-	if !merge1.invoked {
-		t.Fatalf("should invoke delegate")
-	}
-	if !merge2.invoked {
-		t.Fatalf("should invoke delegate")
+	// Check delegate invocation
+	if !merge1.invoked {
+		t.Fatalf("should invoke delegate")
+	}
+	if !merge2.invoked {
+		t.Fatalf("should invoke delegate")
+	}
+}
+
+type CustomAliveDelegate struct {
+	Ignore string
+	count  int
+
+	t *testing.T
+}
+
+func (c *CustomAliveDelegate) NotifyAlive(peer *Node) error {
+	c.count++
+	if peer.Name == c.Ignore {
+		return nil
+	}
+	c.t.Logf("Cancel alive")
+	return fmt.Errorf("Custom alive canceled")
+}
+
+func TestMemberlist_Join_Cancel_Passive(t *testing.T) {
+	c1 := testConfig(t)
+	alive1 := &CustomAliveDelegate{
+		Ignore: c1.Name,
+		t:      t,
+	}
+	c1.Alive = alive1
+
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	// Create a second node
+	c2 := testConfig(t)
+	c2.BindPort = bindPort
+	alive2 := &CustomAliveDelegate{
+		Ignore: c2.Name,
+		t:      t,
+	}
+	c2.Alive = alive2
+
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+	if num != 1 {
+		t.Fatalf("unexpected 1: %d", num)
+	}
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Check the hosts
+	if len(m2.Members()) != 1 {
+		t.Fatalf("should have 1 nodes! %v", m2.Members())
+	}
+	if len(m1.Members()) != 1 {
+		t.Fatalf("should have 1 nodes! %v", m1.Members())
+	}
+
+	// Check delegate invocation
+	if alive1.count == 0 {
+		t.Fatalf("should invoke delegate: %d", alive1.count)
+	}
+	if alive2.count == 0 {
+		t.Fatalf("should invoke delegate: %d", alive2.count)
+	}
+}
+
+type countingMergeDelegate struct {
+	calls  int32
+	reject int32
+}
+
+func (c *countingMergeDelegate) NotifyMerge(nodes []*Node) error {
+	atomic.AddInt32(&c.calls, 1)
+	if atomic.LoadInt32(&c.reject) == 1 {
+		return fmt.Errorf("Custom merge canceled")
+	}
+	return nil
+}
+
+func TestJoinRetryable(t *testing.T) {
+	mismatch := newProtocolMismatchError("a", false, 1, 2, 3)
+	unreachable := fmt.Errorf("connection refused")
+
+	require.True(t, joinRetryable(unreachable))
+	require.False(t, joinRetryable(mismatch))
+	require.False(t, joinRetryable(&MergeRejectedError{unreachable}))
+
+	// A seed with several addresses is only given up on if they all
+	// refused.
+	require.True(t, joinRetryable(multierror.Append(nil, mismatch, unreachable)))
+	require.False(t, joinRetryable(multierror.Append(nil, mismatch, fmt.Errorf("wrapped: %w", mismatch))))
+}
+
+func TestMemberlist_JoinWithRetry(t *testing.T) {
+	c1 := testConfig(t)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	c2 := testConfig(t)
+	c2.BindPort = bindPort
+	merge := &countingMergeDelegate{}
+	c2.Merge = merge
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	// Nothing is listening here, so every attempt should fail to dial.
+	unreachable := getBindAddr().String()
+	num, err := m2.JoinWithRetry([]string{"unreachable/" + unreachable}, 3, time.Millisecond)
+	require.Equal(t, 0, num)
+	var dialErr *DialError
+	require.True(t, errors.As(err, &dialErr), "expected a DialError: %v", err)
+
+	// A good seed should be joined even if it's listed after a bad one.
+	seeds := []string{"unreachable/" + unreachable, m1.config.Name + "/" + m1.config.BindAddr}
+	num, err = m2.JoinWithRetry(seeds, 3, time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, 1, num)
+	require.Equal(t, 2, m2.NumMembers())
+
+	// A rejected merge shouldn't be retried.
+	atomic.StoreInt32(&merge.reject, 1)
+	atomic.StoreInt32(&merge.calls, 0)
+	num, err = m2.JoinWithRetry([]string{m1.config.Name + "/" + m1.config.BindAddr}, 3, time.Millisecond)
+	require.Equal(t, 0, num)
+	var mergeErr *MergeRejectedError
+	require.True(t, errors.As(err, &mergeErr), "expected a MergeRejectedError: %v", err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&merge.calls))
+}
+
+func TestMemberlist_JoinWithRetry_Clock(t *testing.T) {
+	clock := newFakeClock()
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+	})
+	defer m.Shutdown()
+
+	// The backoff is waited out on the configured clock, not in real time.
+	unreachable := getBindAddr().String()
+	doneCh := make(chan error, 1)
+	go func() {
+		_, err := m.JoinWithRetry([]string{"unreachable/" + unreachable}, 2, time.Hour)
+		doneCh <- err
+	}()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-doneCh:
+			var dialErr *DialError
+			require.True(t, errors.As(err, &dialErr), "expected a DialError: %v", err)
+			return
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(time.Hour)
+		case <-timeout:
+			t.Fatalf("JoinWithRetry didn't use the clock")
+		}
+	}
+}
+
+func TestMemberlist_Join_protocolVersions(t *testing.T) {
+	c1 := testConfig(t)
+
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	c2 := testConfig(t)
+	c2.BindPort = bindPort
+
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	c3 := testConfig(t)
+	c3.BindPort = bindPort
+	c3.ProtocolVersion = ProtocolVersionMax
+
+	m3, err := Create(c3)
+	require.NoError(t, err)
+	defer m3.Shutdown()
+
+	_, err = m1.Join([]string{c2.Name + "/" + c2.BindAddr})
+	require.NoError(t, err)
+
+	yield()
+
+	_, err = m1.Join([]string{c3.Name + "/" + c3.BindAddr})
+	require.NoError(t, err)
+}
+
+func TestMemberlist_Join_protocolMismatch(t *testing.T) {
+	c1 := testConfig(t)
+	c1.DelegateProtocolMin = 2
+	c1.DelegateProtocolMax = 2
+	c1.DelegateProtocolVersion = 2
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.DelegateProtocolMax = 1
+	c2.DelegateProtocolVersion = 1
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m2.Join([]string{c1.Name + "/" + c1.BindAddr})
+	var mismatch *ProtocolMismatchError
+	require.True(t, errors.As(err, &mismatch), "expected a ProtocolMismatchError: %v", err)
+	require.Equal(t, c1.Name, mismatch.Node)
+	require.True(t, mismatch.Delegate)
+	require.Equal(t, uint8(2), mismatch.Version)
+	require.Equal(t, uint8(2), mismatch.Min)
+	require.Equal(t, uint8(1), mismatch.Max)
+}
+
+func TestMemberlist_Join_OnMergeCanceled(t *testing.T) {
+	c1 := testConfig(t)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	var (
+		peers  []*Node
+		reason error
+	)
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.Merge = &CustomMergeDelegate{t: t}
+	c2.OnMergeCanceled = func(p []*Node, r error) {
+		peers, reason = p, r
+	}
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m2.Join([]string{c1.Name + "/" + c1.BindAddr})
+	require.Error(t, err)
+
+	// The join is synchronous, so the callback has run by now.
+	var mergeErr *MergeRejectedError
+	require.True(t, errors.As(reason, &mergeErr), "expected a MergeRejectedError: %v", reason)
+	require.Len(t, peers, 1)
+	require.Equal(t, c1.Name, peers[0].Name)
+	require.Equal(t, m1.config.BindPort, int(peers[0].Port))
+	require.Equal(t, c1.ProtocolVersion, peers[0].PCur)
+}
+
+func joinAndTestMemberShip(t *testing.T, self *Memberlist, membersToJoin []string, expectedMembers int) error {
+	t.Helper()
+	num, err := self.Join(membersToJoin)
+	if err != nil {
+		return err
+	}
+	if num != len(membersToJoin) {
+		t.Fatalf("unexpected %d, was expecting %d to be joined", num, len(membersToJoin))
+	}
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	// Check the hosts
+	if len(self.Members()) != expectedMembers {
+		t.Fatalf("should have 2 nodes! %v", self.Members())
+	}
+	if len(self.Members()) != expectedMembers {
+		t.Fatalf("should have 2 nodes! %v", self.Members())
+	}
+	return nil
+}
+
+func TestMemberlist_PauseResume(t *testing.T) {
+	c1 := testConfig(t)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	numTickers := func() int {
+		m1.tickerLock.Lock()
+		defer m1.tickerLock.Unlock()
+		return len(m1.tickers)
+	}
+	scheduled := numTickers()
+	require.NotZero(t, scheduled)
+
+	// Pausing should stop the tickers, and be idempotent.
+	m1.Pause()
+	m1.Pause()
+	require.Zero(t, numTickers())
+
+	// A paused node should still answer pings.
+	addr := &net.UDPAddr{IP: net.ParseIP(c1.BindAddr), Port: c1.BindPort}
+	_, err = m2.Ping(c1.Name, addr)
+	require.NoError(t, err)
+
+	// Resuming should bring the tickers back, and be idempotent.
+	m1.Resume()
+	m1.Resume()
+	require.Equal(t, scheduled, numTickers())
+
+	// Resume shouldn't reschedule after a shutdown.
+	m1.Pause()
+	require.NoError(t, m1.Shutdown())
+	m1.Resume()
+	require.Zero(t, numTickers())
+}
+
+func TestMemberlist_AllNodes(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	vsn := m.config.BuildVsnArray()
+	for _, name := range []string{"alive", "suspect", "dead", "left"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: vsn}
+		m.aliveNode(&a, nil, false)
+	}
+	m.suspectNode(&suspect{Node: "suspect", Incarnation: 1})
+	m.deadNode(&dead{Node: "dead", Incarnation: 1, From: m.config.Name})
+	m.deadNode(&dead{Node: "left", Incarnation: 1, From: "left"})
+
+	states := make(map[string]NodeStateType)
+	for _, n := range m.AllNodes() {
+		states[n.Name] = n.State
+	}
+	require.Equal(t, map[string]NodeStateType{
+		"alive":   StateAlive,
+		"suspect": StateSuspect,
+		"dead":    StateDead,
+		"left":    StateLeft,
+	}, states)
+
+	// Members should still only return the live ones.
+	require.Len(t, m.Members(), 2)
+}
+
+func TestMemberlist_AllNodes_Copies(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Meta: []byte("meta"), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	// Changing what we get back doesn't touch our own state.
+	nodes := m.AllNodes()
+	require.Len(t, nodes, 1)
+	copy(nodes[0].Meta, "xxxx")
+	nodes[0].Addr[3] = 2
+
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	require.Equal(t, []byte("meta"), m.nodeMap["test"].Meta)
+	require.Equal(t, net.IP([]byte{127, 0, 0, 1}), m.nodeMap["test"].Addr)
+}
+
+func TestMemberlist_SetName(t *testing.T) {
+	c1 := testConfig(t)
+	c1.GossipInterval = time.Millisecond
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.GossipInterval = time.Millisecond
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	oldName := m2.config.Name
+	_, err = m2.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+	require.NoError(t, err)
+
+	// Names of live nodes can't be taken.
+	require.Error(t, m2.SetName(m1.config.Name))
+	require.Equal(t, oldName, m2.LocalNode().Name)
+
+	require.NoError(t, m2.SetName("renamed"))
+	require.Equal(t, "renamed", m2.LocalNode().Name)
+	require.Equal(t, StateLeft, m2.getNodeState(oldName))
+
+	iretry.Run(t, func(r *iretry.R) {
+		m1.nodeLock.RLock()
+		defer m1.nodeLock.RUnlock()
+		n, ok := m1.nodeMap["renamed"]
+		require.True(r, ok)
+		require.Equal(r, StateAlive, n.State)
+		require.Equal(r, StateLeft, m1.nodeMap[oldName].State)
+	})
+	require.Equal(t, 2, m1.NumMembers())
+}
+
+func TestMemberlist_SuspicionConfirmers(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	for i, name := range []string{"test", "a", "b", "c"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, byte(i + 10)}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+
+	_, ok := m.SuspicionConfirmers("test")
+	require.False(t, ok)
+	_, ok = m.SuspicionConfirmers("nope")
+	require.False(t, ok)
+
+	// The accuser that started the suspicion isn't reported.
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "a"})
+	confirmers, ok := m.SuspicionConfirmers("test")
+	require.True(t, ok)
+	require.Empty(t, confirmers)
+
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "c"})
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "b"})
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "a"})
+	confirmers, ok = m.SuspicionConfirmers("test")
+	require.True(t, ok)
+	require.Equal(t, []string{"b", "c"}, confirmers)
+}
+
+func TestMemberlist_NodeVersions(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 10}, Incarnation: 1, Vsn: []uint8{1, 5, 4, 0, 3, 2}}
+	m.aliveNode(&a, nil, false)
+
+	pmin, pmax, pcur, dmin, dmax, dcur, ok := m.NodeVersions("test")
+	require.True(t, ok)
+	require.Equal(t, []uint8{1, 5, 4, 0, 3, 2}, []uint8{pmin, pmax, pcur, dmin, dmax, dcur})
+
+	_, _, _, _, _, _, ok = m.NodeVersions("nope")
+	require.False(t, ok)
+}
+
+func TestMemberlist_Refresh(t *testing.T) {
+	c1 := testConfig(t)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.GossipInterval = time.Hour // Rule out regular gossip
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{m2.config.Name + "/" + m2.config.BindAddr})
+	require.NoError(t, err)
+
+	// Stop m2 from gossiping or syncing, so m1 can only hear about the
+	// refresh through the direct send.
+	m2.Pause()
+	before := atomic.LoadUint32(&m2.incarnation)
+	require.NoError(t, m2.Refresh())
+
+	waitForCondition(t, func() (bool, string) {
+		m1.nodeLock.RLock()
+		defer m1.nodeLock.RUnlock()
+		inc := m1.nodeMap[c2.Name].Incarnation
+		return inc > before, fmt.Sprintf("expected incarnation above %d, got %d", before, inc)
+	})
+
+	m2.Leave(10 * time.Millisecond)
+	require.Error(t, m2.Refresh())
+}
+
+func TestMemberlist_UpdateNodeInfo(t *testing.T) {
+	c := testConfig(t)
+	c.DelegateProtocolMin = 1
+	c.DelegateProtocolMax = 3
+	c.DelegateProtocolVersion = 1
+	m, err := Create(c)
+	require.NoError(t, err)
+	defer m.Shutdown()
+	m.broadcasts.Reset()
+
+	before := atomic.LoadUint32(&m.incarnation)
+	require.NoError(t, m.UpdateNodeInfo([]byte("v2"), 2))
+
+	// Both changes land in one alive message, with one new incarnation.
+	me := m.LocalNode()
+	require.Equal(t, []byte("v2"), me.Meta)
+	require.Equal(t, uint8(2), me.DCur)
+	require.Equal(t, before+1, atomic.LoadUint32(&m.incarnation))
+	require.Equal(t, 1, m.broadcasts.NumQueued())
+
+	// A later UpdateNode keeps the new version.
+	require.NoError(t, m.UpdateNode(0))
+	require.Equal(t, uint8(2), m.LocalNode().DCur)
+
+	// Versions outside the supported range are rejected.
+	require.Error(t, m.UpdateNodeInfo(nil, 0))
+	require.Error(t, m.UpdateNodeInfo(nil, 4))
+	require.Equal(t, uint8(2), m.LocalNode().DCur)
+}
+
+func TestMemberlist_UpdateNodeInfo_KeepsTags(t *testing.T) {
+	m1, err := Create(testConfig(t))
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.Tags = map[string]string{"role": "web"}
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{m2.config.Name + "/" + m2.config.BindAddr})
+	require.NoError(t, err)
+
+	// Set a tag, and then replace the meta data while it's pending, so
+	// the tag only gets out if UpdateNodeInfo carries it.
+	m2.tagLock.Lock()
+	m2.tagsUpdatePending = true
+	m2.tagLock.Unlock()
+	require.NoError(t, m2.SetTag("zone", "a"))
+	require.NoError(t, m2.UpdateNodeInfo([]byte("user"), m2.config.DelegateProtocolVersion))
+
+	remote := func() *Node {
+		m1.nodeLock.RLock()
+		defer m1.nodeLock.RUnlock()
+		n := m1.nodeMap[m2.config.Name].Node
+		return &n
+	}
+	waitForCondition(t, func() (bool, string) {
+		n := remote()
+		return bytes.Equal(n.UserMeta(), []byte("user")), fmt.Sprintf("bad meta: %q", n.Meta)
+	})
+	require.Equal(t, map[string]string{"role": "web", "zone": "a"}, remote().Tags())
+
+	// The tags count towards the limit.
+	tags := len(m2.encodedTags())
+	require.Error(t, m2.UpdateNodeInfo(make([]byte, MetaMaxSize-tags+1), m2.config.DelegateProtocolVersion))
+	require.NoError(t, m2.UpdateNodeInfo(make([]byte, MetaMaxSize-tags), m2.config.DelegateProtocolVersion))
+}
+
+func TestMemberlist_SetReady(t *testing.T) {
+	c1 := testConfig(t)
+	events := make(chan NodeEvent, 16)
+	c1.Events = &ChannelEventDelegate{Ch: events}
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{m2.config.Name + "/" + m2.config.BindAddr})
+	require.NoError(t, err)
+
+	ready := func(m *Memberlist, name string) bool {
+		m.nodeLock.RLock()
+		defer m.nodeLock.RUnlock()
+		return m.nodeMap[name].Ready
+	}
+	require.True(t, ready(m1, c2.Name))
+	require.True(t, m2.LocalNode().Ready)
+
+	// Draining the join events so only the update is left to see.
+	for len(events) > 0 {
+		<-events
+	}
+
+	require.NoError(t, m2.SetReady(false))
+	require.False(t, m2.LocalNode().Ready)
+	waitForCondition(t, func() (bool, string) {
+		return !ready(m1, c2.Name), "expected node to be not ready"
+	})
+	select {
+	case e := <-events:
+		require.Equal(t, NodeUpdate, e.Event)
+		require.Equal(t, c2.Name, e.Node.Name)
+		require.False(t, e.Node.Ready)
+	case <-time.After(time.Second):
+		t.Fatalf("expected an update event")
+	}
+
+	// The node is still a full member while it isn't ready.
+	require.Equal(t, StateAlive, m1.nodeMap[c2.Name].State)
+
+	// Setting the same readiness again doesn't announce anything.
+	before := atomic.LoadUint32(&m2.incarnation)
+	require.NoError(t, m2.SetReady(false))
+	require.Equal(t, before, atomic.LoadUint32(&m2.incarnation))
+
+	require.NoError(t, m2.SetReady(true))
+	waitForCondition(t, func() (bool, string) {
+		return ready(m1, c2.Name), "expected node to be ready again"
+	})
+}
+
+func TestMemberlist_UpdateNodeInfo_ConcurrentRefresh(t *testing.T) {
+	c := testConfig(t)
+	c.LocalAliveOverride = func(meta []byte) []byte {
+		// Widen the window between building an alive message and
+		// applying it.
+		time.Sleep(50 * time.Microsecond)
+		return meta
+	}
+	m, err := Create(c)
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	// Refreshes racing with updates must never re-announce stale meta
+	// data after a newer update has been applied.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if err := m.Refresh(); err != nil {
+					t.Errorf("refresh failed: %v", err)
+					return
+				}
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		meta := []byte(fmt.Sprintf("meta-%d", i))
+		require.NoError(t, m.UpdateNodeInfo(meta, m.config.DelegateProtocolVersion))
+		require.Equal(t, meta, m.LocalNode().Meta)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestMemberlist_LocalNode(t *testing.T) {
+	d := &MockDelegate{meta: []byte("before")}
+	c := testConfig(t)
+	c.Delegate = d
+	m, err := Create(c)
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	addr, port := m.getAdvertise()
+	n := m.LocalNode()
+	require.Equal(t, c.Name, n.Name)
+	require.Equal(t, addr, n.Addr)
+	require.Equal(t, port, n.Port)
+	require.Equal(t, uint16(m.config.BindPort), n.Port)
+	require.Equal(t, "before", string(n.Meta))
+
+	// Changing the copy doesn't touch our own state.
+	n.Meta[0] = 'X'
+	n.Addr[0] = 0
+	n.Port = 1
+	again := m.LocalNode()
+	require.Equal(t, "before", string(again.Meta))
+	require.Equal(t, addr, again.Addr)
+	require.Equal(t, port, again.Port)
+
+	// Meta data updates show up.
+	d.setMeta([]byte("after"))
+	require.NoError(t, m.UpdateNode(time.Second))
+	require.Equal(t, "after", string(m.LocalNode().Meta))
+}
+
+func TestMemberlist_CheckAdvertise(t *testing.T) {
+	type change struct{ old, new net.IP }
+	var changes []change
+	m := GetMemberlist(t, func(c *Config) {
+		c.OnAdvertiseChange = func(old, new net.IP) {
+			changes = append(changes, change{old, new})
+		}
+	})
+	defer m.Shutdown()
+	require.NoError(t, m.setAlive())
+
+	// Nothing happens if the address hasn't changed.
+	oldAddr, port := m.getAdvertise()
+	inc := atomic.LoadUint32(&m.incarnation)
+	m.checkAdvertise()
+	require.Empty(t, changes)
+	require.Equal(t, inc, atomic.LoadUint32(&m.incarnation))
+
+	// Pretend the address we should advertise has moved.
+	newAddr := net.IPv4(127, 0, 0, 99).To4()
+	m.config.AdvertiseAddr = newAddr.String()
+	m.config.AdvertisePort = int(port)
+	m.checkAdvertise()
+	require.Equal(t, []change{{oldAddr, newAddr}}, changes)
+
+	m.nodeLock.RLock()
+	me := m.nodeMap[m.config.Name]
+	require.Equal(t, newAddr, me.Addr)
+	require.Equal(t, port, me.Port)
+	require.Equal(t, StateAlive, me.State)
+	m.nodeLock.RUnlock()
+	require.True(t, atomic.LoadUint32(&m.incarnation) > inc)
+
+	// A failed lookup keeps the last good address.
+	m.config.AdvertiseAddr = "not-an-ip"
+	m.checkAdvertise()
+	addr, _ := m.getAdvertise()
+	require.Equal(t, newAddr, addr)
+	require.Len(t, changes, 1)
+
+	// Peers won't take a new address without DeadNodeReclaimTime, so we
+	// warn about that.
+	var buf bytes.Buffer
+	m2 := GetMemberlist(t, func(c *Config) {
+		c.Logger = log.New(&buf, "", 0)
+		c.AdvertiseRefreshInterval = time.Minute
+	})
+	defer m2.Shutdown()
+	require.Contains(t, buf.String(), "without DeadNodeReclaimTime")
+
+	buf.Reset()
+	m3 := GetMemberlist(t, func(c *Config) {
+		c.Logger = log.New(&buf, "", 0)
+		c.AdvertiseRefreshInterval = time.Minute
+		c.DeadNodeReclaimTime = time.Minute
+	})
+	defer m3.Shutdown()
+	require.NotContains(t, buf.String(), "DeadNodeReclaimTime")
+}
+
+func TestMemberlist_ManualTick(t *testing.T) {
+	newConfig := func() *Config {
+		c := testConfig(t)
+		c.ManualTick = true
+		c.ProbeInterval = 10 * time.Millisecond
+		c.ProbeTimeout = 5 * time.Millisecond
+		c.GossipInterval = time.Millisecond
+		c.PushPullInterval = time.Millisecond
+		return c
+	}
+	c1 := newConfig()
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := newConfig()
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m2.Join([]string{c1.Name + "/" + c1.BindAddr})
+	require.NoError(t, err)
+	require.Empty(t, m1.tickers)
+
+	knows := func(m *Memberlist, name string) (NodeStateType, bool) {
+		m.nodeLock.RLock()
+		defer m.nodeLock.RUnlock()
+		n, ok := m.nodeMap[name]
+		if !ok {
+			return 0, false
+		}
+		return n.State, true
+	}
+
+	// Nothing is gossiped until we tick.
+	ghost := alive{Node: "ghost", Addr: []byte{127, 0, 0, 1}, Port: 1, Incarnation: 1, Vsn: c1.BuildVsnArray()}
+	m1.aliveNode(&ghost, nil, false)
+	time.Sleep(50 * time.Millisecond)
+	_, ok := knows(m2, "ghost")
+	require.False(t, ok)
+
+	m1.TickGossip()
+	waitForCondition(t, func() (bool, string) {
+		_, ok := knows(m2, "ghost")
+		return ok, "m2 didn't hear about ghost"
+	})
+
+	// Nor is anything probed.
+	state, _ := knows(m1, "ghost")
+	require.Equal(t, StateAlive, state)
+	for i := 0; i < 3 && state == StateAlive; i++ {
+		m1.TickProbe()
+		state, _ = knows(m1, "ghost")
+	}
+	require.Equal(t, StateSuspect, state)
+}
+
+func TestMemberlist_ManualTick_Advertise(t *testing.T) {
+	var changes int
+	newMemberlist := func(manual bool) *Memberlist {
+		m := GetMemberlist(t, func(c *Config) {
+			c.ManualTick = manual
+			c.OnAdvertiseChange = func(old, new net.IP) {
+				changes++
+			}
+		})
+		require.NoError(t, m.setAlive())
+		_, port := m.getAdvertise()
+		m.config.AdvertiseAddr = getBindAddr().String()
+		m.config.AdvertisePort = int(port)
+		return m
+	}
+
+	// Without ManualTick, ticking by hand would race with the tickers, so
+	// it does nothing.
+	m := newMemberlist(false)
+	defer m.Shutdown()
+	a := alive{Node: "peer", Addr: []byte{127, 0, 0, 1}, Port: 1, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	m.TickAdvertise()
+	m.TickProbe()
+	require.Zero(t, changes)
+	require.Zero(t, atomic.LoadUint32(&m.sequenceNum))
+
+	// With it, the advertise address is checked when we tick.
+	m = newMemberlist(true)
+	defer m.Shutdown()
+	m.TickAdvertise()
+	require.Equal(t, 1, changes)
+}
+
+func TestMemberlist_MetaForPeer(t *testing.T) {
+	c1 := testConfig(t)
+	c1.Delegate = &MockDelegate{meta: []byte("default")}
+	c1.MetaForPeer = func(peer *Node) []byte {
+		return []byte("default for " + peer.Name)
+	}
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	// m1 has to know who m2 is to tailor what it sends.
+	me := m2.LocalNode()
+	a := alive{Node: me.Name, Addr: me.Addr, Port: me.Port, Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+	m1.aliveNode(&a, nil, false)
+
+	require.NoError(t, m2.pushPullNode(Address{Addr: m1.LocalNode().Address(), Name: c1.Name}, false))
+
+	m2.nodeLock.RLock()
+	meta := string(m2.nodeMap[c1.Name].Meta)
+	m2.nodeLock.RUnlock()
+	require.Equal(t, "default for "+c2.Name, meta)
+
+	// Everyone else still sees the usual meta data.
+	require.Equal(t, "default", string(m1.LocalNode().Meta))
+
+	// When m2 syncs the tailored meta data back to m1, m1 doesn't take it
+	// for a stale entry and refute it.
+	before := atomic.LoadUint32(&m1.incarnation)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, m2.pushPullNode(Address{Addr: m1.LocalNode().Address(), Name: c1.Name}, false))
+		require.NoError(t, m1.pushPullNode(Address{Addr: m2.LocalNode().Address(), Name: c2.Name}, false))
 	}
+	require.Equal(t, before, atomic.LoadUint32(&m1.incarnation))
+	require.Equal(t, "default", string(m1.LocalNode().Meta))
+
+	// What each peer was given is forgotten once it dies.
+	inc := atomic.LoadUint32(&m1.incarnation)
+	require.True(t, m1.sentPeerMeta(inc, []byte("default for "+c2.Name)))
+	m1.deadNode(&dead{Node: c2.Name, Incarnation: 1, From: c1.Name})
+	require.False(t, m1.sentPeerMeta(inc, []byte("default for "+c2.Name)))
+	require.Empty(t, m1.peerMetas)
 }
 
-type CustomAliveDelegate struct {
-	Ignore string
-	count  int
+func TestMemberlist_CurrentPushPullInterval(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.PushPullInterval = time.Second
+	})
+	defer m.Shutdown()
 
-	t *testing.T
-}
+	atomic.StoreUint32(&m.numNodes, 64)
+	require.Equal(t, 2*time.Second, m.CurrentPushPullInterval())
 
-func (c *CustomAliveDelegate) NotifyAlive(peer *Node) error {
-	c.count++
-	if peer.Name == c.Ignore {
-		return nil
-	}
-	c.t.Logf("Cancel alive")
-	return fmt.Errorf("Custom alive canceled")
+	// A custom scale function should override the default curve.
+	m2 := GetMemberlist(t, func(c *Config) {
+		c.PushPullInterval = time.Second
+		c.PushPullScaleFunc = func(base time.Duration, n int) time.Duration {
+			return base / time.Duration(n)
+		}
+	})
+	defer m2.Shutdown()
+
+	atomic.StoreUint32(&m2.numNodes, 64)
+	require.Equal(t, time.Second/64, m2.CurrentPushPullInterval())
 }
 
-func TestMemberlist_Join_Cancel_Passive(t *testing.T) {
+func TestMemberlist_EmitInitialJoins(t *testing.T) {
 	c1 := testConfig(t)
-	alive1 := &CustomAliveDelegate{
-		Ignore: c1.Name,
-		t:      t,
-	}
-	c1.Alive = alive1
-
 	m1, err := Create(c1)
 	require.NoError(t, err)
 	defer m1.Shutdown()
 
-	bindPort := m1.config.BindPort
+	// Add a member that m1 currently suspects.
+	vsn := m1.config.BuildVsnArray()
+	m1.aliveNode(&alive{Node: "ghost", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: vsn}, nil, false)
+	m1.suspectNode(&suspect{Node: "ghost", Incarnation: 1, From: m1.config.Name})
 
-	// Create a second node
-	c2 := testConfig(t)
-	c2.BindPort = bindPort
-	alive2 := &CustomAliveDelegate{
-		Ignore: c2.Name,
-		t:      t,
+	join := func(emit bool) (*Memberlist, map[string]int) {
+		eventCh := make(chan NodeEvent, 16)
+		c := testConfig(t)
+		c.BindPort = m1.config.BindPort
+		c.Events = &ChannelEventDelegate{Ch: eventCh}
+		c.EmitInitialJoins = emit
+		m, err := Create(c)
+		require.NoError(t, err)
+
+		_, err = m.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+		require.NoError(t, err)
+
+		joins := make(map[string]int)
+	DRAIN:
+		for {
+			select {
+			case e := <-eventCh:
+				if e.Event == NodeJoin {
+					joins[e.Node.Name]++
+				}
+			default:
+				break DRAIN
+			}
+		}
+		return m, joins
 	}
-	c2.Alive = alive2
 
-	m2, err := Create(c2)
-	require.NoError(t, err)
+	// By default the suspect member isn't announced.
+	m2, joins := join(false)
 	defer m2.Shutdown()
+	require.Equal(t, map[string]int{m1.config.Name: 1, m2.config.Name: 1}, joins)
 
-	num, err := m2.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
-	if num != 1 {
-		t.Fatalf("unexpected 1: %d", num)
-	}
-	if err != nil {
-		t.Fatalf("err: %s", err)
-	}
+	// With EmitInitialJoins it is, exactly once, and it stays suspect.
+	m3, joins := join(true)
+	defer m3.Shutdown()
+	require.Equal(t, map[string]int{m1.config.Name: 1, m2.config.Name: 1, m3.config.Name: 1, "ghost": 1}, joins)
+	require.Equal(t, StateSuspect, m3.getNodeState("ghost"))
+}
 
-	// Check the hosts
-	if len(m2.Members()) != 1 {
-		t.Fatalf("should have 1 nodes! %v", m2.Members())
-	}
-	if len(m1.Members()) != 1 {
-		t.Fatalf("should have 1 nodes! %v", m1.Members())
-	}
+func TestMemberlist_ReportAppHealth(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.AwarenessMaxMultiplier = 4
+	})
+	defer m.Shutdown()
 
-	// Check delegate invocation
-	if alive1.count == 0 {
-		t.Fatalf("should invoke delegate: %d", alive1.count)
+	m.ReportAppHealth(2)
+	require.Equal(t, 2, m.GetHealthScore())
+
+	// The score should stay within its bounds.
+	m.ReportAppHealth(10)
+	require.Equal(t, 3, m.GetHealthScore())
+	m.ReportAppHealth(-10)
+	require.Equal(t, 0, m.GetHealthScore())
+}
+
+func TestMemberlist_EffectiveProbeInterval(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.AwarenessMaxMultiplier = 4
+		c.ProbeInterval = time.Second
+	})
+	defer m.Shutdown()
+
+	require.Equal(t, time.Second, m.EffectiveProbeInterval())
+
+	// A worse health score stretches the interval.
+	m.ReportAppHealth(2)
+	require.Equal(t, 3*time.Second, m.EffectiveProbeInterval())
+}
+
+func TestMemberlist_ReplayJoins(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+	require.NoError(t, m.setAlive())
+
+	for _, name := range []string{"test1", "test2", "test3"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
 	}
-	if alive2.count == 0 {
-		t.Fatalf("should invoke delegate: %d", alive2.count)
+	m.deadNode(&dead{Node: "test2", Incarnation: 1, From: m.config.Name})
+
+	eventCh := make(chan NodeEvent, 4)
+	m.ReplayJoins(&ChannelEventDelegate{Ch: eventCh})
+	close(eventCh)
+
+	joined := make(map[string]bool)
+	for e := range eventCh {
+		require.Equal(t, NodeJoin, e.Event)
+		joined[e.Node.Name] = true
 	}
+	require.Equal(t, map[string]bool{m.config.Name: true, "test1": true, "test3": true}, joined)
 }
 
-func TestMemberlist_Join_protocolVersions(t *testing.T) {
+func TestMemberlist_Observer(t *testing.T) {
 	c1 := testConfig(t)
-
 	m1, err := Create(c1)
 	require.NoError(t, err)
 	defer m1.Shutdown()
 
-	bindPort := m1.config.BindPort
-
 	c2 := testConfig(t)
-	c2.BindPort = bindPort
-
+	c2.BindPort = m1.config.BindPort
+	c2.Observer = true
 	m2, err := Create(c2)
 	require.NoError(t, err)
 	defer m2.Shutdown()
 
-	c3 := testConfig(t)
-	c3.BindPort = bindPort
-	c3.ProtocolVersion = ProtocolVersionMax
-
-	m3, err := Create(c3)
+	_, err = m2.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
 	require.NoError(t, err)
-	defer m3.Shutdown()
 
-	_, err = m1.Join([]string{c2.Name + "/" + c2.BindAddr})
-	require.NoError(t, err)
+	// The observer learns about the cluster, but the cluster never learns
+	// about the observer, even when pulling its state.
+	require.Equal(t, 2, m2.NumMembers())
+	require.NoError(t, m1.pushPullNode(Address{Addr: m2.config.BindAddr + ":" + strconv.Itoa(m2.config.BindPort), Name: m2.config.Name}, false))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, m1.NumMembers())
 
-	yield()
+	// Accusations aren't refuted.
+	inc := atomic.LoadUint32(&m2.incarnation)
+	s := suspect{Node: m2.config.Name, Incarnation: inc, From: m1.config.Name}
+	m2.suspectNode(&s)
+	require.Equal(t, inc, atomic.LoadUint32(&m2.incarnation))
 
-	_, err = m1.Join([]string{c3.Name + "/" + c3.BindAddr})
-	require.NoError(t, err)
+	require.Error(t, m2.Refresh())
+	require.NoError(t, m2.Leave(time.Second))
+	require.Equal(t, 1, m1.NumMembers())
 }
 
-func joinAndTestMemberShip(t *testing.T, self *Memberlist, membersToJoin []string, expectedMembers int) error {
-	t.Helper()
-	num, err := self.Join(membersToJoin)
-	if err != nil {
-		return err
-	}
-	if num != len(membersToJoin) {
-		t.Fatalf("unexpected %d, was expecting %d to be joined", num, len(membersToJoin))
-	}
-	if err != nil {
-		t.Fatalf("unexpected err: %s", err)
-	}
-	// Check the hosts
-	if len(self.Members()) != expectedMembers {
-		t.Fatalf("should have 2 nodes! %v", self.Members())
+func TestMemberlist_OversizedBroadcastPolicy(t *testing.T) {
+	m1, err := Create(testConfig(t))
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	newMember := func(policy OversizedBroadcastPolicy) (*Memberlist, *MockDelegate) {
+		d := &MockDelegate{}
+		c := testConfig(t)
+		c.BindPort = m1.config.BindPort
+		c.UDPBufferSize = 150
+		c.Delegate = d
+		c.OversizedBroadcastPolicy = policy
+		m, err := Create(c)
+		require.NoError(t, err)
+		_, err = m.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+		require.NoError(t, err)
+		return m, d
 	}
-	if len(self.Members()) != expectedMembers {
-		t.Fatalf("should have 2 nodes! %v", self.Members())
+	bigMeta := bytes.Repeat([]byte("a"), 200)
+
+	// Rejected updates are reported to the caller.
+	m2, d2 := newMember(OversizedBroadcastReject)
+	defer m2.Shutdown()
+	d2.setMeta(bigMeta)
+	require.Error(t, m2.UpdateNode(time.Second))
+
+	// Updates sent over TCP still make it.
+	m3, d3 := newMember(OversizedBroadcastTCP)
+	defer m3.Shutdown()
+	d3.setMeta(bigMeta)
+	require.NoError(t, m3.UpdateNode(time.Second))
+	require.NoError(t, m3.UpdateNode(time.Second))
+
+	// They're still queued, so the newest replaces what came before.
+	named := 0
+	for _, lb := range m3.broadcasts.orderedView(false) {
+		if nb, ok := lb.b.(NamedBroadcast); ok && nb.Name() == m3.config.Name {
+			named++
+		}
 	}
-	return nil
+	require.Equal(t, 1, named)
+
+	m1.nodeLock.RLock()
+	meta := m1.nodeMap[m3.config.Name].Meta
+	m1.nodeLock.RUnlock()
+	require.Equal(t, bigMeta, meta)
+}
+
+func TestMemberlist_GossipBytesAvailable(t *testing.T) {
+	m1 := GetMemberlist(t, nil)
+	defer m1.Shutdown()
+	require.Equal(t, 1400-compoundHeaderOverhead, m1.GossipBytesAvailable())
+
+	m2 := GetMemberlist(t, func(c *Config) {
+		c.ClusterName = "blue"
+		c.SecretKey = make([]byte, 16)
+	})
+	defer m2.Shutdown()
+	expect := 1400 - compoundHeaderOverhead - labelOverhead - len("blue") - encryptOverhead(m2.encryptionVersion())
+	require.Equal(t, expect, m2.GossipBytesAvailable())
+
+	var buf bytes.Buffer
+	m3 := GetMemberlist(t, func(c *Config) {
+		c.Logger = log.New(&buf, "", 0)
+		c.UDPBufferSize = 9000
+		c.MaxPacketBytes = 1472
+	})
+	defer m3.Shutdown()
+	require.Contains(t, buf.String(), "exceeds MaxPacketBytes")
+
+	buf.Reset()
+	m4 := GetMemberlist(t, func(c *Config) {
+		c.Logger = log.New(&buf, "", 0)
+		c.UDPBufferSize = 1
+	})
+	defer m4.Shutdown()
+	require.Contains(t, buf.String(), "leaves no room for broadcasts")
 }
 
 func TestMemberlist_Leave(t *testing.T) {
@@ -991,6 +2064,38 @@ func TestMemberlist_Leave(t *testing.T) {
 	}
 }
 
+func TestMemberlist_FastLeave(t *testing.T) {
+	c1 := testConfig(t)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	err = joinAndTestMemberShip(t, m2, []string{m1.config.Name + "/" + m1.config.BindAddr}, 2)
+	require.NoError(t, err)
+
+	// The leave goes out directly, so m1 can go away straight after.
+	require.NoError(t, m1.FastLeave())
+	require.NoError(t, m1.Shutdown())
+
+	waitForCondition(t, func() (bool, string) {
+		state := m2.getNodeState(c1.Name)
+		return state == StateLeft, fmt.Sprintf("bad state: %v", state)
+	})
+
+	// Leave has nothing left to do.
+	m3 := GetMemberlist(t, nil)
+	defer m3.Shutdown()
+	require.NoError(t, m3.setAlive())
+	require.NoError(t, m3.FastLeave())
+	require.NoError(t, m3.Leave(time.Second))
+}
+
 func TestMemberlist_JoinShutdown(t *testing.T) {
 	newConfig := func() *Config {
 		c := testConfig(t)
@@ -1249,6 +2354,113 @@ func TestMemberlist_UserData(t *testing.T) {
 	})
 }
 
+type userMsgRecorder struct {
+	sync.Mutex
+	msgs [][]byte
+}
+
+func (r *userMsgRecorder) NotifyUserMsg(msg []byte) {
+	r.Lock()
+	defer r.Unlock()
+	cp := make([]byte, len(msg))
+	copy(cp, msg)
+	r.msgs = append(r.msgs, cp)
+}
+
+func (r *userMsgRecorder) getMessages() [][]byte {
+	r.Lock()
+	defer r.Unlock()
+	out := make([][]byte, len(r.msgs))
+	copy(out, r.msgs)
+	return out
+}
+
+func TestMemberlist_UserMessageDelegate(t *testing.T) {
+	d1 := &MockDelegate{}
+	um1 := &userMsgRecorder{}
+	c1 := testConfig(t)
+	c1.Delegate = d1
+	c1.UserMessages = um1
+
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m2.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+	require.NoError(t, err)
+
+	to := m1.LocalNode()
+	require.NoError(t, m2.SendUserMsg(to, []byte("best-effort")))
+	require.NoError(t, m2.SendReliable(to, []byte("reliable")))
+
+	waitForCondition(t, func() (bool, string) {
+		msgs := um1.getMessages()
+		return len(msgs) == 2, fmt.Sprintf("expected 2 messages, got %d", len(msgs))
+	})
+
+	got := map[string]bool{}
+	for _, msg := range um1.getMessages() {
+		got[string(msg)] = true
+	}
+	require.Equal(t, map[string]bool{"best-effort": true, "reliable": true}, got)
+
+	// The regular delegate shouldn't see any user messages.
+	require.Empty(t, d1.getMessages())
+}
+
+func TestMemberlist_BroadcastUserMsgTo(t *testing.T) {
+	newMember := func(bindPort int, meta string) (*Memberlist, *MockDelegate) {
+		d := &MockDelegate{meta: []byte(meta)}
+		c := testConfig(t)
+		c.BindPort = bindPort
+		c.GossipInterval = time.Millisecond
+		c.Delegate = d
+		m, err := Create(c)
+		require.NoError(t, err)
+		return m, d
+	}
+
+	m1, _ := newMember(0, "")
+	defer m1.Shutdown()
+	bindPort := m1.config.BindPort
+	m2, d2 := newMember(bindPort, "blue")
+	defer m2.Shutdown()
+	m3, d3 := newMember(bindPort, "green")
+	defer m3.Shutdown()
+
+	for _, m := range []*Memberlist{m2, m3} {
+		_, err := m.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+		require.NoError(t, err)
+	}
+	waitUntilSize(t, m1, 3)
+
+	require.Error(t, m1.BroadcastUserMsgTo([]byte("nope"), nil))
+	require.NoError(t, m1.BroadcastUserMsgTo([]byte("hello blue"), func(n *Node) bool {
+		return string(n.Meta) == "blue"
+	}))
+
+	// Gossip may deliver it more than once.
+	iretry.Run(t, func(r *iretry.R) {
+		msgs := d2.getMessages()
+		require.NotEmpty(r, msgs)
+		for _, msg := range msgs {
+			require.Equal(r, []byte("hello blue"), msg)
+		}
+	})
+
+	// Give the message time to run out its retransmits, it should never
+	// reach the other node.
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, d3.getMessages())
+}
+
 func TestMemberlist_SendTo(t *testing.T) {
 	newConfig := func() (*Config, *MockDelegate, net.IP) {
 		d := &MockDelegate{}
@@ -1341,6 +2553,64 @@ func waitForCondition(t *testing.T, fn func() (bool, string)) {
 	t.Fatalf("timeout waiting for condition: %v", msg)
 }
 
+// testMetrics collects the metrics emitted while a test runs.
+type testMetrics struct {
+	sink *metrics.InmemSink
+}
+
+// newTestMetrics installs an in-memory sink as the global metrics sink,
+// putting back the default blackhole sink once the test is done.
+func newTestMetrics(t *testing.T) *testMetrics {
+	cfg := metrics.DefaultConfig("")
+	cfg.EnableHostname = false
+	cfg.EnableRuntimeMetrics = false
+
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	_, err := metrics.NewGlobal(cfg, sink)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		metrics.NewGlobal(cfg, &metrics.BlackholeSink{})
+	})
+	return &testMetrics{sink: sink}
+}
+
+// Counter returns the named counter, summed over every interval.
+func (tm *testMetrics) Counter(name string) metrics.AggregateSample {
+	return tm.aggregate(name, func(i *metrics.IntervalMetrics) map[string]metrics.SampledValue {
+		return i.Counters
+	})
+}
+
+// Sample returns the named sample, summed over every interval.
+func (tm *testMetrics) Sample(name string) metrics.AggregateSample {
+	return tm.aggregate(name, func(i *metrics.IntervalMetrics) map[string]metrics.SampledValue {
+		return i.Samples
+	})
+}
+
+func (tm *testMetrics) aggregate(name string, values func(*metrics.IntervalMetrics) map[string]metrics.SampledValue) metrics.AggregateSample {
+	var agg metrics.AggregateSample
+	for _, interval := range tm.sink.Data() {
+		interval.RLock()
+		v, ok := values(interval)[name]
+		interval.RUnlock()
+		if !ok {
+			continue
+		}
+
+		if agg.Count == 0 || v.Min < agg.Min {
+			agg.Min = v.Min
+		}
+		if agg.Count == 0 || v.Max > agg.Max {
+			agg.Max = v.Max
+		}
+		agg.Count += v.Count
+		agg.Sum += v.Sum
+		agg.SumSq += v.SumSq
+	}
+	return agg
+}
+
 func TestMemberlistProtocolVersion(t *testing.T) {
 	c := testConfig(t)
 	c.ProtocolVersion = ProtocolVersionMax
@@ -1712,6 +2982,30 @@ func TestMemberlist_PingDelegate(t *testing.T) {
 	}
 }
 
+type MockPingFor struct {
+	MockPing
+}
+
+func (m *MockPingFor) AckPayloadFor(from *Node) []byte {
+	return []byte("hello " + from.Name)
+}
+
+func TestMemberlist_AckPayloadFor(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.Ping = &MockPingFor{}
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	require.Equal(t, []byte("hello test"), m.ackPayload("test"))
+
+	// Unknown and unnamed nodes get the default payload.
+	require.Equal(t, []byte(DEFAULT_PAYLOAD), m.ackPayload("nope"))
+	require.Equal(t, []byte(DEFAULT_PAYLOAD), m.ackPayload(""))
+}
+
 func waitUntilSize(t *testing.T, m *Memberlist, expected int) {
 	t.Helper()
 	retry(t, 15, 500*time.Millisecond, func(failf func(string, ...interface{})) {
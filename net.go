@@ -34,7 +34,10 @@ const (
 	// understand version 4 or greater.
 	ProtocolVersion2Compatible = 2
 
-	ProtocolVersionMax = 5
+	// Version 6 added a TTL to indirect pings. It's only sent to
+	// memberlists who understand version 6 or greater, and requests
+	// without one are treated as having a single hop left.
+	ProtocolVersionMax = 6
 )
 
 // messageType is an integer ID of a type of message that can be received
@@ -73,7 +76,8 @@ const (
 	userMsgOverhead        = 1
 	blockingWarning        = 10 * time.Millisecond // Warn if a UDP packet takes this long to process
 	maxPushStateBytes      = 20 * 1024 * 1024
-	maxPushPullRequests    = 128 // Maximum number of concurrent push/pull requests
+	maxPushPullRequests    = 128                    // Maximum number of concurrent push/pull requests
+	pushPullSlotWait       = 100 * time.Millisecond // How long a push/pull waits for a free slot
 )
 
 // ping request sent directly to node
@@ -106,6 +110,14 @@ type indirectPingReq struct {
 	SourceAddr []byte `codec:",omitempty"` // Source address, used for a direct reply
 	SourcePort uint16 `codec:",omitempty"` // Source port, used for a direct reply
 	SourceNode string `codec:",omitempty"` // Source name, used for a direct reply
+
+	// TTL is the number of hops this request may still take. It's decremented
+	// by each node that handles the request, and the request is dropped once
+	// it reaches zero. It's only set for peers who understand version 6 of
+	// the protocol, and is nil when sent by older versions, which only ever
+	// make a single hop. This isn't omitempty, since the codec would then
+	// drop a TTL of zero.
+	TTL *uint8
 }
 
 // ack response is sent for a ping
@@ -145,6 +157,10 @@ type alive struct {
 	// The versions of the protocol/delegate that are being spoken, order:
 	// pmin, pmax, pcur, dmin, dmax, dcur
 	Vsn []uint8
+
+	// NotReady is set if the node asked not to be given new work. It's
+	// inverted so that alive messages from older versions read as ready.
+	NotReady bool
 }
 
 // dead is broadcast when we confirm a node is dead
@@ -159,8 +175,9 @@ type dead struct {
 // otherside how many states we are transferring
 type pushPullHeader struct {
 	Nodes        int
-	UserStateLen int  // Encodes the byte lengh of user state
-	Join         bool // Is this a join request or a anti-entropy run
+	UserStateLen int    // Encodes the byte lengh of user state
+	Join         bool   // Is this a join request or a anti-entropy run
+	Sender       string // Name of the sending node, empty from older versions
 }
 
 // userMsgHeader is used to encapsulate a userMsg
@@ -178,6 +195,7 @@ type pushNodeState struct {
 	Incarnation uint32
 	State       NodeStateType
 	Vsn         []uint8 // Protocol versions
+	NotReady    bool    // See alive.NotReady
 }
 
 // compress is used to wrap an underlying payload
@@ -204,6 +222,47 @@ func (m *Memberlist) encryptionVersion() encryptionVersion {
 	}
 }
 
+// checkLabel returns true if traffic carrying the given label should be
+// accepted by this node.
+func (m *Memberlist) checkLabel(label string) bool {
+	return m.config.SkipInboundLabelCheck || label == m.config.ClusterName
+}
+
+// labelOverhead returns the number of bytes the cluster label adds to each
+// outgoing packet.
+func (m *Memberlist) labelOverhead() int {
+	if m.config.ClusterName == "" {
+		return 0
+	}
+	return labelOverhead + len(m.config.ClusterName)
+}
+
+// gossipBytesAvail returns the number of bytes left for broadcasts in each
+// gossip packet, once the compound header, label and encryption overheads
+// have been taken out of UDPBufferSize.
+func (m *Memberlist) gossipBytesAvail() int {
+	bytesAvail := m.config.UDPBufferSize - compoundHeaderOverhead - m.labelOverhead()
+	if m.config.EncryptionEnabled() {
+		bytesAvail -= encryptOverhead(m.encryptionVersion())
+	}
+	return bytesAvail
+}
+
+// checkPacketSize warns about packet size settings that are likely to be a
+// mistake, such as overheads that leave no room for any broadcasts, or a
+// UDPBufferSize that produces packets larger than MaxPacketBytes.
+func (m *Memberlist) checkPacketSize() {
+	bytesAvail := m.gossipBytesAvail()
+	if bytesAvail <= 0 {
+		m.logger.Printf("[WARN] memberlist: UDPBufferSize of %d bytes leaves no room for broadcasts after overheads (%d bytes available)",
+			m.config.UDPBufferSize, bytesAvail)
+	}
+	if max := m.config.MaxPacketBytes; max > 0 && m.config.UDPBufferSize > max {
+		m.logger.Printf("[WARN] memberlist: UDPBufferSize of %d bytes exceeds MaxPacketBytes of %d bytes, packets may be fragmented or dropped",
+			m.config.UDPBufferSize, max)
+	}
+}
+
 // streamListen is a long running goroutine that pulls incoming streams from the
 // transport and hands them off for processing.
 func (m *Memberlist) streamListen() {
@@ -227,24 +286,25 @@ func (m *Memberlist) handleConn(conn net.Conn) {
 	metrics.IncrCounter([]string{"memberlist", "tcp", "accept"}, 1)
 
 	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout)) // 设置连接处理超时时限
+
+	// Strip off and check the cluster label
+	conn, label, err := removeLabelHeaderFromStream(conn)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: failed to receive and remove the stream label header: %s", err)
+		return
+	}
+	if !m.checkLabel(label) {
+		metrics.IncrCounter([]string{"memberlist", "tcp", "label_mismatch"}, 1)
+		m.logger.Printf("[ERR] memberlist: discarding stream with unacceptable label %q %s", label, LogConn(conn))
+		return
+	}
+
 	// 执行消息的解密和解压缩操作，以获取原始消息类型和内容，若操作失败，则向连接中写入操作失败数据
 	msgType, bufConn, dec, err := m.readStream(conn)
 	if err != nil {
 		if err != io.EOF {
 			m.logger.Printf("[ERR] memberlist: failed to receive: %s %s", err, LogConn(conn))
-
-			resp := errResp{err.Error()}
-			out, err := encode(errMsg, &resp)
-			if err != nil {
-				m.logger.Printf("[ERR] memberlist: Failed to encode error response: %s", err)
-				return
-			}
-
-			err = m.rawSendMsgStream(conn, out.Bytes())
-			if err != nil {
-				m.logger.Printf("[ERR] memberlist: Failed to send error: %s %s", err, LogConn(conn))
-				return
-			}
+			m.sendErrResp(conn, err.Error())
 		}
 		return
 	}
@@ -268,8 +328,16 @@ func (m *Memberlist) handleConn(conn net.Conn) {
 			m.logger.Printf("[ERR] memberlist: Too many pending push/pull requests")
 			return
 		}
+		if !m.acquirePushPull() {
+			metrics.IncrCounter([]string{"memberlist", "tcp", "push_pull_busy"}, 1)
+			m.logger.Printf("[WARN] memberlist: Turning away push/pull, %d already in progress %s",
+				m.config.MaxConcurrentPushPull, LogConn(conn))
+			m.sendErrResp(conn, "push/pull busy, try again later")
+			return
+		}
+		defer m.releasePushPull()
 		// 否则，首先从连接中读取消息头，然后依次读取节点信息，或者用户状态数据。
-		join, remoteNodes, userState, err := m.readRemoteState(bufConn, dec)
+		header, remoteNodes, userState, err := m.readRemoteState(bufConn, dec)
 		if err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to read remote state: %s %s", err, LogConn(conn))
 			return
@@ -278,7 +346,7 @@ func (m *Memberlist) handleConn(conn net.Conn) {
 		// 首先封装本地的集群成员视图数量，然后调用上层应用的 hook 方法来获取需要被发送的数据（针对远程节点加入，可针对性发送数据）。
 		// 依次向连接中写入消息类型、消息头就是集群成员视图数据以及上层应用需要发送的数据。
 		// 最后通过 rawSendMsgStream 将连接中数据正式发送（消息可能需要被加密和压缩，若配置）。
-		if err := m.sendLocalState(conn, join); err != nil {
+		if err := m.sendLocalState(conn, header.Join, header.Sender); err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to push local state: %s %s", err, LogConn(conn))
 			return
 		}
@@ -286,10 +354,13 @@ func (m *Memberlist) handleConn(conn net.Conn) {
 		// 首先执行远程节点集合的支持协议范围约束的检查，然后回调上层应用在执行状态数据的 merge 操作时自定义的逻辑，
 		// 接下来，正式合并远程节点发来的每一个节点的数据，即根据节点的状态执行对应的消息的处理器，即当作自身收到对应类型的消息时的处理逻辑。
 		// 最后，执行上层应用在节点完成一个 push/pull 消息的处理时需额外进行的操作。
-		if err := m.mergeRemoteState(join, remoteNodes, userState); err != nil {
+		if err := m.mergeRemoteState(header.Join, remoteNodes, userState); err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed push/pull merge: %s %s", err, LogConn(conn))
 			return
 		}
+		if header.Sender != "" {
+			m.recordContact(header.Sender, m.clock().Now())
+		}
 	// Ping 消息。
 	case pingMsg:
 		// 当收到一条 ping 消息，直接返回一条 ack 消息。
@@ -299,7 +370,7 @@ func (m *Memberlist) handleConn(conn net.Conn) {
 			return
 		}
 
-		if p.Node != "" && p.Node != m.config.Name {
+		if p.Node != "" && p.Node != m.localName() {
 			m.logger.Printf("[WARN] memberlist: Got ping for unexpected node %s %s", p.Node, LogConn(conn))
 			return
 		}
@@ -337,6 +408,21 @@ func (m *Memberlist) packetListen() {
 
 // ingestPacket 主要对 udp 数据报尝试解密，以及 md5 校验操作，最后调用真正处理消息的方法 handleCommand
 func (m *Memberlist) ingestPacket(buf []byte, from net.Addr, timestamp time.Time) {
+	m.stats.addUDPReceived(len(buf))
+	metrics.AddSample([]string{"memberlist", "packet", "size", "udp", "in"}, float32(len(buf)))
+
+	// Strip off and check the cluster label
+	buf, label, err := removeLabelHeaderFromPacket(buf)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: %v %s", err, LogAddress(from))
+		return
+	}
+	if !m.checkLabel(label) {
+		metrics.IncrCounter([]string{"memberlist", "udp", "label_mismatch"}, 1)
+		m.logger.Printf("[ERR] memberlist: discarding packet with unacceptable label %q %s", label, LogAddress(from))
+		return
+	}
+
 	// Check if encryption is enabled
 	if m.config.EncryptionEnabled() {
 		// Decrypt the payload
@@ -526,14 +612,14 @@ func (m *Memberlist) handlePing(buf []byte, from net.Addr) {
 		return
 	}
 	// If node is provided, verify that it is for us
-	if p.Node != "" && p.Node != m.config.Name {
+	if p.Node != "" && p.Node != m.localName() {
 		m.logger.Printf("[WARN] memberlist: Got ping for unexpected node '%s' %s", p.Node, LogAddress(from))
 		return
 	}
 	var ack ackResp
 	ack.SeqNo = p.SeqNo
 	if m.config.Ping != nil {
-		ack.Payload = m.config.Ping.AckPayload()
+		ack.Payload = m.ackPayload(p.SourceNode)
 	}
 
 	addr := ""
@@ -552,6 +638,26 @@ func (m *Memberlist) handlePing(buf []byte, from net.Addr) {
 	}
 }
 
+// ackPayload asks the ping delegate for the payload to put in an ack to the
+// named node, tailored to that node if the delegate supports it and we know
+// who it is.
+func (m *Memberlist) ackPayload(from string) []byte {
+	if pd, ok := m.config.Ping.(AckPayloadForDelegate); ok && from != "" {
+		m.nodeLock.RLock()
+		state, ok := m.nodeMap[from]
+		var node Node
+		if ok {
+			node = state.Node
+		}
+		m.nodeLock.RUnlock()
+
+		if ok {
+			return pd.AckPayloadFor(&node)
+		}
+	}
+	return m.config.Ping.AckPayload()
+}
+
 // 首先对消息解码后获取消息详情，然后转换消息的发送者并构建  ping 消息。
 // 接下来，构建 ping 消息的成功响应处理函数，即将 ack 消息转发给 indirectPing 消息的发送者。
 // 然后将此处理函数设置到 indirect ping 处理器集合中，其会在超时时限内将该处理器从该集合中删除。
@@ -565,6 +671,17 @@ func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 		return
 	}
 
+	// Guard against indirect pings being relayed around in a loop. Requests
+	// without a TTL come from older versions, which only make a single hop.
+	if ind.TTL != nil {
+		if *ind.TTL == 0 {
+			metrics.IncrCounter([]string{"memberlist", "indirect_ping", "ttl_expired"}, 1)
+			m.logger.Printf("[WARN] memberlist: Dropping indirect ping request for %s with an expired TTL %s", ind.Node, LogAddress(from))
+			return
+		}
+		*ind.TTL--
+	}
+
 	// For proto versions < 2, there is no port provided. Mask old
 	// behavior by using the configured port.
 	if m.ProtocolVersion() < 2 || ind.Port == 0 {
@@ -580,7 +697,7 @@ func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 		// The outbound message is addressed FROM us.
 		SourceAddr: selfAddr,
 		SourcePort: selfPort,
-		SourceNode: m.config.Name,
+		SourceNode: m.localName(),
 	}
 
 	// Forward the ack back to the requestor. If the request encodes an origin
@@ -733,8 +850,17 @@ func (m *Memberlist) handleDead(buf []byte, from net.Addr) {
 
 // handleUser is used to notify channels of incoming user data
 func (m *Memberlist) handleUser(buf []byte, from net.Addr) {
-	d := m.config.Delegate
-	if d != nil {
+	m.notifyUserMsg(buf)
+}
+
+// notifyUserMsg hands an incoming user-data message to the application,
+// preferring the UserMessageDelegate if one is configured.
+func (m *Memberlist) notifyUserMsg(buf []byte) {
+	if um := m.config.UserMessages; um != nil {
+		um.NotifyUserMsg(buf)
+		return
+	}
+	if d := m.config.Delegate; d != nil {
 		d.NotifyMsg(buf)
 	}
 }
@@ -771,7 +897,7 @@ func (m *Memberlist) encodeAndSendMsg(a Address, msgType messageType, msg interf
 // 以尽可能使得此 compoundMsg 接近 udp 消息的额外网络包大小，最后才将消息发送给对端。
 func (m *Memberlist) sendMsg(a Address, msg []byte) error {
 	// Check if we can piggy back any messages
-	bytesAvail := m.config.UDPBufferSize - len(msg) - compoundHeaderOverhead
+	bytesAvail := m.config.UDPBufferSize - len(msg) - compoundHeaderOverhead - m.labelOverhead()
 	if m.config.EncryptionEnabled() && m.config.GossipVerifyOutgoing {
 		bytesAvail -= encryptOverhead(m.encryptionVersion())
 	}
@@ -853,9 +979,50 @@ func (m *Memberlist) rawSendMsgPacket(a Address, node *Node, msg []byte) error {
 		msg = buf.Bytes()
 	}
 
-	metrics.IncrCounter([]string{"memberlist", "udp", "sent"}, float32(len(msg)))
-	_, err := m.transport.WriteToAddress(msg, a)
-	return err
+	// The transport adds the label header, if there is one, so count it
+	// here to match what goes out on the wire.
+	wireLen := len(msg) + m.labelOverhead()
+	metrics.IncrCounter([]string{"memberlist", "udp", "sent"}, float32(wireLen))
+	metrics.AddSample([]string{"memberlist", "packet", "size", "udp", "out"}, float32(wireLen))
+	m.stats.addUDPSent(wireLen)
+	return m.chaosSend(msg, m.resolveAddress(a, node))
+}
+
+// resolveAddress returns the address to send to for the given node, as
+// given by Config.AddressResolver. If there's no resolver, the node isn't
+// known, or the resolver fails, the address is returned unchanged. Only the
+// address we dial is affected; the node's stored address is left alone.
+func (m *Memberlist) resolveAddress(a Address, node *Node) Address {
+	if m.config.AddressResolver == nil {
+		return a
+	}
+	if node == nil {
+		if a.Name == "" {
+			return a
+		}
+		m.nodeLock.RLock()
+		state, ok := m.nodeMap[a.Name]
+		var n Node
+		if ok {
+			n = state.Node
+		}
+		m.nodeLock.RUnlock()
+		if !ok {
+			return a
+		}
+		node = &n
+	}
+
+	addr, err := m.config.AddressResolver(node)
+	if err != nil {
+		metrics.IncrCounter([]string{"memberlist", "resolve", "failed"}, 1)
+		m.logger.Printf("[WARN] memberlist: Failed to resolve address of %s, using %s: %v", node.Name, a.Addr, err)
+		return a
+	}
+	if addr == "" {
+		return a
+	}
+	return Address{Addr: addr, Name: a.Name}
 }
 
 // rawSendMsgStream is used to stream a message to another host without
@@ -883,6 +1050,7 @@ func (m *Memberlist) rawSendMsgStream(conn net.Conn, sendBuf []byte) error {
 
 	// Write out the entire send buffer
 	metrics.IncrCounter([]string{"memberlist", "tcp", "sent"}, float32(len(sendBuf)))
+	m.stats.addTCPSent(len(sendBuf))
 
 	if n, err := conn.Write(sendBuf); err != nil {
 		return err
@@ -893,13 +1061,22 @@ func (m *Memberlist) rawSendMsgStream(conn net.Conn, sendBuf []byte) error {
 	return nil
 }
 
+// dialTimeout returns how long to wait when dialing a stream connection for
+// an operation that has the given overall timeout.
+func (m *Memberlist) dialTimeout(timeout time.Duration) time.Duration {
+	if d := m.config.TCPDialTimeout; d > 0 && d < timeout {
+		return d
+	}
+	return timeout
+}
+
 // sendUserMsg is used to stream a user message to another host.
 func (m *Memberlist) sendUserMsg(a Address, sendBuf []byte) error {
 	if a.Name == "" && m.config.RequireNodeNames {
 		return errNodeNamesAreRequired
 	}
 
-	conn, err := m.transport.DialAddressTimeout(a, m.config.TCPTimeout)
+	conn, err := m.transport.DialAddressTimeout(a, m.dialTimeout(m.config.TCPTimeout))
 	if err != nil {
 		return err
 	}
@@ -930,9 +1107,9 @@ func (m *Memberlist) sendAndReceiveState(a Address, join bool) ([]pushNodeState,
 	}
 
 	// Attempt to connect
-	conn, err := m.transport.DialAddressTimeout(a, m.config.TCPTimeout)
+	conn, err := m.transport.DialAddressTimeout(m.resolveAddress(a, nil), m.dialTimeout(m.config.TCPTimeout))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, &DialError{Addr: a, Err: err}
 	}
 	defer conn.Close()
 	m.logger.Printf("[DEBUG] memberlist: Initiating push/pull sync with: %s %s", a.Name, conn.RemoteAddr())
@@ -940,7 +1117,7 @@ func (m *Memberlist) sendAndReceiveState(a Address, join bool) ([]pushNodeState,
 
 	// Send our state
 	// 在 push 操作中，节点将自身本地的集群成员视图发送给对应节点
-	if err := m.sendLocalState(conn, join); err != nil {
+	if err := m.sendLocalState(conn, join, a.Name); err != nil {
 		return nil, nil, err
 	}
 
@@ -971,24 +1148,38 @@ func (m *Memberlist) sendAndReceiveState(a Address, join bool) ([]pushNodeState,
 }
 
 // sendLocalState is invoked to send our local state over a stream connection.
-func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
+// The peer is the name of the node on the other end, if we know it.
+func (m *Memberlist) sendLocalState(conn net.Conn, join bool, peer string) error {
 	// Setup a deadline
 	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
 
 	// Prepare the local node state
 	m.nodeLock.RLock()
-	localNodes := make([]pushNodeState, len(m.nodes))
-	for idx, n := range m.nodes {
-		localNodes[idx].Name = n.Name
-		localNodes[idx].Addr = n.Addr
-		localNodes[idx].Port = n.Port
-		localNodes[idx].Incarnation = n.Incarnation
-		localNodes[idx].State = n.State
-		localNodes[idx].Meta = n.Meta
-		localNodes[idx].Vsn = []uint8{
-			n.PMin, n.PMax, n.PCur,
-			n.DMin, n.DMax, n.DCur,
+	localNodes := make([]pushNodeState, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		// Observers leave themselves out so peers never learn about them.
+		if m.config.Observer && n.Name == m.localName() {
+			continue
 		}
+		meta := n.Meta
+		if n.Name == m.localName() {
+			if p, ok := m.nodeMap[peer]; ok {
+				meta = m.metaForPeer(&p.Node, n.Incarnation, meta)
+			}
+		}
+		localNodes = append(localNodes, pushNodeState{
+			Name:        n.Name,
+			Addr:        n.Addr,
+			Port:        n.Port,
+			Incarnation: n.Incarnation,
+			State:       n.State,
+			Meta:        meta,
+			Vsn: []uint8{
+				n.PMin, n.PMax, n.PCur,
+				n.DMin, n.DMax, n.DCur,
+			},
+			NotReady: !n.Ready,
+		})
 	}
 	m.nodeLock.RUnlock()
 
@@ -1003,6 +1194,9 @@ func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 
 	// Send our node state
 	header := pushPullHeader{Nodes: len(localNodes), UserStateLen: len(userData), Join: join}
+	if !m.config.Observer {
+		header.Sender = m.localName()
+	}
 	hd := codec.MsgpackHandle{}
 	enc := codec.NewEncoder(bufConn, &hd)
 
@@ -1086,12 +1280,61 @@ func (m *Memberlist) decryptRemoteState(bufConn io.Reader) ([]byte, error) {
 	return decryptPayload(keys, cipherBytes, dataBytes)
 }
 
+// sendErrResp writes an error response with the given message back over a
+// stream connection.
+func (m *Memberlist) sendErrResp(conn net.Conn, msg string) {
+	resp := errResp{msg}
+	out, err := encode(errMsg, &resp)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to encode error response: %s", err)
+		return
+	}
+
+	if err := m.rawSendMsgStream(conn, out.Bytes()); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send error: %s %s", err, LogConn(conn))
+	}
+}
+
+// acquirePushPull takes one of the inbound push/pull slots allowed by
+// MaxConcurrentPushPull, waiting briefly if they're all in use. It returns
+// false if no slot came free, in which case releasePushPull must not be
+// called.
+func (m *Memberlist) acquirePushPull() bool {
+	if m.pushPullSem == nil {
+		return true
+	}
+
+	select {
+	case m.pushPullSem <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := m.clock().NewTimer(pushPullSlotWait)
+	defer timer.Stop()
+	select {
+	case m.pushPullSem <- struct{}{}:
+		return true
+	case <-timer.C():
+		return false
+	case <-m.shutdownCh:
+		return false
+	}
+}
+
+// releasePushPull gives back a slot taken by acquirePushPull.
+func (m *Memberlist) releasePushPull() {
+	if m.pushPullSem != nil {
+		<-m.pushPullSem
+	}
+}
+
 // readStream is used to read from a stream connection, decrypting and
 // decompressing the stream if necessary.
 // readStream 连接中读取消息，主要是执行消息的解密和解压缩操作，以获取原始消息的类型和内容
 func (m *Memberlist) readStream(conn net.Conn) (messageType, io.Reader, *codec.Decoder, error) {
-	// Created a buffered reader
-	var bufConn io.Reader = bufio.NewReader(conn)
+	// Created a buffered reader, counting the bytes read off the wire
+	var bufConn io.Reader = bufio.NewReader(&countingReader{conn, m.stats.addTCPReceived})
 
 	// Read the message type
 	// 消息的首个字节表示消息的类型
@@ -1153,11 +1396,11 @@ func (m *Memberlist) readStream(conn net.Conn) (messageType, io.Reader, *codec.D
 }
 
 // readRemoteState is used to read the remote state from a connection
-func (m *Memberlist) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (bool, []pushNodeState, []byte, error) {
+func (m *Memberlist) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (pushPullHeader, []pushNodeState, []byte, error) {
 	// Read the push/pull header
 	var header pushPullHeader
 	if err := dec.Decode(&header); err != nil {
-		return false, nil, nil, err
+		return header, nil, nil, err
 	}
 
 	// Allocate space for the transfer
@@ -1166,7 +1409,7 @@ func (m *Memberlist) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (boo
 	// Try to decode all the states
 	for i := 0; i < header.Nodes; i++ {
 		if err := dec.Decode(&remoteNodes[i]); err != nil {
-			return false, nil, nil, err
+			return header, nil, nil, err
 		}
 	}
 
@@ -1181,7 +1424,7 @@ func (m *Memberlist) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (boo
 				bytes, header.UserStateLen)
 		}
 		if err != nil {
-			return false, nil, nil, err
+			return header, nil, nil, err
 		}
 	}
 
@@ -1193,39 +1436,33 @@ func (m *Memberlist) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (boo
 		}
 	}
 
-	return header.Join, remoteNodes, userBuf, nil
+	return header, remoteNodes, userBuf, nil
 }
 
 // mergeRemoteState is used to merge the remote state with our local state
 func (m *Memberlist) mergeRemoteState(join bool, remoteNodes []pushNodeState, userBuf []byte) error {
 	if err := m.verifyProtocol(remoteNodes); err != nil {
+		m.mergeCanceled(remoteNodes, err)
 		return err
 	}
 
 	// Invoke the merge delegate if any
 	if join && m.config.Merge != nil {
-		nodes := make([]*Node, len(remoteNodes))
-		for idx, n := range remoteNodes {
-			nodes[idx] = &Node{
-				Name:  n.Name,
-				Addr:  n.Addr,
-				Port:  n.Port,
-				Meta:  n.Meta,
-				State: n.State,
-				PMin:  n.Vsn[0],
-				PMax:  n.Vsn[1],
-				PCur:  n.Vsn[2],
-				DMin:  n.Vsn[3],
-				DMax:  n.Vsn[4],
-				DCur:  n.Vsn[5],
-			}
-		}
-		if err := m.config.Merge.NotifyMerge(nodes); err != nil {
+		if err := m.config.Merge.NotifyMerge(pushNodeStatesToNodes(remoteNodes)); err != nil {
+			err = &MergeRejectedError{err}
+			m.mergeCanceled(remoteNodes, err)
 			return err
 		}
 	}
 
+	if m.config.NodeFilter != nil {
+		remoteNodes = m.filterRemoteNodes(remoteNodes)
+	}
+
 	// Merge the membership state
+	if join && m.config.EmitInitialJoins {
+		m.addSuspectNodes(remoteNodes)
+	}
 	m.mergeState(remoteNodes)
 
 	// Invoke the delegate for user state
@@ -1236,6 +1473,55 @@ func (m *Memberlist) mergeRemoteState(join bool, remoteNodes []pushNodeState, us
 	return nil
 }
 
+// filterRemoteNodes drops the entries from a push/pull that
+// Config.NodeFilter doesn't accept.
+func (m *Memberlist) filterRemoteNodes(remoteNodes []pushNodeState) []pushNodeState {
+	nodes := pushNodeStatesToNodes(remoteNodes)
+	kept := make([]pushNodeState, 0, len(remoteNodes))
+	for idx, n := range nodes {
+		if !m.config.NodeFilter(n) {
+			metrics.IncrCounter([]string{"memberlist", "push_pull", "filtered"}, 1)
+			continue
+		}
+		kept = append(kept, remoteNodes[idx])
+	}
+	return kept
+}
+
+// mergeCanceled tells Config.OnMergeCanceled, if set, that we aborted a
+// merge with the given remote state.
+func (m *Memberlist) mergeCanceled(remoteNodes []pushNodeState, reason error) {
+	metrics.IncrCounter([]string{"memberlist", "merge", "canceled"}, 1)
+	if m.config.OnMergeCanceled != nil {
+		m.config.OnMergeCanceled(pushNodeStatesToNodes(remoteNodes), reason)
+	}
+}
+
+// pushNodeStatesToNodes converts remote state from a push/pull into nodes
+// for handing to the application.
+func pushNodeStatesToNodes(remoteNodes []pushNodeState) []*Node {
+	nodes := make([]*Node, len(remoteNodes))
+	for idx, n := range remoteNodes {
+		nodes[idx] = &Node{
+			Name:  n.Name,
+			Addr:  n.Addr,
+			Port:  n.Port,
+			Meta:  n.Meta,
+			State: n.State,
+			Ready: !n.NotReady,
+		}
+		if len(n.Vsn) > 5 {
+			nodes[idx].PMin = n.Vsn[0]
+			nodes[idx].PMax = n.Vsn[1]
+			nodes[idx].PCur = n.Vsn[2]
+			nodes[idx].DMin = n.Vsn[3]
+			nodes[idx].DMax = n.Vsn[4]
+			nodes[idx].DCur = n.Vsn[5]
+		}
+	}
+	return nodes
+}
+
 // readUserMsg is used to decode a userMsg from a stream.
 func (m *Memberlist) readUserMsg(bufConn io.Reader, dec *codec.Decoder) error {
 	// Read the user message header
@@ -1258,10 +1544,7 @@ func (m *Memberlist) readUserMsg(bufConn io.Reader, dec *codec.Decoder) error {
 			return err
 		}
 
-		d := m.config.Delegate
-		if d != nil {
-			d.NotifyMsg(userBuf)
-		}
+		m.notifyUserMsg(userBuf)
 	}
 
 	return nil
@@ -1276,7 +1559,7 @@ func (m *Memberlist) sendPingAndWaitForAck(a Address, ping ping, deadline time.T
 		return false, errNodeNamesAreRequired
 	}
 
-	conn, err := m.transport.DialAddressTimeout(a, deadline.Sub(time.Now()))
+	conn, err := m.transport.DialAddressTimeout(a, m.dialTimeout(deadline.Sub(time.Now())))
 	if err != nil {
 		// If the node is actually dead we expect this to fail, so we
 		// shouldn't spam the logs with it. After this point, errors
@@ -264,6 +264,59 @@ func TestHandleIndirectPing(t *testing.T) {
 	doneCh <- struct{}{}
 }
 
+func TestHandleIndirectPing_TTL(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.EnableCompression = false
+	})
+	defer m.Shutdown()
+
+	udp := listenUDP(t)
+	defer udp.Close()
+
+	udpAddr := udp.LocalAddr().(*net.UDPAddr)
+	addr := &net.UDPAddr{IP: net.ParseIP(m.config.BindAddr), Port: m.config.BindPort}
+
+	sendInd := func(seqNo uint32, ttl *uint8) {
+		ind := indirectPingReq{
+			SeqNo:      seqNo,
+			Target:     net.ParseIP(m.config.BindAddr),
+			Port:       uint16(m.config.BindPort),
+			Node:       m.config.Name,
+			SourceAddr: udpAddr.IP,
+			SourcePort: uint16(udpAddr.Port),
+			SourceNode: "test",
+			TTL:        ttl,
+		}
+		buf, err := encode(indirectPingMsg, &ind)
+		require.NoError(t, err)
+		_, err = udp.WriteTo(buf.Bytes(), addr)
+		require.NoError(t, err)
+	}
+
+	// An expired request should be dropped, and a live one relayed.
+	expired, live := uint8(0), uint8(1)
+	sendInd(100, &expired)
+	sendInd(101, &live)
+
+	udp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	in := make([]byte, 1500)
+	n, _, err := udp.ReadFrom(in)
+	require.NoError(t, err)
+	in = in[0:n]
+	require.Equal(t, ackRespMsg, messageType(in[0]))
+
+	var ack ackResp
+	require.NoError(t, decode(in[1:], &ack))
+	require.Equal(t, uint32(101), ack.SeqNo)
+
+	// Requests from older versions won't have a TTL at all.
+	sendInd(102, nil)
+	n, _, err = udp.ReadFrom(in[:cap(in)])
+	require.NoError(t, err)
+	require.NoError(t, decode(in[1:n], &ack))
+	require.Equal(t, uint32(102), ack.SeqNo)
+}
+
 func TestTCPPing(t *testing.T) {
 	var tcp *net.TCPListener
 	var tcpAddr *net.TCPAddr
@@ -558,6 +611,96 @@ func TestTCPPushPull(t *testing.T) {
 	}
 }
 
+func TestTCPPushPull_MaxConcurrent(t *testing.T) {
+	m1 := GetMemberlist(t, func(c *Config) {
+		c.MaxConcurrentPushPull = 1
+	})
+	defer m1.Shutdown()
+	m2 := GetMemberlist(t, nil)
+	defer m2.Shutdown()
+
+	a := Address{
+		Addr: net.JoinHostPort(m1.config.BindAddr, strconv.Itoa(m1.config.BindPort)),
+		Name: m1.config.Name,
+	}
+
+	// With the only slot taken, the sync is turned away as busy.
+	require.True(t, m1.acquirePushPull())
+	_, _, err := m2.sendAndReceiveState(a, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "busy")
+
+	// Once it's free again the sync goes through.
+	m1.releasePushPull()
+	_, _, err = m2.sendAndReceiveState(a, false)
+	require.NoError(t, err)
+}
+
+func TestTCPPushPull_AddressResolver(t *testing.T) {
+	m1 := GetMemberlist(t, nil)
+	defer m1.Shutdown()
+	real := net.JoinHostPort(m1.config.BindAddr, strconv.Itoa(m1.config.BindPort))
+
+	m2 := GetMemberlist(t, func(c *Config) {
+		c.AddressResolver = func(n *Node) (string, error) {
+			if n.Name != m1.config.Name {
+				return "", fmt.Errorf("unknown node %s", n.Name)
+			}
+			return real, nil
+		}
+	})
+	defer m2.Shutdown()
+
+	// m2 has m1 at a stale address, which nothing is listening on.
+	stale := alive{Node: m1.config.Name, Addr: net.ParseIP(m1.config.BindAddr), Port: 1, Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+	m2.aliveNode(&stale, nil, false)
+	a := Address{Addr: net.JoinHostPort(m1.config.BindAddr, "1"), Name: m1.config.Name}
+
+	_, _, err := m2.sendAndReceiveState(a, false)
+	require.NoError(t, err)
+
+	// The stored address is left alone.
+	require.Equal(t, uint16(1), m2.nodeMap[m1.config.Name].Port)
+
+	// Unknown nodes and resolver errors leave the address as it was.
+	other := Address{Addr: "127.0.0.1:2", Name: "other"}
+	require.Equal(t, other, m2.resolveAddress(other, nil))
+	require.Equal(t, other, m2.resolveAddress(other, &Node{Name: "other"}))
+}
+
+func TestDialTimeout(t *testing.T) {
+	m := &Memberlist{config: &Config{}}
+	require.Equal(t, 10*time.Second, m.dialTimeout(10*time.Second))
+
+	// The dial timeout cuts the wait short, but never extends it.
+	m.config.TCPDialTimeout = time.Second
+	require.Equal(t, time.Second, m.dialTimeout(10*time.Second))
+	require.Equal(t, 500*time.Millisecond, m.dialTimeout(500*time.Millisecond))
+}
+
+func TestMergeRemoteState_NodeFilter(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.NodeFilter = func(n *Node) bool {
+			return bytes.Equal(n.Meta, []byte("ok"))
+		}
+	})
+	defer m.Shutdown()
+
+	vsn := m.config.BuildVsnArray()
+	remote := []pushNodeState{
+		{Name: "good", Addr: []byte{127, 0, 0, 1}, Meta: []byte("ok"), Incarnation: 1, State: StateAlive, Vsn: vsn},
+		{Name: "bad", Addr: []byte{127, 0, 0, 2}, Meta: []byte("junk"), Incarnation: 1, State: StateAlive, Vsn: vsn},
+	}
+	require.NoError(t, m.mergeRemoteState(false, remote, nil))
+
+	m.nodeLock.RLock()
+	_, good := m.nodeMap["good"]
+	_, bad := m.nodeMap["bad"]
+	m.nodeLock.RUnlock()
+	require.True(t, good)
+	require.False(t, bad)
+}
+
 func TestSendMsg_Piggyback(t *testing.T) {
 	m := GetMemberlist(t, nil)
 	defer m.Shutdown()
@@ -789,6 +932,34 @@ func TestIngestPacket_CRC(t *testing.T) {
 	}
 }
 
+func TestPacketSizeSamples(t *testing.T) {
+	tm := newTestMetrics(t)
+
+	m := GetMemberlist(t, func(c *Config) {
+		c.EnableCompression = false
+	})
+	defer m.Shutdown()
+
+	udp := listenUDP(t)
+	defer udp.Close()
+
+	// A compound packet is sampled as a whole.
+	compound := makeCompoundMessage([][]byte{{byte(userMsg), 1, 2}, {byte(userMsg), 3}})
+	a := Address{Addr: udp.LocalAddr().String(), Name: "test"}
+	require.NoError(t, m.rawSendMsgPacket(a, &Node{PMax: 5}, compound.Bytes()))
+
+	in := make([]byte, 1500)
+	n, _, err := udp.ReadFrom(in)
+	require.NoError(t, err)
+	m.ingestPacket(in[:n], udp.LocalAddr(), time.Now())
+
+	for _, dir := range []string{"out", "in"} {
+		s := tm.Sample("memberlist.packet.size.udp." + dir)
+		require.Equal(t, 1, s.Count, dir)
+		require.Equal(t, float64(n), s.Sum, dir)
+	}
+}
+
 func TestIngestPacket_ExportedFunc_EmptyMessage(t *testing.T) {
 	m := GetMemberlist(t, func(c *Config) {
 		c.EnableCompression = false
@@ -22,6 +22,10 @@ const (
 	// udpRecvBufSize is a large buffer size that we attempt to set UDP
 	// sockets to in order to handle a large volume of messages.
 	udpRecvBufSize = 2 * 1024 * 1024
+
+	// udpDropsInterval is how often we read the kernel's count of packets
+	// dropped on our UDP sockets, where the platform supports it.
+	udpDropsInterval = 10 * time.Second
 )
 
 // NetTransportConfig is used to configure a net transport.
@@ -33,6 +37,11 @@ type NetTransportConfig struct {
 	// BindPort is the port to listen on, for each address above.
 	BindPort int
 
+	// UDPRecvBufSize is the receive buffer size to ask for on the UDP
+	// sockets, halving it until the OS allows it. If this is 0, we ask
+	// for 2MB.
+	UDPRecvBufSize int
+
 	// Logger is a logger for operator messages.
 	Logger *log.Logger
 }
@@ -48,6 +57,7 @@ type NetTransport struct {
 	tcpListeners []*net.TCPListener
 	udpListeners []*net.UDPConn
 	shutdown     int32
+	shutdownCh   chan struct{}
 }
 
 var _ NodeAwareTransport = (*NetTransport)(nil)
@@ -64,10 +74,11 @@ func NewNetTransport(config *NetTransportConfig) (*NetTransport, error) {
 	// Build out the new transport.
 	var ok bool
 	t := NetTransport{
-		config:   config,
-		packetCh: make(chan *Packet),
-		streamCh: make(chan net.Conn),
-		logger:   config.Logger,
+		config:     config,
+		packetCh:   make(chan *Packet),
+		streamCh:   make(chan net.Conn),
+		logger:     config.Logger,
+		shutdownCh: make(chan struct{}),
 	}
 
 	// Clean up listeners if there's an error.
@@ -101,7 +112,7 @@ func NewNetTransport(config *NetTransportConfig) (*NetTransport, error) {
 		if err != nil {
 			return nil, fmt.Errorf("Failed to start UDP listener on %q port %d: %v", addr, port, err)
 		}
-		if err := setUDPRecvBuf(udpLn); err != nil {
+		if err := setUDPRecvBuf(udpLn, config.UDPRecvBufSize); err != nil {
 			return nil, fmt.Errorf("Failed to resize UDP buffer: %v", err)
 		}
 		t.udpListeners = append(t.udpListeners, udpLn)
@@ -113,6 +124,10 @@ func NewNetTransport(config *NetTransportConfig) (*NetTransport, error) {
 		go t.tcpListen(t.tcpListeners[i])
 		go t.udpListen(t.udpListeners[i])
 	}
+	if _, ok := udpKernelDrops(t.udpListeners[0]); ok {
+		t.wg.Add(1)
+		go t.udpDropsLoop()
+	}
 
 	ok = true
 	return &t, nil
@@ -187,14 +202,70 @@ func (t *NetTransport) WriteToAddress(b []byte, a Address) (time.Time, error) {
 		return time.Time{}, err
 	}
 
-	// We made sure there's at least one UDP listener, so just use the
-	// packet sending interface on the first one. Take the time after the
-	// write call comes back, which will underestimate the time a little,
-	// but help account for any delays before the write occurs.
-	_, err = t.udpListeners[0].WriteTo(b, udpAddr)
+	// We made sure there's at least one UDP listener, so use the packet
+	// sending interface on the one best suited to the destination. Take
+	// the time after the write call comes back, which will underestimate
+	// the time a little, but help account for any delays before the write
+	// occurs.
+	udpLn := t.udpListeners[t.listenerFor(udpAddr.IP)]
+	_, err = udpLn.WriteTo(b, udpAddr)
 	return time.Now(), err
 }
 
+// listenerFor returns the index of the listeners to send from to reach the
+// given IP. With more than one, this is the one bound to the address that
+// shares the longest prefix with the destination, which keeps traffic for
+// each network on that network's interface on multi-homed hosts. Listeners
+// bound to the unspecified address go with anything of their family, but
+// lose out to a specific address that matches at all.
+func (t *NetTransport) listenerFor(ip net.IP) int {
+	if len(t.udpListeners) == 1 || ip == nil {
+		return 0
+	}
+
+	best, bestLen := 0, -1
+	for i, udpLn := range t.udpListeners {
+		bound := udpLn.LocalAddr().(*net.UDPAddr).IP
+		if (bound.To4() == nil) != (ip.To4() == nil) && !bound.IsUnspecified() {
+			continue
+		}
+
+		n := 0
+		if !bound.IsUnspecified() {
+			n = commonPrefixLen(bound, ip)
+		}
+		if n > bestLen {
+			best, bestLen = i, n
+		}
+	}
+	return best
+}
+
+// commonPrefixLen returns the number of leading bits two IPs of the same
+// family have in common.
+func commonPrefixLen(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		a, b = a4, b4
+	} else {
+		a, b = a.To16(), b.To16()
+	}
+
+	n := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
+
 // See Transport.
 func (t *NetTransport) PacketCh() <-chan *Packet {
 	return t.packetCh
@@ -239,6 +310,19 @@ func (t *NetTransport) DialAddressTimeout(a Address, timeout time.Duration) (net
 	addr := a.Addr
 
 	dialer := net.Dialer{Timeout: timeout}
+
+	// Connect from the listener best suited to the destination, if it's
+	// bound to a specific address, for the same reason as with packets.
+	if len(t.tcpListeners) > 1 {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				bound := t.tcpListeners[t.listenerFor(ip)].Addr().(*net.TCPAddr).IP
+				if !bound.IsUnspecified() {
+					dialer.LocalAddr = &net.TCPAddr{IP: bound}
+				}
+			}
+		}
+	}
 	return dialer.Dial("tcp", addr)
 }
 
@@ -256,7 +340,9 @@ func (t *NetTransport) IngestStream(conn net.Conn) error {
 // See Transport.
 func (t *NetTransport) Shutdown() error {
 	// This will avoid log spam about errors when we shut down.
-	atomic.StoreInt32(&t.shutdown, 1)
+	if atomic.SwapInt32(&t.shutdown, 1) == 0 {
+		close(t.shutdownCh)
+	}
 
 	// Rip through all the connections and shut them down.
 	for _, conn := range t.tcpListeners {
@@ -350,11 +436,44 @@ func (t *NetTransport) udpListen(udpLn *net.UDPConn) {
 	}
 }
 
+// udpDropsLoop is a long running goroutine that reports how many packets the
+// kernel dropped on our UDP sockets since the last time it looked.
+func (t *NetTransport) udpDropsLoop() {
+	defer t.wg.Done()
+
+	last := make([]uint64, len(t.udpListeners))
+	for i, udpLn := range t.udpListeners {
+		last[i], _ = udpKernelDrops(udpLn)
+	}
+
+	ticker := time.NewTicker(udpDropsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for i, udpLn := range t.udpListeners {
+				drops, ok := udpKernelDrops(udpLn)
+				if !ok {
+					continue
+				}
+				if drops > last[i] {
+					metrics.IncrCounter([]string{"memberlist", "transport", "udp", "kernel_drops"}, float32(drops-last[i]))
+				}
+				last[i] = drops
+			}
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
 // setUDPRecvBuf is used to resize the UDP receive window. The function
-// attempts to set the read buffer to `udpRecvBuf` but backs off until
-// the read buffer can be set.
-func setUDPRecvBuf(c *net.UDPConn) error {
-	size := udpRecvBufSize
+// attempts to set the read buffer to the given size, or `udpRecvBufSize`
+// if it's zero, but backs off until the read buffer can be set.
+func setUDPRecvBuf(c *net.UDPConn, size int) error {
+	if size <= 0 {
+		size = udpRecvBufSize
+	}
 	var err error
 	for size > 0 {
 		if err = c.SetReadBuffer(size); err == nil {
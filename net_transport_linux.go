@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package memberlist
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// udpKernelDrops returns how many packets the kernel has dropped on the given
+// UDP socket, as reported in the drops column of /proc/net/udp and
+// /proc/net/udp6 for the socket's inode.
+func udpKernelDrops(c *net.UDPConn) (uint64, bool) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var stat syscall.Stat_t
+	var statErr error
+	if err := rc.Control(func(fd uintptr) {
+		statErr = syscall.Fstat(int(fd), &stat)
+	}); err != nil || statErr != nil {
+		return 0, false
+	}
+	inode := strconv.FormatUint(stat.Ino, 10)
+
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		if drops, ok := procNetUDPDrops(path, inode); ok {
+			return drops, true
+		}
+	}
+	return 0, false
+}
+
+// procNetUDPDrops looks up the drops column for the socket with the given
+// inode in a /proc/net/udp style table.
+func procNetUDPDrops(path string, inode string) (uint64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip the header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 || fields[9] != inode {
+			continue
+		}
+		drops, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return drops, true
+	}
+	return 0, false
+}
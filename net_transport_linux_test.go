@@ -0,0 +1,35 @@
+//go:build linux
+// +build linux
+
+package memberlist
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport_UDPRecvBufSize_Linux(t *testing.T) {
+	transport, err := NewNetTransport(&NetTransportConfig{
+		BindAddrs:      []string{"127.0.0.1"},
+		UDPRecvBufSize: 64 * 1024,
+		Logger:         log.New(os.Stderr, "", log.LstdFlags),
+	})
+	require.NoError(t, err)
+	defer transport.Shutdown()
+
+	// Linux reports twice what we asked for, to leave room for its own
+	// bookkeeping.
+	rc, err := transport.udpListeners[0].SyscallConn()
+	require.NoError(t, err)
+	var size int
+	var sockErr error
+	require.NoError(t, rc.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}))
+	require.NoError(t, sockErr)
+	require.Equal(t, 2*64*1024, size)
+}
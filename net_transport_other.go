@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package memberlist
+
+import "net"
+
+// udpKernelDrops isn't supported on this platform, so we never report kernel
+// drops here.
+func udpKernelDrops(c *net.UDPConn) (uint64, bool) {
+	return 0, false
+}
@@ -15,3 +15,12 @@ type PingDelegate interface {
 	// 当收到自己对对方发送的 ping 消息的回应时，会回调该接口。
 	NotifyPingComplete(other *Node, rtt time.Duration, payload []byte)
 }
+
+// AckPayloadForDelegate is an optional interface that a PingDelegate can also
+// implement to tailor the ack payload to the node that pinged us.
+type AckPayloadForDelegate interface {
+	// AckPayloadFor is invoked instead of AckPayload when an ack is being
+	// sent to a node we know about; the returned bytes will be appended to
+	// the ack. The Node argument must not be modified.
+	AckPayloadFor(from *Node) []byte
+}
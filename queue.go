@@ -21,6 +21,12 @@ type TransmitLimitedQueue struct {
 	// number of retransmissions attempted.
 	RetransmitMult int
 
+	// Retired is an optional function that is invoked when a broadcast is
+	// dropped because it reached the retransmit limit, rather than being
+	// invalidated or pruned. It is called once the queue lock has been
+	// released, so it may call back into the queue.
+	Retired func(b Broadcast)
+
 	mu    sync.Mutex
 	tq    *btree.BTree // stores *limitedBroadcast as btree.Item
 	tm    map[string]*limitedBroadcast
@@ -28,12 +34,20 @@ type TransmitLimitedQueue struct {
 }
 
 type limitedBroadcast struct {
-	transmits int   // btree-key[0]: Number of transmissions attempted.
-	msgLen    int64 // btree-key[1]: copied from len(b.Message())
-	id        int64 // btree-key[2]: unique incrementing id stamped at submission time
+	priority  int   // btree-key[0]: copied from Priority() for a PriorityBroadcast
+	transmits int   // btree-key[1]: Number of transmissions attempted.
+	msgLen    int64 // btree-key[2]: copied from len(b.Message())
+	id        int64 // btree-key[3]: unique incrementing id stamped at submission time
 	b         Broadcast
 
-	name string // set if Broadcast is a NamedBroadcast
+	name  string          // set if Broadcast is a NamedBroadcast
+	group *broadcastGroup // set if queued with QueueBroadcastGroup
+}
+
+// broadcastGroup ties together broadcasts queued with QueueBroadcastGroup,
+// so they can be sent in the same packet when they fit.
+type broadcastGroup struct {
+	members []*limitedBroadcast
 }
 
 // Less tests whether the current item is less than the given argument.
@@ -43,11 +57,17 @@ type limitedBroadcast struct {
 // hold one of either a or b in the tree).
 //
 // default ordering is
+// - [priority=inf, ..., priority=0, ..., priority=-inf]
 // - [transmits=0, ..., transmits=inf]
 // - [transmits=0:len=999, ..., transmits=0:len=2, ...]
 // - [transmits=0:len=999,id=999, ..., transmits=0:len=999:id=1, ...]
 func (b *limitedBroadcast) Less(than btree.Item) bool {
 	o := than.(*limitedBroadcast)
+	if b.priority > o.priority {
+		return true
+	} else if b.priority < o.priority {
+		return false
+	}
 	if b.transmits < o.transmits {
 		return true
 	} else if b.transmits > o.transmits {
@@ -89,13 +109,14 @@ func (q *TransmitLimitedQueue) walkReadOnlyLocked(reverse bool, f func(*limitedB
 	iter := func(item btree.Item) bool {
 		cur := item.(*limitedBroadcast)
 
+		prevPriority := cur.priority
 		prevTransmits := cur.transmits
 		prevMsgLen := cur.msgLen
 		prevID := cur.id
 
 		keepGoing := f(cur)
 
-		if prevTransmits != cur.transmits || prevMsgLen != cur.msgLen || prevID != cur.id {
+		if prevPriority != cur.priority || prevTransmits != cur.transmits || prevMsgLen != cur.msgLen || prevID != cur.id {
 			panic("edited queue while walking read only")
 		}
 
@@ -160,11 +181,40 @@ type UniqueBroadcast interface {
 	UniqueBroadcast()
 }
 
+// PriorityBroadcast is an optional interface that gives a broadcast a
+// priority. Broadcasts with a higher priority are sent ahead of those with a
+// lower one, no matter how many times either has been transmitted, and are
+// the last to be dropped when the queue is pruned. Broadcasts that don't
+// implement this have a priority of 0.
+type PriorityBroadcast interface {
+	Broadcast
+	// Priority returns the priority of this broadcast. It must not change
+	// while the broadcast is queued.
+	Priority() int
+}
+
 // QueueBroadcast is used to enqueue a broadcast
 func (q *TransmitLimitedQueue) QueueBroadcast(b Broadcast) {
 	q.queueBroadcast(b, 0)
 }
 
+// QueueBroadcastGroup enqueues several broadcasts at once, so nothing else
+// can be queued in between them. The broadcasts are kept together as a
+// group: whenever one of them is picked for a packet, as many of the rest
+// as fit are sent in the same packet. Each broadcast still invalidates
+// earlier ones as usual, including others in the group.
+func (q *TransmitLimitedQueue) QueueBroadcastGroup(bs []Broadcast) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	group := &broadcastGroup{members: make([]*limitedBroadcast, 0, len(bs))}
+	for _, b := range bs {
+		lb := q.queueBroadcastLocked(b, 0)
+		lb.group = group
+		group.members = append(group.members, lb)
+	}
+}
+
 // lazyInit initializes internal data structures the first time they are
 // needed.  You must already hold the mutex.
 func (q *TransmitLimitedQueue) lazyInit() {
@@ -182,7 +232,12 @@ func (q *TransmitLimitedQueue) lazyInit() {
 func (q *TransmitLimitedQueue) queueBroadcast(b Broadcast, initialTransmits int) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
+	q.queueBroadcastLocked(b, initialTransmits)
+}
 
+// queueBroadcastLocked does the work of queueBroadcast, returning the new
+// queue entry. You must already hold the mutex.
+func (q *TransmitLimitedQueue) queueBroadcastLocked(b Broadcast, initialTransmits int) *limitedBroadcast {
 	q.lazyInit()
 
 	if q.idGen == math.MaxInt64 {
@@ -199,6 +254,9 @@ func (q *TransmitLimitedQueue) queueBroadcast(b Broadcast, initialTransmits int)
 		id:        id,
 		b:         b,
 	}
+	if pb, ok := b.(PriorityBroadcast); ok {
+		lb.priority = pb.Priority()
+	}
 	unique := false
 	if nb, ok := b.(NamedBroadcast); ok {
 		lb.name = nb.Name()
@@ -239,6 +297,7 @@ func (q *TransmitLimitedQueue) queueBroadcast(b Broadcast, initialTransmits int)
 
 	// Append to the relevant queue.
 	q.addItem(lb)
+	return lb
 }
 
 // deleteItem removes the given item from the overall datastructure. You
@@ -266,13 +325,23 @@ func (q *TransmitLimitedQueue) addItem(cur *limitedBroadcast) {
 }
 
 // getTransmitRange returns a pair of min/max values for transmit values
-// represented by the current queue contents. Both values represent actual
-// transmit values on the interval [0, len). You must already hold the mutex.
-func (q *TransmitLimitedQueue) getTransmitRange() (minTransmit, maxTransmit int) {
+// represented by the queue contents at the given priority. Both values
+// represent actual transmit values on the interval [0, len). You must already
+// hold the mutex.
+func (q *TransmitLimitedQueue) getTransmitRange(priority int) (minTransmit, maxTransmit int) {
 	if q.lenLocked() == 0 {
 		return 0, 0
 	}
-	minItem, maxItem := q.tq.Min(), q.tq.Max()
+
+	var minItem, maxItem btree.Item
+	q.tq.AscendGreaterOrEqual(priorityStart(priority), func(item btree.Item) bool {
+		minItem = item
+		return false
+	})
+	q.tq.DescendLessOrEqual(priorityEnd(priority), func(item btree.Item) bool {
+		maxItem = item
+		return false
+	})
 	if minItem == nil || maxItem == nil {
 		return 0, 0
 	}
@@ -283,9 +352,55 @@ func (q *TransmitLimitedQueue) getTransmitRange() (minTransmit, maxTransmit int)
 	return min, max
 }
 
+// priorityStart and priorityEnd return pivots that sort just before the first
+// item at the given priority and just after the last, since no item has
+// negative or maximal transmits.
+func priorityStart(priority int) *limitedBroadcast {
+	return &limitedBroadcast{priority: priority, transmits: -1}
+}
+
+func priorityEnd(priority int) *limitedBroadcast {
+	return &limitedBroadcast{
+		priority:  priority,
+		transmits: math.MaxInt32,
+		msgLen:    math.MinInt64,
+		id:        math.MinInt64,
+	}
+}
+
+// nextPriority returns the highest priority in the queue below the given
+// one, or false if there isn't one. You must already hold the mutex.
+func (q *TransmitLimitedQueue) nextPriority(priority int) (int, bool) {
+	var next *limitedBroadcast
+	q.tq.AscendGreaterOrEqual(priorityEnd(priority), func(item btree.Item) bool {
+		next = item.(*limitedBroadcast)
+		return false
+	})
+	if next == nil {
+		return 0, false
+	}
+	return next.priority, true
+}
+
 // GetBroadcasts is used to get a number of broadcasts, up to a byte limit
 // and applying a per-message overhead as provided.
 func (q *TransmitLimitedQueue) GetBroadcasts(overhead, limit int) [][]byte {
+	return q.getBroadcastsFiltered(overhead, limit, nil)
+}
+
+// getBroadcastsFiltered is like GetBroadcasts, but only considers broadcasts
+// that accept returns true for, if it's given. Broadcasts that are skipped
+// keep their place in the queue and aren't counted as transmitted.
+func (q *TransmitLimitedQueue) getBroadcastsFiltered(overhead, limit int, accept func(Broadcast) bool) [][]byte {
+	// Tell about retired broadcasts only after the lock is released, so the
+	// callback is free to take other locks.
+	var retired []Broadcast
+	defer func() {
+		for _, b := range retired {
+			q.Retired(b)
+		}
+	}()
+
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
@@ -302,66 +417,102 @@ func (q *TransmitLimitedQueue) GetBroadcasts(overhead, limit int) [][]byte {
 		reinsert  []*limitedBroadcast
 	)
 
-	// Visit fresher items first, but only look at stuff that will fit.
-	// We'll go tier by tier, grabbing the largest items first.
-	minTr, maxTr := q.getTransmitRange()
-	for transmits := minTr; transmits <= maxTr; /*do not advance automatically*/ {
-		free := int64(limit - bytesUsed - overhead)
-		if free <= 0 {
-			break // bail out early
-		}
-
-		// Search for the least element on a given tier (by transmit count) as
-		// defined in the limitedBroadcast.Less function that will fit into our
-		// remaining space.
-		greaterOrEqual := &limitedBroadcast{
-			transmits: transmits,
-			msgLen:    free,
-			id:        math.MaxInt64,
-		}
-		lessThan := &limitedBroadcast{
-			transmits: transmits + 1,
-			msgLen:    math.MaxInt64,
-			id:        math.MaxInt64,
-		}
-		var keep *limitedBroadcast
-		q.tq.AscendRange(greaterOrEqual, lessThan, func(item btree.Item) bool {
-			cur := item.(*limitedBroadcast)
-			// Check if this is within our limits
-			if int64(len(cur.b.Message())) > free {
-				// If this happens it's a bug in the datastructure or
-				// surrounding use doing something like having len(Message())
-				// change over time. There's enough going on here that it's
-				// probably sane to just skip it and move on for now.
-				return true
-			}
-			keep = cur
-			return false
-		})
-		if keep == nil {
-			// No more items of an appropriate size in the tier.
-			transmits++
-			continue
-		}
-
-		msg := keep.b.Message()
+	take := func(cur *limitedBroadcast) {
+		msg := cur.b.Message()
 
 		// Add to slice to send
 		bytesUsed += overhead + len(msg)
 		toSend = append(toSend, msg)
 
 		// Check if we should stop transmission
-		q.deleteItem(keep)
-		if keep.transmits+1 >= transmitLimit {
-			keep.b.Finished()
+		q.deleteItem(cur)
+		if cur.transmits+1 >= transmitLimit {
+			cur.b.Finished()
+			if q.Retired != nil {
+				retired = append(retired, cur.b)
+			}
 		} else {
 			// We need to bump this item down to another transmit tier, but
 			// because it would be in the same direction that we're walking the
 			// tiers, we will have to delay the reinsertion until we are
 			// finished our search. Otherwise we'll possibly re-add the message
 			// when we ascend to the next tier.
-			keep.transmits++
-			reinsert = append(reinsert, keep)
+			cur.transmits++
+			reinsert = append(reinsert, cur)
+		}
+	}
+
+	// Visit higher priority items first, then fresher items, but only look
+	// at stuff that will fit. We'll go tier by tier, grabbing the largest
+	// items first.
+	priority, ok := q.tq.Min().(*limitedBroadcast).priority, true
+PRIORITIES:
+	for ; ok; priority, ok = q.nextPriority(priority) {
+		minTr, maxTr := q.getTransmitRange(priority)
+		for transmits := minTr; transmits <= maxTr; /*do not advance automatically*/ {
+			free := int64(limit - bytesUsed - overhead)
+			if free <= 0 {
+				break PRIORITIES // bail out early
+			}
+
+			// Search for the least element on a given tier (by transmit count) as
+			// defined in the limitedBroadcast.Less function that will fit into our
+			// remaining space.
+			greaterOrEqual := &limitedBroadcast{
+				priority:  priority,
+				transmits: transmits,
+				msgLen:    free,
+				id:        math.MaxInt64,
+			}
+			lessThan := &limitedBroadcast{
+				priority:  priority,
+				transmits: transmits + 1,
+				msgLen:    math.MaxInt64,
+				id:        math.MaxInt64,
+			}
+			var keep *limitedBroadcast
+			q.tq.AscendRange(greaterOrEqual, lessThan, func(item btree.Item) bool {
+				cur := item.(*limitedBroadcast)
+				// Check if this is within our limits
+				if int64(len(cur.b.Message())) > free {
+					// If this happens it's a bug in the datastructure or
+					// surrounding use doing something like having len(Message())
+					// change over time. There's enough going on here that it's
+					// probably sane to just skip it and move on for now.
+					return true
+				}
+				if accept != nil && !accept(cur.b) {
+					return true
+				}
+				keep = cur
+				return false
+			})
+			if keep == nil {
+				// No more items of an appropriate size in the tier.
+				transmits++
+				continue
+			}
+
+			take(keep)
+
+			// Bring along the rest of its group, if it has one. Members that
+			// were invalidated, retired or already taken are no longer in the
+			// tree.
+			if keep.group == nil {
+				continue
+			}
+			for _, cur := range keep.group.members {
+				if cur == keep || q.tq.Get(cur) != btree.Item(cur) {
+					continue
+				}
+				if int64(overhead+len(cur.b.Message())) > int64(limit-bytesUsed) {
+					continue
+				}
+				if accept != nil && !accept(cur.b) {
+					continue
+				}
+				take(cur)
+			}
 		}
 	}
 
@@ -379,6 +530,18 @@ func (q *TransmitLimitedQueue) NumQueued() int {
 	return q.lenLocked()
 }
 
+// transmitsFor returns the number of times the named broadcast has been
+// transmitted, or false if there's no broadcast with that name queued.
+func (q *TransmitLimitedQueue) transmitsFor(name string) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lb, ok := q.tm[name]
+	if !ok {
+		return 0, false
+	}
+	return lb.transmits, true
+}
+
 // lenLocked returns the length of the overall queue datastructure. You must
 // hold the mutex.
 func (q *TransmitLimitedQueue) lenLocked() int {
@@ -403,8 +566,27 @@ func (q *TransmitLimitedQueue) Reset() {
 	q.idGen = 0
 }
 
+// dropFiltered discards any queued broadcasts that drop returns true for.
+func (q *TransmitLimitedQueue) dropFiltered(drop func(Broadcast) bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var dropped []*limitedBroadcast
+	q.walkReadOnlyLocked(false, func(cur *limitedBroadcast) bool {
+		if drop(cur.b) {
+			dropped = append(dropped, cur)
+		}
+		return true
+	})
+	for _, cur := range dropped {
+		cur.b.Finished()
+		q.deleteItem(cur)
+	}
+}
+
 // Prune will retain the maxRetain latest messages, and the rest
-// will be discarded. This can be used to prevent unbounded queue sizes
+// will be discarded. This can be used to prevent unbounded queue sizes.
+// Lower priority messages are discarded first.
 func (q *TransmitLimitedQueue) Prune(maxRetain int) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -226,3 +226,77 @@ func TestTransmitLimited_ordering(t *testing.T) {
 		t.Fatalf("bad val %v, %d", dump[4].b.(*memberlistBroadcast).node, dump[4].transmits)
 	}
 }
+
+func TestTransmitLimited_Retired(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 1, NumNodes: func() int { return 10 }}
+
+	var retired []string
+	q.Retired = func(b Broadcast) {
+		retired = append(retired, b.(NamedBroadcast).Name())
+	}
+
+	q.QueueBroadcast(&memberlistBroadcast{"test", []byte("1. this is a test."), nil})
+	q.QueueBroadcast(&memberlistBroadcast{"foo", []byte("2. this is a test."), nil})
+
+	// Invalidated broadcasts are not retired.
+	q.QueueBroadcast(&memberlistBroadcast{"foo", []byte("3. this is a test."), nil})
+	require.Empty(t, retired)
+
+	q.GetBroadcasts(3, 80)
+	require.Empty(t, retired)
+
+	q.GetBroadcasts(3, 80)
+	require.ElementsMatch(t, []string{"test", "foo"}, retired)
+	require.Equal(t, 0, q.NumQueued())
+}
+
+func TestTransmitLimited_QueueBroadcastGroup(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 1, NumNodes: func() int { return 10 }}
+
+	q.QueueBroadcastGroup([]Broadcast{
+		&memberlistBroadcast{"a", []byte("aaaaaaaaaaaaaaaaaaaa"), nil},
+		&memberlistBroadcast{"b", []byte("bbbbb"), nil},
+	})
+	require.Equal(t, 2, q.NumQueued())
+
+	// Newer messages normally win among those the same size, but the rest
+	// of a's group goes along with it.
+	q.QueueBroadcast(&memberlistBroadcast{"c", []byte("ccccc"), nil})
+	out := q.GetBroadcasts(0, 25)
+	require.Equal(t, []string{"'aaaaaaaaaaaaaaaaaaaa'", "'bbbbb'"}, prettyPrintMessages(out))
+
+	// Invalidated members are dropped from the group.
+	q.Reset()
+	q.QueueBroadcastGroup([]Broadcast{
+		&memberlistBroadcast{"a", []byte("aaaaaaaaaaaaaaaaaaaa"), nil},
+		&memberlistBroadcast{"b", []byte("bbbbb"), nil},
+	})
+	q.QueueBroadcast(&memberlistBroadcast{"b", []byte("BBBBBBBBBB"), nil})
+	out = q.GetBroadcasts(0, 25)
+	require.Equal(t, []string{"'aaaaaaaaaaaaaaaaaaaa'"}, prettyPrintMessages(out))
+}
+
+func TestTransmitLimited_Priority(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 3, NumNodes: func() int { return 10 }}
+
+	// Even after going out a couple of times, the dead message is sent
+	// ahead of fresher and bigger alive messages.
+	q.queueBroadcast(&queuedBroadcast{memberlistBroadcast: &memberlistBroadcast{"dead", []byte("dead"), nil}, priority: 1}, 2)
+	q.QueueBroadcast(&memberlistBroadcast{"alive1", []byte("alive-1"), nil})
+	q.QueueBroadcast(&memberlistBroadcast{"alive2", []byte("alive-22"), nil})
+	q.QueueBroadcast(&queuedBroadcast{memberlistBroadcast: &memberlistBroadcast{"low", []byte("low"), nil}, priority: -1})
+
+	out := q.GetBroadcasts(0, 12)
+	require.Equal(t, []string{"'dead'", "'alive-22'"}, prettyPrintMessages(out))
+
+	out = q.GetBroadcasts(0, 100)
+	require.Equal(t, []string{"'dead'", "'alive-1'", "'alive-22'", "'low'"}, prettyPrintMessages(out))
+
+	// Pruning drops the lowest priority first.
+	q.Prune(2)
+	var names []string
+	for _, lb := range q.orderedView(false) {
+		names = append(names, lb.name)
+	}
+	require.Equal(t, []string{"dead", "alive1"}, names)
+}
@@ -2,11 +2,13 @@ package memberlist
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math"
 	"math/rand"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -35,6 +37,7 @@ type Node struct {
 	DMin  uint8         // Min protocol version for the delegate to understand
 	DMax  uint8         // Max protocol version for the delegate to understand
 	DCur  uint8         // Current version delegate is speaking
+	Ready bool          // False if the node asked not to be given new work, see SetReady
 }
 
 // Address returns the host:port form of a node's address, suitable for use
@@ -57,6 +60,15 @@ func (n *Node) String() string {
 	return n.Name
 }
 
+// copy returns a deep copy of the node, which callers can keep or modify
+// without touching our state.
+func (n *Node) copy() *Node {
+	c := *n
+	c.Addr = append(net.IP(nil), n.Addr...)
+	c.Meta = append([]byte(nil), n.Meta...)
+	return &c
+}
+
 // NodeState is used to manage our state view of another node
 // NodeState 用于保存当前节点对集群中其它节点的一个视图数据
 type nodeState struct {
@@ -64,6 +76,17 @@ type nodeState struct {
 	Incarnation uint32        // Last known incarnation number
 	State       NodeStateType // Current state
 	StateChange time.Time     // Time last state change happened
+	Recovering  bool          // Alive again after being suspect, see RecoveryHysteresis
+
+	// lastContact is when we last heard from the node directly, either an
+	// ack to one of our probes or a push/pull. Unlike StateChange this moves
+	// on every successful probe.
+	lastContact time.Time
+
+	// rtt is a moving average of the round-trip time of our direct pings
+	// to the node, if hasRTT is set. See MembersByRTT.
+	rtt    time.Duration
+	hasRTT bool
 }
 
 // Address returns the host:port form of a node's address, suitable for use
@@ -82,21 +105,159 @@ func (n *nodeState) DeadOrLeft() bool {
 	return n.State == StateDead || n.State == StateLeft
 }
 
+// isRecovering returns true if the node came back from being suspect less
+// than RecoveryHysteresis ago. The caller must hold the node lock.
+func (m *Memberlist) isRecovering(n *nodeState) bool {
+	return n.Recovering && n.State == StateAlive &&
+		m.clock().Now().Sub(n.StateChange) < m.config.RecoveryHysteresis
+}
+
+// metricName returns the name used for a node state in metrics.
+func (t NodeStateType) metricName() string {
+	switch t {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	case StateLeft:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// recordTransition counts a change in our local view of a node's state,
+// such as memberlist.transition.suspect_to_alive. Unlike the per-message
+// counters, these only fire when the state actually changes, so a high
+// rate of suspect_to_alive points to flapping or false positives, while
+// suspect_to_dead points to real failures.
+func recordTransition(from, to NodeStateType) {
+	metrics.IncrCounter([]string{"memberlist", "transition", from.metricName() + "_to_" + to.metricName()}, 1)
+}
+
 // ackHandler is used to register handlers for incoming acks and nacks.
 type ackHandler struct {
 	ackFn  func([]byte, time.Time)
 	nackFn func()
-	timer  *time.Timer
+	timer  Timer
+	node   string // node being probed, if any, for lastContact
 }
 
+// PingPhase says how far a ping got before it failed.
+type PingPhase int
+
+const (
+	// PingTimeout means the ping was sent but no ack came back in time.
+	PingTimeout PingPhase = iota
+
+	// PingSendFailed means the ping couldn't be sent at all.
+	PingSendFailed
+)
+
 // NoPingResponseError is used to indicate a 'ping' packet was
-// successfully issued but no response was received
+// successfully issued but no response was received, or that it
+// couldn't be sent, as given by Phase.
 type NoPingResponseError struct {
 	node string
+
+	// Addr is the address the ping was sent to.
+	Addr string
+
+	// Duration is how long we waited for an ack.
+	Duration time.Duration
+
+	// Phase is how far the ping got.
+	Phase PingPhase
+
+	// Err is the reason the send failed, for PingSendFailed.
+	Err error
 }
 
 func (f NoPingResponseError) Error() string {
-	return fmt.Sprintf("No response from node %s", f.node)
+	if f.Phase == PingSendFailed {
+		return fmt.Sprintf("Failed to send ping to node %s at %s: %v", f.node, f.Addr, f.Err)
+	}
+	return fmt.Sprintf("No response from node %s at %s after %v", f.node, f.Addr, f.Duration)
+}
+
+func (f NoPingResponseError) Unwrap() error {
+	return f.Err
+}
+
+// DialError is used to indicate that a stream connection to a remote node
+// could not be established, such as during a push/pull. These failures are
+// usually transient, so it is reasonable to retry the operation, possibly
+// against a different node.
+type DialError struct {
+	Addr Address
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// ProtocolMismatchError is used to indicate that a push/pull was rejected
+// because the remote cluster and the local node can't agree on a protocol
+// version. Retrying won't help until one side is upgraded.
+type ProtocolMismatchError struct {
+	Err error
+
+	// Node is the first node found speaking an incompatible version, and
+	// Delegate is true if it's the delegate protocol rather than the core
+	// memberlist protocol that doesn't match.
+	Node     string
+	Delegate bool
+
+	// Version is the version Node is speaking, and Min and Max are the
+	// range of versions every alive node on both sides understands.
+	Version uint8
+	Min     uint8
+	Max     uint8
+}
+
+func newProtocolMismatchError(node string, delegate bool, version, min, max uint8) *ProtocolMismatchError {
+	kind := "protocol"
+	if delegate {
+		kind = "delegate protocol"
+	}
+	return &ProtocolMismatchError{
+		Err: fmt.Errorf("Node '%s' %s version (%d) is incompatible: [%d, %d]",
+			node, kind, version, min, max),
+		Node:     node,
+		Delegate: delegate,
+		Version:  version,
+		Min:      min,
+		Max:      max,
+	}
+}
+
+func (e *ProtocolMismatchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProtocolMismatchError) Unwrap() error {
+	return e.Err
+}
+
+// MergeRejectedError is used to indicate that the configured MergeDelegate
+// canceled a merge with a remote cluster.
+type MergeRejectedError struct {
+	Err error
+}
+
+func (e *MergeRejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MergeRejectedError) Unwrap() error {
+	return e.Err
 }
 
 // Schedule is used to ensure the Tick is performed periodically. This
@@ -117,6 +278,11 @@ func (m *Memberlist) schedule() {
 		return
 	}
 
+	// Rounds are driven by hand, see Config.ManualTick.
+	if m.config.ManualTick {
+		return
+	}
+
 	// Create the stop tick channel, a blocking channel. We close this
 	// when we should stop the tickers.
 	// 创建定时任务取消通道
@@ -124,9 +290,9 @@ func (m *Memberlist) schedule() {
 
 	// Create a new probeTicker
 	// 创建定时探测任务，执行故障检测的过程
-	if m.config.ProbeInterval > 0 {
-		t := time.NewTicker(m.config.ProbeInterval)
-		go m.triggerFunc(m.config.ProbeInterval, t.C, stopCh, m.probe)
+	if m.config.ProbeInterval > 0 && !m.config.Observer {
+		t := m.clock().NewTicker(m.config.ProbeInterval)
+		go m.triggerFunc(m.config.ProbeInterval, t.C(), stopCh, m.probe)
 		m.tickers = append(m.tickers, t)
 	}
 
@@ -136,11 +302,18 @@ func (m *Memberlist) schedule() {
 		go m.pushPullTrigger(stopCh)
 	}
 
+	// Create an advertise address refresh ticker if needed
+	if m.config.AdvertiseRefreshInterval > 0 {
+		t := m.clock().NewTicker(m.config.AdvertiseRefreshInterval)
+		go m.triggerFunc(m.config.AdvertiseRefreshInterval, t.C(), stopCh, m.checkAdvertise)
+		m.tickers = append(m.tickers, t)
+	}
+
 	// Create a gossip ticker if needed
 	// 创建定时基于 gossip 传播方式的消息传播任务，执行基于 gossip 传播的消息广播过程
 	if m.config.GossipInterval > 0 && m.config.GossipNodes > 0 {
-		t := time.NewTicker(m.config.GossipInterval)
-		go m.triggerFunc(m.config.GossipInterval, t.C, stopCh, m.gossip)
+		t := m.clock().NewTicker(m.config.GossipInterval)
+		go m.triggerFunc(m.config.GossipInterval, t.C(), stopCh, m.gossip)
 		m.tickers = append(m.tickers, t)
 	}
 
@@ -158,7 +331,7 @@ func (m *Memberlist) triggerFunc(stagger time.Duration, C <-chan time.Time, stop
 	// Use a random stagger to avoid syncronizing
 	randStagger := time.Duration(uint64(rand.Int63()) % uint64(stagger))
 	select {
-	case <-time.After(randStagger):
+	case <-m.clock().NewTimer(randStagger).C():
 	case <-stop:
 		return
 	}
@@ -184,7 +357,7 @@ func (m *Memberlist) pushPullTrigger(stop <-chan struct{}) {
 	// Use a random stagger to avoid syncronizing
 	randStagger := time.Duration(uint64(rand.Int63()) % uint64(interval))
 	select {
-	case <-time.After(randStagger):
+	case <-m.clock().NewTimer(randStagger).C():
 	case <-stop:
 		return
 	}
@@ -193,9 +366,9 @@ func (m *Memberlist) pushPullTrigger(stop <-chan struct{}) {
 	for {
 		// 基于集群规模，动态计算超时时间
 		// 一种直观的解释是，当集群成员数目增多时，我们需要扩大同步周期，以避免整个集群网络中充斥着大量的消息。
-		tickTime := pushPullScale(interval, m.estNumNodes())
+		tickTime := m.CurrentPushPullInterval()
 		select {
-		case <-time.After(tickTime):
+		case <-m.clock().NewTimer(tickTime).C():
 			m.pushPull()
 		case <-stop:
 			return
@@ -225,9 +398,100 @@ func (m *Memberlist) deschedule() {
 	m.tickers = nil
 }
 
+// TickProbe runs a single round of failure detection, as the probe ticker
+// would. It's meant for use with Config.ManualTick, and does nothing without
+// it, since it would race with the probe ticker. Observers don't probe, so
+// this does nothing for them either.
+func (m *Memberlist) TickProbe() {
+	if !m.config.ManualTick || m.config.Observer {
+		return
+	}
+	m.probe()
+}
+
+// TickGossip runs a single round of gossip, as the gossip ticker would. It's
+// meant for use with Config.ManualTick, and does nothing without it.
+func (m *Memberlist) TickGossip() {
+	if !m.config.ManualTick {
+		return
+	}
+	m.gossip()
+}
+
+// TickPushPull runs a single push/pull with a random node, as the push/pull
+// ticker would. It's meant for use with Config.ManualTick, and does nothing
+// without it.
+func (m *Memberlist) TickPushPull() {
+	if !m.config.ManualTick {
+		return
+	}
+	m.pushPull()
+}
+
+// TickAdvertise checks our advertise address for changes, as the ticker for
+// Config.AdvertiseRefreshInterval would. It's meant for use with
+// Config.ManualTick, and does nothing without it.
+func (m *Memberlist) TickAdvertise() {
+	if !m.config.ManualTick {
+		return
+	}
+	m.checkAdvertise()
+}
+
 // Tick is used to perform a single round of failure detection and gossip
 // 节点故障检测和探测结果的 gossip 传播
 func (m *Memberlist) probe() {
+	metrics.SetGauge([]string{"memberlist", "ack_handlers", "pending"}, float32(m.PendingAcks()))
+	m.publishHealthScore()
+
+	// Fast path the default case of a single probe per tick, which we run
+	// inline.
+	probesPerTick := m.config.ProbesPerTick
+	if probesPerTick <= 1 {
+		if node, ok := m.nextProbeNode(nil); ok {
+			// Probe the specific node
+			// 真正执行探测指定节点的过程
+			m.probeNode(&node)
+		}
+		return
+	}
+
+	// Otherwise pick up to probesPerTick distinct nodes and probe them in
+	// parallel. We wait for all of them to finish before returning, which
+	// bounds the number of probe goroutines since the ticker that calls us
+	// will skip any ticks we miss.
+	selected := make(map[string]struct{}, probesPerTick)
+	var wg sync.WaitGroup
+	for i := 0; i < probesPerTick; i++ {
+		node, ok := m.nextProbeNode(selected)
+		if !ok {
+			break
+		}
+		selected[node.Name] = struct{}{}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.probeNode(&node)
+		}()
+	}
+	wg.Wait()
+}
+
+// nextProbeNode advances the probe index to the next node that should be
+// probed, skipping ourselves, dead or left nodes, and any nodes in the
+// exclude set. It returns false if there are no nodes eligible for probing.
+func (m *Memberlist) nextProbeNode(exclude map[string]struct{}) (nodeState, bool) {
+	// Alternate between the stalest nodes and the round robin.
+	if m.config.StalenessWeightedProbing {
+		m.probeStale = !m.probeStale
+		if m.probeStale {
+			if node, ok := m.staleProbeNode(exclude); ok {
+				return node, true
+			}
+		}
+	}
+
 	// Track the number of indexes we've considered probing
 	// numCheck 存储了本次探测尝试的次数，考虑到某些情况下被随机选中的探测节点不会被执行探测过程，因此需要重新选择
 	numCheck := 0
@@ -238,7 +502,7 @@ START:
 	// 若执行探测的尝试次数达到了节点数目，则直接退出，以保证我们不会无限的探测下去。
 	if numCheck >= len(m.nodes) {
 		m.nodeLock.RUnlock()
-		return
+		return nodeState{}, false
 	}
 
 	// Handle the wrap around case
@@ -252,16 +516,9 @@ START:
 	}
 
 	// Determine if we should probe this node
-	skip := false
-	var node nodeState
-
 	// 跳过自身节点的探测、dead 节点和 left 节点的探测
-	node = *m.nodes[m.probeIndex]
-	if node.Name == m.config.Name {
-		skip = true
-	} else if node.DeadOrLeft() {
-		skip = true
-	}
+	node := *m.nodes[m.probeIndex]
+	skip := !m.probeEligible(&node, exclude)
 
 	// Potentially skip
 	m.nodeLock.RUnlock()
@@ -270,10 +527,63 @@ START:
 		numCheck++
 		goto START
 	}
+	return node, true
+}
+
+// probeEligible returns true if the node may be probed: it isn't us, it's
+// not dead or left, it isn't in the exclude set, and SkipProbeForNode
+// doesn't rule it out. The caller must hold the node lock.
+func (m *Memberlist) probeEligible(node *nodeState, exclude map[string]struct{}) bool {
+	if node.Name == m.localName() || node.DeadOrLeft() {
+		return false
+	}
+	if _, ok := exclude[node.Name]; ok {
+		return false
+	}
+	if m.config.SkipProbeForNode != nil && m.config.SkipProbeForNode(&node.Node) {
+		return false
+	}
+	return true
+}
+
+// staleProbeNode picks a node to probe at random, weighted by how long it's
+// been since we last heard from it directly, or since it changed state if
+// we never have. It returns false if there are no nodes eligible for
+// probing. See Config.StalenessWeightedProbing.
+func (m *Memberlist) staleProbeNode(exclude map[string]struct{}) (nodeState, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	now := m.clock().Now()
+	var total int64
+	weights := make([]int64, len(m.nodes))
+	for i, n := range m.nodes {
+		if !m.probeEligible(n, exclude) {
+			continue
+		}
+		since := n.lastContact
+		if since.IsZero() {
+			since = n.StateChange
+		}
+		// Everyone gets a chance, even if we just heard from them.
+		weights[i] = int64(now.Sub(since)/time.Millisecond) + 1
+		if weights[i] < 1 {
+			weights[i] = 1
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return nodeState{}, false
+	}
 
-	// Probe the specific node
-	// 真正执行探测指定节点的过程
-	m.probeNode(&node)
+	pick := rand.Int63n(total)
+	for i, w := range weights {
+		if pick < w {
+			return *m.nodes[i], true
+		}
+		pick -= w
+	}
+	return nodeState{}, false
 }
 
 // probeNodeByAddr just safely calls probeNode given only the address of the node (for tests)
@@ -303,7 +613,15 @@ func failedRemote(err error) bool {
 // probeNode handles a single round of failure checking on a node.
 // probeNode 对指定节点执行故障探测的过程
 func (m *Memberlist) probeNode(node *nodeState) {
-	defer metrics.MeasureSince([]string{"memberlist", "probeNode"}, time.Now())
+	m.runProbe(context.Background(), node, true)
+}
+
+// runProbe performs a probe of the given node, returning whether it could
+// be reached and the measured RTT. If failureDetect is set, the outcome
+// feeds into our health awareness, and the node is suspected if it can't be
+// reached. The probe is abandoned if the context is canceled.
+func (m *Memberlist) runProbe(ctx context.Context, node *nodeState, failureDetect bool) (bool, time.Duration, error) {
+	defer metrics.MeasureSinceWithLabels([]string{"memberlist", "probeNode"}, time.Now(), m.nodeLabels(node.Name))
 
 	// We use our health awareness to scale the overall probe interval, so we
 	// slow down if we detect problems. The ticker that calls us can handle
@@ -311,7 +629,8 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	// 探测超时时间是动态设置的，同节点的 local health 成正相关，
 	// 一个直观的解释是，节点的 local health 值越高，其越可能处于高负载状态，
 	// 因此，为了顺利接收到其他成员反馈给他的消息，他需要给与目标成员更多的响应时间。
-	probeInterval := m.awareness.ScaleTimeout(m.config.ProbeInterval)
+	probeInterval := m.EffectiveProbeInterval()
+	metrics.SetGauge([]string{"memberlist", "probe", "interval"}, float32(probeInterval.Milliseconds()))
 	if probeInterval > m.config.ProbeInterval {
 		metrics.IncrCounter([]string{"memberlist", "degraded", "probe"}, 1)
 	}
@@ -324,11 +643,11 @@ func (m *Memberlist) probeNode(node *nodeState) {
 		Node:       node.Name,
 		SourceAddr: selfAddr,
 		SourcePort: selfPort,
-		SourceNode: m.config.Name,
+		SourceNode: m.localName(),
 	}
 	ackCh := make(chan ackMessage, m.config.IndirectChecks+1)
-	nackCh := make(chan struct{}, m.config.IndirectChecks+1)
-	m.setProbeChannels(ping.SeqNo, ackCh, nackCh, probeInterval)
+	nackCh := make(chan struct{}, m.config.IndirectChecks*(m.config.IndirectRetries+1)+1)
+	m.setProbeChannels(ping.SeqNo, node.Name, ackCh, nackCh, probeInterval)
 
 	// Mark the sent time here, which should be after any pre-processing but
 	// before system calls to do the actual send. This probably over-reports
@@ -347,8 +666,57 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	// Arrange for our self-awareness to get updated.
 	var awarenessDelta int
 	defer func() {
-		m.awareness.ApplyDelta(awarenessDelta)
+		if failureDetect {
+			m.awareness.ApplyDelta(awarenessDelta)
+		}
 	}()
+	// Some nodes are better probed over TCP from the start.
+	preferTCP := m.config.PreferTCPForNode != nil && node.PMax >= 3 && m.config.PreferTCPForNode(&node.Node)
+	if preferTCP {
+		// A suspect node needs to hear about it to refute, as it would on
+		// the UDP path below. Streams only carry the ping, so the suspect
+		// message goes over UDP alongside it, as best effort.
+		if node.State != StateAlive {
+			s := suspect{Incarnation: node.Incarnation, Node: node.Name, From: m.localName()}
+			if err := m.encodeAndSendMsg(node.FullAddress(), suspectMsg, &s); err != nil {
+				m.logger.Printf("[DEBUG] memberlist: Failed to send suspect message to %s: %s", addr, err)
+			}
+		}
+
+		// Wait for the ping in the background, so a canceled probe
+		// doesn't have to wait for it.
+		var didContact bool
+		var err error
+		doneCh := make(chan struct{})
+		go func() {
+			defer close(doneCh)
+			didContact, err = m.sendPingAndWaitForAck(node.FullAddress(), ping, sent.Add(m.config.ProbeTimeout))
+		}()
+		select {
+		case <-doneCh:
+		case <-ctx.Done():
+			return false, 0, ctx.Err()
+		}
+		if err == nil && didContact {
+			awarenessDelta = -1
+			rtt := m.measureRTT(time.Since(sent))
+			m.recordRTT(node.Name, rtt)
+			if m.config.Ping != nil {
+				m.config.Ping.NotifyPingComplete(&node.Node, rtt, nil)
+			}
+			return true, rtt, nil
+		}
+		if err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed TCP ping: %s", err)
+		} else {
+			m.logger.Printf("[DEBUG] memberlist: Failed TCP ping: %s (timeout reached)", node.Name)
+		}
+		if ctx.Err() != nil {
+			return false, 0, ctx.Err()
+		}
+		goto HANDLE_REMOTE_FAILURE
+	}
+
 	// 若节点处于 Alive 状态，则向其发送一个 ping 消息，且此基于 udp 的 pingMsg 会通过 piggyback 操作发送出去。
 	if node.State == StateAlive {
 		if err := m.encodeAndSendMsg(node.FullAddress(), pingMsg, &ping); err != nil {
@@ -356,7 +724,7 @@ func (m *Memberlist) probeNode(node *nodeState) {
 			if failedRemote(err) {
 				goto HANDLE_REMOTE_FAILURE
 			} else {
-				return
+				return false, 0, err
 			}
 		}
 	} else {
@@ -366,14 +734,14 @@ func (m *Memberlist) probeNode(node *nodeState) {
 		var msgs [][]byte
 		if buf, err := encode(pingMsg, &ping); err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to encode ping message: %s", err)
-			return
+			return false, 0, err
 		} else {
 			msgs = append(msgs, buf.Bytes())
 		}
-		s := suspect{Incarnation: node.Incarnation, Node: node.Name, From: m.config.Name}
+		s := suspect{Incarnation: node.Incarnation, Node: node.Name, From: m.localName()}
 		if buf, err := encode(suspectMsg, &s); err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to encode suspect message: %s", err)
-			return
+			return false, 0, err
 		} else {
 			msgs = append(msgs, buf.Bytes())
 		}
@@ -384,7 +752,7 @@ func (m *Memberlist) probeNode(node *nodeState) {
 			if failedRemote(err) {
 				goto HANDLE_REMOTE_FAILURE
 			} else {
-				return
+				return false, 0, err
 			}
 		}
 	}
@@ -405,20 +773,26 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	select {
 	case v := <-ackCh:
 		if v.Complete == true {
+			rtt := m.measureRTT(v.Timestamp.Sub(sent))
+			m.recordRTT(node.Name, rtt)
 			if m.config.Ping != nil {
-				rtt := v.Timestamp.Sub(sent)
 				m.config.Ping.NotifyPingComplete(&node.Node, rtt, v.Payload)
 			}
-			return
+			return true, rtt, nil
 		}
 
 		// As an edge case, if we get a timeout, we need to re-enqueue it
-		// here to break out of the select below.
+		// here to break out of the select below. The handler has been
+		// reaped by now, so nothing else can be sent on this probe's
+		// channel, but we never block here in any case.
 		// 尽管节点响应超时，仍然需要将该消息入队，不然后续取不出来。
 		if v.Complete == false {
-			ackCh <- v
+			select {
+			case ackCh <- v:
+			default:
+			}
 		}
-	case <-time.After(m.config.ProbeTimeout):
+	case <-m.clock().NewTimer(m.config.ProbeTimeout).C():
 		// Note that we don't scale this timeout based on awareness and
 		// the health score. That's because we don't really expect waiting
 		// longer to help get UDP through. Since health does extend the
@@ -431,24 +805,18 @@ func (m *Memberlist) probeNode(node *nodeState) {
 		// 基于节点的健康度可以增加更大的超时时限，这能更好的处理由于网络波动而丢包的情况，
 		// 同时也给予我们更多的时间来等待目标节点的 ack 或者 nack 消息。
 		m.logger.Printf("[DEBUG] memberlist: Failed ping: %s (timeout reached)", node.Name)
+	case <-ctx.Done():
+		return false, 0, ctx.Err()
 	}
 
 HANDLE_REMOTE_FAILURE:
 	// 或是探测失败是由远程目标节点导致的，则开始执行间接探测流程。
 	// 首先从本地集群成员视图中选择 k 个成员，要求被选中的成员不能是自身，且必须处于 alive 状态。
-	// Get some random live nodes.
-	m.nodeLock.RLock()
-	kNodes := kRandomNodes(m.config.IndirectChecks, m.nodes, func(n *nodeState) bool {
-		return n.Name == m.config.Name ||
-			n.Name == node.Name ||
-			n.State != StateAlive
-	})
-	m.nodeLock.RUnlock()
-
 	// Attempt an indirect ping.
 	// 尝试执行一个间接探测，即向他们发送基于 udp 的 indirectPing 消息。
 	expectedNacks := 0
 	selfAddr, selfPort = m.getAdvertise()
+	ttl := m.indirectPingTTL()
 	ind := indirectPingReq{
 		SeqNo:      ping.SeqNo,
 		Target:     node.Addr,
@@ -456,19 +824,49 @@ HANDLE_REMOTE_FAILURE:
 		Node:       node.Name,
 		SourceAddr: selfAddr,
 		SourcePort: selfPort,
-		SourceNode: m.config.Name,
+		SourceNode: m.localName(),
 	}
-	for _, peer := range kNodes {
-		// We only expect nack to be sent from peers who understand
-		// version 4 of the protocol.
-		if ind.Nack = peer.PMax >= 4; ind.Nack {
-			expectedNacks++
+	asked := make(map[string]struct{})
+	sendIndirect := func() {
+		// With no indirect checks, we rely on the TCP fallback alone.
+		if m.config.IndirectChecks <= 0 {
+			return
 		}
 
-		if err := m.encodeAndSendMsg(peer.FullAddress(), indirectPingMsg, &ind); err != nil {
-			m.logger.Printf("[ERR] memberlist: Failed to send indirect ping: %s", err)
+		// Get some random live nodes, leaving out any we've already asked.
+		m.nodeLock.RLock()
+		kNodes := kRandomNodes(m.config.IndirectChecks, m.nodes, func(n *nodeState) bool {
+			_, ok := asked[n.Name]
+			return ok ||
+				n.Name == m.localName() ||
+				n.Name == node.Name ||
+				n.State != StateAlive
+		})
+		m.nodeLock.RUnlock()
+
+		for _, peer := range kNodes {
+			asked[peer.Name] = struct{}{}
+
+			// We only expect nack to be sent from peers who understand
+			// version 4 of the protocol.
+			if ind.Nack = peer.PMax >= 4; ind.Nack {
+				expectedNacks++
+			}
+
+			// Likewise, only peers who understand version 6 of the
+			// protocol know about the TTL.
+			if peer.PMax >= 6 {
+				ind.TTL = &ttl
+			} else {
+				ind.TTL = nil
+			}
+
+			if err := m.encodeAndSendMsg(peer.FullAddress(), indirectPingMsg, &ind); err != nil {
+				m.logger.Printf("[ERR] memberlist: Failed to send indirect ping: %s", err)
+			}
 		}
 	}
+	sendIndirect()
 
 	// Also make an attempt to contact the node directly over TCP. This
 	// helps prevent confused clients who get isolated from UDP traffic
@@ -483,14 +881,18 @@ HANDLE_REMOTE_FAILURE:
 	// 上面提到，当 udp 直接探测失败时，会转向使用 tcp 来重试。
 	// 这当对端的网络被错误配置为禁止 udp 包，而允许 tcp 包时会有效。
 	fallbackCh := make(chan bool, 1)
+	fallbackDeadline := deadline
 
 	// 只要没有配置禁止使用 tcp 探测，就转向使用 tcp 向目标节点发送 ping
 	disableTcpPings := m.config.DisableTcpPings ||
 		(m.config.DisableTcpPingsForNode != nil && m.config.DisableTcpPingsForNode(node.Name))
-	if (!disableTcpPings) && (node.PMax >= 3) {
+	if (!disableTcpPings) && (node.PMax >= 3) && !preferTCP {
+		if m.config.TCPPingTimeout > 0 {
+			fallbackDeadline = sent.Add(m.config.TCPPingTimeout)
+		}
 		go func() {
 			defer close(fallbackCh)
-			didContact, err := m.sendPingAndWaitForAck(node.FullAddress(), ping, deadline)
+			didContact, err := m.sendPingAndWaitForAck(node.FullAddress(), ping, fallbackDeadline)
 			if err != nil {
 				m.logger.Printf("[ERR] memberlist: Failed fallback ping: %s", err)
 			} else {
@@ -508,24 +910,78 @@ HANDLE_REMOTE_FAILURE:
 	// 等待 udp 探测请求响应或者超时（v.Complete = false）。
 	// 这里没有检测 tcp 请求的响应，因为，即使 tcp 响应成功，对端也属于不太正常的情况。
 	// 因此需要给出 warning。
-	select {
-	case v := <-ackCh:
+	// If we're retrying, the rounds split what's left of the probe
+	// interval, and each one that goes unanswered asks fresh nodes.
+	roundTimeout := (probeInterval - m.config.ProbeTimeout) / time.Duration(m.config.IndirectRetries+1)
+	for round := 0; ; round++ {
+		var retry Timer
+		var retryCh <-chan time.Time
+		if round < m.config.IndirectRetries && m.config.IndirectChecks > 0 {
+			retry = m.clock().NewTimer(roundTimeout)
+			retryCh = retry.C()
+		}
+
+		var v ackMessage
+		retrying, cancelled := false, false
+		select {
+		case v = <-ackCh:
+		case <-retryCh:
+			retrying = true
+		case <-ctx.Done():
+			cancelled = true
+		}
+
+		// Stop this round's timer now, rather than piling them up until
+		// the probe is done.
+		if retry != nil {
+			retry.Stop()
+		}
+		if cancelled {
+			return false, 0, ctx.Err()
+		}
+		if retrying {
+			metrics.IncrCounter([]string{"memberlist", "indirect_ping", "retry"}, 1)
+			m.logger.Printf("[DEBUG] memberlist: Retrying indirect ping of %s with other nodes", node.Name)
+			sendIndirect()
+			continue
+		}
 		if v.Complete == true {
-			return
+			return true, m.measureRTT(v.Timestamp.Sub(sent)), nil
 		}
+		break
 	}
 
 	// Finally, poll the fallback channel. The timeouts are set such that
 	// the channel will have something or be closed without having to wait
-	// any additional time here.
+	// any additional time here. Should the TCP ping get stuck past its
+	// deadline anyway, we give up on it rather than wedge the prober.
 	// 最后，轮询等从 fallback 通道中读取响应，或者超时返回。
-	for didContact := range fallbackCh {
-		if didContact {
-			m.logger.Printf("[WARN] memberlist: Was able to connect to %s but other probes failed, network may be misconfigured", node.Name)
-			return
+	drainTimer := m.clock().NewTimer(time.Until(fallbackDeadline) + m.config.ProbeTimeout)
+	defer drainTimer.Stop()
+DRAIN_FALLBACK:
+	for {
+		select {
+		case didContact, ok := <-fallbackCh:
+			if !ok {
+				break DRAIN_FALLBACK
+			}
+			if didContact {
+				m.logger.Printf("[WARN] memberlist: Was able to connect to %s but other probes failed, network may be misconfigured", node.Name)
+				return true, m.measureRTT(time.Since(sent)), nil
+			}
+		case <-drainTimer.C():
+			metrics.IncrCounter([]string{"memberlist", "probe", "fallback_timeout"}, 1)
+			m.logger.Printf("[WARN] memberlist: Gave up waiting for the fallback ping of %s, which is still running past its deadline", node.Name)
+			break DRAIN_FALLBACK
+		case <-ctx.Done():
+			return false, 0, ctx.Err()
 		}
 	}
 
+	if !failureDetect {
+		return false, 0, nil
+	}
+
 	// Update our self-awareness based on the results of this failed probe.
 	// If we don't have peers who will send nacks then we penalize for any
 	// failed probe as a simple health metric. If we do have peers to nack
@@ -548,12 +1004,112 @@ HANDLE_REMOTE_FAILURE:
 	// 若通过 tcp 也探测失败，则说明目标节点可能发生故障，
 	// 因此，首先更新节点自身的 local health 值，然后进入到怀疑节点（suspectNode）的操作流程
 	m.logger.Printf("[INFO] memberlist: Suspect %s has failed, no acks received", node.Name)
-	s := suspect{Incarnation: node.Incarnation, Node: node.Name, From: m.config.Name}
+	metrics.IncrCounterWithLabels([]string{"memberlist", "probe", "failed"}, 1, m.nodeLabels(node.Name))
+	s := suspect{Incarnation: node.Incarnation, Node: node.Name, From: m.localName()}
 	m.suspectNode(&s)
+	return false, 0, nil
+}
+
+// ProbeNode immediately probes the named node using the same direct,
+// indirect and TCP fallback checks as the regular probe cycle, and blocks
+// until the probe completes or the context is done. It reports whether the
+// node could be reached and, if so, the round-trip time. Unless
+// Config.ProbeNodeSuspects is set, a failed probe is only reported to the
+// caller and does not mark the node as suspect or affect our awareness.
+func (m *Memberlist) ProbeNode(name string, ctx context.Context) (bool, time.Duration, error) {
+	if name == m.localName() {
+		return false, 0, fmt.Errorf("cannot probe the local node")
+	}
+
+	m.nodeLock.RLock()
+	n, ok := m.nodeMap[name]
+	if !ok {
+		m.nodeLock.RUnlock()
+		return false, 0, fmt.Errorf("unknown node: %s", name)
+	}
+	node := *n
+	m.nodeLock.RUnlock()
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return m.runProbe(ctx, &node, m.config.ProbeNodeSuspects)
 }
 
 // Ping initiates a ping to the node with the specified name.
 func (m *Memberlist) Ping(node string, addr net.Addr) (time.Duration, error) {
+	a := Address{Addr: addr.String(), Name: node}
+	return m.pingAddress(context.Background(), a)
+}
+
+// PingResult is the outcome of pinging a single node with PingAll.
+type PingResult struct {
+	// RTT is the round-trip time of the ping, if it succeeded.
+	RTT time.Duration
+
+	// Err is set if the node couldn't be pinged.
+	Err error
+}
+
+// PingAll sends a direct ping to every alive or suspect node other than
+// ourselves, with at most concurrency pings in flight at once, and returns
+// the outcome for each node keyed by name. Nodes that haven't been pinged
+// by the time the context is done are reported with the context's error.
+func (m *Memberlist) PingAll(ctx context.Context, concurrency int) map[string]PingResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	m.nodeLock.RLock()
+	var targets []Address
+	for _, n := range m.nodes {
+		if n.Name == m.localName() || n.DeadOrLeft() {
+			continue
+		}
+		targets = append(targets, n.FullAddress())
+	}
+	m.nodeLock.RUnlock()
+
+	var (
+		lock    sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]PingResult, len(targets))
+		sem     = make(chan struct{}, concurrency)
+	)
+	for _, a := range targets {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			lock.Lock()
+			results[a.Name] = PingResult{Err: ctx.Err()}
+			lock.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(a Address) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			rtt, err := m.pingAddress(ctx, a)
+			lock.Lock()
+			results[a.Name] = PingResult{RTT: rtt, Err: err}
+			lock.Unlock()
+		}(a)
+	}
+	wg.Wait()
+	return results
+}
+
+// pingAddress sends a direct ping to the node at the given address and waits
+// for the ack, the probe timeout, or the context to be done.
+func (m *Memberlist) pingAddress(ctx context.Context, a Address) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	node := a.Name
+
 	// Prepare a ping message and setup an ack handler.
 	selfAddr, selfPort := m.getAdvertise()
 	ping := ping{
@@ -561,16 +1117,14 @@ func (m *Memberlist) Ping(node string, addr net.Addr) (time.Duration, error) {
 		Node:       node,
 		SourceAddr: selfAddr,
 		SourcePort: selfPort,
-		SourceNode: m.config.Name,
+		SourceNode: m.localName(),
 	}
 	ackCh := make(chan ackMessage, m.config.IndirectChecks+1)
-	m.setProbeChannels(ping.SeqNo, ackCh, nil, m.config.ProbeInterval)
-
-	a := Address{Addr: addr.String(), Name: node}
+	m.setProbeChannels(ping.SeqNo, node, ackCh, nil, m.config.ProbeInterval)
 
 	// Send a ping to the node.
 	if err := m.encodeAndSendMsg(a, pingMsg, &ping); err != nil {
-		return 0, err
+		return 0, NoPingResponseError{node: ping.Node, Addr: a.Addr, Phase: PingSendFailed, Err: err}
 	}
 
 	// Mark the sent time here, which should be after any pre-processing and
@@ -582,14 +1136,55 @@ func (m *Memberlist) Ping(node string, addr net.Addr) (time.Duration, error) {
 	select {
 	case v := <-ackCh:
 		if v.Complete == true {
-			return v.Timestamp.Sub(sent), nil
+			return m.measureRTT(v.Timestamp.Sub(sent)), nil
 		}
-	case <-time.After(m.config.ProbeTimeout):
+	case <-m.clock().NewTimer(m.config.ProbeTimeout).C():
 		// Timeout, return an error below.
+	case <-ctx.Done():
+		return 0, ctx.Err()
 	}
 
 	m.logger.Printf("[DEBUG] memberlist: Failed UDP ping: %v (timeout reached)", node)
-	return 0, NoPingResponseError{ping.Node}
+	return 0, NoPingResponseError{node: ping.Node, Addr: a.Addr, Duration: time.Since(sent), Phase: PingTimeout}
+}
+
+// indirectPingTTL returns the TTL to put on outgoing indirect ping requests.
+func (m *Memberlist) indirectPingTTL() uint8 {
+	ttl := m.config.IndirectPingTTL
+	if ttl < 1 {
+		return 1
+	}
+	if ttl > math.MaxUint8 {
+		return math.MaxUint8
+	}
+	return uint8(ttl)
+}
+
+// measureRTT clamps a raw RTT measurement to [0, ProbeInterval], counting
+// any samples that fall outside that range.
+func (m *Memberlist) measureRTT(rtt time.Duration) time.Duration {
+	rtt, ok := clampRTT(rtt, m.config.ProbeInterval)
+	if !ok {
+		metrics.IncrCounter([]string{"memberlist", "probe", "rtt_out_of_range"}, 1)
+	}
+	return rtt
+}
+
+// nodeLabels returns the labels for metrics about the named node, which is
+// nil unless Config.LabeledMetrics is set.
+func (m *Memberlist) nodeLabels(name string) []metrics.Label {
+	if !m.config.LabeledMetrics {
+		return nil
+	}
+	return []metrics.Label{{Name: "node", Value: name}}
+}
+
+// deadGossipPending returns true if the dead message about a node is still
+// queued and hasn't been gossiped DeadNodeGossipCount times yet, so the node
+// should be kept around a while longer.
+func (m *Memberlist) deadGossipPending(n *nodeState) bool {
+	transmits, ok := m.broadcasts.transmitsFor(n.Name)
+	return ok && transmits < m.config.DeadNodeGossipCount
 }
 
 // resetNodes is used when the tick wraps around. It will reap the
@@ -601,12 +1196,22 @@ func (m *Memberlist) resetNodes() {
 
 	// Move dead nodes, but respect gossip to the dead interval
 	// moveDeadNodes 将本地视图中的 dead 节点（且 gossip 时间小于状态变更的时间）移动节点列表的末尾，以便于后续的截取操作
-	deadIdx := moveDeadNodes(m.nodes, m.config.GossipToTheDeadTime)
+	var retain func(*nodeState) bool
+	if m.config.DeadNodeGossipCount > 0 {
+		retain = m.deadGossipPending
+	}
+	var deadIdx int
+	if m.config.StableProbeOrder {
+		deadIdx = moveDeadNodesStable(m.nodes, m.config.GossipToTheDeadTime, m.clock().Now(), retain)
+	} else {
+		deadIdx = moveDeadNodes(m.nodes, m.config.GossipToTheDeadTime, m.clock().Now(), retain)
+	}
 
 	// Deregister the dead nodes
 	// 将 daed 节点在本地集群成员视图中删除
 	for i := deadIdx; i < len(m.nodes); i++ {
 		delete(m.nodeMap, m.nodes[i].Name)
+		m.forgetPeerMeta(m.nodes[i].Name)
 		m.nodes[i] = nil
 	}
 
@@ -618,6 +1223,12 @@ func (m *Memberlist) resetNodes() {
 	// 更新集群中节点数目
 	atomic.StoreUint32(&m.numNodes, uint32(deadIdx))
 
+	// With a stable probe order, the next round picks up where this one
+	// left off, so every node waits one round between probes.
+	if m.config.StableProbeOrder {
+		return
+	}
+
 	// Shuffle live nodes
 	// 打散节点保存的本地集群节点列表
 	shuffleNodes(m.nodes)
@@ -631,9 +1242,9 @@ func (m *Memberlist) gossip() {
 
 	// Get some random live, suspect, or recently dead nodes
 	// 随机选择节点时，只选择 alive、suspect 以及部分 dead 节点。
-	m.nodeLock.RLock()
-	kNodes := kRandomNodes(m.config.GossipNodes, m.nodes, func(n *nodeState) bool {
-		if n.Name == m.config.Name {
+	gossipNodes := m.gossipFanout()
+	skip := func(n *nodeState) bool {
+		if n.Name == m.localName() {
 			return true
 		}
 
@@ -642,42 +1253,73 @@ func (m *Memberlist) gossip() {
 			return false
 
 		case StateDead:
-			return time.Since(n.StateChange) > m.config.GossipToTheDeadTime
+			// Nodes we've only learned of have no address to gossip to.
+			return len(n.Addr) == 0 ||
+				m.clock().Now().Sub(n.StateChange) > m.config.GossipToTheDeadTime
 
 		default:
 			return true
 		}
+	}
+	m.nodeLock.RLock()
+	kNodes := kRandomNodes(gossipNodes, m.nodes, skip)
+
+	// A targeted broadcast that none of the nodes we gossip to accepts
+	// would never be sent, and so never retired, so drop it.
+	m.broadcasts.dropFiltered(func(b Broadcast) bool {
+		tb, ok := b.(*targetedBroadcast)
+		if !ok {
+			return false
+		}
+		for _, n := range m.nodes {
+			if !skip(n) && tb.target(&n.Node) {
+				return false
+			}
+		}
+		return true
 	})
 	m.nodeLock.RUnlock()
 
 	// Compute the bytes available
-	bytesAvail := m.config.UDPBufferSize - compoundHeaderOverhead
-	if m.config.EncryptionEnabled() {
-		bytesAvail -= encryptOverhead(m.encryptionVersion())
-	}
+	bytesAvail := m.gossipBytesAvail()
+
+	// Track the fanout we actually achieve, which is only meaningful on
+	// ticks where there was something to gossip.
+	var sent int
+	var pending bool
+	defer func() {
+		if pending {
+			metrics.AddSample([]string{"memberlist", "gossip", "fanout"}, float32(sent))
+		}
+	}()
 
 	// 从广播消息队列中取出若干消息，以构成 compound 消息，然后依次向他们发送此 compound 消息。
 	for _, node := range kNodes {
 		// Get any pending broadcasts
 		// 从缓冲队列中选择总容量固定的消息集合
-		msgs := m.getBroadcasts(compoundOverhead, bytesAvail)
+		msgs := m.getBroadcastsFor(&node, compoundOverhead, bytesAvail)
 		if len(msgs) == 0 {
-			return
+			// Targeted broadcasts may still be waiting for the others.
+			continue
 		}
+		pending = true
 
 		addr := node.Address()
 		if len(msgs) == 1 {
 			// Send single message as is
 			if err := m.rawSendMsgPacket(node.FullAddress(), &node, msgs[0]); err != nil {
 				m.logger.Printf("[ERR] memberlist: Failed to send gossip to %s: %s", addr, err)
+				continue
 			}
 		} else {
 			// Otherwise create and send a compound message
 			compound := makeCompoundMessage(msgs)
 			if err := m.rawSendMsgPacket(node.FullAddress(), &node, compound.Bytes()); err != nil {
 				m.logger.Printf("[ERR] memberlist: Failed to send gossip to %s: %s", addr, err)
+				continue
 			}
 		}
+		sent++
 	}
 }
 
@@ -693,11 +1335,16 @@ func (m *Memberlist) gossip() {
 // 此操作的一个代价是网络带宽，
 // 因此，显然此操作不能过于频繁，特别是在集群规模较大的情况
 func (m *Memberlist) pushPull() {
-	// Get a random live node
+	// Get a random live node, or one PushPullStateFilter allows
 	m.nodeLock.RLock()
 	nodes := kRandomNodes(1, m.nodes, func(n *nodeState) bool {
-		return n.Name == m.config.Name ||
-			n.State != StateAlive
+		if n.Name == m.localName() {
+			return true
+		}
+		if m.config.PushPullStateFilter != nil {
+			return len(n.Addr) == 0 || !m.config.PushPullStateFilter(&n.Node, n.State)
+		}
+		return n.State != StateAlive
 	})
 	m.nodeLock.RUnlock()
 
@@ -729,6 +1376,9 @@ func (m *Memberlist) pushPullNode(a Address, join bool) error {
 	if err := m.mergeRemoteState(join, remote, userState); err != nil {
 		return err
 	}
+	if a.Name != "" {
+		m.recordContact(a.Name, m.clock().Now())
+	}
 	return nil
 }
 
@@ -819,15 +1469,11 @@ func (m *Memberlist) verifyProtocol(remote []pushNodeState) error {
 		}
 
 		if nPCur < maxpmin || nPCur > minpmax {
-			return fmt.Errorf(
-				"Node '%s' protocol version (%d) is incompatible: [%d, %d]",
-				n.Name, nPCur, maxpmin, minpmax)
+			return newProtocolMismatchError(n.Name, false, nPCur, maxpmin, minpmax)
 		}
 
 		if nDCur < maxdmin || nDCur > mindmax {
-			return fmt.Errorf(
-				"Node '%s' delegate protocol version (%d) is incompatible: [%d, %d]",
-				n.Name, nDCur, maxdmin, mindmax)
+			return newProtocolMismatchError(n.Name, true, nDCur, maxdmin, mindmax)
 		}
 	}
 
@@ -836,15 +1482,11 @@ func (m *Memberlist) verifyProtocol(remote []pushNodeState) error {
 		nDCur := n.DCur
 
 		if nPCur < maxpmin || nPCur > minpmax {
-			return fmt.Errorf(
-				"Node '%s' protocol version (%d) is incompatible: [%d, %d]",
-				n.Name, nPCur, maxpmin, minpmax)
+			return newProtocolMismatchError(n.Name, false, nPCur, maxpmin, minpmax)
 		}
 
 		if nDCur < maxdmin || nDCur > mindmax {
-			return fmt.Errorf(
-				"Node '%s' delegate protocol version (%d) is incompatible: [%d, %d]",
-				n.Name, nDCur, maxdmin, mindmax)
+			return newProtocolMismatchError(n.Name, true, nDCur, maxdmin, mindmax)
 		}
 	}
 
@@ -871,6 +1513,27 @@ func (m *Memberlist) estNumNodes() int {
 	return int(atomic.LoadUint32(&m.numNodes))
 }
 
+// CurrentPushPullInterval returns the interval currently being used between
+// push/pull syncs, which is PushPullInterval scaled for the current size of
+// the cluster. See Config.PushPullScaleFunc.
+func (m *Memberlist) CurrentPushPullInterval() time.Duration {
+	base := m.config.PushPullInterval
+	if m.config.PushPullScaleFunc != nil {
+		return m.config.PushPullScaleFunc(base, m.estNumNodes())
+	}
+	return pushPullScale(base, m.estNumNodes())
+}
+
+// gossipFanout returns the number of nodes to gossip to each gossip interval,
+// taking DynamicGossipNodes into account.
+func (m *Memberlist) gossipFanout() int {
+	gossipNodes := m.config.GossipNodes
+	if m.config.DynamicGossipNodes {
+		gossipNodes = gossipNodesScale(gossipNodes, m.estNumNodes(), m.config.MaxGossipNodes)
+	}
+	return gossipNodes
+}
+
 type ackMessage struct {
 	Complete  bool
 	Payload   []byte
@@ -882,7 +1545,7 @@ type ackMessage struct {
 // will be false on timeout. Any nack messages will cause an empty struct to be
 // passed to the nackCh, which can be nil if not needed.
 // setProbeChannels 设置 ping 消息被 ack 或者 nack 的处理器，同时，当超时未回复时，则删除对应的处理器
-func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackCh chan struct{}, timeout time.Duration) {
+func (m *Memberlist) setProbeChannels(seqNo uint32, node string, ackCh chan ackMessage, nackCh chan struct{}, timeout time.Duration) {
 	// Create handler functions for acks and nacks
 	ackFn := func(payload []byte, timestamp time.Time) {
 		select {
@@ -898,18 +1561,16 @@ func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackC
 	}
 
 	// Add the handlers
-	ah := &ackHandler{ackFn, nackFn, nil}
+	ah := &ackHandler{ackFn, nackFn, nil, node}
 	m.ackLock.Lock()
 	m.ackHandlers[seqNo] = ah
 	m.ackLock.Unlock()
 
 	// Setup a reaping routing
-	ah.timer = time.AfterFunc(timeout, func() {
-		m.ackLock.Lock()
-		delete(m.ackHandlers, seqNo)
-		m.ackLock.Unlock()
+	ah.timer = m.clock().AfterFunc(timeout, func() {
+		m.reapAckHandler(seqNo, ah)
 		select {
-		case ackCh <- ackMessage{false, nil, time.Now()}:
+		case ackCh <- ackMessage{false, nil, m.clock().Now()}:
 		default:
 		}
 	})
@@ -921,19 +1582,30 @@ func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackC
 // for nacks.
 func (m *Memberlist) setAckHandler(seqNo uint32, ackFn func([]byte, time.Time), timeout time.Duration) {
 	// Add the handler
-	ah := &ackHandler{ackFn, nil, nil}
+	ah := &ackHandler{ackFn, nil, nil, ""}
 	m.ackLock.Lock()
 	m.ackHandlers[seqNo] = ah
 	m.ackLock.Unlock()
 
 	// Setup a reaping routing
-	ah.timer = time.AfterFunc(timeout, func() {
-		m.ackLock.Lock()
-		delete(m.ackHandlers, seqNo)
-		m.ackLock.Unlock()
+	ah.timer = m.clock().AfterFunc(timeout, func() {
+		m.reapAckHandler(seqNo, ah)
 	})
 }
 
+// reapAckHandler removes the handler for the given sequence number once it
+// times out, unless it's already been replaced. Sequence numbers wrap
+// around, so a new handler may have taken the slot, and it mustn't be
+// reaped on the old one's schedule.
+func (m *Memberlist) reapAckHandler(seqNo uint32, ah *ackHandler) {
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+
+	if m.ackHandlers[seqNo] == ah {
+		delete(m.ackHandlers, seqNo)
+	}
+}
+
 // Invokes an ack handler if any is associated, and reaps the handler immediately
 func (m *Memberlist) invokeAckHandler(ack ackResp, timestamp time.Time) {
 	m.ackLock.Lock()
@@ -944,9 +1616,44 @@ func (m *Memberlist) invokeAckHandler(ack ackResp, timestamp time.Time) {
 		return
 	}
 	ah.timer.Stop()
+	if ah.node != "" {
+		m.recordContact(ah.node, timestamp)
+	}
 	ah.ackFn(ack.Payload, timestamp)
 }
 
+// recordContact notes that we heard directly from the named node at the
+// given time. Unknown nodes are ignored.
+func (m *Memberlist) recordContact(name string, t time.Time) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	if state, ok := m.nodeMap[name]; ok && t.After(state.lastContact) {
+		state.lastContact = t
+	}
+}
+
+// rttWeight is how much each new sample counts towards a node's moving
+// average RTT.
+const rttWeight = 0.2
+
+// recordRTT folds the RTT of a direct ping into the named node's moving
+// average. Unknown nodes are ignored.
+func (m *Memberlist) recordRTT(name string, rtt time.Duration) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	state, ok := m.nodeMap[name]
+	if !ok {
+		return
+	}
+	if !state.hasRTT {
+		state.rtt, state.hasRTT = rtt, true
+		return
+	}
+	state.rtt = time.Duration((1-rttWeight)*float64(state.rtt) + rttWeight*float64(rtt))
+}
+
 // Invokes nack handler if any is associated.
 func (m *Memberlist) invokeNackHandler(nack nackResp) {
 	m.ackLock.Lock()
@@ -965,11 +1672,73 @@ func (m *Memberlist) invokeNackHandler(nack nackResp) {
 // nodeLock is held.
 // refute 通过广播一条 alive 消息来驳斥其它节点针对自身的 suspect 或者 dead 消息。
 func (m *Memberlist) refute(me *nodeState, accusedInc uint32) {
+	m.limitRefute(me, accusedInc, m.config.MinRefuteInterval, "limited")
+}
+
+// limitRefute refutes at most once per interval. An accusation that comes
+// in too soon after the last refute is held back, and once the interval is
+// up a single refute answers the newest accusation seen in the meantime,
+// unless a refute sent since then already beats it. The counter names the
+// metric that counts held back refutes. This returns whether a refute was
+// sent right away. The caller must hold the node lock.
+func (m *Memberlist) limitRefute(me *nodeState, accusedInc uint32, interval time.Duration, counter string) bool {
+	// Observers never announce themselves, so there's nothing to refute.
+	if m.config.Observer {
+		return false
+	}
+
+	now := m.clock().Now()
+	wait := interval - now.Sub(m.refuteLast)
+	if m.refuteLast.IsZero() || wait <= 0 {
+		m.refuteLast = now
+		m.sendRefute(me, accusedInc)
+		return true
+	}
+
+	metrics.IncrCounter([]string{"memberlist", "refute", counter}, 1)
+	if m.refuteTimer == nil || incarnationLess(m.refuteInc, accusedInc) {
+		m.refuteInc = accusedInc
+	}
+
+	// Keep a timer that's due sooner, since a shorter interval applies to
+	// some refutes than to others.
+	due := now.Add(wait)
+	if m.refuteTimer != nil {
+		if !due.Before(m.refuteDue) {
+			return false
+		}
+		m.refuteTimer.Stop()
+	}
+
+	var timer Timer
+	timer = m.clock().AfterFunc(wait, func() {
+		m.nodeLock.Lock()
+		defer m.nodeLock.Unlock()
+
+		if m.refuteTimer != timer {
+			return
+		}
+		m.refuteTimer = nil
+		me, ok := m.nodeMap[m.localName()]
+		if !ok || m.hasLeft() || m.hasShutdown() || incarnationLess(m.refuteInc, me.Incarnation) {
+			return
+		}
+		m.refuteLast = m.clock().Now()
+		m.sendRefute(me, m.refuteInc)
+		m.logger.Printf("[WARN] memberlist: Sent a refute that was held back")
+	})
+	m.refuteTimer, m.refuteDue = timer, due
+	return false
+}
+
+// sendRefute bumps our incarnation number past accusedInc and broadcasts an
+// alive message with it. The caller must hold the node lock.
+func (m *Memberlist) sendRefute(me *nodeState, accusedInc uint32) {
 	// Make sure the incarnation number beats the accusation.
 	// 首先递增自身的的 incarnation，以保证该值大于其它节点为自己保存的该值，否则将不能驳斥成功。
 	inc := m.nextIncarnation()
 	// 若其它节点为自己保存的 incarnation 仍旧大于递增后的值，则进一步增加 incarnation 直至大于它。
-	if accusedInc >= inc {
+	if !incarnationLess(accusedInc, inc) {
 		inc = m.skipIncarnation(accusedInc - inc + 1)
 	}
 	me.Incarnation = inc
@@ -990,8 +1759,79 @@ func (m *Memberlist) refute(me *nodeState, accusedInc uint32) {
 			me.PMin, me.PMax, me.PCur,
 			me.DMin, me.DMax, me.DCur,
 		},
+		NotReady: m.isNotReady(),
+	}
+	m.overrideLocalAlive(&a)
+	me.Meta = a.Meta
+	m.encodeAndBroadcastRefute(&a)
+}
+
+// metaForPeer gives Config.MetaForPeer a chance to replace the local node's
+// meta data in something sent only to the given peer. The replacement is
+// remembered for the given incarnation, since the peer will pass it on and
+// it will come back to us.
+func (m *Memberlist) metaForPeer(peer *Node, incarnation uint32, meta []byte) []byte {
+	if m.config.MetaForPeer == nil {
+		return meta
+	}
+	peerMeta := m.config.MetaForPeer(peer)
+	if peerMeta == nil {
+		return meta
+	}
+	if len(peerMeta) > MetaMaxSize {
+		m.logger.Printf("[WARN] memberlist: Ignoring meta data of %d bytes for %s, longer than the limit of %d bytes",
+			len(peerMeta), peer.Name, MetaMaxSize)
+		return meta
+	}
+	if !bytes.Equal(peerMeta, meta) {
+		m.peerMetaLock.Lock()
+		if m.peerMetas == nil || m.peerMetaInc != incarnation {
+			m.peerMetaInc = incarnation
+			m.peerMetas = make(map[string][]byte)
+		}
+		m.peerMetas[peer.Name] = peerMeta
+		m.peerMetaLock.Unlock()
+	}
+	return peerMeta
+}
+
+// sentPeerMeta returns true if MetaForPeer gave out the given meta data for
+// our own entry at the given incarnation.
+func (m *Memberlist) sentPeerMeta(incarnation uint32, meta []byte) bool {
+	m.peerMetaLock.Lock()
+	defer m.peerMetaLock.Unlock()
+	if m.peerMetaInc != incarnation {
+		return false
+	}
+	for _, peerMeta := range m.peerMetas {
+		if bytes.Equal(peerMeta, meta) {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetPeerMeta drops the meta data MetaForPeer gave the given peer, once
+// it has died or been reaped.
+func (m *Memberlist) forgetPeerMeta(name string) {
+	m.peerMetaLock.Lock()
+	delete(m.peerMetas, name)
+	m.peerMetaLock.Unlock()
+}
+
+// overrideLocalAlive gives Config.LocalAliveOverride a chance to replace the
+// meta data in an alive message about the local node before it's sent.
+func (m *Memberlist) overrideLocalAlive(a *alive) {
+	if m.config.LocalAliveOverride == nil {
+		return
+	}
+	meta := m.config.LocalAliveOverride(a.Meta)
+	if len(meta) > MetaMaxSize {
+		m.logger.Printf("[WARN] memberlist: Ignoring overridden meta data of %d bytes, longer than the limit of %d bytes",
+			len(meta), MetaMaxSize)
+		return
 	}
-	m.encodeAndBroadcast(me.Addr.String(), aliveMsg, a)
+	a.Meta = meta
 }
 
 // aliveNode is invoked by the network layer when we get a message about a
@@ -1008,7 +1848,7 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 	// ensures that we don't.
 	// 当节点自身主动离开集群的同时，存在一条 alive 消息未被此处理，
 	// 则此时应该进一步检测，若属于此情况，则应该直接返回。
-	if m.hasLeft() && a.Node == m.config.Name {
+	if m.hasLeft() && a.Node == m.localName() {
 		return
 	}
 
@@ -1035,16 +1875,17 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 			return
 		}
 		node := &Node{
-			Name: a.Node,
-			Addr: a.Addr,
-			Port: a.Port,
-			Meta: a.Meta,
-			PMin: a.Vsn[0],
-			PMax: a.Vsn[1],
-			PCur: a.Vsn[2],
-			DMin: a.Vsn[3],
-			DMax: a.Vsn[4],
-			DCur: a.Vsn[5],
+			Name:  a.Node,
+			Addr:  a.Addr,
+			Port:  a.Port,
+			Meta:  a.Meta,
+			PMin:  a.Vsn[0],
+			PMax:  a.Vsn[1],
+			PCur:  a.Vsn[2],
+			DMin:  a.Vsn[3],
+			DMax:  a.Vsn[4],
+			DCur:  a.Vsn[5],
+			Ready: !a.NotReady,
 		}
 		if err := m.config.Alive.NotifyAlive(node); err != nil {
 			m.logger.Printf("[WARN] memberlist: ignoring alive message for '%s': %s",
@@ -1058,7 +1899,7 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 	// 若将节点先前不存在于节点本地的视图中，则先构造一个节点对象并存储。
 	// 然后，生成一个随机的索引位置，用于放置该节点，这可以保证节点执行随机探测时任一节点被探测的延时存在上限。
 	// 最后更新当前集群中成员数目。
-	var updatesNode bool
+	var updatesNode, isNew bool
 	if !ok {
 		errCon := m.config.IPAllowed(a.Addr)
 		if errCon != nil {
@@ -1083,22 +1924,8 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 			state.DCur = a.Vsn[5]
 		}
 
-		// Add to map
-		m.nodeMap[a.Node] = state
-
-		// Get a random offset. This is important to ensure
-		// the failure detection bound is low on average. If all
-		// nodes did an append, failure detection bound would be
-		// very high.
-		n := len(m.nodes)
-		offset := randomOffset(n)
-
-		// Add at the end and swap with the node at the offset
-		m.nodes = append(m.nodes, state)
-		m.nodes[offset], m.nodes[n] = m.nodes[n], m.nodes[offset]
-
-		// Update numNodes after we've added a new node
-		atomic.AddUint32(&m.numNodes, 1)
+		m.addNode(state)
+		isNew = true
 	} else {
 		// 若节点已存在于节点本地集群成员视图中。
 		// 则进一步判断 alive 消息中存在的节点元信息（如 ip 地址或端口）是否和本地保存的对应节点的元信息冲突，
@@ -1115,10 +1942,24 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 			}
 			// If DeadNodeReclaimTime is configured, check if enough time has elapsed since the node died.
 			canReclaim := (m.config.DeadNodeReclaimTime > 0 &&
-				time.Since(state.StateChange) > m.config.DeadNodeReclaimTime)
+				m.clock().Now().Sub(state.StateChange) > m.config.DeadNodeReclaimTime)
+
+			// A node we only learned of through UnknownNodeLearn has no
+			// address yet, so there's nothing to conflict with.
+			learned := state.State == StateDead && len(state.Addr) == 0
 
 			// Allow the address to be updated if a dead node is being replaced.
-			if state.State == StateLeft || (state.State == StateDead && canReclaim) {
+			if learned {
+				m.logger.Printf("[DEBUG] memberlist: Got address %v:%d for learned node %s",
+					net.IP(a.Addr), a.Port, state.Name)
+			} else if bootstrap && state.Name == m.localName() {
+				m.logger.Printf("[INFO] memberlist: Updating our own address from %v:%d to %v:%d",
+					state.Addr, state.Port, net.IP(a.Addr), a.Port)
+			} else if state.State == StateLeft || (state.State == StateDead && canReclaim) {
+				if m.config.VerifyReclaimByProbe && !m.reclaimVerified(a) {
+					m.verifyReclaim(a)
+					return
+				}
 				m.logger.Printf("[INFO] memberlist: Updating address for left or failed node %s from %v:%d to %v:%d",
 					state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port)
 				updatesNode = true
@@ -1143,24 +1984,44 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 
 	// Bail if the incarnation number is older, and this is not about us
 	// 当节点的 incarnation 的值小于本节点为其存在的值，并且目标节点并非自身，同时也并未执行节点信息变更时，则直接退出。
-	isLocalNode := state.Name == m.config.Name
-	if a.Incarnation <= state.Incarnation && !isLocalNode && !updatesNode {
+	// A node we've only just added has no incarnation of its own yet, so any
+	// non-zero incarnation is newer, wherever it falls in the circular space.
+	isLocalNode := state.Name == m.localName()
+	newer := incarnationLess(state.Incarnation, a.Incarnation) || (isNew && a.Incarnation != 0)
+	if !newer && !isLocalNode && !updatesNode {
+		if meta, ok := m.mergeMeta(state, a); ok {
+			// Carry on with the merged meta, without touching the
+			// caller's copy of the message.
+			merged := *a
+			merged.Meta = meta
+			a = &merged
+			newer = true
+		}
+	}
+	if !newer && !isLocalNode && !updatesNode {
 		return
 	}
 
 	// Bail if strictly less and this is about us
 	// 当节点的 incarnation 的值小于本节点为其存在的值，并且目标节点即为自身，同样直接退出。
-	if a.Incarnation < state.Incarnation && isLocalNode {
+	if incarnationLess(a.Incarnation, state.Incarnation) && isLocalNode && !isNew {
 		return
 	}
 
 	// Clear out any suspicion timer that may be in effect.
 	// 先清除节点的 suspect 定时器，若存在的话。因为该节点收到了目标节点的 alive 消息。
-	delete(m.nodeTimers, a.Node)
+	if _, ok := m.nodeTimers[a.Node]; ok {
+		metrics.IncrCounter([]string{"memberlist", "suspicion", "refuted"}, 1)
+		delete(m.nodeTimers, a.Node)
+	}
+	m.stopShadowTimers(a.Node)
 
-	// Store the old state and meta data
+	// Store the old state, meta data, and address
 	oldState := state.State
 	oldMeta := state.Meta
+	oldReady := state.Ready
+	oldAddr := state.Addr
+	oldPort := state.Port
 
 	// If this is us we need to refute, otherwise re-broadcast
 	// 若发现此 alive 消息正是针对节点自身，且并不是节点自身在启动时加入集群时发出的，
@@ -1183,18 +2044,39 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		// need to do an equality check for this Incarnation. In most cases,
 		// we just ignore, but we may need to refute.
 		//
-		if a.Incarnation == state.Incarnation &&
-			bytes.Equal(a.Meta, state.Meta) &&
-			bytes.Equal(a.Vsn, versions) {
+		if m.localAliveMatches(state, a) {
+			metrics.IncrCounter([]string{"memberlist", "msg", "alive", "self_noop"}, 1)
+			if m.config.LogSelfNoopAlive {
+				m.logger.Printf("[DEBUG] memberlist: Ignoring alive message about ourselves that matches our state (incarnation %d)", a.Incarnation)
+			}
 			return
 		}
+
+		// With the same incarnation, this is most likely what a previous
+		// run of ours announced, as above. Refuting moves us past it for
+		// good, since anything still carrying the old incarnation will be
+		// ignored from then on, so it takes just the one refute.
+		if a.Incarnation == state.Incarnation {
+			metrics.IncrCounter([]string{"memberlist", "refute", "restart_detected"}, 1)
+			m.logger.Printf("[WARN] memberlist: Restart detected, refuting an alive message for '%s' from a previous run at incarnation %d (%v:%d) meta:(%v VS %v), vsn:(%v VS %v)",
+				a.Node, a.Incarnation, net.IP(a.Addr), a.Port, a.Meta, state.Meta, a.Vsn, versions)
+		} else {
+			m.logger.Printf("[WARN] memberlist: Refuting an alive message for '%s' (%v:%d) meta:(%v VS %v), vsn:(%v VS %v)", a.Node, net.IP(a.Addr), a.Port, a.Meta, state.Meta, a.Vsn, versions)
+		}
 		m.refute(state, a.Incarnation)
-		m.logger.Printf("[WARN] memberlist: Refuting an alive message for '%s' (%v:%d) meta:(%v VS %v), vsn:(%v VS %v)", a.Node, net.IP(a.Addr), a.Port, a.Meta, state.Meta, a.Vsn, versions)
 	} else {
 		// 相反，若发现此 aliveMsg 同自身无关，或者即使此消息同自身相关，
 		// 但也并非在节点启动加入集群时发出的，此时直接将此 aliveMsg 广播到集群。
 		// 最后更新本节点为目标节点存储的元信息，如 incarnation 值，状态更新时间等。
-		m.encodeBroadcastNotify(a.Node, aliveMsg, a, notify)
+		if isLocalNode && m.config.Observer {
+			// Keep our own state up to date, but never let anyone
+			// else hear about us.
+			if notify != nil {
+				close(notify)
+			}
+		} else {
+			m.encodeBroadcastNotify(a.Node, aliveMsg, a, notify)
+		}
 
 		// Update protocol versions if it arrived
 		if len(a.Vsn) > 0 {
@@ -1209,11 +2091,17 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		// Update the state and incarnation number
 		state.Incarnation = a.Incarnation
 		state.Meta = a.Meta
+		state.Ready = !a.NotReady
 		state.Addr = a.Addr
 		state.Port = a.Port
 		if state.State != StateAlive {
+			if ok {
+				recordTransition(state.State, StateAlive)
+			}
+			state.Recovering = state.State == StateSuspect && m.config.RecoveryHysteresis > 0
 			state.State = StateAlive
-			state.StateChange = time.Now()
+			state.StateChange = m.clock().Now()
+			m.notifyStateWaiters(state)
 		}
 	}
 
@@ -1224,18 +2112,90 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 	// 若上层应用定义了节点状态变化的 hook，则需要回调它们。
 	// 节点状态变化分为节点的存活状态变化：  dead/left -> alive，
 	// 以及节点的元信息发生变化。
+	addrChanged := !bytes.Equal(oldAddr, state.Addr) || oldPort != state.Port
+	if oldState == StateDead || oldState == StateLeft ||
+		addrChanged || !bytes.Equal(oldMeta, state.Meta) || oldReady != state.Ready {
+		m.membershipChanged()
+	}
 	if m.config.Events != nil {
-		if oldState == StateDead || oldState == StateLeft {
-			// if Dead/Left -> Alive, notify of join
-			m.config.Events.NotifyJoin(&state.Node)
+		if addrChanged {
+			if d, ok := m.config.Events.(AddressChangeDelegate); ok {
+				d.NotifyAddressChange(&state.Node, oldAddr, oldPort)
+			}
+		}
 
-		} else if !bytes.Equal(oldMeta, state.Meta) {
-			// if Meta changed, trigger an update notification
+		if oldState == StateSuspect && state.Recovering {
+			if d, ok := m.config.Events.(RecoveryDelegate); ok {
+				d.NotifyRecovering(&state.Node)
+			}
+		}
+
+		if (oldState == StateDead || oldState == StateLeft) && m.cancelLeave(state.Name) {
+			// The application never heard that the node left, so it
+			// doesn't get told it joined either, only what changed
+			if addrChanged || !bytes.Equal(oldMeta, state.Meta) || oldReady != state.Ready {
+				m.config.Events.NotifyUpdate(&state.Node)
+			}
+
+		} else if oldState == StateDead || oldState == StateLeft {
+			// if Dead/Left -> Alive, notify of join, or of a reclaim if
+			// a node we already knew came back at a new address
+			if d, ok := m.config.Events.(ReclaimDelegate); ok && updatesNode {
+				d.NotifyReclaim(&state.Node)
+			} else {
+				m.config.Events.NotifyJoin(&state.Node)
+			}
+
+		} else if addrChanged || !bytes.Equal(oldMeta, state.Meta) || oldReady != state.Ready {
+			// if Meta, readiness or the address changed, trigger an update notification
 			m.config.Events.NotifyUpdate(&state.Node)
 		}
 	}
 }
 
+// UnknownNodePolicy controls what happens to a suspect or dead message about
+// a node we've never heard of.
+type UnknownNodePolicy int
+
+const (
+	// UnknownNodeIgnore drops the message. This is the default.
+	UnknownNodeIgnore UnknownNodePolicy = iota
+
+	// UnknownNodeLog drops the message, but logs that it did.
+	UnknownNodeLog
+
+	// UnknownNodeLearn adds the node as dead at the message's incarnation
+	// number, without an address. An alive message about it then has to
+	// beat that incarnation, like it would if we'd heard about the node in
+	// the usual order, and it fills in the address. The entry is reaped
+	// like any other dead node if nothing more is heard.
+	UnknownNodeLearn
+)
+
+// unknownNode applies the UnknownNodePolicy to a suspect or dead message
+// about a node that isn't in the node map. The caller must hold the node
+// lock.
+func (m *Memberlist) unknownNode(kind, name string, incarnation uint32, from string) {
+	switch m.config.UnknownNodePolicy {
+	case UnknownNodeLog:
+		m.logger.Printf("[INFO] memberlist: Ignoring %s message about unknown node %s (from: %s)", kind, name, from)
+
+	case UnknownNodeLearn:
+		if name == m.localName() {
+			return
+		}
+		metrics.IncrCounter([]string{"memberlist", "unknown_node", "learned"}, 1)
+		m.logger.Printf("[DEBUG] memberlist: Learned of node %s from a %s message (from: %s)", name, kind, from)
+		state := &nodeState{
+			Node:        Node{Name: name},
+			Incarnation: incarnation,
+			State:       StateDead,
+			StateChange: m.clock().Now(),
+		}
+		m.addNode(state)
+	}
+}
+
 // suspectNode is invoked by the network layer when we get a message
 // about a suspect node
 func (m *Memberlist) suspectNode(s *suspect) {
@@ -1247,13 +2207,14 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	// 若被 suspect 的节点平不存在于当前节点的集群节点列表视图中，则忽略该消息。
 	// 说明该消息可能已被处理过。
 	if !ok {
+		m.unknownNode("suspect", s.Node, s.Incarnation, s.From)
 		return
 	}
 
 	// Ignore old incarnation numbers
 	// 类似地，若被 suspect 的节点的 incarnation 值小于当前节点为该 suspect 保存的 incarnation 值，同样忽略该消息。
 	// 说明该消息已经过时了。
-	if s.Incarnation < state.Incarnation {
+	if incarnationLess(s.Incarnation, state.Incarnation) {
 		return
 	}
 
@@ -1265,7 +2226,14 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	// 执行 confirm 动作，表明进一步“肯定”目标节点处于 dead 状态。
 	// 然后将此 suspect 发送到需要被广播的消息缓存队列中，随后会被广播出去。
 	if timer, ok := m.nodeTimers[s.Node]; ok {
-		if timer.Confirm(s.From) {
+		weight := 1.0
+		if m.config.ConfirmWeightFunc != nil {
+			weight = m.config.ConfirmWeightFunc(s.From)
+		}
+		for _, shadow := range m.shadowTimers[s.Node] {
+			shadow.ConfirmWeighted(s.From, weight)
+		}
+		if timer.ConfirmWeighted(s.From, weight) {
 			m.encodeAndBroadcast(s.Node, suspectMsg, s)
 		}
 		return
@@ -1280,7 +2248,7 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	// If this is us we need to refute, otherwise re-broadcast
 	// 若恰好发现目标节点就是当前节点自身，则显然，自身还是存活的，因此需要立即发送一条 refute 消息以驳斥该 suspect 消息。
 	// 否则，将该 suspect 消息发送到需要被广播的消息缓存队列中，随后会被广播出去。
-	if state.Name == m.config.Name {
+	if state.Name == m.localName() {
 		m.refute(state, s.Incarnation)
 		m.logger.Printf("[WARN] memberlist: Refuting a suspect message (from: %s)", s.From)
 		return // Do not mark ourself suspect
@@ -1294,31 +2262,15 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	// Update the state
 	// 更新当前节点为目标节点保存的 incarnation 值，目标节点的状态、目标节点状态更新时间
 	state.Incarnation = s.Incarnation
+	recordTransition(state.State, StateSuspect)
+	relapsed := m.isRecovering(state)
+	state.Recovering = false
 	state.State = StateSuspect
-	changeTime := time.Now()
+	changeTime := m.clock().Now()
 	state.StateChange = changeTime
+	m.notifyStateWaiters(state)
 
-	// Setup a suspicion timer. Given that we don't have any known phase
-	// relationship with our peers, we set up k such that we hit the nominal
-	// timeout two probe intervals short of what we expect given the suspicion
-	// multiplier.
-	// 设置一个 suspect 计时器。考虑到当前节点未和其它节点有任何联系，
-	// 因此初始设置的超时时间比我们预期的超时时间短两个探测间隔(给定怀疑乘数)
-	k := m.config.SuspicionMult - 2
-
-	// If there aren't enough nodes to give the expected confirmations, just
-	// set k to 0 to say that we don't expect any. Note we subtract 2 from n
-	// here to take out ourselves and the node being probed.
-	// 但若发现集群中的节点（除自身和目标节点处）还小于 k，则直接将 k 设置为 0，以表明我们不期待任何的针对目标节点的 Confirm 操作。
-	n := m.estNumNodes()
-	if n-2 < k {
-		k = 0
-	}
-
-	// Compute the timeouts based on the size of the cluster.
-	// 基于集群的大小以及其它超时参数来计算 suspect 定时器的超时时限的上下限。
-	min := suspicionTimeout(m.config.SuspicionMult, n, m.config.ProbeInterval)
-	max := time.Duration(m.config.SuspicionMaxTimeoutMult) * min
+	k, min, max := m.suspicionBounds(m.config.SuspicionMult, m.config.SuspicionMaxTimeoutMult, relapsed)
 	// 构建基于其它节点对目标节点的 suspect 状态进行 Confirm 操作处理完成，或者达到超时时间的处理器。
 	// 此时已基本可确认目标被 suspect 节点已经处于 dead 状态了。因此，
 	// 将构建一个针对目标被 suspect 的节点的 dead 消息，然后执行对应的处理流程。
@@ -1329,11 +2281,12 @@ func (m *Memberlist) suspectNode(s *suspect) {
 		state, ok := m.nodeMap[s.Node]
 		timeout := ok && state.State == StateSuspect && state.StateChange == changeTime
 		if timeout {
-			d = &dead{Incarnation: state.Incarnation, Node: state.Name, From: m.config.Name}
+			d = &dead{Incarnation: state.Incarnation, Node: state.Name, From: m.localName()}
 		}
 		m.nodeLock.Unlock()
 
 		if timeout {
+			metrics.IncrCounter([]string{"memberlist", "suspicion", "fired"}, 1)
 			if k > 0 && numConfirmations < k {
 				metrics.IncrCounter([]string{"memberlist", "degraded", "timeout"}, 1)
 			}
@@ -1345,7 +2298,99 @@ func (m *Memberlist) suspectNode(s *suspect) {
 		}
 	}
 	// 为该目标节点构建 suspect 超时定时器，并保存
-	m.nodeTimers[s.Node] = newSuspicion(s.From, k, min, max, fn)
+	m.nodeTimers[s.Node] = newSuspicion(m.clock(), s.From, k, min, max, fn)
+	metrics.IncrCounter([]string{"memberlist", "suspicion", "started"}, 1)
+
+	// Run any shadow timers alongside the real one. They only report when
+	// they would have declared the node dead. A shadow is stopped when the
+	// node is refuted or leaves, so one that's still registered when it
+	// fires reports, even if the real timer has marked the node dead.
+	for _, p := range m.config.ShadowSuspicion {
+		p := p
+		k, min, max := m.suspicionBounds(p.SuspicionMult, p.SuspicionMaxTimeoutMult, relapsed)
+		var shadow *suspicion
+		shadowFn := func(numConfirmations int) {
+			m.nodeLock.Lock()
+			timeout := m.dropShadowTimer(s.Node, shadow)
+			m.nodeLock.Unlock()
+
+			if timeout {
+				metrics.IncrCounter([]string{"memberlist", "shadow_suspicion", p.metricName(), "dead"}, 1)
+				m.logger.Printf("[INFO] memberlist: Shadow suspicion %s would mark %s as failed after %v (%d peer confirmations)",
+					p.metricName(), s.Node, m.clock().Now().Sub(changeTime), numConfirmations)
+			}
+		}
+		shadow = newSuspicion(m.clock(), s.From, k, min, max, shadowFn)
+		m.shadowTimers[s.Node] = append(m.shadowTimers[s.Node], shadow)
+	}
+}
+
+// suspicionBounds works out the parameters for a suspicion timer with the
+// given suspicion multipliers: the number of confirmations to wait for, and
+// the minimum and maximum timeouts. Relapsed is true if the node is being
+// suspected again while it's still recovering.
+func (m *Memberlist) suspicionBounds(suspicionMult, maxTimeoutMult int, relapsed bool) (int, time.Duration, time.Duration) {
+	// Setup a suspicion timer. Given that we don't have any known phase
+	// relationship with our peers, we set up k such that we hit the nominal
+	// timeout two probe intervals short of what we expect given the suspicion
+	// multiplier.
+	// 设置一个 suspect 计时器。考虑到当前节点未和其它节点有任何联系，
+	// 因此初始设置的超时时间比我们预期的超时时间短两个探测间隔(给定怀疑乘数)
+	k := suspicionMult - 2
+
+	// If there aren't enough nodes to give the expected confirmations, just
+	// set k to 0 to say that we don't expect any. Note we subtract 2 from n
+	// here to take out ourselves and the node being probed.
+	// 但若发现集群中的节点（除自身和目标节点处）还小于 k，则直接将 k 设置为 0，以表明我们不期待任何的针对目标节点的 Confirm 操作。
+	n := m.estNumNodes()
+	if n-2 < k {
+		k = 0
+	}
+
+	// A node that's suspected again while it's still recovering from its
+	// last suspicion is likely flapping, so don't wait for confirmations
+	// before declaring it dead.
+	if relapsed {
+		k = 0
+	}
+
+	// Compute the timeouts based on the size of the cluster.
+	// 基于集群的大小以及其它超时参数来计算 suspect 定时器的超时时限的上下限。
+	min := suspicionTimeout(suspicionMult, n, m.config.ProbeInterval)
+	if min < m.config.MinSuspicionTimeout {
+		min = m.config.MinSuspicionTimeout
+	}
+	max := time.Duration(maxTimeoutMult) * min
+	return k, min, max
+}
+
+// dropShadowTimer removes a shadow suspicion timer for the node that has
+// fired, returning false if it was already stopped. The caller must hold
+// the node lock.
+func (m *Memberlist) dropShadowTimer(name string, shadow *suspicion) bool {
+	shadows := m.shadowTimers[name]
+	for i, other := range shadows {
+		if other != shadow {
+			continue
+		}
+		shadows = append(shadows[:i], shadows[i+1:]...)
+		if len(shadows) == 0 {
+			delete(m.shadowTimers, name)
+		} else {
+			m.shadowTimers[name] = shadows
+		}
+		return true
+	}
+	return false
+}
+
+// stopShadowTimers stops any shadow suspicion timers for the node. The
+// caller must hold the node lock.
+func (m *Memberlist) stopShadowTimers(name string) {
+	for _, shadow := range m.shadowTimers[name] {
+		shadow.timer.Stop()
+	}
+	delete(m.shadowTimers, name)
 }
 
 // deadNode is invoked by the network layer when we get a message
@@ -1359,18 +2404,24 @@ func (m *Memberlist) deadNode(d *dead) {
 	// If we've never heard about this node before, ignore it
 	// 若该节点不存在于节点的本地集群成员视图中，则直接忽略它，不予处理。
 	if !ok {
+		m.unknownNode("dead", d.Node, d.Incarnation, d.From)
 		return
 	}
 
 	// Ignore old incarnation numbers
 	// 若该节点的 incarnation 值要小于本节点为其存在的 incarnation 值，则同样不予处理。
-	if d.Incarnation < state.Incarnation {
+	if incarnationLess(d.Incarnation, state.Incarnation) {
 		return
 	}
 
-	// Clear out any suspicion timer that may be in effect.
+	// Clear out any suspicion timer that may be in effect. Shadow timers
+	// keep running if the node failed, so the slower ones still report,
+	// but a node that left was never going to fail.
 	// 否则，首先清除本节点为目标节点设置的 suspect 定时器。
 	delete(m.nodeTimers, d.Node)
+	if d.Node == d.From {
+		m.stopShadowTimers(d.Node)
+	}
 
 	// Ignore if node is already dead
 	// 若目标节点已处于 dead 或 left 状态，则直接忽略本消息。
@@ -1382,7 +2433,7 @@ func (m *Memberlist) deadNode(d *dead) {
 	// 节点会判断此 deadMsg 的目标成员是否即为自身，
 	// 若发现当前的 deadMsg 确实针对的是节点自身，且节点自身仍处于存活状态（未宕机），
 	// 因此，会进入驳斥怀疑的流程，即向集群广播 alive 消息，同时更新自身的 local health 值，然后返回。
-	if state.Name == m.config.Name {
+	if state.Name == m.localName() {
 		// If we are not leaving we need to refute
 		if !m.hasLeft() {
 			m.refute(state, d.Incarnation)
@@ -1396,7 +2447,9 @@ func (m *Memberlist) deadNode(d *dead) {
 		// 同时设置一个接收 channel，一旦任意一个成员收到此 dead 消息，此节点就可以放心离开集群，
 		// 否则应该在 Leave 操作中阻塞等待，直到集群成员知悉其已离开集群。
 		// 然后，将节点状态标记为 Left（正常离开）。
-		m.encodeBroadcastNotify(d.Node, deadMsg, d, m.leaveBroadcast)
+		if !m.config.Observer {
+			m.encodeBroadcastNotify(d.Node, deadMsg, d, m.leaveBroadcast)
+		}
 	} else {
 		m.encodeAndBroadcast(d.Node, deadMsg, d)
 	}
@@ -1413,17 +2466,194 @@ func (m *Memberlist) deadNode(d *dead) {
 	// 否则，若 dead 消息的节点即为发送该 dead 消息的节点，则说明该节点为主动离开集群。
 	// 因此，需要将节点的状态标记为 Left 而并非 Dead，反之亦然。
 	// 最后，更新本节点为目标节点保存的视图，比如节点状态的更新时间。
+	newState := StateDead
 	if d.Node == d.From {
-		state.State = StateLeft
-	} else {
-		state.State = StateDead
+		newState = StateLeft
 	}
-	state.StateChange = time.Now()
+	recordTransition(state.State, newState)
+	state.Recovering = false
+	state.State = newState
+	state.StateChange = m.clock().Now()
+	m.notifyStateWaiters(state)
+	m.membershipChanged()
+	m.forgetPeerMeta(state.Name)
 
 	// Notify of death
 	// 最后回调上层应用针对节点离开集群的事件设置的 hook。
 	if m.config.Events != nil {
-		m.config.Events.NotifyLeave(&state.Node)
+		if m.config.LeaveDebounce > 0 {
+			m.debounceLeave(state)
+		} else {
+			m.config.Events.NotifyLeave(&state.Node)
+		}
+	}
+}
+
+// debounceLeave puts off telling the EventDelegate that a node has left
+// until LeaveDebounce has passed, in case it comes right back. The node is
+// copied now, so the leave is still reported if the node has been reaped by
+// then. The caller must hold the node lock.
+func (m *Memberlist) debounceLeave(state *nodeState) {
+	name, changeTime := state.Name, state.StateChange
+	node := state.Node.copy()
+	if timer, ok := m.leaveTimers[name]; ok {
+		timer.Stop()
+	}
+
+	var timer Timer
+	timer = m.clock().AfterFunc(m.config.LeaveDebounce, func() {
+		m.nodeLock.Lock()
+		defer m.nodeLock.Unlock()
+
+		if m.leaveTimers[name] != timer {
+			return
+		}
+		delete(m.leaveTimers, name)
+
+		state, ok := m.nodeMap[name]
+		if !ok {
+			m.config.Events.NotifyLeave(node)
+		} else if state.DeadOrLeft() && state.StateChange == changeTime {
+			m.config.Events.NotifyLeave(&state.Node)
+		}
+	})
+	m.leaveTimers[name] = timer
+}
+
+// reclaimCheck is a probe of the new address a left or dead node is being
+// reclaimed at. See Config.VerifyReclaimByProbe.
+type reclaimCheck struct {
+	addr     []byte
+	port     uint16
+	verified bool
+}
+
+// reclaimVerified returns true if the address in the alive message has
+// answered a probe, using up the check so the next reclaim is probed
+// again. The caller must hold the node lock.
+func (m *Memberlist) reclaimVerified(a *alive) bool {
+	check, ok := m.reclaimChecks[a.Node]
+	if !ok || !check.verified || !bytes.Equal(check.addr, a.Addr) || check.port != a.Port {
+		return false
+	}
+	delete(m.reclaimChecks, a.Node)
+	return true
+}
+
+// verifyReclaim probes the address a left or dead node is being reclaimed
+// at, in the background since we can't do network I/O while holding the
+// node lock. If the node answers there, the alive message is processed
+// again and the reclaim goes ahead; otherwise it's dropped and the node is
+// left as it was. Only one probe per node is in flight at a time. The
+// caller must hold the node lock.
+func (m *Memberlist) verifyReclaim(a *alive) {
+	if check, ok := m.reclaimChecks[a.Node]; ok && !check.verified {
+		return
+	}
+	m.reclaimChecks[a.Node] = &reclaimCheck{addr: a.Addr, port: a.Port}
+
+	retry := *a
+	addr := Address{
+		Addr: joinHostPort(net.IP(a.Addr).String(), a.Port),
+		Name: a.Node,
+	}
+	m.logger.Printf("[DEBUG] memberlist: Probing %s at %s before reclaiming it", a.Node, addr.Addr)
+	go func() {
+		_, err := m.pingAddress(context.Background(), addr)
+
+		m.nodeLock.Lock()
+		if err != nil {
+			delete(m.reclaimChecks, retry.Node)
+			m.nodeLock.Unlock()
+			metrics.IncrCounter([]string{"memberlist", "reclaim", "rejected"}, 1)
+			m.logger.Printf("[WARN] memberlist: Rejected reclaim of %s at %s: %v", retry.Node, addr.Addr, err)
+			return
+		}
+		if check, ok := m.reclaimChecks[retry.Node]; ok {
+			check.verified = true
+		}
+		m.nodeLock.Unlock()
+
+		m.aliveNode(&retry, nil, false)
+
+		// If the reclaim didn't happen after all, say because the node
+		// changed state while we were probing, don't leave the check
+		// lying around to approve a later one.
+		m.nodeLock.Lock()
+		delete(m.reclaimChecks, retry.Node)
+		m.nodeLock.Unlock()
+	}()
+}
+
+// cancelLeave drops a pending leave notification for the node, returning
+// true if there was one. The caller must hold the node lock.
+func (m *Memberlist) cancelLeave(name string) bool {
+	timer, ok := m.leaveTimers[name]
+	if !ok {
+		return false
+	}
+	timer.Stop()
+	delete(m.leaveTimers, name)
+	metrics.IncrCounter([]string{"memberlist", "leave", "debounced"}, 1)
+	return true
+}
+
+// mergeMeta resolves an alive message about another node whose meta
+// conflicts with ours at the same incarnation using MetaMergeFunc, or by
+// merging the tags key by key if it isn't set. It returns the meta to keep,
+// and false if we should keep what we have. The caller must hold the node
+// lock.
+func (m *Memberlist) mergeMeta(state *nodeState, a *alive) ([]byte, bool) {
+	if state.State != StateAlive || a.Incarnation != state.Incarnation ||
+		bytes.Equal(a.Meta, state.Meta) {
+		return nil, false
+	}
+	merge := m.config.MetaMergeFunc
+	if merge == nil {
+		merge = mergeTagsMeta
+	}
+	meta := merge(state.Meta, a.Meta)
+	if bytes.Equal(meta, state.Meta) {
+		return nil, false
+	}
+	return meta, true
+}
+
+// localAliveMatches returns true if an alive message about the local node is
+// the same as what we're currently announcing, so there's nothing to refute.
+// Meta data that MetaForPeer tailored for a peer at this incarnation counts
+// as a match.
+func (m *Memberlist) localAliveMatches(state *nodeState, a *alive) bool {
+	versions := []uint8{
+		state.PMin, state.PMax, state.PCur,
+		state.DMin, state.DMax, state.DCur,
+	}
+	return a.Incarnation == state.Incarnation &&
+		(bytes.Equal(a.Meta, state.Meta) || m.sentPeerMeta(a.Incarnation, a.Meta)) &&
+		bytes.Equal(a.Vsn, versions) &&
+		a.NotReady != state.Ready
+}
+
+// coalesceMergeRefute handles an alive message about the local node that
+// came from a push/pull merge when RefuteCoalesce is set. If we refuted
+// anything recently, the refute is put off until the interval is up, and
+// then one refute covers every stale entry seen in the meantime.
+func (m *Memberlist) coalesceMergeRefute(a *alive) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	state, ok := m.nodeMap[m.localName()]
+	if !ok || incarnationLess(a.Incarnation, state.Incarnation) || m.localAliveMatches(state, a) {
+		return
+	}
+
+	// Merged refutes are held back for whichever interval is longer.
+	interval := m.config.RefuteCoalesce
+	if interval < m.config.MinRefuteInterval {
+		interval = m.config.MinRefuteInterval
+	}
+	if m.limitRefute(state, a.Incarnation, interval, "coalesced") {
+		m.logger.Printf("[WARN] memberlist: Refuting a merged alive message for '%s'", a.Node)
 	}
 }
 
@@ -1443,6 +2673,11 @@ func (m *Memberlist) mergeState(remote []pushNodeState) {
 				Port:        r.Port,
 				Meta:        r.Meta,
 				Vsn:         r.Vsn,
+				NotReady:    r.NotReady,
+			}
+			if r.Name == m.localName() && m.config.RefuteCoalesce > 0 {
+				m.coalesceMergeRefute(&a)
+				continue
 			}
 			m.aliveNode(&a, nil, false)
 
@@ -1456,8 +2691,89 @@ func (m *Memberlist) mergeState(remote []pushNodeState) {
 			// suspect that node instead of declaring it dead instantly
 			fallthrough
 		case StateSuspect:
-			s := suspect{Incarnation: r.Incarnation, Node: r.Name, From: m.config.Name}
+			s := suspect{Incarnation: r.Incarnation, Node: r.Name, From: m.localName()}
 			m.suspectNode(&s)
 		}
 	}
 }
+
+// addNode stores a node we've never seen before. It must be called with
+// nodeLock held.
+func (m *Memberlist) addNode(state *nodeState) {
+	// Add to map
+	m.nodeMap[state.Name] = state
+
+	// Get a random offset. This is important to ensure
+	// the failure detection bound is low on average. If all
+	// nodes did an append, failure detection bound would be
+	// very high.
+	n := len(m.nodes)
+	offset := randomOffset(n)
+	if m.config.StableProbeOrder {
+		offset = n
+	}
+
+	// Add at the end and swap with the node at the offset
+	m.nodes = append(m.nodes, state)
+	m.nodes[offset], m.nodes[n] = m.nodes[n], m.nodes[offset]
+
+	// Update numNodes after we've added a new node
+	atomic.AddUint32(&m.numNodes, 1)
+}
+
+// addSuspectNodes adds any nodes the remote side suspects that we don't know
+// about yet as alive nodes, so they're announced to the EventDelegate. A
+// subsequent mergeState will then mark them as suspect. They're only added
+// locally, since an alive message we made up for someone else's node could
+// cancel a real suspicion elsewhere in the cluster.
+func (m *Memberlist) addSuspectNodes(remote []pushNodeState) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	for _, r := range remote {
+		if r.State != StateSuspect {
+			continue
+		}
+		if _, known := m.nodeMap[r.Name]; known {
+			continue
+		}
+		if err := m.config.IPAllowed(r.Addr); err != nil {
+			m.logger.Printf("[WARN] memberlist: Rejected node %s (%v): %s", r.Name, net.IP(r.Addr), err)
+			continue
+		}
+
+		state := &nodeState{
+			Node: Node{
+				Name:  r.Name,
+				Addr:  r.Addr,
+				Port:  r.Port,
+				Meta:  r.Meta,
+				Ready: !r.NotReady,
+			},
+			Incarnation: r.Incarnation,
+			State:       StateAlive,
+			StateChange: m.clock().Now(),
+		}
+		if len(r.Vsn) > 5 {
+			state.PMin = r.Vsn[0]
+			state.PMax = r.Vsn[1]
+			state.PCur = r.Vsn[2]
+			state.DMin = r.Vsn[3]
+			state.DMax = r.Vsn[4]
+			state.DCur = r.Vsn[5]
+		}
+		if m.config.Alive != nil {
+			if err := m.config.Alive.NotifyAlive(&state.Node); err != nil {
+				m.logger.Printf("[WARN] memberlist: ignoring suspect node '%s': %s", r.Name, err)
+				continue
+			}
+		}
+
+		m.addNode(state)
+		m.notifyStateWaiters(state)
+		m.membershipChanged()
+		if m.config.Events != nil {
+			m.config.Events.NotifyJoin(&state.Node)
+		}
+	}
+}
@@ -2,17 +2,22 @@ package memberlist
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
 	iretry "github.com/hashicorp/memberlist/internal/retry"
 	"github.com/stretchr/testify/require"
 )
@@ -85,6 +90,192 @@ func TestMemberList_Probe(t *testing.T) {
 	}
 }
 
+func TestMemberList_Probe_MultiplePerTick(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.ProbesPerTick = 5
+		c.DisableTcpPings = true
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte(net.ParseIP(m.config.BindAddr)), Port: uint16(m.config.BindPort), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	for i := 0; i < 3; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+
+	m.probe()
+
+	// Each of the three peers should be probed exactly once, even though
+	// more probes per tick were allowed.
+	if seq := atomic.LoadUint32(&m.sequenceNum); seq != 3 {
+		t.Fatalf("bad seqno %v", seq)
+	}
+	for i := 0; i < 3; i++ {
+		if state := m.getNodeState(fmt.Sprintf("test%d", i)); state != StateSuspect {
+			t.Fatalf("expected test%d to be suspect, got %v", i, state)
+		}
+	}
+}
+
+func TestMemberList_Probe_SkipProbeForNode(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.DisableTcpPings = true
+		c.SkipProbeForNode = func(n *Node) bool {
+			return n.Name == "observer"
+		}
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte(net.ParseIP(m.config.BindAddr)), Port: uint16(m.config.BindPort), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	a = alive{Node: "observer", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	// Probe a few times, the observer should never be picked.
+	for i := 0; i < 3; i++ {
+		m.probe()
+	}
+	if seq := atomic.LoadUint32(&m.sequenceNum); seq != 0 {
+		t.Fatalf("bad seqno %v", seq)
+	}
+	if state := m.getNodeState("observer"); state != StateAlive {
+		t.Fatalf("expected observer to be alive, got %v", state)
+	}
+}
+
+func TestMemberList_NextProbeNode_StalenessWeighted(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.StalenessWeightedProbing = true
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte(net.ParseIP(m.config.BindAddr)), Port: uint16(m.config.BindPort), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	for i := 0; i < 4; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+
+	// We heard from everyone just now, except test0.
+	now := time.Now()
+	m.nodeLock.Lock()
+	for _, n := range m.nodes {
+		n.lastContact = now
+	}
+	m.nodeMap["test0"].lastContact = now.Add(-time.Hour)
+	m.nodeLock.Unlock()
+
+	picks := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		node, ok := m.nextProbeNode(nil)
+		require.True(t, ok)
+		picks[node.Name]++
+	}
+
+	// The stale node wins nearly every weighted pick, but the round robin
+	// still gets to everyone else.
+	require.True(t, picks["test0"] > 60, "picks: %v", picks)
+	for i := 1; i < 4; i++ {
+		require.True(t, picks[fmt.Sprintf("test%d", i)] > 0, "picks: %v", picks)
+	}
+	require.Zero(t, picks[m.config.Name])
+}
+
+func TestMemberList_ProbeNode_OnDemand(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	addr3 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+	ip3 := []byte(addr3)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ProbeInterval = 50 * time.Millisecond
+		c.DisableTcpPings = true
+	})
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+	})
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: uint16(bindPort), Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+	m1.aliveNode(&a2, nil, false)
+	a3 := alive{Node: addr3.String(), Addr: ip3, Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a3, nil, false)
+
+	// A live node is reachable.
+	ok, rtt, err := m1.ProbeNode(addr2.String(), context.Background())
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, rtt > 0)
+
+	// A dead node is unreachable, but isn't suspected by default.
+	ok, _, err = m1.ProbeNode(addr3.String(), context.Background())
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, StateAlive, m1.getNodeState(addr3.String()))
+
+	// A canceled probe gives up right away.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ok, _, err = m1.ProbeNode(addr3.String(), ctx)
+	require.Equal(t, context.Canceled, err)
+	require.False(t, ok)
+
+	// Unknown nodes and ourselves can't be probed.
+	_, _, err = m1.ProbeNode("nope", context.Background())
+	require.Error(t, err)
+	_, _, err = m1.ProbeNode(addr1.String(), context.Background())
+	require.Error(t, err)
+
+	// Opting in makes a failed probe suspect the node.
+	m1.config.ProbeNodeSuspects = true
+	ok, _, err = m1.ProbeNode(addr3.String(), context.Background())
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, StateSuspect, m1.getNodeState(addr3.String()))
+}
+
+func TestMemberList_ProbeNode_LabeledMetrics(t *testing.T) {
+	tm := newTestMetrics(t)
+
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.LabeledMetrics = true
+	})
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+	a1 := alive{Node: addr1.String(), Addr: []byte(addr1), Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: "gone", Addr: []byte(addr2), Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a2, nil, false)
+
+	m1.probeNode(m1.nodeMap["gone"])
+
+	require.Equal(t, 1, tm.Counter("memberlist.probe.failed;node=gone").Count)
+	require.Equal(t, 1, tm.Sample("memberlist.probeNode;node=gone").Count)
+
+	// Without the option there are no labels.
+	m1.config.LabeledMetrics = false
+	require.Nil(t, m1.nodeLabels("gone"))
+}
+
 func TestMemberList_ProbeNode_Suspect(t *testing.T) {
 	addr1 := getBindAddr()
 	addr2 := getBindAddr()
@@ -135,6 +326,161 @@ func TestMemberList_ProbeNode_Suspect(t *testing.T) {
 	}
 }
 
+func TestMemberList_ProbeNode_IndirectRetries(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	addr3 := getBindAddr()
+	addr4 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+	ip3 := []byte(addr3)
+	ip4 := []byte(addr4)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 100 * time.Millisecond
+		c.IndirectChecks = 1
+		c.IndirectRetries = 1
+	})
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+	})
+	defer m2.Shutdown()
+	m3 := HostMemberlist(addr3.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+	})
+	defer m3.Shutdown()
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: uint16(bindPort), Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+	m1.aliveNode(&a2, nil, false)
+	a3 := alive{Node: addr3.String(), Addr: ip3, Port: uint16(bindPort), Incarnation: 1, Vsn: m3.config.BuildVsnArray()}
+	m1.aliveNode(&a3, nil, false)
+	a4 := alive{Node: addr4.String(), Addr: ip4, Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a4, nil, false)
+
+	n := m1.nodeMap[addr4.String()]
+	m1.probeNode(n)
+	require.Equal(t, StateSuspect, n.State)
+	time.Sleep(10 * time.Millisecond)
+
+	// With one retry and one indirect check per round, both peers should
+	// have been asked to probe.
+	require.Equal(t, uint32(1), atomic.LoadUint32(&m2.sequenceNum))
+	require.Equal(t, uint32(1), atomic.LoadUint32(&m3.sequenceNum))
+}
+
+func TestMemberList_ProbeNode_NoIndirectChecks(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ProbeInterval = 50 * time.Millisecond
+		c.IndirectChecks = 0
+		c.IndirectRetries = 2
+		c.DisableTcpPings = true
+	})
+	defer m.Shutdown()
+
+	// A live peer that would normally be asked to ping the node for us.
+	peer := listenUDP(t)
+	defer peer.Close()
+	peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	a = alive{Node: "peer", Addr: []byte(peerAddr.IP.To4()), Port: uint16(peerAddr.Port), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	a = alive{Node: "gone", Addr: []byte{127, 0, 0, 1}, Port: 1, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	m.nodeLock.RLock()
+	n := m.nodeMap["gone"]
+	m.nodeLock.RUnlock()
+	m.probeNode(n)
+
+	// The node is still suspected, and without nacks to go by, the failed
+	// probe counts against our own health.
+	require.Equal(t, StateSuspect, m.getNodeState("gone"))
+	require.Equal(t, 1, m.GetHealthScore())
+
+	// But the peer was never asked for an indirect ping.
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	buf := make([]byte, udpPacketBufSize)
+	_, _, err := peer.ReadFrom(buf)
+	require.Error(t, err)
+}
+
+func TestMemberList_ProbeNode_IndirectTTL(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ProbeInterval = 50 * time.Millisecond
+		c.IndirectChecks = 2
+		c.IndirectPingTTL = 3
+		c.DisableTcpPings = true
+		c.EnableCompression = false
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+
+	// One peer speaks the current protocol, the other predates the TTL.
+	udpNew, udpOld := listenUDP(t), listenUDP(t)
+	defer udpNew.Close()
+	defer udpOld.Close()
+	for name, udp := range map[string]*net.UDPConn{"new": udpNew, "old": udpOld} {
+		addr := udp.LocalAddr().(*net.UDPAddr)
+		vsn := m.config.BuildVsnArray()
+		if name == "old" {
+			vsn[1] = 5
+		}
+		a := alive{Node: name, Addr: []byte(addr.IP.To4()), Port: uint16(addr.Port), Incarnation: 1, Vsn: vsn}
+		m.aliveNode(&a, nil, false)
+	}
+	a = alive{Node: "gone", Addr: []byte{127, 0, 0, 1}, Port: 1, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	m.nodeLock.RLock()
+	n := m.nodeMap["gone"]
+	m.nodeLock.RUnlock()
+	m.probeNode(n)
+
+	readInd := func(udp *net.UDPConn) indirectPingReq {
+		buf := make([]byte, udpPacketBufSize)
+		for {
+			require.NoError(t, udp.SetReadDeadline(time.Now().Add(time.Second)))
+			n, _, err := udp.ReadFrom(buf)
+			require.NoError(t, err)
+
+			msgs := [][]byte{buf[:n]}
+			if messageType(buf[0]) == compoundMsg {
+				_, msgs, err = decodeCompoundMessage(buf[1:n])
+				require.NoError(t, err)
+			}
+			for _, msg := range msgs {
+				if messageType(msg[0]) != indirectPingMsg {
+					continue
+				}
+				var ind indirectPingReq
+				require.NoError(t, decode(msg[1:], &ind))
+				return ind
+			}
+		}
+	}
+
+	ind := readInd(udpNew)
+	require.NotNil(t, ind.TTL)
+	require.Equal(t, uint8(3), *ind.TTL)
+	require.True(t, ind.Nack)
+
+	ind = readInd(udpOld)
+	require.Nil(t, ind.TTL)
+	require.True(t, ind.Nack)
+}
+
 func TestMemberList_ProbeNode_Suspect_Dogpile(t *testing.T) {
 	cases := []struct {
 		name          string
@@ -227,6 +573,58 @@ func TestMemberList_ProbeNode_Suspect_Dogpile(t *testing.T) {
 	}
 }
 
+func TestMemberList_ProbeNode_TCPPingTimeout(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ProbeInterval = 50 * time.Millisecond
+		c.TCPPingTimeout = 300 * time.Millisecond
+	})
+	defer m.Shutdown()
+
+	// Accept TCP connections but never answer them, so the fallback ping
+	// runs until its deadline.
+	addr := getBindAddr()
+	list, err := net.Listen("tcp", net.JoinHostPort(addr.String(), "0"))
+	require.NoError(t, err)
+	defer list.Close()
+	go func() {
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	port := list.Addr().(*net.TCPAddr).Port
+	a := alive{Node: "slow", Addr: []byte(addr), Port: uint16(port), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	start := time.Now()
+	ok, _, err := m.ProbeNode("slow", context.Background())
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.True(t, time.Since(start) >= 250*time.Millisecond, "probe took %v", time.Since(start))
+
+	// Canceling the probe stops the wait for the fallback ping.
+	probe := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, _, err := m.ProbeNode("slow", ctx)
+		require.Equal(t, context.DeadlineExceeded, err)
+		require.True(t, time.Since(start) < 250*time.Millisecond, "probe took %v", time.Since(start))
+	}
+	probe()
+
+	// Likewise for the direct ping of a node that prefers TCP.
+	m.config.ProbeTimeout = 300 * time.Millisecond
+	m.config.ProbeInterval = time.Second
+	m.config.PreferTCPForNode = func(*Node) bool { return true }
+	probe()
+}
+
 /*
 func TestMemberList_ProbeNode_FallbackTCP(t *testing.T) {
 	addr1 := getBindAddr()
@@ -548,6 +946,56 @@ func TestMemberList_ProbeNode_FallbackTCP_OldProtocol(t *testing.T) {
 }
 */
 
+// stuckDialTransport never finishes a dial until it's released, like a
+// transport that ignores its timeout.
+type stuckDialTransport struct {
+	NodeAwareTransport
+	release chan struct{}
+}
+
+func (s *stuckDialTransport) DialAddressTimeout(a Address, timeout time.Duration) (net.Conn, error) {
+	<-s.release
+	return nil, fmt.Errorf("released")
+}
+
+func TestMemberList_ProbeNode_FallbackTCP_Stuck(t *testing.T) {
+	nt, err := NewNetTransport(&NetTransportConfig{
+		BindAddrs: []string{"127.0.0.1"},
+		Logger:    log.New(os.Stderr, "", log.LstdFlags),
+	})
+	require.NoError(t, err)
+	release := make(chan struct{})
+	defer close(release)
+
+	m := GetMemberlist(t, func(c *Config) {
+		c.Transport = &stuckDialTransport{nt, release}
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ProbeInterval = 50 * time.Millisecond
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Port: uint16(nt.GetAutoBindPort()), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	a = alive{Node: "gone", Addr: []byte{127, 0, 0, 1}, Port: 1, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	// The probe gives up on the stuck fallback ping instead of hanging.
+	m.nodeLock.RLock()
+	n := m.nodeMap["gone"]
+	m.nodeLock.RUnlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.probeNode(n)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("probe is stuck")
+	}
+	require.Equal(t, StateSuspect, m.getNodeState("gone"))
+}
+
 func TestMemberList_ProbeNode_Awareness_Degraded(t *testing.T) {
 	addr1 := getBindAddr()
 	addr2 := getBindAddr()
@@ -973,6 +1421,146 @@ func TestMemberList_ProbeNode(t *testing.T) {
 	}
 }
 
+func TestMemberList_ProbeNode_PreferTCP(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	ping := &MockPing{}
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 100 * time.Millisecond
+		c.ProbeInterval = 200 * time.Millisecond
+		c.PreferTCPForNode = func(n *Node) bool {
+			return n.Name == addr2.String()
+		}
+		c.Ping = ping
+	})
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+	})
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: uint16(bindPort), Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+	m1.aliveNode(&a2, nil, false)
+
+	// The probe goes over TCP without trying UDP first.
+	before := m1.TransportStats()
+	n := m1.nodeMap[addr2.String()]
+	m1.probeNode(n)
+	require.Equal(t, StateAlive, n.State)
+	after := m1.TransportStats()
+	require.Equal(t, before.UDPSent, after.UDPSent)
+	require.True(t, after.TCPSent > before.TCPSent, "no TCP sent")
+
+	// The ping delegate still hears about it, though there's no payload.
+	other, rtt, payload := ping.getContents()
+	require.NotNil(t, other)
+	require.Equal(t, addr2.String(), other.Name)
+	require.True(t, rtt > 0)
+	require.Nil(t, payload)
+}
+
+func TestMemberList_ProbeNode_PreferTCP_Suspect(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 100 * time.Millisecond
+		c.ProbeInterval = 200 * time.Millisecond
+		c.PreferTCPForNode = func(n *Node) bool {
+			return n.Name == addr2.String()
+		}
+	})
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+	})
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: uint16(bindPort), Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+	m1.aliveNode(&a2, nil, false)
+	m2.aliveNode(&a2, nil, true)
+	m2.aliveNode(&a1, nil, false)
+
+	// Probing a suspect node over TCP still tells it, so it refutes.
+	m1.suspectNode(&suspect{Node: addr2.String(), Incarnation: 1, From: addr1.String()})
+	n := m1.nodeMap[addr2.String()]
+	m1.probeNode(n)
+	waitForCondition(t, func() (bool, string) {
+		inc := atomic.LoadUint32(&m2.incarnation)
+		return inc > 1, fmt.Sprintf("expected a refute, incarnation is %d", inc)
+	})
+}
+
+func TestMemberList_LastContact(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 100 * time.Millisecond
+		c.ProbeInterval = time.Second
+	})
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+	})
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: uint16(bindPort), Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+	m1.aliveNode(&a2, nil, false)
+	m2.aliveNode(&a2, nil, true)
+	m2.aliveNode(&a1, nil, false)
+
+	_, ok := m1.LastContact("nope")
+	require.False(t, ok)
+	last, ok := m1.LastContact(addr2.String())
+	require.True(t, ok)
+	require.True(t, last.IsZero())
+
+	// A successful probe records the contact without changing state.
+	n := m1.nodeMap[addr2.String()]
+	stateChange := n.StateChange
+	m1.probeNode(n)
+	require.Equal(t, StateAlive, n.State)
+	require.Equal(t, stateChange, n.StateChange)
+	probed, _ := m1.LastContact(addr2.String())
+	require.False(t, probed.IsZero())
+
+	// A push/pull updates both sides.
+	before, _ := m2.LastContact(addr1.String())
+	require.True(t, before.IsZero())
+	require.NoError(t, m1.pushPullNode(n.FullAddress(), false))
+	pushed, _ := m1.LastContact(addr2.String())
+	require.True(t, pushed.After(probed))
+	iretry.Run(t, func(r *iretry.R) {
+		after, _ := m2.LastContact(addr1.String())
+		if after.IsZero() {
+			r.Fatal("no contact recorded for inbound push/pull")
+		}
+	})
+}
+
 func TestMemberList_Ping(t *testing.T) {
 	addr1 := getBindAddr()
 	addr2 := getBindAddr()
@@ -1016,6 +1604,72 @@ func TestMemberList_Ping(t *testing.T) {
 	if _, ok := err.(NoPingResponseError); !ok || err == nil {
 		t.Fatalf("bad: %v", err)
 	}
+	pingErr := err.(NoPingResponseError)
+	require.Equal(t, PingTimeout, pingErr.Phase)
+	require.Equal(t, addr.String(), pingErr.Addr)
+	require.True(t, pingErr.Duration >= m1.config.ProbeTimeout, "bad duration: %v", pingErr.Duration)
+
+	// A ping that can't be sent says so.
+	m1.config.RequireNodeNames = true
+	_, err = m1.Ping("", addr)
+	require.True(t, errors.As(err, &pingErr), "bad: %v", err)
+	require.Equal(t, PingSendFailed, pingErr.Phase)
+	require.True(t, errors.Is(err, errNodeNamesAreRequired))
+}
+
+func TestMemberList_PingAll(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	addr3 := getBindAddr()
+	addr4 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+	ip3 := []byte(addr3)
+	ip4 := []byte(addr4)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 200 * time.Millisecond
+	})
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+	})
+	defer m2.Shutdown()
+	m3 := HostMemberlist(addr3.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+	})
+	defer m3.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: uint16(bindPort), Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: uint16(bindPort), Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+	a3 := alive{Node: addr3.String(), Addr: ip3, Port: uint16(bindPort), Incarnation: 1}
+	m1.aliveNode(&a3, nil, false)
+
+	// Nothing is listening for the fourth node.
+	a4 := alive{Node: addr4.String(), Addr: ip4, Port: uint16(bindPort), Incarnation: 1}
+	m1.aliveNode(&a4, nil, false)
+
+	results := m1.PingAll(context.Background(), 2)
+	require.Len(t, results, 3)
+	for _, addr := range []string{addr2.String(), addr3.String()} {
+		require.NoError(t, results[addr].Err)
+		require.True(t, results[addr].RTT > 0)
+	}
+	require.IsType(t, NoPingResponseError{}, results[addr4.String()].Err)
+
+	// Once the context is done, everything left reports its error.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = m1.PingAll(ctx, 1)
+	require.Len(t, results, 3)
+	for _, r := range results {
+		require.Error(t, r.Err)
+	}
 }
 
 func TestMemberList_ResetNodes(t *testing.T) {
@@ -1051,6 +1705,64 @@ func TestMemberList_ResetNodes(t *testing.T) {
 	}
 }
 
+func TestMemberList_ResetNodes_DeadNodeGossipCount(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.GossipToTheDeadTime = 0
+		c.DeadNodeGossipCount = 2
+	})
+	defer m.Shutdown()
+
+	a1 := alive{Node: "test1", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a1, nil, false)
+	a2 := alive{Node: "test2", Addr: []byte{127, 0, 0, 2}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a2, nil, false)
+	m.broadcasts.Reset()
+	m.deadNode(&dead{Node: "test2", Incarnation: 1})
+
+	// The dead node sticks around until it's been gossiped twice, even
+	// though the time bound is up.
+	for i := 0; i < 2; i++ {
+		m.resetNodes()
+		require.Contains(t, m.nodeMap, "test2", "round %d", i)
+		require.Len(t, m.getBroadcasts(compoundOverhead, 1400), 1)
+	}
+	m.resetNodes()
+	require.NotContains(t, m.nodeMap, "test2")
+	require.Len(t, m.nodes, 1)
+}
+
+func TestMemberList_ResetNodes_StableProbeOrder(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.StableProbeOrder = true
+	})
+	defer m.Shutdown()
+
+	for i := 1; i <= 5; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, byte(i)}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+	order := func() []string {
+		var names []string
+		for _, n := range m.nodes {
+			names = append(names, n.Name)
+		}
+		return names
+	}
+	require.Equal(t, []string{"test1", "test2", "test3", "test4", "test5"}, order())
+
+	// Each round probes them in the same order.
+	m.resetNodes()
+	require.Equal(t, []string{"test1", "test2", "test3", "test4", "test5"}, order())
+
+	// Reaping keeps the rest in order, and new nodes go on the end.
+	m.deadNode(&dead{Node: "test4", Incarnation: 1})
+	m.nodeMap["test4"].StateChange = time.Now().Add(-time.Hour)
+	a := alive{Node: "test6", Addr: []byte{127, 0, 0, 6}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	m.resetNodes()
+	require.Equal(t, []string{"test1", "test2", "test3", "test5", "test6"}, order())
+}
+
 func TestMemberList_NextSeq(t *testing.T) {
 	m := &Memberlist{}
 	if m.nextSeqNo() != 1 {
@@ -1075,7 +1787,7 @@ func TestMemberList_setProbeChannels(t *testing.T) {
 	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
 
 	ch := make(chan ackMessage, 1)
-	m.setProbeChannels(0, ch, nil, 10*time.Millisecond)
+	m.setProbeChannels(0, "", ch, nil, 10*time.Millisecond)
 
 	require.True(t, ackHandlerExists(t, m, 0), "missing handler")
 
@@ -1084,6 +1796,156 @@ func TestMemberList_setProbeChannels(t *testing.T) {
 	require.False(t, ackHandlerExists(t, m, 0), "non-reaped handler")
 }
 
+func TestMemberList_setProbeChannels_SeqNoReuse(t *testing.T) {
+	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
+
+	// A wrapped around sequence number takes over the slot of a probe
+	// that hasn't timed out yet.
+	oldCh := make(chan ackMessage, 1)
+	m.setProbeChannels(0, "", oldCh, nil, 10*time.Millisecond)
+	newCh := make(chan ackMessage, 1)
+	m.setProbeChannels(0, "", newCh, nil, time.Second)
+
+	// The old probe still times out, without taking the new handler.
+	select {
+	case v := <-oldCh:
+		require.False(t, v.Complete)
+	case <-time.After(time.Second):
+		t.Fatalf("old probe didn't time out")
+	}
+	require.True(t, ackHandlerExists(t, m, 0), "new handler was reaped")
+
+	// The ack only goes to the new probe.
+	m.invokeAckHandler(ackResp{0, nil}, time.Now())
+	v := <-newCh
+	require.True(t, v.Complete)
+	select {
+	case v := <-oldCh:
+		t.Fatalf("old probe got %v", v)
+	default:
+	}
+}
+
+func TestMemberList_ProbeNode_Rapid(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 50 * time.Millisecond
+		c.ProbeInterval = 100 * time.Millisecond
+	})
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+	})
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: uint16(bindPort), Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: uint16(bindPort), Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	// Back to back probes each get their own ack, and none of them are
+	// left waiting once they're done.
+	m1.nodeLock.RLock()
+	n := m1.nodeMap[addr2.String()]
+	m1.nodeLock.RUnlock()
+	for i := 0; i < 50; i++ {
+		ok, _, err := m1.runProbe(context.Background(), n, true)
+		require.NoError(t, err)
+		require.True(t, ok, "probe %d failed", i)
+		require.Equal(t, StateAlive, m1.getNodeState(addr2.String()))
+	}
+	require.Equal(t, 0, m1.PendingAcks())
+
+	// Each direct ack fed the node's RTT.
+	m1.nodeLock.RLock()
+	require.True(t, n.hasRTT)
+	m1.nodeLock.RUnlock()
+}
+
+func TestMemberList_MembersByRTT(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	for _, name := range []string{"far", "near", "new", "suspect"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+	m.suspectNode(&suspect{Node: "suspect", Incarnation: 1, From: m.config.Name})
+	m.recordRTT("far", 30*time.Millisecond)
+	m.recordRTT("near", 10*time.Millisecond)
+	m.recordRTT("suspect", time.Millisecond)
+
+	names := func() []string {
+		var out []string
+		for _, n := range m.MembersByRTT() {
+			out = append(out, n.Name)
+		}
+		return out
+	}
+	require.Equal(t, []string{"near", "far", "new"}, names())
+
+	// A single slow ping only nudges the average.
+	m.recordRTT("near", 60*time.Millisecond)
+	require.Equal(t, []string{"near", "far", "new"}, names())
+
+	// But a node that stays slow sinks.
+	for i := 0; i < 10; i++ {
+		m.recordRTT("near", 60*time.Millisecond)
+	}
+	require.Equal(t, []string{"far", "near", "new"}, names())
+
+	// We get copies.
+	nodes := m.MembersByRTT()
+	nodes[0].Addr[0] = 0
+	require.Equal(t, byte(127), m.MembersByRTT()[0].Addr[0])
+}
+
+func TestMemberList_IsAlive(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	requireState := func(name string, want NodeStateType) {
+		t.Helper()
+		state, ok := m.NodeState(name)
+		require.True(t, ok)
+		require.Equal(t, want, state)
+		require.Equal(t, want == StateAlive, m.IsAlive(name))
+	}
+
+	_, ok := m.NodeState("test")
+	require.False(t, ok)
+	require.False(t, m.IsAlive("test"))
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	requireState("test", StateAlive)
+
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: m.config.Name})
+	requireState("test", StateSuspect)
+
+	// A refutation brings it back.
+	a.Incarnation = 2
+	m.aliveNode(&a, nil, false)
+	requireState("test", StateAlive)
+
+	m.deadNode(&dead{Node: "test", Incarnation: 2, From: m.config.Name})
+	requireState("test", StateDead)
+
+	a.Incarnation = 3
+	m.aliveNode(&a, nil, false)
+	m.deadNode(&dead{Node: "test", Incarnation: 3, From: "test"})
+	requireState("test", StateLeft)
+}
+
 func TestMemberList_setAckHandler(t *testing.T) {
 	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
 
@@ -1097,6 +1959,21 @@ func TestMemberList_setAckHandler(t *testing.T) {
 	require.False(t, ackHandlerExists(t, m, 0), "non-reaped handler")
 }
 
+func TestMemberList_PendingAcks(t *testing.T) {
+	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
+	require.Equal(t, 0, m.PendingAcks())
+
+	f := func([]byte, time.Time) {}
+	m.setAckHandler(0, f, 10*time.Millisecond)
+	m.setAckHandler(1, f, time.Second)
+	require.Equal(t, 2, m.PendingAcks())
+
+	// One is answered and one is reaped.
+	m.invokeAckHandler(ackResp{1, nil}, time.Now())
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 0, m.PendingAcks())
+}
+
 func TestMemberList_invokeAckHandler(t *testing.T) {
 	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
 
@@ -1126,7 +2003,7 @@ func TestMemberList_invokeAckHandler_Channel_Ack(t *testing.T) {
 
 	ackCh := make(chan ackMessage, 1)
 	nackCh := make(chan struct{}, 1)
-	m.setProbeChannels(0, ackCh, nackCh, 10*time.Millisecond)
+	m.setProbeChannels(0, "", ackCh, nackCh, 10*time.Millisecond)
 
 	// Should send message
 	m.invokeAckHandler(ack, time.Now())
@@ -1160,7 +2037,7 @@ func TestMemberList_invokeAckHandler_Channel_Nack(t *testing.T) {
 
 	ackCh := make(chan ackMessage, 1)
 	nackCh := make(chan struct{}, 1)
-	m.setProbeChannels(0, ackCh, nackCh, 10*time.Millisecond)
+	m.setProbeChannels(0, "", ackCh, nackCh, 10*time.Millisecond)
 
 	// Should send message.
 	m.invokeNackHandler(nack)
@@ -1241,10 +2118,42 @@ func TestMemberList_AliveNode_NewNode(t *testing.T) {
 		t.Fatalf("no join message")
 	}
 
-	// Check a broad cast is queued
-	if m.broadcasts.NumQueued() != 1 {
-		t.Fatalf("expected queued message")
-	}
+	// Check a broad cast is queued
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("expected queued message")
+	}
+}
+
+func TestMemberList_AddSuspectNodes(t *testing.T) {
+	ch := make(chan NodeEvent, 1)
+	m := GetMemberlist(t, func(c *Config) {
+		c.Events = &ChannelEventDelegate{ch}
+	})
+	defer m.Shutdown()
+
+	remote := []pushNodeState{{
+		Name:        "test",
+		Addr:        []byte{127, 0, 0, 1},
+		Incarnation: 1,
+		State:       StateSuspect,
+		Vsn:         m.config.BuildVsnArray(),
+	}}
+	m.addSuspectNodes(remote)
+
+	select {
+	case e := <-ch:
+		require.Equal(t, NodeJoin, e.Event)
+		require.Equal(t, "test", e.Node.Name)
+	default:
+		t.Fatalf("no join message")
+	}
+
+	// Nothing is announced about someone else's node.
+	require.Equal(t, 0, m.broadcasts.NumQueued())
+
+	// Merging then marks it suspect as usual.
+	m.mergeState(remote)
+	require.Equal(t, StateSuspect, m.getNodeState("test"))
 }
 
 func TestMemberList_AliveNode_SuspectNode(t *testing.T) {
@@ -1479,6 +2388,237 @@ func TestMemberList_AliveNode_Refute(t *testing.T) {
 	}
 }
 
+func TestMemberList_AliveNode_MetaMergeFunc(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.MetaMergeFunc = func(existing, incoming []byte) []byte {
+			if bytes.Compare(incoming, existing) > 0 {
+				return incoming
+			}
+			return existing
+		}
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Meta: []byte("b"), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	m.broadcasts.Reset()
+
+	// The lesser meta at the same incarnation is ignored.
+	lesser := a
+	lesser.Meta = []byte("a")
+	m.aliveNode(&lesser, nil, false)
+	require.Equal(t, []byte("b"), m.nodeMap["test"].Meta)
+	require.Equal(t, 0, m.broadcasts.NumQueued())
+
+	// The greater one wins, and gets passed along.
+	greater := a
+	greater.Meta = []byte("c")
+	m.aliveNode(&greater, nil, false)
+	require.Equal(t, []byte("c"), m.nodeMap["test"].Meta)
+	require.Equal(t, uint32(1), m.nodeMap["test"].Incarnation)
+	require.Equal(t, 1, m.broadcasts.NumQueued())
+}
+
+func TestMemberList_AliveNode_RestartDetected(t *testing.T) {
+	var logs bytes.Buffer
+	m := GetMemberlist(t, func(c *Config) {
+		c.Logger = log.New(&logs, "", 0)
+	})
+	defer m.Shutdown()
+
+	// We restarted with configuration C' at the same incarnation as before.
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Meta: []byte("new"), Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	m.broadcasts.Reset()
+
+	// Peers keep gossiping what we announced with configuration C.
+	old := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Meta: []byte("old"), Vsn: m.config.BuildVsnArray()}
+	for i := 0; i < 5; i++ {
+		stale := old
+		m.aliveNode(&stale, nil, false)
+	}
+
+	// A single refute takes care of all of them.
+	state := m.nodeMap[m.config.Name]
+	require.Equal(t, uint32(2), state.Incarnation)
+	require.Equal(t, []byte("new"), state.Meta)
+	require.Equal(t, 1, m.broadcasts.NumQueued())
+	require.Equal(t, 1, strings.Count(logs.String(), "Restart detected"))
+}
+
+func TestMemberList_LocalAliveOverride(t *testing.T) {
+	var calls int
+	m := GetMemberlist(t, func(c *Config) {
+		c.LocalAliveOverride = func(meta []byte) []byte {
+			calls++
+			return []byte(fmt.Sprintf("load=%d", calls))
+		}
+	})
+	defer m.Shutdown()
+
+	require.NoError(t, m.setAlive())
+	require.Equal(t, []byte("load=1"), m.LocalNode().Meta)
+
+	// Refuting recomputes the meta data, both in the broadcast and in our
+	// own state.
+	m.broadcasts.Reset()
+	s := suspect{Node: m.config.Name, Incarnation: 1, From: "other"}
+	m.suspectNode(&s)
+
+	require.Equal(t, 1, m.broadcasts.NumQueued())
+	msg := m.broadcasts.orderedView(true)[0].b.Message()
+	require.Equal(t, aliveMsg, messageType(msg[0]))
+	var a alive
+	require.NoError(t, decode(msg[1:], &a))
+	require.Equal(t, []byte("load=2"), a.Meta)
+	require.Equal(t, []byte("load=2"), m.LocalNode().Meta)
+}
+
+type addrChangeRecorder struct {
+	ChannelEventDelegate
+	oldAddrs []string
+}
+
+func (r *addrChangeRecorder) NotifyAddressChange(n *Node, oldAddr net.IP, oldPort uint16) {
+	r.oldAddrs = append(r.oldAddrs, joinHostPort(oldAddr.String(), oldPort)+" -> "+n.Address())
+}
+
+func TestMemberList_AliveNode_SelfNoop(t *testing.T) {
+	tm := newTestMetrics(t)
+
+	var logs bytes.Buffer
+	m := GetMemberlist(t, func(c *Config) {
+		c.Logger = log.New(&logs, "", 0)
+		c.LogSelfNoopAlive = true
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	m.broadcasts.Reset()
+
+	// Hearing the same thing back about ourselves is a no-op.
+	dup := a
+	m.aliveNode(&dup, nil, false)
+	require.Equal(t, 1, tm.Counter("memberlist.msg.alive.self_noop").Count)
+	require.Contains(t, logs.String(), "Ignoring alive message about ourselves")
+	require.Zero(t, m.broadcasts.NumQueued())
+	require.Equal(t, uint32(1), m.nodeMap[m.config.Name].Incarnation)
+}
+
+func TestMemberList_AliveNode_AddressChange(t *testing.T) {
+	ch := make(chan NodeEvent, 4)
+	events := &addrChangeRecorder{ChannelEventDelegate: ChannelEventDelegate{ch}}
+	m := GetMemberlist(t, func(c *Config) {
+		c.DeadNodeReclaimTime = 10 * time.Millisecond
+		c.Events = events
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 8000, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	m.deadNode(&dead{Node: "test", Incarnation: 1})
+	time.Sleep(m.config.DeadNodeReclaimTime)
+
+	// Reclaim the node at a new address.
+	a = alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Port: 9000, Incarnation: 2, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	require.Equal(t, []string{"127.0.0.1:8000 -> 127.0.0.2:9000"}, events.oldAddrs)
+
+	var types []NodeEventType
+	for len(ch) > 0 {
+		types = append(types, (<-ch).Event)
+	}
+	require.Equal(t, []NodeEventType{NodeJoin, NodeLeave, NodeJoin}, types)
+}
+
+func TestMemberList_AliveNode_Reclaimed(t *testing.T) {
+	ch := make(chan NodeEvent, 8)
+	m := GetMemberlist(t, func(c *Config) {
+		c.DeadNodeReclaimTime = 10 * time.Millisecond
+		c.Events = &ChannelEventDelegate{ch}
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 8000, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	m.deadNode(&dead{Node: "test", Incarnation: 1})
+
+	// Coming back at the same address is an ordinary join.
+	a.Incarnation = 2
+	m.aliveNode(&a, nil, false)
+	m.deadNode(&dead{Node: "test", Incarnation: 2})
+	time.Sleep(m.config.DeadNodeReclaimTime)
+
+	// Coming back at a new address is a reclaim.
+	a = alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Port: 9000, Incarnation: 3, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	var joins []bool
+	for len(ch) > 0 {
+		if e := <-ch; e.Event == NodeJoin {
+			joins = append(joins, e.Reclaimed)
+		}
+	}
+	require.Equal(t, []bool{false, false, true}, joins)
+}
+
+func TestMemberList_AliveNode_VerifyReclaimByProbe(t *testing.T) {
+	m1 := GetMemberlist(t, func(c *Config) {
+		c.DeadNodeReclaimTime = 10 * time.Millisecond
+		c.VerifyReclaimByProbe = true
+		c.ProbeTimeout = 100 * time.Millisecond
+	})
+	defer m1.Shutdown()
+
+	m2 := GetMemberlist(t, nil)
+	defer m2.Shutdown()
+	require.NoError(t, m2.setAlive())
+	name := m2.config.Name
+	addr, port := m2.getAdvertise()
+
+	// Nothing answers pings here.
+	udp := listenUDP(t)
+	defer udp.Close()
+	silent := udp.LocalAddr().(*net.UDPAddr)
+
+	nodeAt := func() (string, NodeStateType) {
+		m1.nodeLock.RLock()
+		defer m1.nodeLock.RUnlock()
+		n := m1.nodeMap[name]
+		return n.Address(), n.State
+	}
+	waitForCheck := func() {
+		waitForCondition(t, func() (bool, string) {
+			m1.nodeLock.RLock()
+			defer m1.nodeLock.RUnlock()
+			return len(m1.reclaimChecks) == 0, "reclaim check still pending"
+		})
+	}
+
+	a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Port: 8000, Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a, nil, false)
+	m1.deadNode(&dead{Node: name, Incarnation: 1})
+	time.Sleep(m1.config.DeadNodeReclaimTime)
+
+	// A reclaim at an address that doesn't answer is rejected.
+	a = alive{Node: name, Addr: silent.IP.To4(), Port: uint16(silent.Port), Incarnation: 2, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a, nil, false)
+	waitForCheck()
+	where, state := nodeAt()
+	require.Equal(t, "127.0.0.1:8000", where)
+	require.Equal(t, StateDead, state)
+
+	// One where the node answers goes ahead once it's been probed.
+	a = alive{Node: name, Addr: addr, Port: port, Incarnation: 3, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a, nil, false)
+	waitForCheck()
+	where, state = nodeAt()
+	require.Equal(t, joinHostPort(addr.String(), port), where)
+	require.Equal(t, StateAlive, state)
+}
+
 func TestMemberList_AliveNode_Conflict(t *testing.T) {
 	m := GetMemberlist(t, func(c *Config) {
 		c.DeadNodeReclaimTime = 10 * time.Millisecond
@@ -1571,6 +2711,35 @@ func TestMemberList_SuspectNode_NoNode(t *testing.T) {
 	}
 }
 
+func TestMemberList_SuspectNode_NoNode_Learn(t *testing.T) {
+	ch := make(chan NodeEvent, 1)
+	m := GetMemberlist(t, func(c *Config) {
+		c.UnknownNodePolicy = UnknownNodeLearn
+		c.Events = &ChannelEventDelegate{ch}
+	})
+	defer m.Shutdown()
+
+	// The suspect message gets here ahead of the alive it follows.
+	m.suspectNode(&suspect{Node: "test", Incarnation: 2, From: "other"})
+	require.Len(t, m.nodes, 1)
+	require.Equal(t, StateDead, m.getNodeState("test"))
+	require.Len(t, ch, 0)
+
+	// The alive it beats is ignored, and doesn't count as a conflict.
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 2, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	require.Equal(t, StateDead, m.getNodeState("test"))
+
+	// A newer one brings the node in, at its address.
+	a.Incarnation = 3
+	m.aliveNode(&a, nil, false)
+	require.Equal(t, StateAlive, m.getNodeState("test"))
+	require.Equal(t, net.IP([]byte{127, 0, 0, 1}), m.nodeMap["test"].Addr)
+	e := <-ch
+	require.Equal(t, NodeJoin, e.Event)
+	require.Len(t, m.nodes, 1)
+}
+
 func TestMemberList_SuspectNode(t *testing.T) {
 	m := GetMemberlist(t, func(c *Config) {
 		c.ProbeInterval = time.Millisecond
@@ -1737,6 +2906,48 @@ func TestMemberList_SuspectNode_Refute(t *testing.T) {
 	}
 }
 
+func TestMemberList_SuspectNode_RefuteWraparound(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	atomic.StoreUint32(&m.incarnation, math.MaxUint32)
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: math.MaxUint32, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+	m.broadcasts.Reset()
+
+	// Refuting has to wrap the incarnation around to zero.
+	m.suspectNode(&suspect{Node: m.config.Name, Incarnation: math.MaxUint32})
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("expected only one queued message")
+	}
+	msg := m.broadcasts.orderedView(true)[0].b.Message()
+	if messageType(msg[0]) != aliveMsg {
+		t.Fatalf("expected queued alive msg")
+	}
+	var refute alive
+	if err := decode(msg[1:], &refute); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if refute.Incarnation != 0 {
+		t.Fatalf("bad incarnation: %d", refute.Incarnation)
+	}
+
+	// A peer that knew us at the top of the range must still take the
+	// wrapped incarnation as newer, and ignore the stale suspicion.
+	m2 := GetMemberlist(t, nil)
+	defer m2.Shutdown()
+	m2.aliveNode(&a, nil, false)
+	m2.aliveNode(&refute, nil, false)
+	state := m2.nodeMap[m.config.Name]
+	if state.State != StateAlive || state.Incarnation != 0 {
+		t.Fatalf("bad state: %v %d", state.State, state.Incarnation)
+	}
+	m2.suspectNode(&suspect{Node: m.config.Name, Incarnation: math.MaxUint32, From: m2.config.Name})
+	if state.State != StateAlive {
+		t.Fatalf("stale suspicion should be ignored")
+	}
+}
+
 func TestMemberList_DeadNode_NoNode(t *testing.T) {
 	m := GetMemberlist(t, nil)
 	defer m.Shutdown()
@@ -1748,6 +2959,26 @@ func TestMemberList_DeadNode_NoNode(t *testing.T) {
 	}
 }
 
+func TestMemberList_DeadNode_NoNode_Policy(t *testing.T) {
+	var logs bytes.Buffer
+	m := GetMemberlist(t, func(c *Config) {
+		c.UnknownNodePolicy = UnknownNodeLog
+		c.Logger = log.New(&logs, "", 0)
+	})
+	defer m.Shutdown()
+
+	m.deadNode(&dead{Node: "test", Incarnation: 1, From: "other"})
+	require.Len(t, m.nodes, 0)
+	require.Contains(t, logs.String(), "Ignoring dead message about unknown node test")
+
+	// Learning the node records it as dead at the given incarnation.
+	m.config.UnknownNodePolicy = UnknownNodeLearn
+	m.deadNode(&dead{Node: "test", Incarnation: 1, From: "other"})
+	require.Len(t, m.nodes, 1)
+	require.Equal(t, StateDead, m.getNodeState("test"))
+	require.Equal(t, uint32(1), m.nodeMap["test"].Incarnation)
+}
+
 func TestMemberList_DeadNodeLeft(t *testing.T) {
 	ch := make(chan NodeEvent, 1)
 
@@ -1822,6 +3053,33 @@ func TestMemberList_DeadNodeLeft(t *testing.T) {
 	}
 }
 
+func TestMemberList_TransitionMetrics(t *testing.T) {
+	tm := newTestMetrics(t)
+
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+
+	s := suspect{Node: "test", Incarnation: 1}
+	m.suspectNode(&s)
+	a.Incarnation = 2
+	m.aliveNode(&a, nil, false)
+	s.Incarnation = 2
+	m.suspectNode(&s)
+	d := dead{Node: "test", Incarnation: 2}
+	m.deadNode(&d)
+
+	count := func(name string) int {
+		return tm.Counter("memberlist.transition." + name).Count
+	}
+	require.Equal(t, 2, count("alive_to_suspect"))
+	require.Equal(t, 1, count("suspect_to_alive"))
+	require.Equal(t, 1, count("suspect_to_dead"))
+	require.Equal(t, 0, count("dead_to_alive"))
+}
+
 func TestMemberList_DeadNode(t *testing.T) {
 	ch := make(chan NodeEvent, 1)
 
@@ -2199,6 +3457,249 @@ func TestMemberlist_GossipToDead(t *testing.T) {
 	})
 }
 
+func TestMemberlist_GossipTargetedSecondPeer(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.GossipNodes = 2
+	})
+	defer m.Shutdown()
+
+	udpA, udpB := listenUDP(t), listenUDP(t)
+	defer udpA.Close()
+	defer udpB.Close()
+	for name, udp := range map[string]*net.UDPConn{"a": udpA, "b": udpB} {
+		addr := udp.LocalAddr().(*net.UDPAddr)
+		a := alive{Node: name, Addr: addr.IP, Port: uint16(addr.Port), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+
+	// Peers are picked in random order, so try a few rounds. The message
+	// for b has to go out even when a, with nothing to send, comes first.
+	buf := make([]byte, udpPacketBufSize)
+	for i := 0; i < 10; i++ {
+		m.broadcasts.Reset()
+		m.queueBroadcastTo(func(n *Node) bool { return n.Name == "b" }, []byte{byte(userMsg), 'h', 'i'}, nil)
+		m.gossip()
+
+		udpB.SetDeadline(time.Now().Add(time.Second))
+		_, _, err := udpB.ReadFrom(buf)
+		require.NoError(t, err, "round %d", i)
+	}
+
+	udpA.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err := udpA.ReadFrom(buf)
+	require.Error(t, err)
+}
+
+func TestMemberlist_GossipTargetedNoMatch(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	udp := listenUDP(t)
+	defer udp.Close()
+	addr := udp.LocalAddr().(*net.UDPAddr)
+	a := alive{Node: "a", Addr: addr.IP, Port: uint16(addr.Port), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	m.broadcasts.Reset()
+
+	// A broadcast for a node we don't know about is dropped, rather than
+	// waiting in the queue forever, while one for a known node is kept
+	// until it's been sent.
+	notify := make(chan struct{}, 1)
+	m.queueBroadcastTo(func(n *Node) bool { return n.Name == "nobody" }, []byte{byte(userMsg), 'h', 'i'}, notify)
+	m.queueBroadcastTo(func(n *Node) bool { return n.Name == "a" }, []byte{byte(userMsg), 'y', 'o'}, nil)
+	require.Equal(t, 2, m.broadcasts.NumQueued())
+	m.gossip()
+	require.Equal(t, 1, m.broadcasts.NumQueued())
+	select {
+	case <-notify:
+	default:
+		t.Fatalf("dropped broadcast wasn't finished")
+	}
+
+	// The same goes once the node it was meant for is gone.
+	m.deadNode(&dead{Node: "a", Incarnation: 1, From: "a"})
+	m.broadcasts.Reset()
+	m.queueBroadcastTo(func(n *Node) bool { return n.Name == "a" }, []byte{byte(userMsg), 'y', 'o'}, nil)
+	m.gossip()
+	require.Zero(t, m.broadcasts.NumQueued())
+}
+
+func TestMemberlist_GossipFanoutSample(t *testing.T) {
+	tm := newTestMetrics(t)
+
+	m := GetMemberlist(t, func(c *Config) {
+		c.GossipNodes = 3
+	})
+	defer m.Shutdown()
+	require.NoError(t, m.setAlive())
+
+	// Only two peers to gossip to, with their alive messages queued.
+	for i, name := range []string{"peer1", "peer2"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, byte(i + 1)}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+	m.gossip()
+
+	fanout := func() metrics.AggregateSample {
+		return tm.Sample("memberlist.gossip.fanout")
+	}
+	require.Equal(t, 1, fanout().Count)
+	require.Equal(t, float64(2), fanout().Sum)
+
+	// Ticks with nothing to gossip aren't sampled.
+	m.broadcasts.Reset()
+	m.gossip()
+	require.Equal(t, 1, fanout().Count)
+}
+
+func TestMemberlist_SuppressSelfGossip(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.SuppressSelfGossip = true
+	})
+	defer m.Shutdown()
+	require.NoError(t, m.setAlive())
+
+	peer := &Node{Name: "peer", Addr: []byte{127, 0, 0, 1}, Port: 7946}
+
+	// Our own alive isn't gossiped, but is still piggybacked.
+	require.Len(t, m.getBroadcastsFor(peer, compoundOverhead, 1400), 0)
+	require.Len(t, m.getBroadcasts(compoundOverhead, 1400), 1)
+
+	// Alive messages about others are gossiped as usual.
+	a := alive{Node: "other", Addr: []byte{127, 0, 0, 2}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	require.Len(t, m.getBroadcastsFor(peer, compoundOverhead, 1400), 1)
+
+	// So are refutes.
+	m.broadcasts.Reset()
+	m.suspectNode(&suspect{Node: m.config.Name, Incarnation: atomic.LoadUint32(&m.incarnation), From: "other"})
+	require.Len(t, m.getBroadcastsFor(peer, compoundOverhead, 1400), 1)
+
+	// Until we announce ourselves again.
+	require.NoError(t, m.Refresh())
+	require.Len(t, m.getBroadcastsFor(peer, compoundOverhead, 1400), 0)
+}
+
+func TestMemberlist_SuppressSelfGossip_Named(t *testing.T) {
+	// Our name doesn't match our address here, unlike in most tests.
+	m := GetMemberlist(t, func(c *Config) {
+		c.Name = "me"
+		c.SuppressSelfGossip = true
+	})
+	defer m.Shutdown()
+	require.NoError(t, m.setAlive())
+
+	peer := &Node{Name: "peer", Addr: []byte{127, 0, 0, 1}, Port: 7946}
+	require.Len(t, m.getBroadcastsFor(peer, compoundOverhead, 1400), 0)
+
+	// A refute replaces the alive message we'd queued before, and is the
+	// only thing gossiped.
+	m.suspectNode(&suspect{Node: "me", Incarnation: atomic.LoadUint32(&m.incarnation), From: "other"})
+	require.Equal(t, 1, m.broadcasts.NumQueued())
+	msgs := m.getBroadcastsFor(peer, compoundOverhead, 1400)
+	require.Len(t, msgs, 1)
+	var a alive
+	require.NoError(t, decode(msgs[0][1:], &a))
+	require.Equal(t, atomic.LoadUint32(&m.incarnation), a.Incarnation)
+
+	// Until we announce ourselves again.
+	require.NoError(t, m.Refresh())
+	require.Len(t, m.getBroadcastsFor(peer, compoundOverhead, 1400), 0)
+}
+
+func TestMemberlist_SuppressSelfGossip_Traffic(t *testing.T) {
+	// count gossips to a few peers for a while and returns how many of our
+	// own alive messages went out, both when we announce ourselves and
+	// when we refute a suspicion.
+	count := func(suppress bool) (announced, refuted int) {
+		m := GetMemberlist(t, func(c *Config) {
+			c.SuppressSelfGossip = suppress
+		})
+		defer m.Shutdown()
+
+		var peers []*Node
+		for i := 0; i < 4; i++ {
+			a := alive{Node: fmt.Sprintf("peer%d", i), Addr: []byte{127, 0, 0, byte(i + 10)}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+			m.aliveNode(&a, nil, false)
+			peers = append(peers, &Node{Name: a.Node, Addr: a.Addr, Port: a.Port})
+		}
+		m.broadcasts.Reset()
+
+		rounds := func() int {
+			var n int
+			for i := 0; i < 50; i++ {
+				for _, peer := range peers {
+					for _, msg := range m.getBroadcastsFor(peer, compoundOverhead, 1400) {
+						var a alive
+						if messageType(msg[0]) == aliveMsg && decode(msg[1:], &a) == nil && a.Node == m.config.Name {
+							n++
+						}
+					}
+				}
+			}
+			return n
+		}
+		require.NoError(t, m.setAlive())
+		announced = rounds()
+		m.suspectNode(&suspect{Node: m.config.Name, Incarnation: atomic.LoadUint32(&m.incarnation), From: "peer0"})
+		refuted = rounds()
+		return announced, refuted
+	}
+
+	announced, refuted := count(false)
+	require.NotZero(t, announced)
+	require.NotZero(t, refuted)
+
+	// Only the announcement is left out, the refute is gossiped just as
+	// much as before.
+	suppressedAnnounced, suppressedRefuted := count(true)
+	require.Zero(t, suppressedAnnounced)
+	require.Equal(t, refuted, suppressedRefuted)
+}
+
+func TestMemberlist_SuppressSelfGossip_Converges(t *testing.T) {
+	// Without probes there's nothing to piggyback on, so a refute can only
+	// spread through gossip.
+	newMember := func(bindPort int) *Memberlist {
+		c := testConfig(t)
+		c.BindPort = bindPort
+		c.SuppressSelfGossip = true
+		c.GossipInterval = 5 * time.Millisecond
+		c.ProbeInterval = time.Hour
+		c.PushPullInterval = 0
+		m, err := Create(c)
+		require.NoError(t, err)
+		return m
+	}
+	m1 := newMember(0)
+	defer m1.Shutdown()
+	members := []*Memberlist{m1}
+	for i := 0; i < 3; i++ {
+		m := newMember(m1.config.BindPort)
+		defer m.Shutdown()
+		_, err := m.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+		require.NoError(t, err)
+		members = append(members, m)
+	}
+	for _, m := range members {
+		waitUntilSize(t, m, 4)
+	}
+
+	// m1 suspects m4, which hears about it and refutes, and everyone
+	// should end up seeing m4 alive again.
+	m4 := members[3]
+	inc := atomic.LoadUint32(&m4.incarnation)
+	m1.suspectNode(&suspect{Node: m4.config.Name, Incarnation: inc, From: m1.config.Name})
+	for _, m := range members[:3] {
+		m := m
+		waitForCondition(t, func() (bool, string) {
+			state, _ := m.NodeState(m4.config.Name)
+			return state == StateAlive, fmt.Sprintf("%s sees %s as %v", m.config.Name, m4.config.Name, state)
+		})
+	}
+	require.True(t, atomic.LoadUint32(&m4.incarnation) > inc)
+}
+
 func TestMemberlist_FailedRemote(t *testing.T) {
 	type test struct {
 		name     string
@@ -2270,6 +3771,51 @@ func TestMemberlist_PushPull(t *testing.T) {
 	})
 }
 
+func TestMemberlist_PushPullStateFilter(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+
+	ch := make(chan NodeEvent, 3)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.GossipInterval = 10 * time.Second
+	})
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+		c.GossipInterval = 10 * time.Second
+		c.Events = &ChannelEventDelegate{ch}
+	})
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: []byte(addr1), Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: []byte(addr2), Port: uint16(bindPort), Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+	m1.aliveNode(&a2, nil, false)
+	m1.nodeMap[addr2.String()].State = StateSuspect
+
+	// By default suspect nodes aren't picked.
+	m1.pushPull()
+	select {
+	case <-ch:
+		t.Fatalf("shouldn't push/pull with a suspect node")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	m1.config.PushPullStateFilter = func(n *Node, state NodeStateType) bool {
+		return state == StateAlive || state == StateSuspect
+	}
+	m1.pushPull()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a push/pull with the suspect node")
+	}
+}
+
 func TestVerifyProtocol(t *testing.T) {
 	cases := []struct {
 		Anodes   [][3]uint8
@@ -2390,4 +3936,8 @@ func testVerifyProtocolSingle(t *testing.T, A [][6]uint8, B [][6]uint8, expect b
 	if (err == nil) != expect {
 		t.Fatalf("bad:\nA: %v\nB: %v\nErr: %s", A, B, err)
 	}
+	var mismatch *ProtocolMismatchError
+	if err != nil && !errors.As(err, &mismatch) {
+		t.Fatalf("expected a ProtocolMismatchError: %v", err)
+	}
 }
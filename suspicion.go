@@ -1,11 +1,32 @@
 package memberlist
 
 import (
+	"fmt"
 	"math"
+	"sort"
 	"sync/atomic"
 	"time"
 )
 
+// SuspicionParams is a set of suspicion timer parameters for a shadow timer,
+// see Config.ShadowSuspicion. The multipliers mean the same as the ones in
+// Config.
+type SuspicionParams struct {
+	// Name identifies the shadow timer in logs and metrics. If it's empty,
+	// a name is made up from the multipliers.
+	Name string
+
+	SuspicionMult           int
+	SuspicionMaxTimeoutMult int
+}
+
+func (p SuspicionParams) metricName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return fmt.Sprintf("mult_%d_max_%d", p.SuspicionMult, p.SuspicionMaxTimeoutMult)
+}
+
 // suspicion manages the suspect timer for a node and provides an interface
 // to accelerate the timeout as we get more independent confirmations that
 // a node is suspect.
@@ -36,7 +57,14 @@ type suspicion struct {
 	start time.Time
 
 	// timer is the underlying timer that implements the timeout.
-	timer *time.Timer
+	timer Timer
+
+	// clock is the source of time for the timer and elapsed durations.
+	clock Clock
+
+	// from is the node that started the suspicion, which is seeded into
+	// confirmations so it can't confirm its own accusation.
+	from string
 
 	// f is the function to call when the timer expires. We hold on to this
 	// because there are cases where we call it directly.
@@ -44,9 +72,15 @@ type suspicion struct {
 	timeoutFn func()
 
 	// confirmations is a map of "from" nodes that have confirmed a given
-	// node is suspect. This prevents double counting.
+	// node is suspect, to the weight their confirmation counted for. This
+	// prevents double counting.
 	// confirmations 保存了当前节点已经针对某些 suspect 节点执行了 confirm 动作。
-	confirmations map[string]struct{}
+	confirmations map[string]float64
+
+	// weight is the total weight of the confirmations we've seen, which is
+	// what actually drives the timer. It's the same as n unless some of the
+	// confirmations were weighted.
+	weight float64
 }
 
 // newSuspicion returns a timer started with the max time, and that will drive
@@ -55,17 +89,19 @@ type suspicion struct {
 // gossiped back to us. The minimum time will be used if no confirmations are
 // called for (k <= 0).
 // newSuspicion 构建一个 suspect 定时器，每收到一个针对目标节点的 confirm，则减少 max 的值，当收到 k 个确认时，则将其等于 min。
-func newSuspicion(from string, k int, min time.Duration, max time.Duration, fn func(int)) *suspicion {
+func newSuspicion(clock Clock, from string, k int, min time.Duration, max time.Duration, fn func(int)) *suspicion {
 	s := &suspicion{
 		k:             int32(k),
 		min:           min,
 		max:           max,
-		confirmations: make(map[string]struct{}),
+		confirmations: make(map[string]float64),
+		clock:         clock,
+		from:          from,
 	}
 
 	// Exclude the from node from any confirmations.
 	// 排除目标节点的 confirm 操作
-	s.confirmations[from] = struct{}{}
+	s.confirmations[from] = 0
 
 	// Pass the number of confirmations into the timeout function for
 	// easy telemetry.
@@ -81,12 +117,12 @@ func newSuspicion(from string, k int, min time.Duration, max time.Duration, fn f
 	if k < 1 {
 		timeout = min
 	}
-	s.timer = time.AfterFunc(timeout, s.timeoutFn)
+	s.timer = clock.AfterFunc(timeout, s.timeoutFn)
 
 	// Capture the start time right after starting the timer above so
 	// we should always err on the side of a little longer timeout if
 	// there's any preemption that separates this and the step above.
-	s.start = time.Now()
+	s.start = clock.Now()
 	return s
 }
 
@@ -94,8 +130,8 @@ func newSuspicion(from string, k int, min time.Duration, max time.Duration, fn f
 // calculates the remaining time to wait before considering a node dead. The
 // return value can be negative, so be prepared to fire the timer immediately in
 // that case.
-func remainingSuspicionTime(n, k int32, elapsed time.Duration, min, max time.Duration) time.Duration {
-	frac := math.Log(float64(n)+1.0) / math.Log(float64(k)+1.0)
+func remainingSuspicionTime(n float64, k int32, elapsed time.Duration, min, max time.Duration) time.Duration {
+	frac := math.Log(n+1.0) / math.Log(float64(k)+1.0)
 	raw := max.Seconds() - frac*(max.Seconds()-min.Seconds())
 	timeout := time.Duration(math.Floor(1000.0*raw)) * time.Millisecond
 	if timeout < min {
@@ -115,10 +151,18 @@ func remainingSuspicionTime(n, k int32, elapsed time.Duration, min, max time.Dur
 // confirm 操作即表示集群中其它的节点也认为目标节点处于 suspect 状态。
 // 因此每当其收到的一个 suspect 消息，会执行一个 confirm 操作。
 func (s *suspicion) Confirm(from string) bool {
+	return s.ConfirmWeighted(from, 1.0)
+}
+
+// ConfirmWeighted is like Confirm, but the confirmation only counts for the
+// given weight, so a confirmation with a weight of 0.5 advances the timer
+// half as much as a full one. A confirmation with a weight of zero or less
+// is recorded, but doesn't advance the timer and isn't new information.
+func (s *suspicion) ConfirmWeighted(from string, weight float64) bool {
 	// If we've got enough confirmations then stop accepting them.
 	// 若收到的 confirm 数已经达到预期的 k 值，则表示我们已经收到足够的 confirm 了，
 	//即 已经可以确定目标节点处于 dead 状态了。
-	if atomic.LoadInt32(&s.n) >= s.k {
+	if s.weight >= float64(s.k) {
 		return false
 	}
 
@@ -127,7 +171,12 @@ func (s *suspicion) Confirm(from string) bool {
 	if _, ok := s.confirmations[from]; ok {
 		return false
 	}
-	s.confirmations[from] = struct{}{}
+	if weight <= 0 {
+		s.confirmations[from] = 0
+		return false
+	}
+	s.confirmations[from] = weight
+	s.weight += weight
 
 	// Compute the new timeout given the current number of confirmations and
 	// adjust the timer. If the timeout becomes negative *and* we can cleanly
@@ -135,9 +184,9 @@ func (s *suspicion) Confirm(from string) bool {
 	// here.
 	// 更新当前的执行的 confirm 次数，根据当前时间戳、执行的 confirm 次数，最小最大次数 以此来更新超时定时器时限。
 	// 若发现更新后的剩余时间已经小于0，则直接停止定时器，同时执行对应的超时处理器函数。
-	n := atomic.AddInt32(&s.n, 1)
-	elapsed := time.Since(s.start)
-	remaining := remainingSuspicionTime(n, s.k, elapsed, s.min, s.max)
+	atomic.AddInt32(&s.n, 1)
+	elapsed := s.clock.Now().Sub(s.start)
+	remaining := remainingSuspicionTime(s.weight, s.k, elapsed, s.min, s.max)
 	if s.timer.Stop() {
 		if remaining > 0 {
 			s.timer.Reset(remaining)
@@ -147,3 +196,19 @@ func (s *suspicion) Confirm(from string) bool {
 	}
 	return true
 }
+
+// Confirmers returns the nodes that have confirmed the suspicion, not
+// counting the node that started it, or any whose confirmation had no
+// weight, so they match what's driving the timer. This isn't safe against
+// concurrent calls to Confirm, so callers must hold the same lock they use
+// for those.
+func (s *suspicion) Confirmers() []string {
+	confirmers := make([]string, 0, len(s.confirmations))
+	for name, weight := range s.confirmations {
+		if name != s.from && weight > 0 {
+			confirmers = append(confirmers, name)
+		}
+	}
+	sort.Strings(confirmers)
+	return confirmers
+}
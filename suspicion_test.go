@@ -1,13 +1,14 @@
 package memberlist
 
 import (
+	"reflect"
 	"testing"
 	"time"
 )
 
 func TestSuspicion_remainingSuspicionTime(t *testing.T) {
 	cases := []struct {
-		n        int32
+		n        float64
 		k        int32
 		elapsed  time.Duration
 		min      time.Duration
@@ -15,6 +16,7 @@ func TestSuspicion_remainingSuspicionTime(t *testing.T) {
 		expected time.Duration
 	}{
 		{0, 3, 0, 2 * time.Second, 30 * time.Second, 30 * time.Second},
+		{0.5, 3, 0, 2 * time.Second, 30 * time.Second, 21810 * time.Millisecond},
 		{1, 3, 2 * time.Second, 2 * time.Second, 30 * time.Second, 14 * time.Second},
 		{2, 3, 3 * time.Second, 2 * time.Second, 30 * time.Second, 4810 * time.Millisecond},
 		{3, 3, 4 * time.Second, 2 * time.Second, 30 * time.Second, -2 * time.Second},
@@ -118,7 +120,7 @@ func TestSuspicion_Timer(t *testing.T) {
 		// Create the timer and add the requested confirmations. Wait
 		// the fudge amount to help make sure we calculate the timeout
 		// overall, and don't accumulate extra time.
-		s := newSuspicion(c.from, k, min, max, f)
+		s := newSuspicion(realClock{}, c.from, k, min, max, f)
 		fudge := 25 * time.Millisecond
 		for _, p := range c.confirmations {
 			time.Sleep(fudge)
@@ -158,6 +160,46 @@ func TestSuspicion_Timer(t *testing.T) {
 	}
 }
 
+func TestSuspicion_ConfirmWeighted(t *testing.T) {
+	s := newSuspicion(realClock{}, "me", 2, 100*time.Millisecond, 30*time.Second, func(int) {})
+	defer s.timer.Stop()
+
+	// Half-weight confirmations should take twice as many to saturate.
+	for _, from := range []string{"a", "b", "c", "d"} {
+		if !s.ConfirmWeighted(from, 0.5) {
+			t.Fatalf("expected new info from %s", from)
+		}
+	}
+	if s.ConfirmWeighted("e", 0.5) {
+		t.Fatalf("should have enough confirmations")
+	}
+	if s.n != 4 || s.weight != 2.0 {
+		t.Fatalf("bad confirmations: %d, %f", s.n, s.weight)
+	}
+
+	// Zero-weight confirmations are ignored.
+	s = newSuspicion(realClock{}, "me", 2, 100*time.Millisecond, 30*time.Second, func(int) {})
+	defer s.timer.Stop()
+	if s.ConfirmWeighted("a", 0) {
+		t.Fatalf("should not provide new information")
+	}
+	if s.n != 0 || s.weight != 0 {
+		t.Fatalf("bad confirmations: %d, %f", s.n, s.weight)
+	}
+
+	// And aren't reported as confirmers, though they still can't count
+	// again.
+	if !s.ConfirmWeighted("b", 0.5) {
+		t.Fatalf("expected new info from b")
+	}
+	if s.ConfirmWeighted("a", 1.0) {
+		t.Fatalf("should not count a twice")
+	}
+	if confirmers := s.Confirmers(); !reflect.DeepEqual(confirmers, []string{"b"}) {
+		t.Fatalf("bad confirmers: %v", confirmers)
+	}
+}
+
 func TestSuspicion_Timer_ZeroK(t *testing.T) {
 	ch := make(chan struct{}, 1)
 	f := func(int) {
@@ -166,7 +208,7 @@ func TestSuspicion_Timer_ZeroK(t *testing.T) {
 
 	// This should select the min time since there are no expected
 	// confirmations to accelerate the timer.
-	s := newSuspicion("me", 0, 25*time.Millisecond, 30*time.Second, f)
+	s := newSuspicion(realClock{}, "me", 0, 25*time.Millisecond, 30*time.Second, f)
 	if s.Confirm("foo") {
 		t.Fatalf("should not provide new information")
 	}
@@ -185,7 +227,7 @@ func TestSuspicion_Timer_Immediate(t *testing.T) {
 	}
 
 	// This should underflow the timeout and fire immediately.
-	s := newSuspicion("me", 1, 100*time.Millisecond, 30*time.Second, f)
+	s := newSuspicion(realClock{}, "me", 1, 100*time.Millisecond, 30*time.Second, f)
 	time.Sleep(200 * time.Millisecond)
 	s.Confirm("foo")
 
@@ -0,0 +1,546 @@
+package memberlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// tagsMetaMagic marks node meta data that starts with encoded tags. It's
+// followed by the length of the encoded tags as a uvarint, the tags, and
+// then whatever meta data the Delegate provided.
+const tagsMetaMagic = "\xfftags"
+
+// displayNameTag is the tag that carries a node's display name. See
+// Config.DisplayName.
+const displayNameTag = "memberlist.display_name"
+
+// healthScoreTag is the tag that carries a node's health score. See
+// Config.GossipHealthScore.
+const healthScoreTag = "memberlist.health"
+
+const (
+	// healthScoreProtocolVersion is the lowest protocol version at which
+	// we publish our health score.
+	healthScoreProtocolVersion = 6
+
+	// healthScorePublishTicks is the fewest probe ticks between changes
+	// to our published health score, and healthScoreSettleTicks is how
+	// many ticks in a row a new score has to hold before it's published.
+	// Each change costs an alive broadcast, which is most expensive just
+	// when a node is degraded.
+	healthScorePublishTicks = 10
+	healthScoreSettleTicks  = 3
+)
+
+// gossipsHealthScore returns true if the config asks for our health score
+// to be published, and the protocol version allows it.
+func gossipsHealthScore(conf *Config) bool {
+	return conf.GossipHealthScore && conf.ProtocolVersion >= healthScoreProtocolVersion
+}
+
+// configTags returns the local node's starting tags from the config,
+// including its display name. It returns nil if there aren't any.
+func configTags(conf *Config) map[string]string {
+	var tags map[string]string
+	for k, v := range conf.Tags {
+		if tags == nil {
+			tags = make(map[string]string, len(conf.Tags)+1)
+		}
+		tags[k] = v
+	}
+	if conf.DisplayName != "" {
+		if tags == nil {
+			tags = make(map[string]string, 1)
+		}
+		tags[displayNameTag] = conf.DisplayName
+	}
+	if gossipsHealthScore(conf) {
+		if tags == nil {
+			tags = make(map[string]string, 1)
+		}
+		tags[healthScoreTag] = "0"
+	}
+	return tags
+}
+
+// encodeTags serializes tags for the front of a node's meta data. The keys
+// are sorted so the same tags always encode to the same bytes. It returns
+// nil if there are no tags.
+func encodeTags(tags map[string]string) []byte {
+	return encodeTagsVersioned(tags, nil)
+}
+
+// encodeTagsVersioned is like encodeTags, but also records the version of
+// each tag, if versions isn't nil, for merging. Versions of keys that aren't
+// in tags are recorded as tombstones, so a deletion wins over older meta
+// data that still has the tag. The versions follow the tags, in the same
+// order, and then the tombstones, where decoders that don't know about them
+// ignore them.
+func encodeTagsVersioned(tags map[string]string, versions map[string]uint64) []byte {
+	var deleted []string
+	for k := range versions {
+		if _, ok := tags[k]; !ok {
+			deleted = append(deleted, k)
+		}
+	}
+	if len(tags) == 0 && len(deleted) == 0 {
+		return nil
+	}
+	sort.Strings(deleted)
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var body bytes.Buffer
+	writeUvarint(&body, uint64(len(keys)))
+	for _, k := range keys {
+		writeTagString(&body, k)
+		writeTagString(&body, tags[k])
+	}
+	if versions != nil {
+		for _, k := range keys {
+			writeUvarint(&body, versions[k])
+		}
+		writeUvarint(&body, uint64(len(deleted)))
+		for _, k := range deleted {
+			writeTagString(&body, k)
+			writeUvarint(&body, versions[k])
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString(tagsMetaMagic)
+	writeUvarint(&out, uint64(body.Len()))
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	buf.Write(scratch[:n])
+}
+
+func writeTagString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// splitTagsMeta splits node meta data into its tags and the rest, which is
+// what the Delegate provided. Meta data without tags, or whose tags can't be
+// decoded, is returned whole with nil tags.
+func splitTagsMeta(meta []byte) (map[string]string, []byte) {
+	tags, _, user := splitTagsMetaVersioned(meta)
+	return tags, user
+}
+
+// splitTagsMetaVersioned is like splitTagsMeta, but also returns the version
+// of each tag, along with those of deleted tags, which have a version but no
+// value. Tags encoded without versions are all at version 0.
+func splitTagsMetaVersioned(meta []byte) (map[string]string, map[string]uint64, []byte) {
+	if !bytes.HasPrefix(meta, []byte(tagsMetaMagic)) {
+		return nil, nil, meta
+	}
+	rest := meta[len(tagsMetaMagic):]
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || size > uint64(len(rest)-n) {
+		return nil, nil, meta
+	}
+	body, user := rest[n:n+int(size)], rest[n+int(size):]
+
+	count, n := binary.Uvarint(body)
+	if n <= 0 || count > uint64(len(body)) {
+		return nil, nil, meta
+	}
+	body = body[n:]
+	tags := make(map[string]string, count)
+	keys := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var k, v string
+		var ok bool
+		if k, body, ok = readTagString(body); !ok {
+			return nil, nil, meta
+		}
+		if v, body, ok = readTagString(body); !ok {
+			return nil, nil, meta
+		}
+		tags[k] = v
+		keys = append(keys, k)
+	}
+
+	versions := make(map[string]uint64, count)
+	if len(body) > 0 {
+		for _, k := range keys {
+			version, n := binary.Uvarint(body)
+			if n <= 0 {
+				return nil, nil, meta
+			}
+			versions[k] = version
+			body = body[n:]
+		}
+	}
+	if len(body) > 0 {
+		deleted, n := binary.Uvarint(body)
+		if n <= 0 || deleted > uint64(len(body)) {
+			return nil, nil, meta
+		}
+		body = body[n:]
+		for i := uint64(0); i < deleted; i++ {
+			var k string
+			var ok bool
+			if k, body, ok = readTagString(body); !ok {
+				return nil, nil, meta
+			}
+			version, n := binary.Uvarint(body)
+			if n <= 0 {
+				return nil, nil, meta
+			}
+			versions[k] = version
+			body = body[n:]
+		}
+	}
+	return tags, versions, user
+}
+
+func readTagString(buf []byte) (string, []byte, bool) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || size > uint64(len(buf)-n) {
+		return "", nil, false
+	}
+	end := n + int(size)
+	return string(buf[n:end]), buf[end:], true
+}
+
+// Tags returns the node's tags, or nil if it doesn't have any. See
+// Config.Tags.
+func (n *Node) Tags() map[string]string {
+	tags, _ := splitTagsMeta(n.Meta)
+	return tags
+}
+
+// DisplayName returns the node's display name, or its Name if it didn't
+// set one. See Config.DisplayName.
+func (n *Node) DisplayName() string {
+	if name, ok := n.Tags()[displayNameTag]; ok && name != "" {
+		return name
+	}
+	return n.Name
+}
+
+// HealthScore returns the health score the node last published, and
+// whether it publishes one at all. See Config.GossipHealthScore.
+func (n *Node) HealthScore() (int, bool) {
+	v, ok := n.Tags()[healthScoreTag]
+	if !ok {
+		return 0, false
+	}
+	score, err := strconv.Atoi(v)
+	if err != nil || score < 0 {
+		return 0, false
+	}
+	return score, true
+}
+
+// NodesWithTag returns copies of the known live nodes that have the given
+// tag set to value. See FindNodes.
+func (m *Memberlist) NodesWithTag(key, value string) []*Node {
+	return m.FindNodes(func(n *Node) bool {
+		v, ok := n.Tags()[key]
+		return ok && v == value
+	})
+}
+
+// UserMeta returns the part of the node's meta data that came from its
+// Delegate, leaving out any tags. For nodes without tags, this is the same
+// as Meta.
+func (n *Node) UserMeta() []byte {
+	_, user := splitTagsMeta(n.Meta)
+	return user
+}
+
+// encodedTags returns the local node's current tags, encoded.
+func (m *Memberlist) encodedTags() []byte {
+	m.tagLock.Lock()
+	defer m.tagLock.Unlock()
+	return encodeTagsVersioned(m.tags, m.tagVersions)
+}
+
+// localMeta builds the local node's meta data from its tags and whatever
+// the Delegate provides. The Delegate is only offered the space the tags
+// leave free.
+func (m *Memberlist) localMeta() []byte {
+	meta := m.encodedTags()
+	if m.config.Delegate != nil {
+		limit := MetaMaxSize - len(meta)
+		user := m.config.Delegate.NodeMeta(limit)
+		if len(user) > limit {
+			panic("Node meta data provided is longer than the limit")
+		}
+		meta = append(meta, user...)
+	}
+	return meta
+}
+
+// SetTag sets one of the local node's tags, and announces the change to the
+// cluster in the background. Several changes made close together are sent
+// in a single alive message. An error is returned if the tags, along with
+// the Delegate's meta data, would no longer fit in MetaMaxSize. Each change
+// advances the tag's version, which peers use to merge the tags key by key
+// when they hear different meta data for us at the same incarnation, so a
+// change to one tag doesn't lose a change to another. Versions only matter
+// within an incarnation, so they're dropped once they've been announced.
+func (m *Memberlist) SetTag(key, value string) error {
+	m.tagLock.Lock()
+	defer m.tagLock.Unlock()
+
+	if old, ok := m.tags[key]; ok && old == value {
+		return nil
+	}
+	tags := make(map[string]string, len(m.tags)+1)
+	for k, v := range m.tags {
+		tags[k] = v
+	}
+	tags[key] = value
+	versions := m.nextTagVersions(key)
+	if err := m.checkTagsFit(encodeTagsVersioned(tags, versions)); err != nil {
+		return err
+	}
+	m.tags = tags
+	m.tagVersions = versions
+	m.scheduleTagsUpdate()
+	return nil
+}
+
+// DeleteTag removes one of the local node's tags, and announces the change
+// to the cluster in the background, like SetTag. The deletion advances the
+// tag's version too, so peers merging it with older meta data at the same
+// incarnation don't bring the tag back. An error is returned if the
+// deletion wouldn't fit in the node's meta data, as with SetTag.
+func (m *Memberlist) DeleteTag(key string) error {
+	m.tagLock.Lock()
+	defer m.tagLock.Unlock()
+
+	if _, ok := m.tags[key]; !ok {
+		return nil
+	}
+	tags := make(map[string]string, len(m.tags))
+	for k, v := range m.tags {
+		if k != key {
+			tags[k] = v
+		}
+	}
+	versions := m.nextTagVersions(key)
+	if err := m.checkTagsFit(encodeTagsVersioned(tags, versions)); err != nil {
+		return err
+	}
+	m.tags = tags
+	m.tagVersions = versions
+	m.scheduleTagsUpdate()
+	return nil
+}
+
+// checkTagsFit returns an error if the given encoded tags, along with the
+// Delegate's part of the local node's current meta data, would be longer
+// than MetaMaxSize. The caller must hold the tag lock.
+func (m *Memberlist) checkTagsFit(tags []byte) error {
+	var user []byte
+	m.nodeLock.RLock()
+	if me, ok := m.nodeMap[m.localName()]; ok {
+		_, user = splitTagsMeta(me.Meta)
+	}
+	m.nodeLock.RUnlock()
+
+	if size := len(tags) + len(user); size > MetaMaxSize {
+		return fmt.Errorf("tags would take %d bytes, which with %d bytes of other meta data is more than the limit of %d bytes",
+			len(tags), len(user), MetaMaxSize)
+	}
+	return nil
+}
+
+// nextTagVersions returns a copy of the local tag versions with the given
+// key's advanced. The caller must hold the tag lock.
+func (m *Memberlist) nextTagVersions(key string) map[string]uint64 {
+	versions := make(map[string]uint64, len(m.tagVersions)+1)
+	for k, v := range m.tagVersions {
+		versions[k] = v
+	}
+	versions[key]++
+	return versions
+}
+
+// pruneTagVersions drops the tag versions and tombstones that went out in
+// an announcement at a new incarnation. Meta data is only merged at the same
+// incarnation, so they can't matter to anything we send later, and leaving
+// them would slowly fill up the meta data. Versions that changed since the
+// announcement are kept for the next one.
+func (m *Memberlist) pruneTagVersions(announced map[string]uint64) {
+	m.tagLock.Lock()
+	defer m.tagLock.Unlock()
+
+	versions := make(map[string]uint64, len(m.tagVersions))
+	for k, v := range m.tagVersions {
+		if old, ok := announced[k]; !ok || old != v {
+			versions[k] = v
+		}
+	}
+	m.tagVersions = versions
+}
+
+// mergeTagsMeta merges two versions of a node's meta data that both start
+// with tags, key by key. For each tag the one with the higher version wins,
+// whether it's a value or a deletion, and a tie goes to a value over a
+// deletion and then to the greater value, so every node settles on the same
+// result whatever order it hears them in. The Delegate's part is taken from
+// whichever side has the greater one, for the same reason. Meta data that
+// isn't made up of tags on both sides is left as existing.
+func mergeTagsMeta(existing, incoming []byte) []byte {
+	oldTags, oldVersions, oldUser := splitTagsMetaVersioned(existing)
+	newTags, newVersions, newUser := splitTagsMetaVersioned(incoming)
+	if oldTags == nil || newTags == nil {
+		return existing
+	}
+
+	tags := make(map[string]string, len(oldTags)+len(newTags))
+	versions := make(map[string]uint64, len(oldVersions)+len(newVersions))
+	for k, v := range oldTags {
+		tags[k] = v
+	}
+	for k, v := range oldVersions {
+		versions[k] = v
+	}
+	keys := make(map[string]struct{}, len(newTags)+len(newVersions))
+	for k := range newTags {
+		keys[k] = struct{}{}
+	}
+	for k := range newVersions {
+		keys[k] = struct{}{}
+	}
+	for k := range keys {
+		v, ok := newTags[k]
+		old, oldOK := tags[k]
+		_, oldVersioned := versions[k]
+		newVersion, oldVersion := newVersions[k], versions[k]
+		wins := (!oldOK && !oldVersioned) || newVersion > oldVersion ||
+			(newVersion == oldVersion && ok && (!oldOK || v > old))
+		if !wins {
+			continue
+		}
+		if ok {
+			tags[k] = v
+		} else {
+			delete(tags, k)
+		}
+		versions[k] = newVersion
+	}
+
+	user := oldUser
+	if bytes.Compare(newUser, oldUser) > 0 {
+		user = newUser
+	}
+	return append(encodeTagsVersioned(tags, versions), user...)
+}
+
+// scheduleTagsUpdate arranges for the local node's tags to be announced, if
+// that isn't already pending. The caller must hold the tag lock.
+func (m *Memberlist) scheduleTagsUpdate() {
+	if m.tagsUpdatePending {
+		return
+	}
+	m.tagsUpdatePending = true
+	go m.announceTags()
+}
+
+// announceTags re-announces the local node with its current tags and a new
+// incarnation number. The Delegate's meta data is carried over as it is.
+func (m *Memberlist) announceTags() {
+	m.localAliveLock.Lock()
+	defer m.localAliveLock.Unlock()
+
+	m.tagLock.Lock()
+	m.tagsUpdatePending = false
+	versions := m.tagVersions
+	tags := encodeTagsVersioned(m.tags, versions)
+	m.tagLock.Unlock()
+
+	if m.hasLeft() || m.hasShutdown() {
+		return
+	}
+
+	m.nodeLock.RLock()
+	me, ok := m.nodeMap[m.localName()]
+	if !ok {
+		m.nodeLock.RUnlock()
+		return
+	}
+	_, user := splitTagsMeta(me.Meta)
+	a := alive{
+		Incarnation: m.nextIncarnation(),
+		Node:        me.Name,
+		Addr:        me.Addr,
+		Port:        me.Port,
+		Meta:        append(tags, user...),
+		Vsn: []uint8{
+			me.PMin, me.PMax, me.PCur,
+			me.DMin, me.DMax, me.DCur,
+		},
+		NotReady: m.isNotReady(),
+	}
+	m.nodeLock.RUnlock()
+
+	// SetTag checked this, but the Delegate's meta data may have grown
+	// since.
+	if len(a.Meta) > MetaMaxSize {
+		m.logger.Printf("[ERR] memberlist: Failed to announce tags: meta data of %d bytes is longer than the limit of %d bytes",
+			len(a.Meta), MetaMaxSize)
+		return
+	}
+
+	m.overrideLocalAlive(&a)
+	if err := m.checkLocalAlive(&a); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to announce tags: %v", err)
+		return
+	}
+	m.aliveNode(&a, nil, true)
+	m.pruneTagVersions(versions)
+}
+
+// publishHealthScore is called on each probe tick, and updates the local
+// node's health score tag once a changed score has settled, but no more
+// often than every healthScorePublishTicks ticks.
+func (m *Memberlist) publishHealthScore() {
+	if !gossipsHealthScore(m.config) {
+		return
+	}
+	score := m.GetHealthScore()
+
+	m.tagLock.Lock()
+	m.healthTicks++
+	if score == m.healthPublished {
+		m.healthSettle = 0
+		m.tagLock.Unlock()
+		return
+	}
+	m.healthSettle++
+	if m.healthTicks < healthScorePublishTicks || m.healthSettle < healthScoreSettleTicks {
+		m.tagLock.Unlock()
+		return
+	}
+	m.healthTicks, m.healthSettle = 0, 0
+	m.tagLock.Unlock()
+
+	// SetTag makes sure the score still fits in our meta data. If it
+	// doesn't, it's tried again once the ticks have come round.
+	if err := m.SetTag(healthScoreTag, strconv.Itoa(score)); err != nil {
+		m.logger.Printf("[WARN] memberlist: Failed to publish health score: %v", err)
+		return
+	}
+	m.tagLock.Lock()
+	m.healthPublished = score
+	m.tagLock.Unlock()
+}
@@ -0,0 +1,462 @@
+package memberlist
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTags_EncodeSplit(t *testing.T) {
+	require.Nil(t, encodeTags(nil))
+
+	tags := map[string]string{"role": "web", "zone": "us-east-1a", "empty": ""}
+	enc := encodeTags(tags)
+	require.Equal(t, enc, encodeTags(map[string]string{"zone": "us-east-1a", "empty": "", "role": "web"}))
+
+	meta := append(enc, []byte("user")...)
+	got, user := splitTagsMeta(meta)
+	require.Equal(t, tags, got)
+	require.Equal(t, []byte("user"), user)
+
+	// Meta data without tags is left alone.
+	got, user = splitTagsMeta([]byte("plain"))
+	require.Nil(t, got)
+	require.Equal(t, []byte("plain"), user)
+
+	// So is meta data whose tags are cut short.
+	got, user = splitTagsMeta(enc[:len(enc)-2])
+	require.Nil(t, got)
+	require.Equal(t, enc[:len(enc)-2], user)
+}
+
+func TestTags_Versioned(t *testing.T) {
+	tags := map[string]string{"role": "web", "zone": "a"}
+	versions := map[string]uint64{"role": 3, "zone": 1}
+	meta := append(encodeTagsVersioned(tags, versions), []byte("user")...)
+
+	got, gotVersions, user := splitTagsMetaVersioned(meta)
+	require.Equal(t, tags, got)
+	require.Equal(t, versions, gotVersions)
+	require.Equal(t, []byte("user"), user)
+
+	// Decoders that don't know about versions see the same tags.
+	got, user = splitTagsMeta(meta)
+	require.Equal(t, tags, got)
+	require.Equal(t, []byte("user"), user)
+
+	// Tags without versions are all at version 0.
+	_, gotVersions, _ = splitTagsMetaVersioned(encodeTags(tags))
+	require.Equal(t, map[string]uint64{}, gotVersions)
+
+	// Deleted tags keep their version, even when there are no tags left.
+	versions["gone"] = 4
+	got, gotVersions, _ = splitTagsMetaVersioned(encodeTagsVersioned(tags, versions))
+	require.Equal(t, tags, got)
+	require.Equal(t, versions, gotVersions)
+	got, gotVersions, _ = splitTagsMetaVersioned(encodeTagsVersioned(nil, map[string]uint64{"gone": 4}))
+	require.Empty(t, got)
+	require.Equal(t, map[string]uint64{"gone": 4}, gotVersions)
+}
+
+func TestTags_Merge(t *testing.T) {
+	existing := encodeTagsVersioned(
+		map[string]string{"a": "1", "b": "1", "c": "1"},
+		map[string]uint64{"a": 2, "b": 1, "c": 1})
+	incoming := encodeTagsVersioned(
+		map[string]string{"a": "2", "b": "2", "c": "0", "d": "2"},
+		map[string]uint64{"a": 1, "b": 2, "c": 1, "d": 1})
+
+	// Newer versions win key by key, ties go to the greater value, and
+	// keys only one side has are kept.
+	want := map[string]string{"a": "1", "b": "2", "c": "1", "d": "2"}
+	merged, _ := splitTagsMeta(mergeTagsMeta(existing, incoming))
+	require.Equal(t, want, merged)
+	merged, _ = splitTagsMeta(mergeTagsMeta(incoming, existing))
+	require.Equal(t, want, merged)
+
+	// A deletion wins over older meta data that still has the tag, such as
+	// what a peer heard before we restarted, and loses to a newer value.
+	deleted := encodeTagsVersioned(
+		map[string]string{"a": "1"},
+		map[string]uint64{"a": 2, "b": 2})
+	older := encodeTagsVersioned(
+		map[string]string{"a": "1", "b": "1"},
+		map[string]uint64{"a": 2, "b": 1})
+	newer := encodeTagsVersioned(
+		map[string]string{"a": "1", "b": "3"},
+		map[string]uint64{"a": 2, "b": 3})
+	for _, pair := range [][2][]byte{{deleted, older}, {older, deleted}} {
+		merged, versions, _ := splitTagsMetaVersioned(mergeTagsMeta(pair[0], pair[1]))
+		require.Equal(t, map[string]string{"a": "1"}, merged)
+		require.Equal(t, uint64(2), versions["b"])
+	}
+	for _, pair := range [][2][]byte{{deleted, newer}, {newer, deleted}} {
+		merged, _ := splitTagsMeta(mergeTagsMeta(pair[0], pair[1]))
+		require.Equal(t, map[string]string{"a": "1", "b": "3"}, merged)
+	}
+
+	// Meta data that isn't all tags is left alone.
+	require.Equal(t, []byte("plain"), mergeTagsMeta([]byte("plain"), incoming))
+	require.Equal(t, existing, mergeTagsMeta(existing, []byte("plain")))
+}
+
+func TestMemberlist_AliveNode_MergeTags(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	// Two updates to different tags show up at the same incarnation.
+	base := map[string]string{"role": "web", "zone": "a"}
+	meta := func(key, value string) []byte {
+		tags := map[string]string{key: value}
+		versions := map[string]uint64{key: 2}
+		for k, v := range base {
+			if k != key {
+				tags[k] = v
+				versions[k] = 1
+			}
+		}
+		return encodeTagsVersioned(tags, versions)
+	}
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Meta: meta("role", "db"), Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	b := a
+	b.Meta = meta("zone", "b")
+	m.aliveNode(&b, nil, false)
+
+	// Neither is lost.
+	m.nodeLock.RLock()
+	tags := m.nodeMap["test"].Tags()
+	m.nodeLock.RUnlock()
+	require.Equal(t, map[string]string{"role": "db", "zone": "b"}, tags)
+}
+
+func TestMemberlist_Tags(t *testing.T) {
+	c1 := testConfig(t)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.Delegate = &MockDelegate{meta: []byte("user")}
+	c2.Tags = map[string]string{"role": "web"}
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{c2.Name + "/" + c2.BindAddr})
+	require.NoError(t, err)
+
+	remote := func() *Node {
+		m1.nodeLock.RLock()
+		defer m1.nodeLock.RUnlock()
+		n := m1.nodeMap[c2.Name].Node
+		return &n
+	}
+	n := remote()
+	require.Equal(t, map[string]string{"role": "web"}, n.Tags())
+	require.Equal(t, []byte("user"), n.UserMeta())
+
+	// Changes made while an update is pending go out in one alive
+	// message.
+	m2.tagLock.Lock()
+	m2.tagsUpdatePending = true
+	m2.tagLock.Unlock()
+	before := atomic.LoadUint32(&m2.incarnation)
+	require.NoError(t, m2.SetTag("zone", "a"))
+	require.NoError(t, m2.SetTag("role", "db"))
+	require.NoError(t, m2.DeleteTag("nope"))
+	m2.announceTags()
+	require.Equal(t, before+1, atomic.LoadUint32(&m2.incarnation))
+	waitForCondition(t, func() (bool, string) {
+		tags := remote().Tags()
+		return tags["zone"] == "a" && tags["role"] == "db", fmt.Sprintf("bad tags: %v", tags)
+	})
+	require.Equal(t, []byte("user"), remote().UserMeta())
+
+	// Versions and tombstones are dropped once they've been announced.
+	m2.tagLock.Lock()
+	m2.tagsUpdatePending = true
+	m2.tagLock.Unlock()
+	require.NoError(t, m2.DeleteTag("role"))
+	m2.tagLock.Lock()
+	require.Equal(t, map[string]uint64{"role": 1}, m2.tagVersions)
+	m2.tagLock.Unlock()
+	m2.announceTags()
+	m2.tagLock.Lock()
+	require.Empty(t, m2.tagVersions)
+	m2.tagLock.Unlock()
+	waitForCondition(t, func() (bool, string) {
+		tags := remote().Tags()
+		return len(tags) == 1 && tags["zone"] == "a", fmt.Sprintf("bad tags: %v", tags)
+	})
+
+	// Deleting lots of tags doesn't fill up the meta data.
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("tag-%d", i)
+		m2.tagLock.Lock()
+		m2.tagsUpdatePending = true
+		m2.tagLock.Unlock()
+		require.NoError(t, m2.SetTag(key, "x"))
+		require.NoError(t, m2.DeleteTag(key))
+		m2.announceTags()
+	}
+	m2.tagLock.Lock()
+	require.Empty(t, m2.tagVersions)
+	m2.tagLock.Unlock()
+
+	// Tags have to fit in the meta data.
+	big := make([]byte, MetaMaxSize)
+	require.Error(t, m2.SetTag("big", string(big)))
+}
+
+func TestMemberlist_SetTag_TooBig(t *testing.T) {
+	c := testConfig(t)
+	c.Delegate = &MockDelegate{meta: bytes.Repeat([]byte("a"), MetaMaxSize-16)}
+	m, err := Create(c)
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	// The tags fit on their own, but not with the Delegate's meta data.
+	require.Error(t, m.SetTag("role", strings.Repeat("b", 16)))
+	require.Empty(t, m.tags)
+
+	require.NoError(t, m.SetTag("a", "b"))
+	require.Equal(t, map[string]string{"a": "b"}, m.tags)
+}
+
+func TestMemberlist_DeleteTag_TooBig(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	// Fill the meta data up exactly, so that the tombstone count going to
+	// two bytes and the version going to two bytes take it over the limit.
+	m.tagsUpdatePending = true
+	versions := make(map[string]uint64)
+	for i := 0; i < 127; i++ {
+		versions[string([]byte{byte(i)})] = 1
+	}
+	key := "kk"
+	tags := map[string]string{key: ""}
+	versions[key] = 127
+	for len(encodeTagsVersioned(tags, versions)) < MetaMaxSize {
+		delete(tags, key)
+		delete(versions, key)
+		key += "k"
+		tags[key] = ""
+		versions[key] = 127
+	}
+	require.Equal(t, MetaMaxSize, len(encodeTagsVersioned(tags, versions)))
+	m.tags, m.tagVersions = tags, versions
+
+	require.Error(t, m.DeleteTag(key))
+	require.Equal(t, tags, m.tags)
+	require.Equal(t, versions, m.tagVersions)
+}
+
+func TestMemberlist_DisplayName(t *testing.T) {
+	c1 := testConfig(t)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.DisplayName = "Web Server (rack 4)"
+	c2.Tags = map[string]string{"role": "web"}
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{c2.Name + "/" + c2.BindAddr})
+	require.NoError(t, err)
+
+	m1.nodeLock.RLock()
+	n := m1.nodeMap[c2.Name].Node
+	_, byDisplay := m1.nodeMap[c2.DisplayName]
+	m1.nodeLock.RUnlock()
+	require.Equal(t, c2.Name, n.Name)
+	require.Equal(t, c2.DisplayName, n.DisplayName())
+	require.Equal(t, "web", n.Tags()["role"])
+	require.False(t, byDisplay)
+
+	// Nodes without a display name fall back to their name.
+	require.Equal(t, c1.Name, m1.LocalNode().DisplayName())
+}
+
+func TestMemberlist_ClusterHealth(t *testing.T) {
+	c1 := testConfig(t)
+	c1.GossipHealthScore = true
+	c1.ProtocolVersion = healthScoreProtocolVersion
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	// Keep m2 from probing so its score stays where we put it.
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.GossipHealthScore = true
+	c2.ProtocolVersion = healthScoreProtocolVersion
+	c2.ProbeInterval = time.Hour
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	// This one's protocol version is too old to publish a score, so it
+	// isn't counted.
+	c3 := testConfig(t)
+	c3.BindPort = m1.config.BindPort
+	c3.GossipHealthScore = true
+	m3, err := Create(c3)
+	require.NoError(t, err)
+	defer m3.Shutdown()
+
+	_, err = m1.Join([]string{c2.Name + "/" + c2.BindAddr, c3.Name + "/" + c3.BindAddr})
+	require.NoError(t, err)
+
+	m1.nodeLock.RLock()
+	score, ok := m1.nodeMap[c2.Name].Node.HealthScore()
+	_, published := m1.nodeMap[c3.Name].Node.HealthScore()
+	m1.nodeLock.RUnlock()
+	require.True(t, ok)
+	require.Equal(t, 0, score)
+	require.False(t, published)
+
+	avg, max, degraded := m1.ClusterHealth()
+	require.Equal(t, 0.0, avg)
+	require.Equal(t, 0, max)
+	require.Equal(t, 0, degraded)
+
+	m2.awareness.ApplyDelta(4)
+	for i := 0; i < healthScorePublishTicks; i++ {
+		m2.publishHealthScore()
+	}
+	waitForCondition(t, func() (bool, string) {
+		_, max, _ := m1.ClusterHealth()
+		return max == 4, fmt.Sprintf("max is %d", max)
+	})
+
+	avg, max, degraded = m1.ClusterHealth()
+	require.Equal(t, 2.0, avg)
+	require.Equal(t, 4, max)
+	require.Equal(t, 1, degraded)
+}
+
+func TestMemberlist_PublishHealthScore(t *testing.T) {
+	m, err := Create(func() *Config {
+		c := testConfig(t)
+		c.GossipHealthScore = true
+		c.ProtocolVersion = healthScoreProtocolVersion
+		c.ProbeInterval = time.Hour
+		return c
+	}())
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	published := func() int {
+		score, ok := m.LocalNode().HealthScore()
+		require.True(t, ok)
+		return score
+	}
+	tick := func(n int) {
+		for i := 0; i < n; i++ {
+			m.publishHealthScore()
+		}
+	}
+
+	// A score that doesn't hold for long enough is never published.
+	tick(healthScorePublishTicks)
+	m.awareness.ApplyDelta(2)
+	tick(healthScoreSettleTicks - 1)
+	m.awareness.ApplyDelta(-2)
+	tick(1)
+	require.Equal(t, 0, published())
+
+	// One that holds is, once it has settled.
+	m.awareness.ApplyDelta(2)
+	tick(healthScoreSettleTicks - 1)
+	require.Equal(t, 0, published())
+	tick(1)
+	waitForCondition(t, func() (bool, string) {
+		return published() == 2, "score not published"
+	})
+
+	// Further changes wait out the publish interval.
+	m.awareness.ApplyDelta(-2)
+	tick(healthScorePublishTicks - 1)
+	require.Equal(t, 2, published())
+	tick(1)
+	waitForCondition(t, func() (bool, string) {
+		return published() == 0, "score not published"
+	})
+}
+
+func TestMemberlist_PublishHealthScore_TooBig(t *testing.T) {
+	// Leave exactly enough room for the starting score.
+	tags := encodeTagsVersioned(map[string]string{healthScoreTag: "0"}, map[string]uint64{})
+	c := testConfig(t)
+	c.GossipHealthScore = true
+	c.ProtocolVersion = healthScoreProtocolVersion
+	c.ProbeInterval = time.Hour
+	c.AwarenessMaxMultiplier = 20
+	c.Delegate = &MockDelegate{meta: bytes.Repeat([]byte("a"), MetaMaxSize-len(tags))}
+	m, err := Create(c)
+	require.NoError(t, err)
+	defer m.Shutdown()
+	require.Len(t, m.LocalNode().Meta, MetaMaxSize)
+
+	// A two digit score doesn't fit, so it isn't published.
+	m.awareness.ApplyDelta(10)
+	for i := 0; i < healthScorePublishTicks; i++ {
+		m.publishHealthScore()
+	}
+	score, ok := m.LocalNode().HealthScore()
+	require.True(t, ok)
+	require.Equal(t, 0, score)
+	require.Equal(t, "0", m.tags[healthScoreTag])
+	require.Equal(t, 0, m.healthPublished)
+}
+
+func TestMemberlist_FindNodes(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	vsn := m.config.BuildVsnArray()
+	for i, role := range []string{"web", "db", "web", "web"} {
+		a := alive{
+			Node:        fmt.Sprintf("node%d", i),
+			Addr:        []byte{127, 0, 0, byte(i + 1)},
+			Port:        8000,
+			Meta:        encodeTags(map[string]string{"role": role}),
+			Incarnation: 1,
+			Vsn:         vsn,
+		}
+		m.aliveNode(&a, nil, false)
+	}
+	m.deadNode(&dead{Node: "node3", Incarnation: 1})
+
+	var names []string
+	for _, n := range m.NodesWithTag("role", "web") {
+		names = append(names, n.Name)
+	}
+	require.ElementsMatch(t, []string{"node0", "node2"}, names)
+	require.Empty(t, m.NodesWithTag("role", "cache"))
+
+	found := m.FindNodes(func(n *Node) bool { return n.Name == "node1" })
+	require.Len(t, found, 1)
+	require.Equal(t, "db", found[0].Tags()["role"])
+
+	// The results are copies.
+	found[0].Meta[0] = 0
+	found[0].Addr[3] = 99
+	m.nodeLock.RLock()
+	n := m.nodeMap["node1"]
+	require.Equal(t, "db", n.Tags()["role"])
+	require.Equal(t, byte(2), n.Addr[3])
+	m.nodeLock.RUnlock()
+}
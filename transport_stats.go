@@ -0,0 +1,63 @@
+package memberlist
+
+import (
+	"io"
+	"sync/atomic"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// TransportStats holds the number of bytes memberlist has sent and received
+// over the transport, as they appear on the wire after any compression and
+// encryption.
+type TransportStats struct {
+	UDPSent     uint64
+	UDPReceived uint64
+	TCPSent     uint64
+	TCPReceived uint64
+}
+
+// TransportStats returns the number of bytes sent and received over the
+// transport since this memberlist was created.
+func (m *Memberlist) TransportStats() TransportStats {
+	return TransportStats{
+		UDPSent:     atomic.LoadUint64(&m.stats.UDPSent),
+		UDPReceived: atomic.LoadUint64(&m.stats.UDPReceived),
+		TCPSent:     atomic.LoadUint64(&m.stats.TCPSent),
+		TCPReceived: atomic.LoadUint64(&m.stats.TCPReceived),
+	}
+}
+
+func (s *TransportStats) addUDPSent(n int) {
+	atomic.AddUint64(&s.UDPSent, uint64(n))
+	metrics.IncrCounter([]string{"memberlist", "transport", "udp", "sent"}, float32(n))
+}
+
+func (s *TransportStats) addUDPReceived(n int) {
+	atomic.AddUint64(&s.UDPReceived, uint64(n))
+	metrics.IncrCounter([]string{"memberlist", "transport", "udp", "received"}, float32(n))
+}
+
+func (s *TransportStats) addTCPSent(n int) {
+	atomic.AddUint64(&s.TCPSent, uint64(n))
+	metrics.IncrCounter([]string{"memberlist", "transport", "tcp", "sent"}, float32(n))
+}
+
+func (s *TransportStats) addTCPReceived(n int) {
+	atomic.AddUint64(&s.TCPReceived, uint64(n))
+	metrics.IncrCounter([]string{"memberlist", "transport", "tcp", "received"}, float32(n))
+}
+
+// countingReader reports the number of bytes read through it.
+type countingReader struct {
+	r     io.Reader
+	count func(n int)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.count(n)
+	}
+	return n, err
+}
@@ -0,0 +1,58 @@
+package memberlist
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemberlist_TransportStats(t *testing.T) {
+	m1, err := Create(testConfig(t))
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	// A join is a push/pull over TCP in both directions.
+	_, err = m2.Join([]string{m1.config.Name + "/" + m1.config.BindAddr})
+	require.NoError(t, err)
+	stats := m2.TransportStats()
+	require.NotZero(t, stats.TCPSent)
+	require.NotZero(t, stats.TCPReceived)
+
+	// A ping and its ack go over UDP.
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(m1.config.BindAddr, strconv.Itoa(m1.config.BindPort)))
+	require.NoError(t, err)
+	_, err = m2.Ping(m1.config.Name, addr)
+	require.NoError(t, err)
+	stats = m2.TransportStats()
+	require.NotZero(t, stats.UDPSent)
+	require.NotZero(t, stats.UDPReceived)
+	require.NotZero(t, m1.TransportStats().UDPReceived)
+}
+
+func TestMemberlist_TransportStats_Label(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.ClusterName = "blue"
+	})
+	defer m.Shutdown()
+
+	udp := listenUDP(t)
+	defer udp.Close()
+	to := Address{Addr: udp.LocalAddr().String(), Name: "peer"}
+
+	// The count includes the label header the transport adds.
+	require.NoError(t, m.rawSendMsgPacket(to, nil, []byte("hello")))
+	buf := make([]byte, udpPacketBufSize)
+	require.NoError(t, udp.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := udp.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, uint64(n), m.TransportStats().UDPSent)
+}
@@ -1,8 +1,11 @@
 package memberlist
 
 import (
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"runtime"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -203,3 +206,82 @@ func TestTransport_TcpListenBackoff(t *testing.T) {
 	// no connections should have been accepted and sent to the channel
 	require.Equal(t, len(transport.streamCh), 0)
 }
+
+func TestTransport_UDPRecvBufSize(t *testing.T) {
+	transport, err := NewNetTransport(&NetTransportConfig{
+		BindAddrs:      []string{"127.0.0.1"},
+		UDPRecvBufSize: 64 * 1024,
+		Logger:         log.New(os.Stderr, "", log.LstdFlags),
+	})
+	require.NoError(t, err)
+
+	// A fresh socket hasn't dropped anything, where we can tell.
+	drops, ok := udpKernelDrops(transport.udpListeners[0])
+	require.Equal(t, runtime.GOOS == "linux", ok)
+	require.Equal(t, uint64(0), drops)
+
+	// Shutting down twice is harmless.
+	require.NoError(t, transport.Shutdown())
+	require.NoError(t, transport.Shutdown())
+}
+
+func TestTransport_MultipleBindAddrs(t *testing.T) {
+	transport, err := NewNetTransport(&NetTransportConfig{
+		BindAddrs: []string{"127.0.0.1", "127.0.0.2"},
+		Logger:    log.New(os.Stderr, "", log.LstdFlags),
+	})
+	require.NoError(t, err)
+	defer transport.Shutdown()
+	port := transport.GetAutoBindPort()
+
+	// Packets sent to either address come in the same way.
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		conn, err := net.Dial("udp", net.JoinHostPort(ip, fmt.Sprint(port)))
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(ip))
+		conn.Close()
+		require.NoError(t, err)
+
+		select {
+		case p := <-transport.PacketCh():
+			require.Equal(t, ip, string(p.Buf))
+		case <-time.After(time.Second):
+			t.Fatalf("no packet sent to %s", ip)
+		}
+	}
+
+	// Replies go out from the address closest to the destination.
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2")})
+	require.NoError(t, err)
+	defer peer.Close()
+	_, err = transport.WriteTo([]byte("hi"), peer.LocalAddr().String())
+	require.NoError(t, err)
+
+	buf := make([]byte, 16)
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(time.Second)))
+	_, from, err := peer.ReadFromUDP(buf)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.2", from.IP.String())
+	require.Equal(t, port, from.Port)
+
+	// We still advertise the one address.
+	ip, _, err := transport.FinalAdvertiseAddr("", 0)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", ip.String())
+}
+
+func TestTransport_CommonPrefixLen(t *testing.T) {
+	cases := []struct {
+		a, b string
+		n    int
+	}{
+		{"10.1.0.1", "10.1.0.1", 32},
+		{"10.1.0.1", "10.1.2.3", 22},
+		{"10.1.0.1", "10.2.0.1", 14},
+		{"10.1.0.1", "192.168.0.1", 0},
+		{"fd00::1", "fd00::2", 126},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.n, commonPrefixLen(net.ParseIP(c.a), net.ParseIP(c.b)), "%s %s", c.a, c.b)
+	}
+}
@@ -0,0 +1,14 @@
+package memberlist
+
+// UserMessageDelegate is used to receive user-data messages sent with
+// SendUserMsg, SendBestEffort, or SendReliable, as well as any user
+// broadcasts, separately from the rest of the Delegate interface. This lets
+// an application keep its own messaging apart from its membership hooks.
+type UserMessageDelegate interface {
+	// NotifyUserMsg is called when a user-data message is received. When a
+	// UserMessageDelegate is configured, Delegate.NotifyMsg is not called.
+	// Care should be taken that this method does not block, since doing
+	// so would block the entire UDP packet receive loop. Additionally, the byte
+	// slice may be modified after the call returns, so it should be copied if needed
+	NotifyUserMsg([]byte)
+}
@@ -75,6 +75,15 @@ func retransmitLimit(retransmitMult, n int) int {
 	return limit
 }
 
+// incarnationLess reports whether incarnation a is older than b. Incarnation
+// numbers live in a circular space, so they are compared using serial number
+// arithmetic (RFC 1982): a is older than b if b is less than half the space
+// ahead of it. This lets a node keep refuting after its incarnation wraps
+// past math.MaxUint32.
+func incarnationLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
 // shuffleNodes randomly shuffles the input nodes using the Fisher-Yates shuffle
 func shuffleNodes(nodes []*nodeState) {
 	n := len(nodes)
@@ -96,9 +105,84 @@ func pushPullScale(interval time.Duration, n int) time.Duration {
 	return time.Duration(multiplier) * interval
 }
 
+// convergenceTime estimates how long it takes a gossiped message to reach
+// all n nodes. Each gossip round, every node that has the message passes it
+// on to fanout other nodes, but no more than transmitLimit times in total,
+// so the number of informed nodes grows by a factor of about
+// min(fanout, transmitLimit)+1 per round, giving ceil(log_{that}(n)) rounds.
+// A push/pull sync brings every node up to date regardless of gossip, so the
+// push/pull interval is used as an upper bound. A zero result means neither
+// mechanism is enabled.
+func convergenceTime(n, fanout, transmitLimit int, gossipInterval, pushPull time.Duration) time.Duration {
+	spread := fanout
+	if transmitLimit < spread {
+		spread = transmitLimit
+	}
+	if gossipInterval <= 0 || spread <= 0 {
+		return pushPull
+	}
+	if n <= 1 {
+		return 0
+	}
+
+	rounds := math.Ceil(math.Log(float64(n)) / math.Log(float64(spread+1)))
+	gossip := time.Duration(rounds) * gossipInterval
+	if pushPull > 0 && pushPull < gossip {
+		return pushPull
+	}
+	return gossip
+}
+
+// gossipNodesScale is used to scale the number of nodes we gossip to with
+// the size of the cluster, as gossipNodes * log10(n+1) rounded up. The scale
+// factor is at least 1, so the result is never less than gossipNodes unless
+// max is positive and lower, since max caps the result.
+func gossipNodesScale(gossipNodes, n, max int) int {
+	nodeScale := math.Max(1.0, math.Log10(float64(n+1)))
+	fanout := int(math.Ceil(float64(gossipNodes) * nodeScale))
+	if max > 0 && fanout > max {
+		fanout = max
+	}
+	return fanout
+}
+
+// clampRTT constrains an RTT measurement to the range [0, max]. Steps in the
+// local clock can make a measured RTT negative or absurdly large, so this
+// keeps such samples from skewing anything downstream. The returned bool is
+// false if the measurement had to be clamped.
+func clampRTT(rtt, max time.Duration) (time.Duration, bool) {
+	if rtt < 0 {
+		return 0, false
+	}
+	if rtt > max {
+		return max, false
+	}
+	return rtt, true
+}
+
+// joinBackoff returns how long to wait before the given retry attempt of a
+// join. The backoff doubles with every attempt, up to 32 times the base,
+// and is jittered down by as much as half to keep nodes that start together
+// from retrying in lockstep.
+func joinBackoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 || attempt < 1 {
+		return 0
+	}
+	shift := attempt - 1
+	if shift > 5 {
+		shift = 5
+	}
+	backoff := base << uint(shift)
+	if jitter := int64(backoff / 2); jitter > 0 {
+		backoff -= time.Duration(rand.Int63n(jitter))
+	}
+	return backoff
+}
+
 // moveDeadNodes moves nodes that are dead and beyond the gossip to the dead interval
 // to the end of the slice and returns the index of the first moved node.
-func moveDeadNodes(nodes []*nodeState, gossipToTheDeadTime time.Duration) int {
+// Nodes that retain returns true for are also left alone; retain may be nil.
+func moveDeadNodes(nodes []*nodeState, gossipToTheDeadTime time.Duration, now time.Time, retain func(*nodeState) bool) int {
 	numDead := 0
 	n := len(nodes)
 	for i := 0; i < n-numDead; i++ {
@@ -107,7 +191,10 @@ func moveDeadNodes(nodes []*nodeState, gossipToTheDeadTime time.Duration) int {
 		}
 
 		// Respect the gossip to the dead interval
-		if time.Since(nodes[i].StateChange) <= gossipToTheDeadTime {
+		if now.Sub(nodes[i].StateChange) <= gossipToTheDeadTime {
+			continue
+		}
+		if retain != nil && retain(nodes[i]) {
 			continue
 		}
 
@@ -119,9 +206,27 @@ func moveDeadNodes(nodes []*nodeState, gossipToTheDeadTime time.Duration) int {
 	return n - numDead
 }
 
+// moveDeadNodesStable is like moveDeadNodes, but keeps the nodes that aren't
+// moved in the same order relative to each other.
+func moveDeadNodesStable(nodes []*nodeState, gossipToTheDeadTime time.Duration, now time.Time, retain func(*nodeState) bool) int {
+	var dead []*nodeState
+	live := 0
+	for _, n := range nodes {
+		if n.State == StateDead && now.Sub(n.StateChange) > gossipToTheDeadTime &&
+			(retain == nil || !retain(n)) {
+			dead = append(dead, n)
+			continue
+		}
+		nodes[live] = n
+		live++
+	}
+	copy(nodes[live:], dead)
+	return live
+}
+
 // kRandomNodes is used to select up to k random Nodes, excluding any nodes where
-// the exclude function returns true. It is possible that less than k nodes are
-// returned.
+// the exclude function returns true. Fewer than k nodes are only returned if
+// there aren't k eligible nodes.
 func kRandomNodes(k int, nodes []*nodeState, exclude func(*nodeState) bool) []Node {
 	n := len(nodes)
 	kNodes := make([]Node, 0, k)
@@ -149,6 +254,32 @@ OUTER:
 		// Append the node
 		kNodes = append(kNodes, state.Node)
 	}
+	if len(kNodes) == k || len(kNodes) == n {
+		return kNodes
+	}
+
+	// Random probing can keep missing when most of the nodes are excluded,
+	// so fall back to collecting everything still eligible and sampling
+	// the rest from that.
+	picked := make(map[string]struct{}, len(kNodes))
+	for _, node := range kNodes {
+		picked[node.Name] = struct{}{}
+	}
+	var eligible []*nodeState
+	for _, state := range nodes {
+		if _, ok := picked[state.Name]; ok {
+			continue
+		}
+		if exclude != nil && exclude(state) {
+			continue
+		}
+		eligible = append(eligible, state)
+	}
+	for i := 0; i < len(eligible) && len(kNodes) < k; i++ {
+		j := i + randomOffset(len(eligible)-i)
+		eligible[i], eligible[j] = eligible[j], eligible[i]
+		kNodes = append(kNodes, eligible[i].Node)
+	}
 	return kNodes
 }
 
@@ -2,6 +2,7 @@ package memberlist
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"testing"
 	"time"
@@ -102,6 +103,26 @@ func TestRetransmitLimit(t *testing.T) {
 	}
 }
 
+func TestIncarnationLess(t *testing.T) {
+	cases := []struct {
+		a, b uint32
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{math.MaxUint32, 0, true},
+		{0, math.MaxUint32, false},
+		{math.MaxUint32 - 10, 10, true},
+		{10, math.MaxUint32 - 10, false},
+	}
+	for _, c := range cases {
+		if got := incarnationLess(c.a, c.b); got != c.less {
+			t.Fatalf("incarnationLess(%d, %d) = %v, want %v", c.a, c.b, got, c.less)
+		}
+	}
+}
+
 func TestShuffleNodes(t *testing.T) {
 	orig := []*nodeState{
 		&nodeState{
@@ -162,6 +183,97 @@ func TestPushPullScale(t *testing.T) {
 	}
 }
 
+func TestGossipNodesScale(t *testing.T) {
+	cases := []struct {
+		nodes    int
+		max      int
+		expected int
+	}{
+		{0, 0, 3},
+		{1, 0, 3},
+		{9, 0, 3},
+		{10, 0, 4},
+		{99, 0, 6},
+		{5000, 0, 12},
+		{5000, 8, 8},
+		{1, 2, 2},
+	}
+	for _, c := range cases {
+		if s := gossipNodesScale(3, c.nodes, c.max); s != c.expected {
+			t.Fatalf("bad fanout for %d nodes (max %d): %d != %d", c.nodes, c.max, s, c.expected)
+		}
+	}
+}
+
+func TestConvergenceTime(t *testing.T) {
+	sec := time.Second
+	cases := []struct {
+		n        int
+		fanout   int
+		limit    int
+		gossip   time.Duration
+		pushPull time.Duration
+		expected time.Duration
+	}{
+		{1, 3, 4, sec, 30 * sec, 0},
+		{4, 3, 4, sec, 30 * sec, sec},
+		{5, 3, 4, sec, 30 * sec, 2 * sec},
+		{64, 3, 4, sec, 30 * sec, 3 * sec},
+		{64, 3, 1, sec, 30 * sec, 6 * sec},
+		{64, 3, 4, sec, 2 * sec, 2 * sec},
+		{64, 3, 4, 0, 30 * sec, 30 * sec},
+		{64, 3, 4, 0, 0, 0},
+	}
+	for _, c := range cases {
+		d := convergenceTime(c.n, c.fanout, c.limit, c.gossip, c.pushPull)
+		if d != c.expected {
+			t.Fatalf("bad convergence time for %+v: %v", c, d)
+		}
+	}
+}
+
+func TestJoinBackoff(t *testing.T) {
+	base := 10 * time.Second
+	if d := joinBackoff(base, 0); d != 0 {
+		t.Fatalf("bad backoff: %v", d)
+	}
+	for attempt, max := range map[int]time.Duration{
+		1:  base,
+		2:  2 * base,
+		3:  4 * base,
+		6:  32 * base,
+		20: 32 * base,
+	} {
+		for i := 0; i < 10; i++ {
+			d := joinBackoff(base, attempt)
+			if d > max || d <= max/2 {
+				t.Fatalf("bad backoff for attempt %d: %v", attempt, d)
+			}
+		}
+	}
+}
+
+func TestClampRTT(t *testing.T) {
+	max := time.Second
+	cases := []struct {
+		rtt      time.Duration
+		expected time.Duration
+		ok       bool
+	}{
+		{-time.Millisecond, 0, false},
+		{0, 0, true},
+		{10 * time.Millisecond, 10 * time.Millisecond, true},
+		{max, max, true},
+		{time.Hour, max, false},
+	}
+	for _, c := range cases {
+		rtt, ok := clampRTT(c.rtt, max)
+		if rtt != c.expected || ok != c.ok {
+			t.Fatalf("bad clamp for %v: %v %v", c.rtt, rtt, ok)
+		}
+	}
+}
+
 func TestMoveDeadNodes(t *testing.T) {
 	nodes := []*nodeState{
 		&nodeState{
@@ -192,7 +304,7 @@ func TestMoveDeadNodes(t *testing.T) {
 		},
 	}
 
-	idx := moveDeadNodes(nodes, (15 * time.Second))
+	idx := moveDeadNodes(nodes, (15 * time.Second), time.Now(), nil)
 	if idx != 4 {
 		t.Fatalf("bad index")
 	}
@@ -274,6 +386,40 @@ func TestKRandomNodes(t *testing.T) {
 	}
 }
 
+func TestKRandomNodes_MostlyExcluded(t *testing.T) {
+	nodes := []*nodeState{}
+	for i := 0; i < 10000; i++ {
+		state := StateDead
+		if i%1000 == 0 {
+			state = StateAlive
+		}
+		nodes = append(nodes, &nodeState{
+			Node: Node{
+				Name: fmt.Sprintf("test%d", i),
+			},
+			State: state,
+		})
+	}
+	filterFunc := func(n *nodeState) bool {
+		return n.State != StateAlive
+	}
+
+	// Only one node in a thousand is eligible, which random probing alone
+	// would rarely find enough of.
+	s := kRandomNodes(5, nodes, filterFunc)
+	require.Len(t, s, 5)
+	seen := make(map[string]bool)
+	for _, n := range s {
+		require.Contains(t, []string{"test0", "test1000", "test2000", "test3000", "test4000",
+			"test5000", "test6000", "test7000", "test8000", "test9000"}, n.Name)
+		require.False(t, seen[n.Name], "duplicate %s", n.Name)
+		seen[n.Name] = true
+	}
+
+	// Asking for more than there are gets them all.
+	require.Len(t, kRandomNodes(50, nodes, filterFunc), 10)
+}
+
 func TestMakeCompoundMessage(t *testing.T) {
 	msg := &ping{SeqNo: 100}
 	buf, err := encode(pingMsg, msg)
@@ -0,0 +1,211 @@
+package memberlist
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// stateWaiter is a caller of WaitForState waiting for a node to reach a
+// given state.
+type stateWaiter struct {
+	want NodeStateType
+	ch   chan struct{}
+}
+
+// WaitForState blocks until the named node reaches the wanted state in our
+// local view, or the context is done, in which case the context's error is
+// returned. It returns right away if the node is already in that state, and
+// otherwise wakes as soon as the state changes, without polling. The node
+// doesn't need to be known yet, so this can be used to wait for a node to
+// join.
+func (m *Memberlist) WaitForState(ctx context.Context, name string, want NodeStateType) error {
+	m.nodeLock.Lock()
+	if n, ok := m.nodeMap[name]; ok && n.State == want {
+		m.nodeLock.Unlock()
+		return nil
+	}
+	w := &stateWaiter{want: want, ch: make(chan struct{})}
+	if m.stateWaiters == nil {
+		m.stateWaiters = make(map[string][]*stateWaiter)
+	}
+	m.stateWaiters[name] = append(m.stateWaiters[name], w)
+	m.nodeLock.Unlock()
+
+	select {
+	case <-w.ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+	select {
+	case <-w.ch:
+		// We raced with the state change, so count it as a success.
+		return nil
+	default:
+	}
+	waiters := m.stateWaiters[name]
+	for i, other := range waiters {
+		if other == w {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(m.stateWaiters, name)
+	} else {
+		m.stateWaiters[name] = waiters
+	}
+	return ctx.Err()
+}
+
+// notifyStateWaiters wakes anyone waiting for the node to reach the state
+// it's now in. The caller must hold the node lock.
+func (m *Memberlist) notifyStateWaiters(n *nodeState) {
+	waiters, ok := m.stateWaiters[n.Name]
+	if !ok {
+		return
+	}
+
+	remaining := waiters[:0]
+	for _, w := range waiters {
+		if w.want == n.State {
+			close(w.ch)
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(m.stateWaiters, n.Name)
+	} else {
+		m.stateWaiters[n.Name] = remaining
+	}
+}
+
+// WaitForStable blocks until no node has joined, left or been updated for
+// the quiet period, or the context is done, in which case the context's
+// error is returned. The changes counted are the ones the EventDelegate
+// hears about. It returns right away if membership has already been quiet
+// for long enough.
+func (m *Memberlist) WaitForStable(ctx context.Context, quietPeriod time.Duration) error {
+	for {
+		m.nodeLock.Lock()
+		if m.membershipChangeCh == nil {
+			m.membershipChangeCh = make(chan struct{})
+		}
+		changeCh := m.membershipChangeCh
+		wait := quietPeriod - m.clock().Now().Sub(m.lastMembershipChange)
+		m.nodeLock.Unlock()
+
+		if wait <= 0 {
+			return nil
+		}
+
+		timer := m.clock().NewTimer(wait)
+		select {
+		case <-timer.C():
+			// Loop around in case a change snuck in.
+		case <-changeCh:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// membershipChanged notes that a node joined, left or was updated, and
+// wakes anyone in WaitForStable so they can start their quiet period over.
+// The caller must hold the node lock.
+func (m *Memberlist) membershipChanged() {
+	m.lastMembershipChange = m.clock().Now()
+	if m.membershipChangeCh != nil {
+		close(m.membershipChangeCh)
+		m.membershipChangeCh = nil
+	}
+	m.checkSizeThresholds()
+}
+
+// checkSizeThresholds arranges for a report of the SizeThresholds crossed
+// once the number of live members has stayed at the same level for
+// SizeThresholdDebounce. Each change of level starts the wait over, and a
+// return to the level we last reported drops the report, so a node that
+// comes and goes in the meantime is never reported. The caller must hold
+// the node lock.
+func (m *Memberlist) checkSizeThresholds() {
+	if len(m.config.SizeThresholds) == 0 || m.config.OnSizeThreshold == nil {
+		return
+	}
+
+	level, _ := m.sizeLevelNow()
+	if m.sizeTimer != nil {
+		if level == m.sizeSeen {
+			return
+		}
+		m.sizeTimer.Stop()
+		m.sizeTimer = nil
+	}
+	if level == m.sizeLevel {
+		return
+	}
+
+	m.sizeSeen = level
+	var timer Timer
+	timer = m.clock().AfterFunc(m.config.SizeThresholdDebounce, func() {
+		m.nodeLock.Lock()
+		if m.sizeTimer != timer {
+			m.nodeLock.Unlock()
+			return
+		}
+		m.sizeTimer = nil
+		crossed, up, size := m.sizeThresholdsCrossed()
+		m.nodeLock.Unlock()
+
+		if m.hasShutdown() {
+			return
+		}
+		for _, threshold := range crossed {
+			m.config.OnSizeThreshold(threshold, up, size)
+		}
+	})
+	m.sizeTimer = timer
+}
+
+// sizeLevelNow returns how many of the SizeThresholds the number of live
+// members is at or above, along with that number. The caller must hold the
+// node lock.
+func (m *Memberlist) sizeLevelNow() (int, int) {
+	size := 0
+	for _, n := range m.nodes {
+		if !n.DeadOrLeft() {
+			size++
+		}
+	}
+
+	thresholds := append([]int(nil), m.config.SizeThresholds...)
+	sort.Ints(thresholds)
+	return sort.SearchInts(thresholds, size+1), size
+}
+
+// sizeThresholdsCrossed returns the SizeThresholds the number of live
+// members has crossed since we last looked, in the order they were crossed,
+// along with the direction and the size. The caller must hold the node lock.
+func (m *Memberlist) sizeThresholdsCrossed() ([]int, bool, int) {
+	level, size := m.sizeLevelNow()
+	thresholds := append([]int(nil), m.config.SizeThresholds...)
+	sort.Ints(thresholds)
+
+	var crossed []int
+	up := level > m.sizeLevel
+	if up {
+		crossed = thresholds[m.sizeLevel:level]
+	} else {
+		for i := m.sizeLevel - 1; i >= level; i-- {
+			crossed = append(crossed, thresholds[i])
+		}
+	}
+	m.sizeLevel = level
+	return crossed, up, size
+}
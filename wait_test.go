@@ -0,0 +1,208 @@
+package memberlist
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemberlist_WaitForState(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	// A node we haven't heard of yet can be waited on to join.
+	done := make(chan error, 1)
+	go func() {
+		done <- m.WaitForState(context.Background(), "test", StateAlive)
+	}()
+	waitForCondition(t, func() (bool, string) {
+		m.nodeLock.RLock()
+		defer m.nodeLock.RUnlock()
+		return len(m.stateWaiters["test"]) == 1, "waiter not registered"
+	})
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for alive")
+	}
+
+	// Already in the wanted state returns right away.
+	require.NoError(t, m.WaitForState(context.Background(), "test", StateAlive))
+
+	// Other transitions don't wake a waiter for a different state.
+	go func() {
+		done <- m.WaitForState(context.Background(), "test", StateDead)
+	}()
+	waitForCondition(t, func() (bool, string) {
+		m.nodeLock.RLock()
+		defer m.nodeLock.RUnlock()
+		return len(m.stateWaiters["test"]) == 1, "waiter not registered"
+	})
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: m.config.Name})
+	select {
+	case err := <-done:
+		t.Fatalf("woke early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	m.deadNode(&dead{Node: "test", Incarnation: 1, From: m.config.Name})
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for dead")
+	}
+
+	// Giving up cleans up the waiter.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := m.WaitForState(ctx, "test", StateLeft)
+	require.Equal(t, context.DeadlineExceeded, err)
+	m.nodeLock.RLock()
+	require.Empty(t, m.stateWaiters)
+	m.nodeLock.RUnlock()
+}
+
+func TestMemberlist_WaitForStable(t *testing.T) {
+	clock := newFakeClock()
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+	})
+	defer m.Shutdown()
+
+	join := func(name string) {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+	waitForTimer := func(when time.Time) {
+		waitForCondition(t, func() (bool, string) {
+			clock.mu.Lock()
+			defer clock.mu.Unlock()
+			for _, timer := range clock.timers {
+				if timer.active && timer.ch != nil && timer.when.Equal(when) {
+					return true, ""
+				}
+			}
+			return false, "timer not started"
+		})
+	}
+	start := clock.Now()
+	join("a")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.WaitForStable(context.Background(), 10*time.Second)
+	}()
+	waitForTimer(start.Add(10 * time.Second))
+
+	// A change part way through starts the quiet period over.
+	clock.Advance(5 * time.Second)
+	join("b")
+	waitForTimer(start.Add(15 * time.Second))
+	clock.Advance(6 * time.Second)
+	select {
+	case err := <-done:
+		t.Fatalf("returned early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(4 * time.Second)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for stable")
+	}
+
+	// Already quiet for long enough returns right away.
+	require.NoError(t, m.WaitForStable(context.Background(), 10*time.Second))
+
+	// Giving up returns the context's error.
+	join("c")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, m.WaitForStable(ctx, 10*time.Second))
+}
+
+func TestMemberlist_SizeThresholds(t *testing.T) {
+	type crossing struct {
+		threshold int
+		up        bool
+		size      int
+	}
+	var mu sync.Mutex
+	var crossings []crossing
+	clock := newFakeClock()
+	m := GetMemberlist(t, func(c *Config) {
+		c.Clock = clock
+		c.SizeThresholds = []int{3, 2}
+		c.SizeThresholdDebounce = 10 * time.Second
+		c.OnSizeThreshold = func(threshold int, up bool, size int) {
+			mu.Lock()
+			defer mu.Unlock()
+			crossings = append(crossings, crossing{threshold, up, size})
+		}
+	})
+	defer m.Shutdown()
+
+	var inc uint32
+	join := func(name string) {
+		inc++
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: inc, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+	leave := func(name string) {
+		inc++
+		m.deadNode(&dead{Node: name, From: name, Incarnation: inc})
+	}
+	seen := func() []crossing {
+		mu.Lock()
+		defer mu.Unlock()
+		out := crossings
+		crossings = nil
+		return out
+	}
+
+	// Nothing is reported until the debounce is up.
+	join("a")
+	join("b")
+	require.Empty(t, seen())
+	clock.Advance(10 * time.Second)
+	require.Equal(t, []crossing{{2, true, 2}}, seen())
+
+	// A node that comes and goes within the debounce isn't reported.
+	join("c")
+	leave("c")
+	clock.Advance(10 * time.Second)
+	require.Empty(t, seen())
+
+	// Once it sticks, it is. Each time the size crosses back, the wait
+	// starts over.
+	join("c")
+	clock.Advance(9 * time.Second)
+	leave("c")
+	clock.Advance(500 * time.Millisecond)
+	join("c")
+	clock.Advance(500 * time.Millisecond)
+	require.Empty(t, seen())
+	clock.Advance(9500 * time.Millisecond)
+	require.Equal(t, []crossing{{3, true, 3}}, seen())
+
+	// Dropping past both thresholds reports each, in order.
+	leave("c")
+	leave("b")
+	clock.Advance(10 * time.Second)
+	require.Equal(t, []crossing{{3, false, 1}, {2, false, 1}}, seen())
+
+	// Pending reports are dropped on shutdown.
+	join("b")
+	require.NoError(t, m.Shutdown())
+	require.Nil(t, m.sizeTimer)
+	clock.Advance(10 * time.Second)
+	require.Empty(t, seen())
+}